@@ -1,23 +1,320 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
+	"net/smtp"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/cloud9-tools/cloud9/repo"
 	"github.com/cloud9-tools/cloud9/server"
 )
 
+var (
+	flagListen             = flag.String("listen", ":8002", "comma-separated addresses to listen on, each host:port or proto://host:port (proto is tcp, tcp4, tcp6 or unix)")
+	flagAdminListen        = flag.String("adminlisten", "127.0.0.1:8003", "comma-separated private addresses for the admin endpoints, in the same form as -listen, or empty to serve none")
+	flagTrustLoopbackAdmin = flag.Bool("trustloopbackadmin", false, "let requests over the loopback interface use the admin endpoints without credentials; any local user can then act as an admin")
+	flagLogLevel           = flag.String("loglevel", envOr("C9_LOGLEVEL", "info"), "minimum level to log: debug, info, warn, or error")
+	flagServerHeader       = flag.String("serverheader", server.DefaultServerHeader, "value of the Server response header, or empty to omit it")
+	flagMaxLoginFailures   = flag.Int("maxloginfailures", server.DefaultMaxLoginFailures, "failed logins before an account is locked, or 0 for no lockout")
+	flagLoginFailureWindow = flag.Duration("loginfailurewindow", server.DefaultLoginFailureWindow, "window for counting failed logins, and length of the lockout")
+	flagPasswordCost       = flag.Int("passwordcost", bcrypt.DefaultCost, "bcrypt cost for password hashes")
+	flagAuthRateBurst      = flag.Int("authrateburst", server.DefaultAuthRateBurst, "failed logins and password reset attempts allowed at once per address or account, or 0 for no limit")
+	flagAuthRateInterval   = flag.Duration("authrateinterval", server.DefaultAuthRateInterval, "time to regain one failed login or password reset attempt")
+	flagTrustedProxies     = flag.String("trustedproxies", "", "comma-separated addresses or CIDR blocks of reverse proxies whose X-Forwarded-For header gives the client address; it is ignored from anyone else")
+	flagMaxInFlight        = flag.Int("maxinflight", 0, "maximum number of requests handled at once, or 0 for no limit")
+	flagQueueWhenBusy      = flag.Bool("queuewhenbusy", false, "make requests beyond -maxinflight wait instead of failing with 503")
+	flagDisplayName        = flag.String("displayname", "username", "how to derive a display name set to \"\": username (as is), title (first letter upper case) or blank")
+	flagMaxGroupMembers    = flag.Int("maxgroupmembers", server.DefaultMaxGroupMembers, "maximum number of members in one group, or 0 for no limit")
+	flagMaxPageSize        = flag.Int("maxpagesize", server.DefaultMaxPageSize, "largest page of users or groups a listing may ask for; larger limits are lowered to it, or 0 for no cap")
+	flagReservedNames      = flag.String("reservednames", strings.Join(server.DefaultReservedNames, ","), "comma-separated names that new users and groups may not take")
+	flagReparentGroups     = flag.Bool("reparentgroups", false, "when deleting a group with child groups, move them to its parent instead of refusing")
+	flagBlobCacheMaxAge    = flag.Duration("blobcachemaxage", server.DefaultCacheMaxAge, "how long clients may cache blobs, or 0 to always revalidate")
+	flagObjectCacheMaxAge  = flag.Duration("objectcachemaxage", server.DefaultCacheMaxAge, "how long clients may cache users, groups and listings, or 0 to always revalidate")
+	flagVerifyBlobs        = flag.Bool("verifyblobs", false, "check each blob read against its stored digest, answering 500 if it is corrupt; costs a SHA-256 per read")
+	flagInlineBlobs        = flag.Bool("inlineblobs", false, "let browsers display blobs in place instead of downloading them; unsafe if untrusted users upload HTML or scripts")
+	flagMaxMultipartParts  = flag.Int("maxmultipartparts", server.DefaultMaxMultipartParts, "most parts a multipart upload to POST /blob may have, or 0 for no limit")
+	flagMaxMultipartSize   = flag.Int64("maxmultipartsize", server.DefaultMaxMultipartSize, "most bytes the parts of a multipart upload to POST /blob may hold between them, or 0 for no limit")
+	flagUploadTTL          = flag.Duration("uploadttl", server.DefaultUploadTTL, "how long a resumable upload may go without receiving data before it is removed, or 0 for no limit")
+	flagMaxUploadsPerUser  = flag.Int("maxuploadsperuser", server.DefaultMaxUploadsPerUser, "most resumable uploads each user may have unfinished at once, or 0 for no limit")
+	flagPublicLists        = flag.Bool("publiclists", true, "allow shared caches to store listings")
+	flagObjectCacheSize    = flag.Int("objectcachesize", 0, "number of users and groups to keep encoded in memory, or 0 for none")
+	flagETagCacheSize      = flag.Int("etagcachesize", server.DefaultETagCacheSize, "number of user and group ETags to keep in memory for conditional GET, or 0 for none")
+	flagSettingsFile       = flag.String("settingsfile", "", "file of name=value lines overriding the reloadable flags (loglevel, maxloginfailures, loginfailurewindow, authrateburst, authrateinterval, nosync); reread on SIGHUP")
+	flagKeepAlivePeriod    = flag.Duration("keepaliveperiod", server.DefaultKeepAlivePeriod, "TCP keep-alive period for client connections")
+	flagTCPNoDelay         = flag.Bool("tcpnodelay", true, "disable Nagle's algorithm on client connections, for lower latency on small responses")
+	flagAcceptBackoff      = flag.Duration("acceptbackoff", server.DefaultAcceptBackoff, "how long to wait before retrying after a temporary error accepting a connection, such as running out of file descriptors")
+	flagMaxAcceptBackoff   = flag.Duration("maxacceptbackoff", server.DefaultMaxAcceptBackoff, "longest wait between retries after temporary accept errors; the wait doubles with each error in a row")
+	flagMaxHeaderBytes     = flag.Int("maxheaderbytes", server.DefaultMaxHeaderBytes, "largest request headers accepted, in bytes, including the request line; larger requests get 431")
+	flagPreStopDelay       = flag.Duration("prestopdelay", 0, "how long /healthz and /readyz report not ready on SIGTERM before the server stops accepting connections")
+	flagShutdownTimeout    = flag.Duration("shutdowntimeout", server.DefaultShutdownTimeout, "how long to wait for requests in progress when shutting down or handing over on SIGUSR2")
+	flagSlowUpdate         = flag.Duration("slowupdate", server.DefaultSlowUpdate, "log a warning when a repository write holds the lock for longer than this, or 0 for never")
+	flagContentFanout      = flag.Int("contentfanout", repo.DefaultContentFanout, fmt.Sprintf("directory levels, each named for one byte of the digest, to spread stored blob files over (0 to %d); files stored under another setting are still found", repo.MaxContentFanout))
+	flagNoSync             = flag.Bool("nosync", false, "UNSAFE: do not flush writes to disk before answering, for faster bulk loads; a crash may lose or corrupt data")
+	flagWebhooks           = flag.String("webhooks", "", "comma-separated URLs to POST user and group change events to; requests are signed with $C9_WEBHOOK_SECRET if set")
+	flagHSTSMaxAge         = flag.Duration("hstsmaxage", 0, "max-age of the Strict-Transport-Security header, or 0 to omit it; only for servers reached over HTTPS")
+	flagHSTSSubdomains     = flag.Bool("hstssubdomains", false, "include subdomains in the Strict-Transport-Security header")
+	flagNoSniff            = flag.Bool("nosniff", false, "send \"X-Content-Type-Options: nosniff\" on every response")
+	flagFrameOptions       = flag.String("frameoptions", "", "value of the X-Frame-Options header, such as DENY or SAMEORIGIN, or empty to omit it")
+	flagCSP                = flag.String("csp", "", "value of the Content-Security-Policy header, or empty to omit it")
+	flagPublicURL          = flag.String("publicurl", "", "URL at which clients reach the server, such as https://cloud9.example.com, for links in e-mail; without it, none are sent")
+	flagSMTPAddr           = flag.String("smtpaddr", "", "host:port of the SMTP relay for outgoing e-mail, or empty to send none")
+	flagSMTPFrom           = flag.String("smtpfrom", "cloud9@localhost", "sender address for outgoing e-mail")
+	flagSMTPUser           = flag.String("smtpuser", "", "user name for SMTP authentication; the password is read from $C9_SMTP_PASSWORD")
+)
+
+func envOr(key, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return def
+}
+
+// parseListenAddrs parses the -listen flag.
+func parseListenAddrs(s string) []server.ListenAddr {
+	var addrs []server.ListenAddr
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		a := server.ListenAddr{Proto: "tcp", Addr: item}
+		if i := strings.Index(item, "://"); i >= 0 {
+			a.Proto, a.Addr = item[:i], item[i+3:]
+		}
+		addrs = append(addrs, a)
+	}
+	return addrs
+}
+
+// readSettings applies the settings file at path, if any, to s.  Each
+// non-blank line not starting with '#' sets one of the reloadable flags.
+func readSettings(path string, s *server.Settings) error {
+	if path == "" {
+		return nil
+	}
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	fs := flag.NewFlagSet(path, flag.ContinueOnError)
+	level := fs.String("loglevel", s.LogLevel.String(), "")
+	fs.IntVar(&s.MaxLoginFailures, "maxloginfailures", s.MaxLoginFailures, "")
+	fs.DurationVar(&s.LoginFailureWindow, "loginfailurewindow", s.LoginFailureWindow, "")
+	fs.IntVar(&s.AuthRateBurst, "authrateburst", s.AuthRateBurst, "")
+	fs.DurationVar(&s.AuthRateInterval, "authrateinterval", s.AuthRateInterval, "")
+	fs.BoolVar(&s.NoSync, "nosync", s.NoSync, "")
+	for i, line := range strings.Split(string(raw), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			return fmt.Errorf("%s:%d: expected name=value", path, i+1)
+		}
+		name, value := strings.TrimSpace(line[:eq]), strings.TrimSpace(line[eq+1:])
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("%s:%d: %q is not a reloadable flag", path, i+1, name)
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, i+1, err)
+		}
+	}
+	s.LogLevel, err = server.ParseLogLevel(*level)
+	if err != nil {
+		return fmt.Errorf("%s: loglevel: %v", path, err)
+	}
+	return nil
+}
+
+// scrub runs "c9master scrub", which checks every blob against its stored
+// digest.  It opens the repo itself, so the server must be stopped; POST
+// /admin/scrub checks a running one.  Interrupted, it prints the -after to
+// carry on from.
+func scrub(dir string, args []string) {
+	fs := flag.NewFlagSet("scrub", flag.ExitOnError)
+	after := fs.Uint64("after", 0, "id of the blob to carry on after, as printed by an interrupted scrub")
+	quarantine := fs.Bool("quarantine", false, "move corrupt content files out of the store")
+	fs.Parse(args)
+	r, err := repo.Open(dir)
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	defer r.Close()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var lastProgress time.Time
+	report, err := server.Scrub(ctx, r, server.ScrubOptions{
+		After:      *after,
+		Quarantine: *quarantine,
+		Progress: func(report *server.ScrubReport) {
+			if time.Since(lastProgress) >= 5*time.Second {
+				lastProgress = time.Now()
+				log.Printf("scrub: %d checked, %d corrupt so far", report.Checked, len(report.Corrupt))
+			}
+		},
+	})
+	for _, item := range report.Corrupt {
+		switch {
+		case item.Missing:
+			log.Printf("blob %d: content missing", item.Id)
+		case item.Quarantined:
+			log.Printf("blob %d: corrupt, quarantined: digest is %s, want %s", item.Id, item.Actual, item.Digest)
+		default:
+			log.Printf("blob %d: corrupt: digest is %s, want %s", item.Id, item.Actual, item.Digest)
+		}
+	}
+	log.Printf("scrub: %d checked, %d skipped (no digest), %d corrupt", report.Checked, report.Skipped, len(report.Corrupt))
+	if err != nil {
+		if ctx.Err() != nil {
+			log.Fatalf("scrub: interrupted; carry on with: scrub -after %d", report.NextAfter)
+		}
+		log.Fatalf("error: %v", err)
+	}
+	if len(report.Corrupt) > 0 {
+		os.Exit(1)
+	}
+}
+
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags]\n       %s scrub [-after id] [-quarantine]\n", os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	switch flag.Arg(0) {
+	case "":
+	case "scrub":
+		scrub("/srv/c9", flag.Args()[1:])
+		return
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	level, err := server.ParseLogLevel(*flagLogLevel)
+	if err != nil {
+		log.Fatalf("error: -loglevel: %v", err)
+	}
+	if *flagPasswordCost < bcrypt.MinCost || *flagPasswordCost > bcrypt.MaxCost {
+		log.Fatalf("error: -passwordcost: must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	if server.DisplayNamePolicies[*flagDisplayName] == nil {
+		log.Fatalf("error: -displayname: must be username, title or blank")
+	}
+	addrs := parseListenAddrs(*flagListen)
+	if len(addrs) == 0 {
+		log.Fatalf("error: -listen: no addresses")
+	}
+	for _, a := range parseListenAddrs(*flagAdminListen) {
+		a.Admin = true
+		addrs = append(addrs, a)
+	}
 	srv, err := server.New("/srv/c9")
 	if err != nil {
 		log.Fatalf("error: %v", err)
 	}
 	defer srv.Close()
-	err = srv.ListenAndServe("tcp", ":8002")
+	if err := srv.Repo.SetContentFanout(*flagContentFanout); err != nil {
+		log.Fatalf("error: -contentfanout: %v", err)
+	}
+	srv.Log.Level = level
+	srv.ServerHeader = *flagServerHeader
+	srv.MaxLoginFailures = *flagMaxLoginFailures
+	srv.LoginFailureWindow = *flagLoginFailureWindow
+	srv.PasswordCost = *flagPasswordCost
+	srv.AuthRateBurst = *flagAuthRateBurst
+	srv.AuthRateInterval = *flagAuthRateInterval
+	srv.MaxInFlight = *flagMaxInFlight
+	srv.QueueWhenBusy = *flagQueueWhenBusy
+	srv.MaxGroupMembers = *flagMaxGroupMembers
+	srv.ReparentGroups = *flagReparentGroups
+	srv.MaxPageSize = *flagMaxPageSize
+	srv.ReservedNames = strings.Split(*flagReservedNames, ",")
+	srv.DisplayNamePolicy = server.DisplayNamePolicies[*flagDisplayName]
+	srv.BlobCacheMaxAge = *flagBlobCacheMaxAge
+	srv.ObjectCacheMaxAge = *flagObjectCacheMaxAge
+	srv.PublicLists = *flagPublicLists
+	srv.InlineBlobs = *flagInlineBlobs
+	srv.VerifyBlobs = *flagVerifyBlobs
+	srv.MaxMultipartParts = *flagMaxMultipartParts
+	srv.MaxMultipartSize = *flagMaxMultipartSize
+	srv.UploadTTL = *flagUploadTTL
+	srv.MaxUploadsPerUser = *flagMaxUploadsPerUser
+	srv.ObjectCacheSize = *flagObjectCacheSize
+	srv.ETagCacheSize = *flagETagCacheSize
+	srv.KeepAlivePeriod = *flagKeepAlivePeriod
+	srv.TCPNoDelay = *flagTCPNoDelay
+	srv.AcceptBackoff = *flagAcceptBackoff
+	srv.MaxAcceptBackoff = *flagMaxAcceptBackoff
+	srv.MaxHeaderBytes = *flagMaxHeaderBytes
+	srv.PreStopDelay = *flagPreStopDelay
+	srv.ShutdownTimeout = *flagShutdownTimeout
+	srv.SlowUpdate = *flagSlowUpdate
+	srv.TrustLoopbackAdmin = *flagTrustLoopbackAdmin
+	srv.TrustedProxies, err = server.ParseTrustedProxies(*flagTrustedProxies)
 	if err != nil {
-		operr, ok := err.(*net.OpError)
-		if !ok || operr.Op != "accept" || operr.Err.Error() != "use of closed network connection" {
-			log.Fatalf("error: %#v\n", err)
+		log.Fatalf("error: -trustedproxies: %v", err)
+	}
+	srv.SecurityHeaders = server.SecurityHeaders{
+		HSTSMaxAge:            *flagHSTSMaxAge,
+		HSTSIncludeSubdomains: *flagHSTSSubdomains,
+		NoSniff:               *flagNoSniff,
+		FrameOptions:          *flagFrameOptions,
+		ContentSecurityPolicy: *flagCSP,
+	}
+	base := srv.Settings()
+	base.NoSync = *flagNoSync
+	settings := base
+	if err := readSettings(*flagSettingsFile, &settings); err != nil {
+		log.Fatalf("error: -settingsfile: %v", err)
+	}
+	srv.Reconfigure(settings)
+	srv.Reload = func(s *server.Settings) error {
+		*s = base
+		return readSettings(*flagSettingsFile, s)
+	}
+	if *flagPublicURL != "" {
+		u, err := url.Parse(*flagPublicURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Fatalf("error: -publicurl: must be an absolute http or https URL")
 		}
+		srv.PublicURL = *flagPublicURL
+	}
+	if *flagSMTPAddr != "" {
+		notifier := server.SMTPNotifier{Addr: *flagSMTPAddr, From: *flagSMTPFrom}
+		if *flagSMTPUser != "" {
+			host, _, err := net.SplitHostPort(*flagSMTPAddr)
+			if err != nil {
+				log.Fatalf("error: -smtpaddr: %v", err)
+			}
+			notifier.Auth = smtp.PlainAuth("", *flagSMTPUser, os.Getenv("C9_SMTP_PASSWORD"), host)
+		}
+		srv.Notifier = notifier
+	}
+	if *flagWebhooks != "" {
+		var urls []string
+		for _, u := range strings.Split(*flagWebhooks, ",") {
+			if u = strings.TrimSpace(u); u != "" {
+				urls = append(urls, u)
+			}
+		}
+		sink := server.NewWebhookSink(urls, []byte(os.Getenv("C9_WEBHOOK_SECRET")), srv.Log)
+		defer sink.Close()
+		srv.Events = sink
+	}
+	if err := srv.ListenAndServeMulti(addrs); err != nil {
+		log.Fatalf("error: %v", err)
 	}
 }
@@ -0,0 +1,317 @@
+package repo
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// benchRecords is the number of objects in the repo for the read and list
+// benchmarks.
+const benchRecords = 10000
+
+func benchName(i int) string {
+	return fmt.Sprintf("user%d", i)
+}
+
+// benchFill creates n users named user0, user1, ..., with ids 1 to n, in
+// one Update.
+func benchFill(b *testing.B, r *Repo, n int) {
+	b.Helper()
+	err := r.Update(USER, func(tx *Tx) error {
+		for i := 0; i < n; i++ {
+			if err := benchPut(tx, i); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+}
+
+func benchPut(tx *Tx, i int) error {
+	id, err := tx.AllocateId()
+	if err != nil {
+		return err
+	}
+	if err := tx.Associate(id, benchName(i)); err != nil {
+		return err
+	}
+	return tx.Put(id, make([]byte, 64))
+}
+
+// BenchmarkCreate measures one Update per new object, as POST does.
+func BenchmarkCreate(b *testing.B) {
+	benchCreate(b, openTestRepo(b))
+}
+
+// BenchmarkCreateNoSync is BenchmarkCreate without flushing each Update to
+// disk, as during a bulk load with -nosync.
+func BenchmarkCreateNoSync(b *testing.B) {
+	r := openTestRepo(b)
+	if err := r.SetNoSync(true); err != nil {
+		b.Fatal(err)
+	}
+	benchCreate(b, r)
+}
+
+func benchCreate(b *testing.B, r *Repo) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := r.Update(USER, func(tx *Tx) error {
+			return benchPut(tx, i)
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	r := openTestRepo(b)
+	benchFill(b, r, benchRecords)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := r.View(USER, func(tx *Tx) error {
+			_, err := tx.Get(uint64(i%benchRecords) + 1)
+			return err
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchGetManyN is how many objects the GetMany and GetEach benchmarks
+// read per operation, as for a group's members.
+const benchGetManyN = 100
+
+// BenchmarkGetMany measures reading benchGetManyN objects with a View for
+// each.
+func BenchmarkGetMany(b *testing.B) {
+	r := openTestRepo(b)
+	benchFill(b, r, benchRecords)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < benchGetManyN; j++ {
+			err := r.View(USER, func(tx *Tx) error {
+				_, err := tx.Get(uint64((i*benchGetManyN+j)%benchRecords) + 1)
+				return err
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// BenchmarkGetEach measures reading benchGetManyN objects in one View.
+func BenchmarkGetEach(b *testing.B) {
+	r := openTestRepo(b)
+	benchFill(b, r, benchRecords)
+	ids := make([]uint64, benchGetManyN)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := range ids {
+			ids[j] = uint64((i*benchGetManyN+j)%benchRecords) + 1
+		}
+		err := r.View(USER, func(tx *Tx) error {
+			return tx.GetEach(ids, func(_ uint64, _ []byte, err error) error {
+				return err
+			})
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkLookup(b *testing.B) {
+	r := openTestRepo(b)
+	benchFill(b, r, benchRecords)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := r.View(USER, func(tx *Tx) error {
+			_, err := tx.Lookup(benchName(i % benchRecords))
+			return err
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkForEach measures listing every object, as GET /user does.
+func BenchmarkForEach(b *testing.B) {
+	r := openTestRepo(b)
+	benchFill(b, r, benchRecords)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := r.View(USER, func(tx *Tx) error {
+			return tx.ForEach(func(uint64, []byte) error {
+				return nil
+			})
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkDelete measures one Update per deleted object, as DELETE does.
+func BenchmarkDelete(b *testing.B) {
+	r := openTestRepo(b)
+	benchFill(b, r, b.N)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := r.Update(USER, func(tx *Tx) error {
+			if err := tx.Delete(uint64(i) + 1); err != nil {
+				return err
+			}
+			return tx.Unassociate(benchName(i))
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchBlobSize is the size of each blob uploaded by the concurrent
+// benchmarks.
+const benchBlobSize = 64 << 10
+
+// benchUpload records a new blob with content data, which it changes to be
+// unique to n, making the writes an upload makes through server.PutBlob
+// but for the metadata: a record of the blob, of type ot, indexed by
+// digest, and an audit entry.  The content goes in the record itself if
+// inline is set, or else to the content store first.
+func benchUpload(r *Repo, ot ObjectType, data []byte, n uint64, inline bool) error {
+	binary.BigEndian.PutUint64(data, n)
+	sum := sha256.Sum256(data)
+	digest := fmt.Sprintf("sha256:%x", sum)
+	value := data
+	if !inline {
+		key, err := r.StoreContent(data)
+		if err != nil {
+			return err
+		}
+		defer r.ReleaseContent(key)
+		value = []byte(key)
+	}
+	return r.Update(ot, func(tx *Tx) error {
+		id, err := tx.AllocateId()
+		if err != nil {
+			return err
+		}
+		if err := tx.Put(id, value); err != nil {
+			return err
+		}
+		if err := tx.Associate(id, digest); err != nil {
+			return err
+		}
+		atx := tx.As(AUDIT)
+		auditId, err := atx.AllocateId()
+		if err != nil {
+			return err
+		}
+		return atx.Put(auditId, make([]byte, 64))
+	})
+}
+
+// BenchmarkUploadsAndCreates measures blob uploads and user creates made
+// at the same time, half and half, with the blob data written inside the
+// upload's Update or, as now, to the content store before it.
+func BenchmarkUploadsAndCreates(b *testing.B) {
+	for _, inline := range []bool{true, false} {
+		name := "external"
+		if inline {
+			name = "inline"
+		}
+		b.Run(name, func(b *testing.B) {
+			r := openTestRepo(b)
+			var n uint64
+			b.SetBytes(benchBlobSize / 2)
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				data := make([]byte, benchBlobSize)
+				for pb.Next() {
+					i := atomic.AddUint64(&n, 1)
+					var err error
+					if i%2 == 0 {
+						err = benchUpload(r, BLOB, data, i, inline)
+					} else {
+						err = r.Update(USER, func(tx *Tx) error {
+							return benchPut(tx, int(i))
+						})
+					}
+					if err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkCreateDuringUploads measures user creates while blobs are
+// uploaded continually alongside.  The blobs are recorded in their own
+// database, as now, or, as before they had one, in the users' database,
+// standing in as groups.
+func BenchmarkCreateDuringUploads(b *testing.B) {
+	for _, ot := range []ObjectType{BLOB, GROUP} {
+		name := "separate"
+		if ot == GROUP {
+			name = "shared"
+		}
+		b.Run(name, func(b *testing.B) {
+			r := openTestRepo(b)
+			stop := make(chan struct{})
+			var wg sync.WaitGroup
+			for w := 0; w < 4; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					data := make([]byte, benchBlobSize)
+					for i := uint64(w) << 32; ; i++ {
+						select {
+						case <-stop:
+							return
+						default:
+						}
+						if err := benchUpload(r, ot, data, i, false); err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				}(w)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				err := r.Update(USER, func(tx *Tx) error {
+					return benchPut(tx, i)
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			close(stop)
+			wg.Wait()
+		})
+	}
+}
@@ -0,0 +1,245 @@
+package repo
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// The content store keeps large values, such as blob data, as files
+// beside the database instead of in it.  Files are written before the
+// Update that refers to them and outside it, so that only a short key is
+// written while holding the write lock.  Each file is named for the
+// SHA-256 of its content, so storing the same data twice writes one file,
+// and a file never changes once written.
+//
+// Like git's object store, files are spread over subdirectories named for
+// the leading bytes of their keys, since some filesystems slow down with
+// many files in one directory: with a fanout of 2, the file for key
+// "abcd..." is content/ab/cd/abcd....  The fanout may be changed; files
+// stored under an earlier one are still found.
+
+// ContentDir is the directory, within the repo's, of the content store.
+const ContentDir = "content"
+
+// DefaultContentFanout is the number of directory levels new content files
+// are stored under until SetContentFanout is called; MaxContentFanout is
+// the most it allows.  A fanout of 0 keeps every file in ContentDir
+// itself, as the store did before it had subdirectories.
+const (
+	DefaultContentFanout = 1
+	MaxContentFanout     = 3
+)
+
+// SetContentFanout sets the number of directory levels, each named for
+// one byte of the key, under which new content files are stored.
+func (r *Repo) SetContentFanout(fanout int) error {
+	if fanout < 0 || fanout > MaxContentFanout {
+		return fmt.Errorf("github.com/cloud9-tools/cloud9/repo: content fanout %d is not between 0 and %d", fanout, MaxContentFanout)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.contentFanout = fanout
+	return nil
+}
+
+// ContentFanout returns the fanout set by SetContentFanout.
+func (r *Repo) ContentFanout() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.contentFanout
+}
+
+// StoreContent durably writes data to the content store and returns the
+// key under which LoadContent finds it.  The key is held, so that
+// DiscardContent leaves the file alone, until the caller has made the
+// Update referring to it and calls ReleaseContent.
+func (r *Repo) StoreContent(data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	key := hex.EncodeToString(sum[:])
+	r.holdContent(key)
+	if err := r.writeContent(key, data); err != nil {
+		r.ReleaseContent(key)
+		return "", err
+	}
+	return key, nil
+}
+
+func (r *Repo) writeContent(key string, data []byte) error {
+	if _, err := r.findContent(key); err == nil {
+		return nil
+	}
+	path := r.contentPath(key, r.ContentFanout())
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return syncDir(dir)
+}
+
+func (r *Repo) holdContent(key string) {
+	r.contentMu.Lock()
+	defer r.contentMu.Unlock()
+	if r.contentHolds == nil {
+		r.contentHolds = make(map[string]int)
+	}
+	r.contentHolds[key]++
+}
+
+// ReleaseContent ends the hold StoreContent took on key.
+func (r *Repo) ReleaseContent(key string) {
+	r.contentMu.Lock()
+	defer r.contentMu.Unlock()
+	if r.contentHolds[key]--; r.contentHolds[key] <= 0 {
+		delete(r.contentHolds, key)
+	}
+}
+
+// DiscardContent removes the file for key, which an Update failed to refer
+// to, unless StoreContent holds it for another caller.  Call it, having
+// released the key, within an Update of the bucket that refers to content
+// and once sure that nothing there does, so that no reference can be made
+// meanwhile.  It reports whether there was a file to remove.
+func (r *Repo) DiscardContent(key string) (bool, error) {
+	r.contentMu.Lock()
+	defer r.contentMu.Unlock()
+	if r.contentHolds[key] > 0 {
+		return false, nil
+	}
+	path, err := r.findContent(key)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := os.Remove(path); err != nil {
+		return false, err
+	}
+	return true, syncDir(filepath.Dir(path))
+}
+
+// LoadContent returns the data stored under key.
+func (r *Repo) LoadContent(key string) ([]byte, error) {
+	if _, err := hex.DecodeString(key); err != nil || len(key) != 2*sha256.Size {
+		return nil, fmt.Errorf("github.com/cloud9-tools/cloud9/repo: invalid content key %q", key)
+	}
+	path, err := r.findContent(key)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(path)
+}
+
+// QuarantineDir is the directory, within the repo's, that
+// QuarantineContent moves files to.
+const QuarantineDir = "quarantine"
+
+// QuarantineContent moves the file for key out of the content store, so
+// that it is no longer served, and keeps it in QuarantineDir for
+// inspection.  Storing the same data again writes a fresh file.
+func (r *Repo) QuarantineContent(key string) error {
+	path, err := r.findContent(key)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(r.dir, QuarantineDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if err := os.Rename(path, filepath.Join(dir, key)); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// ForEachContent calls fn with the key and size of each file in the
+// content store, under whichever fanout it was stored.  Files being
+// written are skipped.
+func (r *Repo) ForEachContent(fn func(key string, size int64) error) error {
+	root := filepath.Join(r.dir, ContentDir)
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		key := fi.Name()
+		if fi.IsDir() || len(key) != 2*sha256.Size {
+			return nil
+		}
+		if _, err := hex.DecodeString(key); err != nil {
+			return nil
+		}
+		return fn(key, fi.Size())
+	})
+	return stopped(err)
+}
+
+// ContentPath returns the path of the file for key in the layout with the
+// given fanout, relative to the content store.
+func ContentPath(key string, fanout int) string {
+	parts := make([]string, 0, fanout+1)
+	for i := 0; i < fanout && 2*i+2 <= len(key); i++ {
+		parts = append(parts, key[2*i:2*i+2])
+	}
+	return filepath.Join(append(parts, key)...)
+}
+
+func (r *Repo) contentPath(key string, fanout int) string {
+	return filepath.Join(r.dir, ContentDir, ContentPath(key, fanout))
+}
+
+// findContent returns the path of the file for key, looking first in the
+// current layout and then in the others.  If there is none, the error is
+// that for the current layout.
+func (r *Repo) findContent(key string) (string, error) {
+	current := r.ContentFanout()
+	path := r.contentPath(key, current)
+	_, err := os.Stat(path)
+	if !os.IsNotExist(err) {
+		return path, err
+	}
+	for fanout := 0; fanout <= MaxContentFanout; fanout++ {
+		if fanout == current {
+			continue
+		}
+		other := r.contentPath(key, fanout)
+		if _, err := os.Stat(other); err == nil {
+			return other, nil
+		}
+	}
+	return path, err
+}
+
+// syncDir makes a rename within dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
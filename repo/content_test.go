@@ -0,0 +1,147 @@
+package repo
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiscardContent(t *testing.T) {
+	r := openTestRepo(t)
+	data := []byte("hello, world")
+	key, err := r.StoreContent(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.StoreContent(data); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another caller still holds the key.
+	r.ReleaseContent(key)
+	if removed, err := r.DiscardContent(key); err != nil || removed {
+		t.Fatalf("DiscardContent of held content: got %v, %v", removed, err)
+	}
+	if _, err := r.LoadContent(key); err != nil {
+		t.Fatalf("content held by another caller was discarded: %v", err)
+	}
+
+	r.ReleaseContent(key)
+	if removed, err := r.DiscardContent(key); err != nil || !removed {
+		t.Fatalf("DiscardContent: got %v, %v", removed, err)
+	}
+	if _, err := r.LoadContent(key); !os.IsNotExist(err) {
+		t.Fatalf("LoadContent after DiscardContent: got %v, want a missing file", err)
+	}
+	if removed, err := r.DiscardContent(key); err != nil || removed {
+		t.Errorf("DiscardContent of missing content: got %v, %v", removed, err)
+	}
+
+	// Storing it again writes a fresh file.
+	if _, err := r.StoreContent(data); err != nil {
+		t.Fatal(err)
+	}
+	r.ReleaseContent(key)
+	if got, err := r.LoadContent(key); err != nil || string(got) != string(data) {
+		t.Fatalf("LoadContent: got %q, %v", got, err)
+	}
+}
+
+func TestForEachContent(t *testing.T) {
+	r := openTestRepo(t)
+	want := make(map[string]int64)
+	for fanout, data := range []string{"flat", "one level", "two levels"} {
+		if err := r.SetContentFanout(fanout); err != nil {
+			t.Fatal(err)
+		}
+		key, err := r.StoreContent([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.ReleaseContent(key)
+		want[key] = int64(len(data))
+	}
+	got := make(map[string]int64)
+	err := r.ForEachContent(func(key string, size int64) error {
+		got[key] = size
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for key, size := range want {
+		if got[key] != size {
+			t.Errorf("key %s: got size %d, want %d", key, got[key], size)
+		}
+	}
+}
+
+func TestContentPath(t *testing.T) {
+	key := "abcdef0123"
+	for fanout, want := range []string{
+		"abcdef0123",
+		filepath.Join("ab", "abcdef0123"),
+		filepath.Join("ab", "cd", "abcdef0123"),
+		filepath.Join("ab", "cd", "ef", "abcdef0123"),
+	} {
+		if got := ContentPath(key, fanout); got != want {
+			t.Errorf("ContentPath(%q, %d) = %q, want %q", key, fanout, got, want)
+		}
+	}
+}
+
+func TestContentFanout(t *testing.T) {
+	r := openTestRepo(t)
+	if got := r.ContentFanout(); got != DefaultContentFanout {
+		t.Errorf("ContentFanout of a new repo = %d, want %d", got, DefaultContentFanout)
+	}
+	for _, fanout := range []int{-1, MaxContentFanout + 1} {
+		if err := r.SetContentFanout(fanout); err == nil {
+			t.Errorf("SetContentFanout(%d) succeeded", fanout)
+		}
+	}
+
+	keys := make(map[int]string)
+	for fanout := 0; fanout <= MaxContentFanout; fanout++ {
+		if err := r.SetContentFanout(fanout); err != nil {
+			t.Fatal(err)
+		}
+		key, err := r.StoreContent([]byte(fmt.Sprintf("stored under fanout %d", fanout)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.ReleaseContent(key)
+		keys[fanout] = key
+		path := filepath.Join(r.Dir(), ContentDir, ContentPath(key, fanout))
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("fanout %d: %v", fanout, err)
+		}
+	}
+
+	// Every file is found whatever the fanout now, and storing the same
+	// data again does not make a second copy.
+	if err := r.SetContentFanout(2); err != nil {
+		t.Fatal(err)
+	}
+	for fanout, key := range keys {
+		data, err := r.LoadContent(key)
+		if want := fmt.Sprintf("stored under fanout %d", fanout); err != nil || string(data) != want {
+			t.Errorf("LoadContent of a file stored under fanout %d: got %q, %v", fanout, data, err)
+		}
+		if _, err := r.StoreContent(data); err != nil {
+			t.Fatal(err)
+		}
+		r.ReleaseContent(key)
+	}
+	n := 0
+	if err := r.ForEachContent(func(string, int64) error { n++; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if n != len(keys) {
+		t.Errorf("%d content files, want %d", n, len(keys))
+	}
+}
@@ -0,0 +1,479 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/protobuf/proto"
+)
+
+// openTestRepo opens a repo in a temporary directory that is removed when
+// the test ends.
+func openTestRepo(t testing.TB) *Repo {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "cloud9-repo-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	r, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+// putTestObjects stores n objects of type ot with newly allocated ids.
+func putTestObjects(t *testing.T, r *Repo, ot ObjectType, n int) {
+	t.Helper()
+	err := r.Update(ot, func(tx *Tx) error {
+		for i := 0; i < n; i++ {
+			id, err := tx.AllocateId()
+			if err != nil {
+				return err
+			}
+			if err := tx.Put(id, []byte("x")); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScan(t *testing.T) {
+	r := openTestRepo(t)
+	putTestObjects(t, r, USER, 5)
+	scan := func(after uint64, limit int) []uint64 {
+		var ids []uint64
+		err := r.View(USER, func(tx *Tx) error {
+			return tx.Scan(after, limit, func(id uint64, _ []byte) error {
+				ids = append(ids, id)
+				return nil
+			})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ids
+	}
+	if got := scan(0, 0); len(got) != 5 || got[0] != 1 {
+		t.Errorf("Scan(0, 0) = %v, want ids 1 to 5", got)
+	}
+	if got := scan(2, 2); len(got) != 2 || got[0] != 3 || got[1] != 4 {
+		t.Errorf("Scan(2, 2) = %v, want [3 4]", got)
+	}
+	if got := scan(5, 0); len(got) != 0 {
+		t.Errorf("Scan(5, 0) = %v, want nothing", got)
+	}
+	if got := scan(math.MaxUint64, 0); len(got) != 0 {
+		t.Errorf("Scan(MaxUint64, 0) = %v, want nothing", got)
+	}
+}
+
+func TestCount(t *testing.T) {
+	r := openTestRepo(t)
+	count := func() int {
+		var n int
+		err := r.View(GROUP, func(tx *Tx) error {
+			var err error
+			n, err = tx.Count()
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	if n := count(); n != 0 {
+		t.Fatalf("Count() = %d in a new repo, want 0", n)
+	}
+	putTestObjects(t, r, GROUP, 3)
+	err := r.Update(GROUP, func(tx *Tx) error {
+		if err := tx.Put(1, []byte("replaced")); err != nil {
+			return err
+		}
+		return tx.Delete(2)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := count(); n != 2 {
+		t.Fatalf("Count() = %d after 3 puts, 1 replacement and 1 delete, want 2", n)
+	}
+
+	// A rolled back transaction leaves the count alone.
+	r.Update(GROUP, func(tx *Tx) error {
+		tx.Delete(1)
+		return ErrStopIteration
+	})
+	if n := count(); n != 2 {
+		t.Fatalf("Count() = %d after a rollback, want 2", n)
+	}
+}
+
+func TestCountInitialized(t *testing.T) {
+	r := openTestRepo(t)
+	putTestObjects(t, r, USER, 4)
+	// Forget the count, as in a repo written before counts were kept.
+	err := r.db.Update(func(bolttx *bolt.Tx) error {
+		return bolttx.Bucket([]byte(countsBucket)).Delete([]byte(USER))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.initCounts(); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	err = r.View(USER, func(tx *Tx) error {
+		n, err = tx.Count()
+		return err
+	})
+	if err != nil || n != 4 {
+		t.Fatalf("Count() = %d, %v, want 4", n, err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	r := openTestRepo(t)
+	putTestObjects(t, r, GROUP, 3)
+	putTestObjects(t, r, BLOB, 2)
+	stats, err := r.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range append(append([]string(nil), requiredBuckets...), blobBuckets...) {
+		if _, ok := stats[name]; !ok {
+			t.Errorf("no stats for bucket %q", name)
+		}
+	}
+	if n := stats["group"].KeyN; n != 3 {
+		t.Errorf("group has %d keys, want 3", n)
+	}
+	if n := stats["blob"].KeyN; n != 2 {
+		t.Errorf("blob has %d keys, want 2", n)
+	}
+}
+
+// testRecord is a message for the tests of ForEachDecoded.
+type testRecord struct {
+	Name string `protobuf:"bytes,1,opt,name=name"`
+}
+
+func (m *testRecord) Reset()         { *m = testRecord{} }
+func (m *testRecord) String() string { return proto.CompactTextString(m) }
+func (*testRecord) ProtoMessage()    {}
+
+func TestForEachDecoded(t *testing.T) {
+	r := openTestRepo(t)
+	err := r.Update(USER, func(tx *Tx) error {
+		for _, raw := range [][]byte{
+			mustMarshal(t, &testRecord{Name: "alice"}),
+			{0xff, 0xff},
+			mustMarshal(t, &testRecord{Name: "bob"}),
+		} {
+			id, err := tx.AllocateId()
+			if err != nil {
+				return err
+			}
+			if err := tx.Put(id, raw); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	alloc := func() proto.Message { return &testRecord{} }
+
+	// Skipping the record that cannot be decoded.
+	var names []string
+	var bad []uint64
+	err = r.View(USER, func(tx *Tx) error {
+		return tx.ForEachDecoded(alloc, func(id uint64, msg proto.Message, err error) error {
+			var derr *DecodeError
+			if errors.As(err, &derr) {
+				bad = append(bad, derr.Id)
+				return nil
+			}
+			names = append(names, msg.(*testRecord).Name)
+			return err
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(names, ",") != "alice,bob" || len(bad) != 1 || bad[0] != 2 {
+		t.Fatalf("got names %v and undecodable ids %v", names, bad)
+	}
+
+	// Stopping at it.
+	names = nil
+	err = r.View(USER, func(tx *Tx) error {
+		return tx.ForEachDecoded(alloc, func(id uint64, msg proto.Message, err error) error {
+			if err != nil {
+				return err
+			}
+			names = append(names, msg.(*testRecord).Name)
+			return nil
+		})
+	})
+	var derr *DecodeError
+	if !errors.As(err, &derr) || derr.Type != USER || derr.Id != 2 || len(names) != 1 {
+		t.Fatalf("got %v after %v, want a DecodeError for user 2", err, names)
+	}
+}
+
+func mustMarshal(t *testing.T, msg proto.Message) []byte {
+	t.Helper()
+	raw, err := proto.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestChangeListeners(t *testing.T) {
+	r := openTestRepo(t)
+	var got []string
+	r.AddListener(ChangeFunc(func(ot ObjectType, action Action, id uint64) {
+		// The change is visible by the time listeners hear of it.
+		err := r.View(ot, func(tx *Tx) error {
+			_, err := tx.Get(id)
+			return err
+		})
+		if visible := err == nil; visible != (action != Deleted) {
+			t.Errorf("%s %s %d: Get gave %v", ot, action, id, err)
+		}
+		got = append(got, fmt.Sprintf("%s %s %d", ot, action, id))
+	}))
+	var ids []uint64
+	r.OnChange(func(ot ObjectType, id uint64) { ids = append(ids, id) })
+	expect := func(want ...string) {
+		t.Helper()
+		if strings.Join(got, ", ") != strings.Join(want, ", ") {
+			t.Errorf("changes %q, want %q", got, want)
+		}
+		got = nil
+	}
+
+	err := r.Update(USER, func(tx *Tx) error {
+		if err := tx.Put(1, []byte("a")); err != nil {
+			return err
+		}
+		if err := tx.Put(1, []byte("b")); err != nil {
+			return err
+		}
+		if err := tx.As(AUDIT).Put(5, []byte("c")); err != nil {
+			return err
+		}
+		return tx.Put(2, []byte("d"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect("user create 1", "user update 1", "audit create 5", "user create 2")
+	if len(ids) != 4 || ids[3] != 2 {
+		t.Errorf("OnChange got ids %v", ids)
+	}
+
+	err = r.Update(USER, func(tx *Tx) error { return tx.Delete(2) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect("user delete 2")
+
+	// Nothing is reported for Updates that fail, nor for Views.
+	err = r.Update(USER, func(tx *Tx) error {
+		if err := tx.Put(3, []byte("e")); err != nil {
+			return err
+		}
+		return errors.New("roll back")
+	})
+	if err == nil {
+		t.Fatal("Update did not fail")
+	}
+	err = r.Update(USER, func(tx *Tx) error { return tx.Delete(2) })
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Delete of a deleted id gave %v", err)
+	}
+	r.View(USER, func(tx *Tx) error {
+		_, err := tx.Get(1)
+		return err
+	})
+	expect()
+}
+
+func TestForEachName(t *testing.T) {
+	r := openTestRepo(t)
+	err := r.Update(USER, func(tx *Tx) error {
+		for i, name := range []string{"bob", "Alice", "alfred", "al", "Albert", "carol"} {
+			if err := tx.Associate(uint64(i+1), name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := func(prefix, after string, limit int) string {
+		t.Helper()
+		var got []string
+		err := r.View(USER, func(tx *Tx) error {
+			return tx.ForEachNameAfter(prefix, after, func(name string, id uint64) error {
+				got = append(got, fmt.Sprintf("%s=%d", name, id))
+				if len(got) == limit {
+					return ErrStopIteration
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(got, " ")
+	}
+	for _, test := range []struct {
+		prefix, after string
+		limit         int
+		want          string
+	}{
+		{"al", "", 0, "al=4 albert=5 alfred=3 alice=2"},
+		{"AL", "", 0, "al=4 albert=5 alfred=3 alice=2"},
+		{"ali", "", 0, "alice=2"},
+		{"alz", "", 0, ""},
+		{"", "", 0, "al=4 albert=5 alfred=3 alice=2 bob=1 carol=6"},
+		{"al", "", 2, "al=4 albert=5"},
+		{"al", "Albert", 0, "alfred=3 alice=2"},
+		{"al", "alb", 0, "albert=5 alfred=3 alice=2"},
+		{"al", "a", 0, "al=4 albert=5 alfred=3 alice=2"},
+		{"al", "alice", 0, ""},
+		{"", "bob", 0, "carol=6"},
+	} {
+		if got := names(test.prefix, test.after, test.limit); got != test.want {
+			t.Errorf("ForEachNameAfter(%q, %q) with limit %d gave %q, want %q", test.prefix, test.after, test.limit, got, test.want)
+		}
+	}
+}
+
+func TestErrorsWrapped(t *testing.T) {
+	r := openTestRepo(t)
+	err := r.Update(GROUP, func(tx *Tx) error {
+		if err := tx.Associate(1, "Admins"); err != nil {
+			return err
+		}
+		if err := tx.Associate(2, "admins"); err != nil {
+			return fmt.Errorf("creating group 2: %w", err)
+		}
+		return nil
+	})
+	if !errors.Is(err, ErrDuplicate) || errors.Is(err, ErrNotFound) {
+		t.Errorf("Associate of a taken name gave %v", err)
+	}
+	var derr *DuplicateError
+	if !errors.As(err, &derr) || derr.Type != GROUP || derr.ExistingId != 1 || derr.DesiredName != "admins" {
+		t.Errorf("errors.As gave %+v from %v", derr, err)
+	}
+
+	err = r.View(GROUP, func(tx *Tx) error {
+		_, err := tx.Get(7)
+		return fmt.Errorf("loading group: %w", fmt.Errorf("member of 3: %w", err))
+	})
+	if !errors.Is(err, ErrNotFound) || errors.Is(err, ErrDuplicate) {
+		t.Errorf("Get of a missing id gave %v", err)
+	}
+	var nerr *NotFoundError
+	if !errors.As(err, &nerr) || nerr.Type != GROUP || nerr.Id != 7 {
+		t.Errorf("errors.As gave %+v from %v", nerr, err)
+	}
+
+	err = r.View(GROUP, func(tx *Tx) error {
+		_, err := tx.Lookup("nobody")
+		return err
+	})
+	if !errors.As(err, &nerr) || nerr.Name != "nobody" || !errors.Is(err, ErrNotFound) {
+		t.Errorf("Lookup of a missing name gave %v", err)
+	}
+
+	// The sentinels themselves match only themselves.
+	if errors.Is(ErrNotFound, ErrDuplicate) || errors.Is(errors.New("other"), ErrNotFound) {
+		t.Error("sentinel matched the wrong error")
+	}
+}
+
+func TestContext(t *testing.T) {
+	r := openTestRepo(t)
+	type key struct{}
+	ctx := context.WithValue(context.Background(), key{}, "request 7")
+
+	err := r.ViewContext(ctx, USER, func(tx *Tx) error {
+		if got := tx.As(GROUP).Context().Value(key{}); got != "request 7" {
+			t.Errorf("View's tx.Context() lacks the value: %v", got)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.UpdateContext(ctx, USER, func(tx *Tx) error {
+		if got := tx.Context().Value(key{}); got != "request 7" {
+			t.Errorf("Update's tx.Context() lacks the value: %v", got)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.View(USER, func(tx *Tx) error {
+		if tx.Context() == nil {
+			t.Error("View without a context gave a nil tx.Context()")
+		}
+		return nil
+	})
+
+	// A context already done stops the transaction from starting.
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	ran := false
+	err = r.ViewContext(cancelled, USER, func(*Tx) error { ran = true; return nil })
+	if !errors.Is(err, context.Canceled) || ran {
+		t.Errorf("ViewContext with a cancelled context: ran %t, gave %v", ran, err)
+	}
+	err = r.UpdateContext(cancelled, USER, func(*Tx) error { ran = true; return nil })
+	if !errors.Is(err, context.Canceled) || ran {
+		t.Errorf("UpdateContext with a cancelled context: ran %t, gave %v", ran, err)
+	}
+
+	// Once started, fn may give up itself, which rolls back.
+	cancelLater, cancel := context.WithCancel(ctx)
+	err = r.UpdateContext(cancelLater, USER, func(tx *Tx) error {
+		if err := tx.Put(1, []byte("x")); err != nil {
+			return err
+		}
+		cancel()
+		return tx.Context().Err()
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("UpdateContext gave %v, want %v", err, context.Canceled)
+	}
+	err = r.View(USER, func(tx *Tx) error {
+		_, err := tx.Get(1)
+		return err
+	})
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Put in an abandoned Update was kept: %v", err)
+	}
+}
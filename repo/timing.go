@@ -0,0 +1,67 @@
+package repo
+
+import (
+	"sync"
+	"time"
+)
+
+// recentUpdates is how many of the latest Updates UpdateStats considers
+// when reporting the longest recent one.
+const recentUpdates = 128
+
+// UpdateStats describes how long Updates have held a write lock.  Since
+// only one Update runs at a time per database, a slow one delays every
+// other writer to the same database.
+type UpdateStats struct {
+	Updates       uint64        `json:"updates"`
+	SlowUpdates   uint64        `json:"slow_updates"`
+	LongestRecent time.Duration `json:"longest_recent_ns"`
+}
+
+type updateTiming struct {
+	mu        sync.Mutex
+	threshold time.Duration
+	onSlow    func(ObjectType, time.Duration)
+	count     uint64
+	slow      uint64
+	recent    [recentUpdates]time.Duration
+}
+
+// SetSlowUpdate arranges for onSlow to be called after each Update that
+// held the write lock for longer than threshold.  A threshold of zero
+// disables the check.
+func (r *Repo) SetSlowUpdate(threshold time.Duration, onSlow func(ot ObjectType, held time.Duration)) {
+	r.timing.mu.Lock()
+	defer r.timing.mu.Unlock()
+	r.timing.threshold = threshold
+	r.timing.onSlow = onSlow
+}
+
+// UpdateStats returns timing statistics for the Updates so far.
+func (r *Repo) UpdateStats() UpdateStats {
+	t := &r.timing
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	stats := UpdateStats{Updates: t.count, SlowUpdates: t.slow}
+	for _, d := range t.recent {
+		if d > stats.LongestRecent {
+			stats.LongestRecent = d
+		}
+	}
+	return stats
+}
+
+func (t *updateTiming) record(ot ObjectType, held time.Duration) {
+	t.mu.Lock()
+	t.recent[t.count%recentUpdates] = held
+	t.count++
+	slow := t.threshold > 0 && held > t.threshold
+	if slow {
+		t.slow++
+	}
+	onSlow := t.onSlow
+	t.mu.Unlock()
+	if slow && onSlow != nil {
+		onSlow(ot, held)
+	}
+}
@@ -0,0 +1,43 @@
+package repo
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSlowUpdate(t *testing.T) {
+	r := openTestRepo(t)
+	var slow []ObjectType
+	r.SetSlowUpdate(20*time.Millisecond, func(ot ObjectType, held time.Duration) {
+		if held <= 20*time.Millisecond {
+			t.Errorf("reported %v as slow", held)
+		}
+		slow = append(slow, ot)
+	})
+	before := r.UpdateStats().Updates
+
+	putTestObjects(t, r, GROUP, 1)
+	err := r.Update(USER, func(tx *Tx) error {
+		time.Sleep(30 * time.Millisecond)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := r.UpdateStats()
+	if stats.Updates-before != 2 || stats.SlowUpdates != 1 || stats.LongestRecent < 30*time.Millisecond {
+		t.Errorf("UpdateStats() = %+v, want 2 more updates, one of them slow", stats)
+	}
+	if len(slow) != 1 || slow[0] != USER {
+		t.Errorf("slow updates reported for %v, want [user]", slow)
+	}
+
+	r.SetSlowUpdate(0, nil)
+	r.Update(USER, func(tx *Tx) error {
+		time.Sleep(30 * time.Millisecond)
+		return nil
+	})
+	if n := r.UpdateStats().SlowUpdates; n != 1 {
+		t.Errorf("%d slow updates with the check disabled, want 1", n)
+	}
+}
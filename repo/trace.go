@@ -0,0 +1,49 @@
+package repo
+
+import (
+	"context"
+	"errors"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerName names the tracer that the repo's spans come from.
+const TracerName = "github.com/cloud9-tools/cloud9/repo"
+
+// tracerRef wraps the tracer set by SetTracerProvider, since atomic.Value
+// cannot hold a nil interface.
+type tracerRef struct {
+	tracer trace.Tracer
+}
+
+// SetTracerProvider makes ViewContext and UpdateContext record a span for
+// each transaction, using a tracer from tp.  If tp is nil, as it is by
+// default, no spans are recorded and tracing costs nothing.
+func (r *Repo) SetTracerProvider(tp trace.TracerProvider) {
+	var ref tracerRef
+	if tp != nil {
+		ref.tracer = tp.Tracer(TracerName)
+	}
+	r.tracer.Store(ref)
+}
+
+// startSpan starts the span for a transaction op on objects of type ot.
+// It returns the context carrying the span, and a function that ends the
+// span with the transaction's outcome.
+func (r *Repo) startSpan(ctx context.Context, op string, ot ObjectType) (context.Context, func(error)) {
+	ref, _ := r.tracer.Load().(tracerRef)
+	if ref.tracer == nil {
+		return ctx, func(error) {}
+	}
+	ctx, span := ref.tracer.Start(ctx, op, trace.WithAttributes(attribute.String("cloud9.object_type", string(ot))))
+	return ctx, func(err error) {
+		// A missing object is an answer, not a failure.
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/cloud9-tools/cloud9/repo"
+)
+
+type AuditEntry struct {
+	Id     uint64 `protobuf:"varint,1,opt,name=id" json:"id,omitempty"`
+	Time   int64  `protobuf:"varint,2,opt,name=time" json:"time,omitempty"`
+	Actor  uint64 `protobuf:"varint,3,opt,name=actor" json:"actor,omitempty"`
+	Method string `protobuf:"bytes,4,opt,name=method" json:"method,omitempty"`
+	Path   string `protobuf:"bytes,5,opt,name=path" json:"path,omitempty"`
+	Type   string `protobuf:"bytes,6,opt,name=type" json:"type,omitempty"`
+	Target uint64 `protobuf:"varint,7,opt,name=target" json:"target,omitempty"`
+	Status int32  `protobuf:"varint,8,opt,name=status" json:"status,omitempty"`
+}
+
+func (m *AuditEntry) Reset()         { *m = AuditEntry{} }
+func (m *AuditEntry) String() string { return proto.CompactTextString(m) }
+func (*AuditEntry) ProtoMessage()    {}
+
+// Audit appends a record of a successful mutation to the audit log.  It
+// should be called inside the mutation's own transaction, so that the
+// entry is committed only if the mutation is.  The two are committed
+// together, except for blobs: their Update commits blobs.db before meta.db,
+// where the log is kept, so a crash in between can keep a blob without
+// its entry; see repo.Repo.Update.  Time is in nanoseconds since the Unix
+// epoch.
+func Audit(tx *repo.Tx, r *http.Request, actor uint64, target uint64, status int) error {
+	atx := tx.As(repo.AUDIT)
+	id, err := atx.AllocateId()
+	if err != nil {
+		return err
+	}
+	e := AuditEntry{
+		Id:     id,
+		Time:   time.Now().UnixNano(),
+		Actor:  actor,
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Type:   tx.Type().String(),
+		Target: target,
+		Status: int32(status),
+	}
+	return atx.Put(id, MustMarshalProto(&e))
+}
+
+// UserId returns u's id, or 0 for the anonymous caller, a nil u.
+func UserId(u *User) uint64 {
+	if u == nil {
+		return 0
+	}
+	return u.Id
+}
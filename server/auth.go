@@ -0,0 +1,346 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/cloud9-tools/cloud9/repo"
+)
+
+const (
+	MinPasswordLength = 8
+	MaxPasswordLength = 72 // bcrypt ignores anything past 72 bytes
+
+	authRealm = "cloud9"
+)
+
+var (
+	ErrNoCredentials  = errors.New("no credentials")
+	ErrBadCredentials = errors.New("bad credentials")
+	ErrDisabled       = errors.New("account disabled")
+)
+
+// ValidatePassword checks pw against the password policy.  field names the
+// JSON field that pw came from, for use in the error message.
+func ValidatePassword(field, pw string) error {
+	switch {
+	case utf8.RuneCountInString(pw) < MinPasswordLength:
+		return fmt.Errorf("Field '%s' must be at least %d characters long", field, MinPasswordLength)
+	case len(pw) > MaxPasswordLength:
+		return fmt.Errorf("Field '%s' must be at most %d bytes long", field, MaxPasswordLength)
+	}
+	return nil
+}
+
+// HashPassword hashes pw with the given bcrypt cost.  A cost of zero means
+// bcrypt.DefaultCost.
+func HashPassword(pw string, cost int) ([]byte, error) {
+	if cost == 0 {
+		cost = bcrypt.DefaultCost
+	}
+	return bcrypt.GenerateFromPassword([]byte(pw), cost)
+}
+
+func CheckPassword(hash []byte, pw string) bool {
+	if len(hash) == 0 {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(pw)) == nil
+}
+
+type LoginFailures struct {
+	Count       uint32 `protobuf:"varint,1,opt,name=count" json:"count,omitempty"`
+	First       int64  `protobuf:"varint,2,opt,name=first" json:"first,omitempty"`
+	LockedUntil int64  `protobuf:"varint,3,opt,name=locked_until" json:"locked_until,omitempty"`
+}
+
+func (m *LoginFailures) Reset()         { *m = LoginFailures{} }
+func (m *LoginFailures) String() string { return proto.CompactTextString(m) }
+func (*LoginFailures) ProtoMessage()    {}
+
+type LockedOutError struct {
+	UserName string
+	Until    time.Time
+}
+
+func (err *LockedOutError) Error() string {
+	return fmt.Sprintf("user %q is locked out until %v", err.UserName, err.Until)
+}
+
+const (
+	DefaultMaxLoginFailures   = 5
+	DefaultLoginFailureWindow = 15 * time.Minute
+)
+
+// Authenticator checks HTTP Basic credentials against the stored users.
+// After MaxFailures bad passwords within Window, the account is locked for
+// the following Window.  A MaxFailures of zero disables the lockout.
+//
+// New passwords are hashed with bcrypt cost PasswordCost, and stored hashes
+// with a lower cost are upgraded the next time their owner logs in.
+//
+// Limiter, if set, limits attempts per client address and per account, so
+// that failures are turned away by GetCaller before costing a bcrypt hash.
+//
+// Once the Authenticator is in use, MaxFailures and Window may only be
+// changed with SetLockout.
+type Authenticator struct {
+	Repo         *repo.Repo
+	MaxFailures  int
+	Window       time.Duration
+	PasswordCost int
+	Limiter      *RateLimiter
+
+	mu    sync.RWMutex
+	dummy []byte
+}
+
+// SetLockout changes MaxFailures and Window.
+func (a *Authenticator) SetLockout(maxFailures int, window time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.MaxFailures = maxFailures
+	a.Window = window
+}
+
+func (a *Authenticator) lockout() (int, time.Duration) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.MaxFailures, a.Window
+}
+
+func (a *Authenticator) HashPassword(pw string) ([]byte, error) {
+	return HashPassword(pw, a.PasswordCost)
+}
+
+// cost returns the bcrypt cost for new hashes.
+func (a *Authenticator) cost() int {
+	if a.PasswordCost == 0 {
+		return bcrypt.DefaultCost
+	}
+	return a.PasswordCost
+}
+
+// dummyHash returns a hash, at the cost of new hashes, that no password
+// is checked against for real.  Authenticate checks against it when there
+// is no real hash, so as to take as long as when there is.
+func (a *Authenticator) dummyHash() []byte {
+	a.mu.RLock()
+	hash := a.dummy
+	a.mu.RUnlock()
+	if cost, err := bcrypt.Cost(hash); err == nil && cost == a.cost() {
+		return hash
+	}
+	hash, err := a.HashPassword("no one's password")
+	if err != nil {
+		panic(err)
+	}
+	a.mu.Lock()
+	a.dummy = hash
+	a.mu.Unlock()
+	return hash
+}
+
+// Authenticate returns the user named by the HTTP Basic credentials in r.
+// If the password is right but the user is disabled, it returns
+// ErrDisabled, or if the account is locked, a *LockedOutError.  Otherwise
+// it fails with ErrBadCredentials, taking about as long whether or not
+// the user exists, so as not to give away which names are taken.
+func (a *Authenticator) Authenticate(r *http.Request) (*User, error) {
+	userName, pw, ok := r.BasicAuth()
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+	now := time.Now()
+	var u User
+	var lf LoginFailures
+	err := a.Repo.ViewContext(r.Context(), repo.USER, func(tx *repo.Tx) error {
+		userId, err := tx.Lookup(userName)
+		if err != nil {
+			return err
+		}
+		value, err := tx.Get(userId)
+		if err != nil {
+			return err
+		}
+		MustUnmarshalProto(value, &u)
+		value, err = tx.As(repo.LOCKOUT).Get(userId)
+		if errors.Is(err, repo.ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		MustUnmarshalProto(value, &lf)
+		return nil
+	})
+	if errors.Is(err, repo.ErrNotFound) {
+		CheckPassword(a.dummyHash(), pw)
+		return nil, ErrBadCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+	hash := u.PasswordHash
+	if len(hash) == 0 {
+		hash = a.dummyHash()
+	}
+	ok = CheckPassword(hash, pw) && len(u.PasswordHash) != 0
+	until := time.Unix(lf.LockedUntil, 0)
+	locked := now.Before(until)
+	if !ok {
+		// Failures while locked out are not counted, lest they restart
+		// the count and so lift the lockout.
+		if !locked {
+			if err := a.recordFailure(u.Id, now); err != nil {
+				return nil, err
+			}
+		}
+		return nil, ErrBadCredentials
+	}
+	// Only those with the password learn of the lockout; to anyone else,
+	// a locked account looks like any other.
+	if locked {
+		return nil, &LockedOutError{UserName: u.UserName, Until: until}
+	}
+	if u.Disabled {
+		return nil, ErrDisabled
+	}
+	if err := a.upgradeHash(&u, pw); err != nil {
+		return nil, err
+	}
+	if lf.Count != 0 || lf.LockedUntil != 0 {
+		err = a.Repo.Update(repo.LOCKOUT, func(tx *repo.Tx) error {
+			err := tx.Delete(u.Id)
+			if errors.Is(err, repo.ErrNotFound) {
+				return nil
+			}
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &u, nil
+}
+
+// upgradeHash rehashes u's password if it was hashed with a lower cost than
+// a.PasswordCost.  pw must already have been checked against the old hash.
+func (a *Authenticator) upgradeHash(u *User, pw string) error {
+	cost, err := bcrypt.Cost(u.PasswordHash)
+	if err != nil {
+		return err
+	}
+	if cost >= a.cost() {
+		return nil
+	}
+	hash, err := a.HashPassword(pw)
+	if err != nil {
+		return err
+	}
+	return a.Repo.Update(repo.USER, func(tx *repo.Tx) error {
+		value, err := tx.Get(u.Id)
+		if err != nil {
+			return err
+		}
+		var current User
+		MustUnmarshalProto(value, &current)
+		if !bytes.Equal(current.PasswordHash, u.PasswordHash) {
+			// Changed by someone else in the meantime; leave it be.
+			return nil
+		}
+		current.PasswordHash = hash
+		u.PasswordHash = hash
+		return tx.Put(u.Id, MustMarshalProto(&current))
+	})
+}
+
+func (a *Authenticator) recordFailure(userId uint64, now time.Time) error {
+	maxFailures, window := a.lockout()
+	if maxFailures <= 0 {
+		return nil
+	}
+	return a.Repo.Update(repo.LOCKOUT, func(tx *repo.Tx) error {
+		var lf LoginFailures
+		value, err := tx.Get(userId)
+		if err == nil {
+			MustUnmarshalProto(value, &lf)
+		} else if !errors.Is(err, repo.ErrNotFound) {
+			return err
+		}
+		if now.Sub(time.Unix(lf.First, 0)) > window {
+			lf = LoginFailures{First: now.Unix()}
+		}
+		lf.Count++
+		if int(lf.Count) >= maxFailures {
+			lf = LoginFailures{LockedUntil: now.Add(window).Unix()}
+		}
+		return tx.Put(userId, MustMarshalProto(&lf))
+	})
+}
+
+// GetCaller authenticates r, responding with 401, 403 (for a disabled
+// user) or 429 if that isn't possible.  Only failed attempts count against
+// auth.Limiter.
+func GetCaller(logger *Logger, auth *Authenticator, w http.ResponseWriter, r *http.Request) (*User, bool) {
+	userName, _, ok := r.BasicAuth()
+	if ok && !AllowAuthAttempt(auth.Limiter, w, r, userName) {
+		return nil, false
+	}
+	u, err := auth.Authenticate(r)
+	if err == nil {
+		ForgiveAuthAttempt(auth.Limiter, r, userName)
+	}
+	if errors.Is(err, ErrNoCredentials) || errors.Is(err, ErrBadCredentials) {
+		Deny(w, nil)
+		return nil, false
+	}
+	if errors.Is(err, ErrDisabled) {
+		http.Error(w, "Account disabled", 403)
+		return nil, false
+	}
+	var lerr *LockedOutError
+	if errors.As(err, &lerr) {
+		logger.For(r).Warnf("%v", lerr)
+		secs := int64(lerr.Until.Sub(time.Now())/time.Second) + 1
+		w.Header().Set(RetryAfter, strconv.FormatInt(secs, 10))
+		http.Error(w, "Too Many Requests", 429)
+		return nil, false
+	}
+	if err != nil {
+		logger.For(r).Errorf("failed to authenticate: %v", err)
+		InternalError(w, r)
+		return nil, false
+	}
+	return u, true
+}
+
+// GetOptionalCaller is GetCaller for endpoints that anonymous callers may
+// also use: a request without credentials gets a nil *User.  Credentials
+// that are given must be valid.
+func GetOptionalCaller(logger *Logger, auth *Authenticator, w http.ResponseWriter, r *http.Request) (*User, bool) {
+	if _, _, ok := r.BasicAuth(); !ok || auth == nil {
+		return nil, true
+	}
+	return GetCaller(logger, auth, w, r)
+}
+
+// Deny refuses r to caller: 401, asking for credentials, if caller is nil,
+// or 403 otherwise.
+func Deny(w http.ResponseWriter, caller *User) {
+	if caller == nil {
+		w.Header().Set(WWWAuthenticate, fmt.Sprintf("Basic realm=%q", authRealm))
+		http.Error(w, "Unauthorized", 401)
+		return
+	}
+	http.Error(w, "Forbidden", 403)
+}
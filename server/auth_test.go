@@ -0,0 +1,157 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/cloud9-tools/cloud9/repo"
+)
+
+func TestAuthenticateUpgradesHash(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	alice := addTestUser(t, auth, "alice", false)
+	storedCost := func() int {
+		t.Helper()
+		var u User
+		err := rp.View(repo.USER, func(tx *repo.Tx) error {
+			raw, err := tx.Get(alice.Id)
+			if err == nil {
+				MustUnmarshalProto(raw, &u)
+			}
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cost, err := bcrypt.Cost(u.PasswordHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cost
+	}
+
+	r := newTestRequest(GET, "/", "")
+	r.SetBasicAuth("alice", "not"+testPassword)
+	auth.PasswordCost = 5
+	if _, err := auth.Authenticate(r); err != ErrBadCredentials {
+		t.Fatalf("Authenticate with a bad password: %v", err)
+	}
+	if cost := storedCost(); cost != 4 {
+		t.Errorf("a bad password changed the cost to %d", cost)
+	}
+
+	r.SetBasicAuth("alice", testPassword)
+	if _, err := auth.Authenticate(r); err != nil {
+		t.Fatal(err)
+	}
+	if cost := storedCost(); cost != 5 {
+		t.Errorf("cost is %d after login, want 5", cost)
+	}
+
+	// A lower cost does not downgrade it.
+	auth.PasswordCost = 4
+	if _, err := auth.Authenticate(r); err != nil {
+		t.Fatal(err)
+	}
+	if cost := storedCost(); cost != 5 {
+		t.Errorf("cost is %d after login at a lower cost, want 5", cost)
+	}
+}
+
+func TestAuthenticateTakesAsLong(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	auth.PasswordCost = 8
+	err := rp.Update(repo.USER, func(tx *repo.Tx) error {
+		id, err := tx.AllocateId()
+		if err != nil {
+			return err
+		}
+		if err := tx.Associate(id, "nohash"); err != nil {
+			return err
+		}
+		return tx.Put(id, MustMarshalProto(&User{Id: id, UserName: "nohash"}))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// However slow the machine, checking a password takes at least this.
+	hash, err := auth.HashPassword(testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := time.Hour
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		bcrypt.CompareHashAndPassword(hash, []byte("not"+testPassword))
+		if d := time.Since(start); d < check {
+			check = d
+		}
+	}
+
+	for _, user := range []string{"nobody", "nohash"} {
+		for _, pw := range []string{testPassword, ""} {
+			r := newTestRequest(GET, "/", "")
+			r.SetBasicAuth(user, pw)
+			start := time.Now()
+			if _, err := auth.Authenticate(r); err != ErrBadCredentials {
+				t.Errorf("Authenticate %s with %q: %v", user, pw, err)
+			}
+			if d := time.Since(start); d < check/2 {
+				t.Errorf("Authenticate %s took %v, but a password check takes %v", user, d, check)
+			}
+		}
+	}
+}
+
+func TestGetCallerRateLimit(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	auth.Limiter = NewRateLimiter(3, time.Hour)
+	addTestUser(t, auth, "alice", false)
+	addTestUser(t, auth, "bob", false)
+	h := UserHandler{Repo: rp, Auth: auth}
+	me := func(user, pw string) int {
+		r := newTestRequest(GET, "/me", "")
+		r.SetBasicAuth(user, pw)
+		return serve(h, r, "").Code
+	}
+
+	// Good credentials cost nothing.
+	for i := 0; i < 5; i++ {
+		if code := me("alice", testPassword); code != 200 {
+			t.Fatalf("GET /me %d gave %d, want 200", i+1, code)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if code := me("alice", "not"+testPassword); code != 401 {
+			t.Fatalf("bad password %d gave %d, want 401", i+1, code)
+		}
+	}
+	r := newTestRequest(GET, "/me", "")
+	r.SetBasicAuth("alice", "not"+testPassword)
+	w := serve(h, r, "")
+	expectStatus(t, w, 429)
+	if w.Header().Get(RetryAfter) == "" {
+		t.Errorf("throttled with no %s", RetryAfter)
+	}
+	// Once throttled, even the right password is turned away, from that
+	// address or at that account, and so is /login.
+	if code := me("bob", testPassword); code != 429 {
+		t.Errorf("another account from the same address gave %d, want 429", code)
+	}
+	r = newTestRequest(GET, "/me", "")
+	r.RemoteAddr = "192.0.2.2:1234"
+	if code := serve(h, r, "alice").Code; code != 429 {
+		t.Errorf("the same account from another address gave %d, want 429", code)
+	}
+	if code := serve(LoginHandler{Auth: auth}, newTestRequest(POST, "/login", ""), "alice").Code; code != 429 {
+		t.Errorf("POST /login gave %d, want 429", code)
+	}
+	// Anonymous requests are not limited.
+	expectStatus(t, serve(h, newTestRequest(GET, "/user/alice", ""), ""), 200)
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+)
+
+// benchUsers is the number of users in the repo for the server benchmarks.
+const benchUsers = 100
+
+func newBenchUserHandler(b *testing.B) UserHandler {
+	rp := newTestRepo(b)
+	auth := newTestAuth(rp)
+	for i := 0; i < benchUsers; i++ {
+		addTestUser(b, auth, fmt.Sprintf("user%d", i), false)
+	}
+	return UserHandler{Repo: rp, Auth: auth}
+}
+
+// BenchmarkGetUser measures GET /user/<name>, without an ObjectCache.
+func BenchmarkGetUser(b *testing.B) {
+	h := newBenchUserHandler(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, newTestRequest(GET, fmt.Sprintf("/user/user%d", i%benchUsers), ""))
+		if w.Code != 200 {
+			b.Fatalf("got status %d", w.Code)
+		}
+	}
+}
+
+// BenchmarkListUsers measures GET /user, listing every user.
+func BenchmarkListUsers(b *testing.B) {
+	h := newBenchUserHandler(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, newTestRequest(GET, "/user", ""))
+		if w.Code != 200 {
+			b.Fatalf("got status %d", w.Code)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// DefaultCacheMaxAge is how long clients and shared caches may keep blobs,
+// objects and listings unless configured otherwise.
+const DefaultCacheMaxAge = 24 * time.Hour
+
+// CachePolicy holds the "Cache-Control" values sent with cacheable
+// responses.  An empty field means the matching CacheControl* constant:
+// public, for a day.
+type CachePolicy struct {
+	Blob   string // blob content and blob metadata
+	Object string // a single user or group
+	List   string // a listing of blobs, users or groups
+}
+
+// NewCachePolicy builds a CachePolicy.  Blobs and objects may be cached
+// publicly for blobMaxAge and objectMaxAge respectively; listings are
+// cached for objectMaxAge, by shared caches only if publicLists is set.  A
+// zero max-age means "no-cache".
+func NewCachePolicy(blobMaxAge, objectMaxAge time.Duration, publicLists bool) CachePolicy {
+	return CachePolicy{
+		Blob:   CacheControlFor(true, blobMaxAge),
+		Object: CacheControlFor(true, objectMaxAge),
+		List:   CacheControlFor(publicLists, objectMaxAge),
+	}
+}
+
+// CacheControlFor returns the "Cache-Control" value allowing a response to
+// be cached for maxAge, by shared caches too if public is set.
+func CacheControlFor(public bool, maxAge time.Duration) string {
+	if maxAge <= 0 {
+		return CacheControlNoCache
+	}
+	scope := "private"
+	if public {
+		scope = "public"
+	}
+	return fmt.Sprintf("%s, max-age=%d", scope, int64(maxAge/time.Second))
+}
+
+func (p CachePolicy) blob() string {
+	if p.Blob == "" {
+		return CacheControlPublic
+	}
+	return p.Blob
+}
+
+func (p CachePolicy) object() string {
+	if p.Object == "" {
+		return CacheControlPublic
+	}
+	return p.Object
+}
+
+func (p CachePolicy) list() string {
+	if p.List == "" {
+		return CacheControlPublic
+	}
+	return p.List
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestCachePolicy(t *testing.T) {
+	for _, test := range []struct {
+		blobMaxAge, objectMaxAge time.Duration
+		publicLists              bool
+		blob, object, list       string
+	}{
+		{DefaultCacheMaxAge, DefaultCacheMaxAge, true, CacheControlPublic, CacheControlPublic, CacheControlPublic},
+		{time.Hour, 5 * time.Minute, false, "public, max-age=3600", "public, max-age=300", "private, max-age=300"},
+		{0, 90 * time.Second, true, CacheControlNoCache, "public, max-age=90", "public, max-age=90"},
+		{time.Minute, 0, false, "public, max-age=60", CacheControlNoCache, CacheControlNoCache},
+	} {
+		srv, err := New(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer srv.Close()
+		srv.Log = NewLogger(io.Discard, ERROR)
+		srv.PasswordCost = 4
+		srv.BlobCacheMaxAge = test.blobMaxAge
+		srv.ObjectCacheMaxAge = test.objectMaxAge
+		srv.PublicLists = test.publicLists
+		addTestUser(t, srv.authenticator(), "root", true)
+		h := srv.Handler()
+		w := serve(h, newTestRequest(POST, "/blob", "content"), "root")
+		expectStatus(t, w, 201)
+		blob := w.Header().Get(Location)
+		expectStatus(t, serve(h, newTestRequest(POST, "/group", `{"group_name":"g1"}`), "root"), 201)
+
+		for _, get := range []struct{ path, want string }{
+			{blob, test.blob},
+			{"/group/g1", test.object},
+			{"/user/root", test.object},
+			{"/group", test.list},
+			{"/user", test.list},
+			{"/blob", test.list},
+		} {
+			w := serve(h, newTestRequest(GET, get.path, ""), "root")
+			expectStatus(t, w, 200)
+			if got := w.Header().Get(CacheControl); got != get.want {
+				t.Errorf("with %v, %v and %t, GET %s gave %s %q, want %q",
+					test.blobMaxAge, test.objectMaxAge, test.publicLists, get.path, CacheControl, got, get.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"errors"
+	"time"
+
+	"github.com/cloud9-tools/cloud9/repo"
+)
+
+// ConfirmationTokenLifetime is how long a dry run's confirmation token may
+// be used to carry out the operation.
+const ConfirmationTokenLifetime = 5 * time.Minute
+
+// ErrBadConfirmation is returned by UseConfirmation for a token that is
+// malformed, unknown, expired, already used, or issued for another
+// operation or caller.
+var ErrBadConfirmation = errors.New("bad confirmation token")
+
+// NewConfirmation stores and returns a single-use token that lets actor
+// carry out operation, a description of one destructive request that
+// names its target exactly, within ConfirmationTokenLifetime.  Expired
+// tokens are swept out as new ones are made.
+func NewConfirmation(tx *repo.Tx, actor uint64, operation string) (string, error) {
+	tx = tx.As(repo.CONFIRMATION)
+	now := time.Now()
+	var expired []uint64
+	err := tx.ForEach(func(id uint64, raw []byte) error {
+		var t Token
+		MustUnmarshalProto(raw, &t)
+		if !now.Before(time.Unix(t.Expires, 0)) {
+			expired = append(expired, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, id := range expired {
+		if err := tx.Delete(id); err != nil {
+			return "", err
+		}
+	}
+	id, err := tx.AllocateId()
+	if err != nil {
+		return "", err
+	}
+	s, t, err := NewToken(id, "", ConfirmationTokenLifetime)
+	if err != nil {
+		return "", err
+	}
+	t.Operation, t.Actor = operation, actor
+	return s, tx.Put(id, MustMarshalProto(t))
+}
+
+// UseConfirmation checks that token was issued by NewConfirmation to actor
+// for operation and is still valid, and deletes it so that it cannot be
+// used again.  Otherwise it returns ErrBadConfirmation.  It must be called
+// in the transaction that carries out the operation, so that the token is
+// spent only if the operation commits.
+func UseConfirmation(tx *repo.Tx, token string, actor uint64, operation string) error {
+	tx = tx.As(repo.CONFIRMATION)
+	id, secret, err := ParseToken(token)
+	if err != nil {
+		return ErrBadConfirmation
+	}
+	raw, err := tx.Get(id)
+	if errors.Is(err, repo.ErrNotFound) {
+		return ErrBadConfirmation
+	}
+	if err != nil {
+		return err
+	}
+	var t Token
+	MustUnmarshalProto(raw, &t)
+	if !t.Check(secret, time.Now()) || t.Operation != operation || t.Actor != actor {
+		return ErrBadConfirmation
+	}
+	return tx.Delete(id)
+}
@@ -43,7 +43,9 @@ const (
 	IfRange           = "If-Range"
 	IfUnmodifiedSince = "If-Unmodified-Since"
 	LastModified      = "Last-Modified"
+	Link              = "Link"
 	Location          = "Location"
+	Range             = "Range"
 	Referer           = "Referer" // sic
 	RetryAfter        = "Retry-After"
 	Server            = "Server"
@@ -55,28 +57,53 @@ const (
 	Vary              = "Vary"
 	Via               = "Via"
 	Warning           = "Warning"
+	WWWAuthenticate   = "Www-Authenticate"
 	XForwardedFor     = "X-Forwarded-For"
 	XForwardedHost    = "X-Forwarded-Host"
 	XForwardedProto   = "X-Forwarded-Proto"
 )
 
+// HTTP Headers for hardening
+const (
+	ContentDisposition      = "Content-Disposition"
+	ContentSecurityPolicy   = "Content-Security-Policy"
+	StrictTransportSecurity = "Strict-Transport-Security"
+	XContentTypeOptions     = "X-Content-Type-Options"
+	XFrameOptions           = "X-Frame-Options"
+)
+
+// Non-standard HTTP Headers
+const (
+	LastEventId         = "Last-Event-Id"
+	XAccelBuffering     = "X-Accel-Buffering"
+	XCloud9Event        = "X-Cloud9-Event"
+	XCloud9Signature    = "X-Cloud9-Signature"
+	XHTTPMethodOverride = "X-Http-Method-Override"
+	XPageSize           = "X-Page-Size"
+	XRequestId          = "X-Request-Id"
+	XTotalCount         = "X-Total-Count"
+)
+
 // Values for the HTTP "Cache-Control" Header
 const (
-	CacheControlNoCache = "no-cache"
-	CacheControlPrivate = "private, max-age=86400"
-	CacheControlPublic  = "public, max-age=86400"
+	CacheControlNoCache        = "no-cache"
+	CacheControlPrivate        = "private, max-age=86400"
+	CacheControlPrivateNoCache = "private, no-cache"
+	CacheControlPublic         = "public, max-age=86400"
 )
 
 // Values for the HTTP "Content-Type" Header
 const (
 	MediaTypeJS      = "application/javascript"
 	MediaTypeJSON    = "application/json"
+	MediaTypeJSONAPI = "application/vnd.api+json"
 	MediaTypeWwwForm = "application/x-www-form-urlencoded"
 	MediaTypeXML     = "application/xml"
 
-	MediaTypeCSS  = "text/css; charset=utf-8"
-	MediaTypeHTML = "text/html; charset=utf-8"
-	MediaTypeText = "text/plain; charset=utf-8"
+	MediaTypeCSS         = "text/css; charset=utf-8"
+	MediaTypeEventStream = "text/event-stream; charset=utf-8"
+	MediaTypeHTML        = "text/html; charset=utf-8"
+	MediaTypeText        = "text/plain; charset=utf-8"
 
 	MediaTypeGIF  = "image/gif"
 	MediaTypeICO  = "image/x-icon"
@@ -84,4 +111,6 @@ const (
 	MediaTypePNG  = "image/png"
 
 	MediaTypeBinary = "application/octet-stream"
+
+	MediaTypeFormData = "multipart/form-data"
 )
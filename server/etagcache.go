@@ -0,0 +1,94 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/cloud9-tools/cloud9/repo"
+)
+
+// DefaultETagCacheSize is how many objects' ETags are remembered unless
+// configured otherwise.
+const DefaultETagCacheSize = 4096
+
+// ETagCache remembers the current ETags of recently read users and groups,
+// so that a conditional GET whose If-None-Match matches can be answered
+// 304 without loading or encoding the object.  It holds the ETags of at
+// most a fixed number of objects, forgetting arbitrary ones when full.  A
+// nil *ETagCache remembers nothing.
+//
+// Like ObjectCache, it is kept up to date by repo.OnChange, and Add takes
+// the Generation read before the object was loaded.
+type ETagCache struct {
+	mu    sync.Mutex
+	max   int
+	gen   uint64
+	etags map[objectKey]map[string]string // by media type
+}
+
+// NewETagCache returns a cache of the ETags of up to max objects, or nil if
+// max is not positive.
+func NewETagCache(max int) *ETagCache {
+	if max <= 0 {
+		return nil
+	}
+	return &ETagCache{max: max, etags: make(map[objectKey]map[string]string)}
+}
+
+// Generation returns a value to pass to Add for an object about to be
+// loaded.
+func (c *ETagCache) Generation() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// Get returns the ETag of the object of type ot with the given id, as
+// encoded for mediaType.
+func (c *ETagCache) Get(ot repo.ObjectType, id uint64, mediaType string) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	etag, ok := c.etags[objectKey{ot, id}][mediaType]
+	return etag, ok
+}
+
+// Add records etag for the object, unless the cache has forgotten anything
+// since Generation returned gen.
+func (c *ETagCache) Add(gen uint64, ot repo.ObjectType, id uint64, mediaType, etag string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return
+	}
+	key := objectKey{ot, id}
+	if m, ok := c.etags[key]; ok {
+		m[mediaType] = etag
+		return
+	}
+	for k := range c.etags {
+		if len(c.etags) < c.max {
+			break
+		}
+		delete(c.etags, k)
+	}
+	c.etags[key] = map[string]string{mediaType: etag}
+}
+
+// Invalidate forgets the ETags of the object of type ot with the given id.
+func (c *ETagCache) Invalidate(ot repo.ObjectType, id uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	delete(c.etags, objectKey{ot, id})
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cloud9-tools/cloud9/repo"
+)
+
+func TestETagCache(t *testing.T) {
+	c := NewETagCache(2)
+	c.Add(c.Generation(), repo.GROUP, 1, MediaTypeJSON, `"a"`)
+	c.Add(c.Generation(), repo.GROUP, 1, MediaTypeJSONAPI, `"b"`)
+	if etag, ok := c.Get(repo.GROUP, 1, MediaTypeJSONAPI); !ok || etag != `"b"` {
+		t.Errorf("Get = %s, %v, want \"b\"", etag, ok)
+	}
+	if _, ok := c.Get(repo.USER, 1, MediaTypeJSON); ok {
+		t.Error("Get found a group's ETag for a user")
+	}
+
+	c.Add(c.Generation(), repo.GROUP, 2, MediaTypeJSON, `"c"`)
+	c.Add(c.Generation(), repo.GROUP, 3, MediaTypeJSON, `"d"`)
+	n := 0
+	for id := uint64(1); id <= 3; id++ {
+		if _, ok := c.Get(repo.GROUP, id, MediaTypeJSON); ok {
+			n++
+		}
+	}
+	if n != 2 {
+		t.Errorf("holds the ETags of %d objects, want 2", n)
+	}
+
+	gen := c.Generation()
+	c.Invalidate(repo.GROUP, 3)
+	if _, ok := c.Get(repo.GROUP, 3, MediaTypeJSON); ok {
+		t.Error("Invalidate left the ETag")
+	}
+	c.Add(gen, repo.GROUP, 3, MediaTypeJSON, `"stale"`)
+	if _, ok := c.Get(repo.GROUP, 3, MediaTypeJSON); ok {
+		t.Error("Add stored an ETag read before an invalidation")
+	}
+}
+
+func TestETagCacheNotModified(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	etags := NewETagCache(10)
+	rp.OnChange(func(ot repo.ObjectType, id uint64) { etags.Invalidate(ot, id) })
+	h := GroupHandler{Repo: rp, Auth: auth, ETags: etags}
+	addTestGroups(t, h, 1)
+
+	w := serve(h, newTestRequest(GET, "/group/g1", ""), "")
+	expectStatus(t, w, 200)
+	etag := w.Header().Get(ETag)
+	conditional := func() *httptest.ResponseRecorder {
+		r := newTestRequest(GET, "/group/g1", "")
+		r.Header.Set(IfNoneMatch, etag)
+		return serve(h, r, "")
+	}
+	w = conditional()
+	expectStatus(t, w, 304)
+	if got := w.Header().Get(ETag); got != etag {
+		t.Errorf("304 with %s %q, want %s", ETag, got, etag)
+	}
+
+	expectStatus(t, serve(h, newTestRequest(PATCH, "/group/g1", `{"description":"new"}`), "root"), 200)
+	expectStatus(t, conditional(), 200)
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cloud9-tools/cloud9/repo"
+)
+
+// Event describes a change to a user or group.
+type Event struct {
+	Type   string    `json:"type"`   // "user" or "group"
+	Action string    `json:"action"` // EventCreate, EventUpdate or EventDelete
+	Id     uint64    `json:"id"`
+	Time   time.Time `json:"timestamp"`
+}
+
+const (
+	EventCreate = string(repo.Created)
+	EventUpdate = string(repo.Updated)
+	EventDelete = string(repo.Deleted)
+)
+
+// EventSink receives an Event for each change, once the transaction making
+// it has committed (see repo.ChangeListener).  Emit must not block.
+type EventSink interface {
+	Emit(e Event)
+}
+
+// NopEventSink discards all events.
+type NopEventSink struct{}
+
+func (NopEventSink) Emit(Event) {}
+
+const (
+	DefaultWebhookQueueSize = 1000
+	DefaultWebhookRetries   = 5
+
+	webhookTimeout      = 10 * time.Second
+	webhookFirstBackoff = 1 * time.Second
+)
+
+// WebhookSink POSTs each Event as JSON to every one of a list of URLs.
+// Each URL has its own queue and goroutine, so that a slow or failing
+// receiver delays only its own deliveries; an event that finds a queue full
+// is dropped for that URL, with a warning.  A delivery that fails with a
+// network error, a 429 or a 5xx is retried up to DefaultWebhookRetries
+// times, waiting one second before the first retry and twice as long
+// before each one after.
+//
+// If the secret is not empty, each request carries an X-Cloud9-Signature
+// header of "sha256=" followed by the hex HMAC-SHA256 of the body, so that
+// receivers can check where it came from.
+type WebhookSink struct {
+	secret []byte
+	client *http.Client
+	log    *Logger
+
+	mu      sync.RWMutex
+	closed  bool
+	queues  []chan Event
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewWebhookSink returns a WebhookSink delivering to urls, and starts its
+// goroutines.  Close stops them.
+func NewWebhookSink(urls []string, secret []byte, log *Logger) *WebhookSink {
+	s := &WebhookSink{
+		secret:  secret,
+		client:  &http.Client{Timeout: webhookTimeout},
+		log:     log,
+		closing: make(chan struct{}),
+	}
+	for _, url := range urls {
+		q := make(chan Event, DefaultWebhookQueueSize)
+		s.queues = append(s.queues, q)
+		s.wg.Add(1)
+		go s.run(url, q)
+	}
+	return s
+}
+
+func (s *WebhookSink) Emit(e Event) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return
+	}
+	for _, q := range s.queues {
+		select {
+		case q <- e:
+		default:
+			s.log.Warnf("webhook: queue full, dropping %s %s %d", e.Type, e.Action, e.Id)
+		}
+	}
+}
+
+// Close stops accepting events and waits for those already queued to be
+// delivered, each with a single attempt.
+func (s *WebhookSink) Close() error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.closing)
+		for _, q := range s.queues {
+			close(q)
+		}
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return nil
+}
+
+func (s *WebhookSink) run(url string, q <-chan Event) {
+	defer s.wg.Done()
+	for e := range q {
+		body := MustMarshalJSON(e)
+		backoff := webhookFirstBackoff
+		for attempt := 0; ; attempt++ {
+			retry, err := s.deliver(url, e, body)
+			if err == nil {
+				break
+			}
+			if !retry || attempt >= DefaultWebhookRetries {
+				s.log.Errorf("webhook %s: giving up on %s %s %d: %v", url, e.Type, e.Action, e.Id, err)
+				break
+			}
+			s.log.Warnf("webhook %s: %s %s %d: %v; retrying in %v", url, e.Type, e.Action, e.Id, err, backoff)
+			select {
+			case <-time.After(backoff):
+			case <-s.closing:
+				s.log.Errorf("webhook %s: shutting down, dropping %s %s %d", url, e.Type, e.Action, e.Id)
+			}
+			if s.isClosing() {
+				break
+			}
+			backoff *= 2
+		}
+	}
+}
+
+func (s *WebhookSink) isClosing() bool {
+	select {
+	case <-s.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// deliver makes one attempt to POST body, and reports whether a failure
+// is worth retrying.
+func (s *WebhookSink) deliver(url string, e Event, body []byte) (bool, error) {
+	req, err := http.NewRequest(POST, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set(ContentType, MediaTypeJSON)
+	req.Header.Set(XCloud9Event, e.Type+"."+e.Action)
+	if len(s.secret) > 0 {
+		req.Header.Set(XCloud9Signature, "sha256="+SignWebhook(s.secret, body))
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == 429 || resp.StatusCode >= 500:
+		return true, fmt.Errorf("status %s", resp.Status)
+	default:
+		return false, fmt.Errorf("status %s", resp.Status)
+	}
+}
+
+// SignWebhook returns the hex HMAC-SHA256 of body under secret, as sent in
+// the X-Cloud9-Signature header.
+func SignWebhook(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cloud9-tools/cloud9/repo"
+)
+
+// testEventSink passes the events it is given to a channel.
+type testEventSink chan Event
+
+func (s testEventSink) Emit(e Event) { s <- e }
+
+// expectEvent fails the test unless the next event on s is the one given.
+func expectEvent(t *testing.T, s testEventSink, typ, action string, id uint64) {
+	t.Helper()
+	select {
+	case e := <-s:
+		if e.Type != typ || e.Action != action || e.Id != id {
+			t.Errorf("got event %s %s %d, want %s %s %d", e.Type, e.Action, e.Id, typ, action, id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no event %s %s %d", typ, action, id)
+	}
+}
+
+func TestEmitChanges(t *testing.T) {
+	srv, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.Log = NewLogger(io.Discard, ERROR)
+	auth := newTestAuth(srv.Repo)
+	addTestUser(t, auth, "root", true)
+	sink := make(testEventSink, 10)
+	srv.Events = sink
+	users := UserHandler{Repo: srv.Repo, Auth: auth}
+	groups := GroupHandler{Repo: srv.Repo, Auth: auth}
+
+	expectStatus(t, serve(users, newTestRequest(POST, "/user", `{"user_name":"alice","email":"alice@example.com"}`), "root"), 201)
+	expectEvent(t, sink, "user", EventCreate, 2)
+	expectStatus(t, serve(groups, newTestRequest(POST, "/group", `{"group_name":"g1"}`), "root"), 201)
+	expectEvent(t, sink, "group", EventCreate, 1)
+	expectStatus(t, serve(groups, newTestRequest(PATCH, "/group/g1", `{"users":[2]}`), "root"), 200)
+	expectEvent(t, sink, "group", EventUpdate, 1)
+	expectStatus(t, serve(users, newTestRequest(DELETE, "/user/alice", ""), "root"), 204)
+	expectEvent(t, sink, "user", EventDelete, 2)
+
+	// Neither failed updates nor other kinds of object make events.
+	expectStatus(t, serve(groups, newTestRequest(POST, "/group", `{"group_name":"G1"}`), "root"), 409)
+	createTestBlob(t, BlobHandler{repo: srv.Repo, Auth: auth}, "text/plain", "hello")
+	err = srv.Repo.Update(repo.USER, func(tx *repo.Tx) error {
+		if err := tx.Put(99, MustMarshalProto(&User{Id: 99})); err != nil {
+			return err
+		}
+		return errors.New("roll back")
+	})
+	if err == nil {
+		t.Fatal("Update did not fail")
+	}
+	select {
+	case e := <-sink:
+		t.Errorf("unexpected event %s %s %d", e.Type, e.Action, e.Id)
+	default:
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	secret := []byte("s3cret")
+	type delivery struct {
+		header http.Header
+		body   []byte
+	}
+	got := make(chan delivery, 10)
+	var failures int32 = 1
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			http.Error(w, "try again", 503)
+			return
+		}
+		got <- delivery{r.Header, body}
+	}))
+	defer ts.Close()
+	rejected := make(chan struct{}, 10)
+	reject := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rejected <- struct{}{}
+		http.Error(w, "no", 400)
+	}))
+	defer reject.Close()
+
+	s := NewWebhookSink([]string{ts.URL, reject.URL}, secret, NewLogger(io.Discard, ERROR))
+	now := time.Unix(1700000000, 0).UTC()
+	emitted := time.Now()
+	s.Emit(Event{Type: "user", Action: EventUpdate, Id: 7, Time: now})
+
+	// The first attempt fails with 503, and is retried a second later.
+	var d delivery
+	select {
+	case d = <-got:
+	case <-time.After(5 * time.Second):
+		t.Fatal("event not delivered")
+	}
+	if sig, want := d.header.Get(XCloud9Signature), "sha256="+SignWebhook(secret, d.body); sig != want {
+		t.Errorf("%s %q, want %q", XCloud9Signature, sig, want)
+	}
+	if got := d.header.Get(XCloud9Event); got != "user.update" {
+		t.Errorf("%s %q, want user.update", XCloud9Event, got)
+	}
+	if got := d.header.Get(ContentType); got != MediaTypeJSON {
+		t.Errorf("%s %q", ContentType, got)
+	}
+	var e Event
+	if err := json.Unmarshal(d.body, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != "user" || e.Action != EventUpdate || e.Id != 7 || !e.Time.Equal(now) {
+		t.Errorf("delivered %+v", e)
+	}
+
+	// A 400 is not retried, though a retry would be due by now.
+	time.Sleep(time.Until(emitted.Add(webhookFirstBackoff + 200*time.Millisecond)))
+	if n := len(rejected); n != 1 {
+		t.Errorf("a delivery refused with 400 was tried %d times", n)
+	}
+	s.Close()
+
+	// Nothing is sent after Close.
+	s.Emit(Event{Type: "user", Action: EventDelete, Id: 7, Time: now})
+	select {
+	case d := <-got:
+		t.Errorf("delivered %s after Close", d.body)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestSignWebhook(t *testing.T) {
+	// From RFC 4231, test case 2.
+	got := SignWebhook([]byte("Jefe"), []byte("what do ya want for nothing?"))
+	if want := "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"; got != want {
+		t.Errorf("SignWebhook = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,46 @@
+//go:build gofuzz
+// +build gofuzz
+
+package server
+
+import (
+	"bytes"
+	"net/http/httptest"
+)
+
+// Fuzz is the entry point for go-fuzz (github.com/dvyukov/go-fuzz).  It
+// feeds data to GetJSONBody as the body of a request to create or update a
+// user or group, then validates whatever was decoded.  To run it:
+//
+//	go-fuzz-build github.com/cloud9-tools/cloud9/server
+//	go-fuzz -bin=server-fuzz.zip -workdir=fuzz
+//
+// Crashers are written to fuzz/crashers.
+func Fuzz(data []byte) int {
+	parsed := 0
+	for _, alloc := range []func() interface{}{
+		func() interface{} { return new(UserDelta) },
+		func() interface{} { return new(GroupDelta) },
+	} {
+		v := alloc()
+		r := httptest.NewRequest(POST, "/", bytes.NewReader(data))
+		r.Header.Set(ContentType, MediaTypeJSON)
+		w := httptest.NewRecorder()
+		if !GetJSONBody(nil, w, r, v) {
+			if w.Code == 500 {
+				panic("GetJSONBody: internal error on in-memory body")
+			}
+			continue
+		}
+		parsed = 1
+		switch d := v.(type) {
+		case *UserDelta:
+			d.Validate(NewUser)
+			d.Validate(ExistingUser)
+		case *GroupDelta:
+			d.Validate(NewGroup)
+			d.Validate(ExistingGroup)
+		}
+	}
+	return parsed
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	"errors"
+
+	"github.com/cloud9-tools/cloud9/repo"
+)
+
+// DefaultGCBatch is how many content files CollectGarbage checks per
+// transaction.
+const DefaultGCBatch = 100
+
+// GCReport sums up a CollectGarbage: the content files that no blob refers
+// to, and how many of them were removed.  Confirm is set by
+// AdminHandler.CollectGarbage.
+type GCReport struct {
+	Checked      int    `json:"checked"`
+	Unreferenced int    `json:"unreferenced"`
+	Bytes        int64  `json:"bytes"`
+	Removed      int    `json:"removed"`
+	Confirm      string `json:"confirm,omitempty"`
+}
+
+// CollectGarbage looks for files in the content store that no blob refers
+// to, such as those left by a crash between storing content and recording
+// the blob, and removes them if remove is set.  Every blob with content is
+// indexed by its digest, so that is where it looks.  Files are checked a
+// batch at a time, each in an Update of the blobs, so that none can be
+// referred to while it is removed; content being uploaded is left alone,
+// see repo.Repo.DiscardContent.
+func CollectGarbage(ctx context.Context, r *repo.Repo, remove bool) (*GCReport, error) {
+	report := &GCReport{}
+	var keys []string
+	var sizes []int64
+	flush := func() error {
+		check := func(tx *repo.Tx) error {
+			for i, key := range keys {
+				_, err := tx.Lookup("sha256:" + key)
+				if err == nil {
+					continue
+				}
+				if !errors.Is(err, repo.ErrNotFound) {
+					return err
+				}
+				report.Unreferenced++
+				report.Bytes += sizes[i]
+				if remove {
+					removed, err := r.DiscardContent(key)
+					if err != nil {
+						return err
+					}
+					if removed {
+						report.Removed++
+					}
+				}
+			}
+			return nil
+		}
+		var err error
+		if remove {
+			err = r.UpdateContext(ctx, repo.BLOB, check)
+		} else {
+			err = r.ViewContext(ctx, repo.BLOB, check)
+		}
+		report.Checked += len(keys)
+		keys, sizes = keys[:0], sizes[:0]
+		return err
+	}
+	err := r.ForEachContent(func(key string, size int64) error {
+		keys = append(keys, key)
+		sizes = append(sizes, size)
+		if len(keys) < DefaultGCBatch {
+			return nil
+		}
+		return flush()
+	})
+	if err == nil && len(keys) > 0 {
+		err = flush()
+	}
+	return report, err
+}
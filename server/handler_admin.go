@@ -0,0 +1,312 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cloud9-tools/cloud9/repo"
+)
+
+const (
+	DefaultAuditPageSize = 100
+	MaxAuditPageSize     = 1000
+
+	// DefaultScrubLimit is how many blobs POST /admin/scrub checks unless
+	// told otherwise.
+	DefaultScrubLimit = 1000
+)
+
+type AdminHandler struct {
+	Repo    *repo.Repo
+	Auth    *Authenticator
+	Metrics *Metrics
+	Log     *Logger
+
+	// TrustLoopback lets requests over the loopback interface in without
+	// credentials.  Any local process, or a proxy on the same host, may
+	// send such requests.  See IsLocalRequest.
+	TrustLoopback bool
+}
+
+type AuditPage struct {
+	Entries   []AuditEntry `json:"entries"`
+	NextAfter uint64       `json:"next_after,omitempty"`
+}
+
+func (h AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// A trusted local request acts as no one in particular.
+	var actor uint64
+	if !h.TrustLoopback || !IsLocalRequest(r) {
+		caller, ok := GetCaller(h.Log, h.Auth, w, r)
+		if !ok {
+			return
+		}
+		if !caller.Admin {
+			http.Error(w, "Forbidden", 403)
+			return
+		}
+		actor = caller.Id
+	}
+	switch r.URL.Path {
+	case "/admin/stats":
+		if !AllowMethods(w, r, GET) {
+			return
+		}
+		h.GetStats(w, r)
+
+	case "/admin/metrics":
+		if !AllowMethods(w, r, GET) {
+			return
+		}
+		h.GetMetrics(w, r)
+
+	case "/admin/audit":
+		if !AllowMethods(w, r, GET) {
+			return
+		}
+		h.GetAudit(w, r)
+
+	case "/admin/scrub":
+		if !AllowMethods(w, r, GET, POST) {
+			return
+		}
+		h.Scrub(w, r, actor)
+
+	case "/admin/gc":
+		if !AllowMethods(w, r, GET, POST) {
+			return
+		}
+		h.CollectGarbage(w, r, actor)
+
+	default:
+		NotFound(w, r)
+	}
+}
+
+func (h AdminHandler) GetStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := h.Repo.Stats()
+	if err != nil {
+		h.Log.For(r).Errorf("GET /admin/stats: %v", err)
+		InternalError(w, r)
+		return
+	}
+	raw := MarshalJSONFor(r, stats)
+	w.Header().Set(ContentType, MediaTypeJSON)
+	w.Header().Set(CacheControl, CacheControlNoCache)
+	w.Header().Set(ETag, ETagFor(raw))
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(raw))
+}
+
+// GetMetrics reports connection and request counts, repository write
+// timings and runtime statistics.
+func (h AdminHandler) GetMetrics(w http.ResponseWriter, r *http.Request) {
+	m := h.Metrics
+	if m == nil {
+		m = new(Metrics)
+	}
+	report := m.Report()
+	if h.Repo != nil {
+		report.RepoUpdates = h.Repo.UpdateStats()
+	}
+	raw := MarshalJSONFor(r, report)
+	w.Header().Set(ContentType, MediaTypeJSON)
+	w.Header().Set(CacheControl, CacheControlNoCache)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(raw))
+}
+
+// GetAudit returns up to "limit" audit entries following the entry with id
+// "after".  If there may be more, "next_after" gives the cursor for the next
+// page.
+func (h AdminHandler) GetAudit(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var after uint64
+	if s := q.Get("after"); s != "" {
+		var err error
+		after, err = strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			http.Error(w, "Parameter 'after' must be an entry id", 400)
+			return
+		}
+	}
+	limit := DefaultAuditPageSize
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > MaxAuditPageSize {
+			http.Error(w, fmt.Sprintf("Parameter 'limit' must be between 1 and %d", MaxAuditPageSize), 400)
+			return
+		}
+		limit = n
+	}
+	page := AuditPage{Entries: make([]AuditEntry, 0, limit)}
+	err := h.Repo.ViewContext(r.Context(), repo.AUDIT, func(tx *repo.Tx) error {
+		return tx.Scan(after, limit, func(_ uint64, raw []byte) error {
+			var e AuditEntry
+			MustUnmarshalProto(raw, &e)
+			page.Entries = append(page.Entries, e)
+			return nil
+		})
+	})
+	if err != nil {
+		h.Log.For(r).Errorf("GET /admin/audit: %v", err)
+		InternalError(w, r)
+		return
+	}
+	if len(page.Entries) == limit {
+		page.NextAfter = page.Entries[limit-1].Id
+	}
+	raw := MarshalJSONFor(r, page)
+	w.Header().Set(ContentType, MediaTypeJSON)
+	w.Header().Set(CacheControl, CacheControlNoCache)
+	w.Header().Set(ETag, ETagFor(raw))
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(raw))
+}
+
+// Scrub serves /admin/scrub, which checks up to "limit" blobs following
+// the one with id "after" against their stored digests; see the Scrub
+// function.  If there may be more, "next_after" in the report gives the
+// cursor to carry on from.  For a whole large store, "c9master scrub"
+// avoids the request timeouts.
+//
+// POST with "quarantine" set also moves corrupt content aside, which needs
+// confirming: a GET for the same blobs is the dry run, and gives the token
+// for "confirm" if it finds any corrupt, as for ResourceHandler.BulkDelete.
+func (h AdminHandler) Scrub(w http.ResponseWriter, r *http.Request, actor uint64) {
+	q := r.URL.Query()
+	opts := ScrubOptions{Limit: DefaultScrubLimit}
+	if s := q.Get("after"); s != "" {
+		var err error
+		opts.After, err = strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			http.Error(w, "Parameter 'after' must be a blob id", 400)
+			return
+		}
+	}
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			http.Error(w, "Parameter 'limit' must be a positive integer", 400)
+			return
+		}
+		opts.Limit = n
+	}
+	operation := fmt.Sprintf("POST /admin/scrub?after=%d&limit=%d&quarantine=1", opts.After, opts.Limit)
+	if r.Method == POST && boolParam(r, "quarantine") {
+		if !h.spendConfirmation(w, r, actor, operation) {
+			return
+		}
+		opts.Quarantine = true
+	}
+	report, err := Scrub(r.Context(), h.Repo, opts)
+	if err != nil && r.Context().Err() != nil {
+		h.Log.For(r).Debugf("%s /admin/scrub: client went away: %v", r.Method, err)
+		return
+	}
+	if err == nil && r.Method != POST && len(report.Corrupt) > 0 {
+		report.Confirm, err = h.newConfirmation(r, actor, operation)
+	}
+	if err != nil {
+		h.Log.For(r).Errorf("%s /admin/scrub: %v", r.Method, err)
+		InternalError(w, r)
+		return
+	}
+	for _, item := range report.Corrupt {
+		h.Log.For(r).Warnf("%s /admin/scrub: blob %d is corrupt: %+v", r.Method, item.Id, item)
+	}
+	raw := MarshalJSONFor(r, report)
+	w.Header().Set(ContentLength, fmt.Sprintf("%d", len(raw)))
+	w.Header().Set(ContentType, MediaTypeJSON)
+	w.Header().Set(CacheControl, CacheControlNoCache)
+	w.WriteHeader(200)
+	w.Write(raw)
+}
+
+// CollectGarbage serves /admin/gc, which finds the files in the content
+// store that no blob refers to; see the CollectGarbage function.  GET only
+// counts them, and is the dry run for POST, which removes them: if there
+// are any, it gives the token that POST needs as "confirm".
+func (h AdminHandler) CollectGarbage(w http.ResponseWriter, r *http.Request, actor uint64) {
+	const operation = "POST /admin/gc"
+	remove := r.Method == POST
+	if remove && !h.spendConfirmation(w, r, actor, operation) {
+		return
+	}
+	report, err := CollectGarbage(r.Context(), h.Repo, remove)
+	if err != nil && r.Context().Err() != nil {
+		h.Log.For(r).Debugf("%s /admin/gc: client went away: %v", r.Method, err)
+		return
+	}
+	if err == nil && !remove && report.Unreferenced > 0 {
+		report.Confirm, err = h.newConfirmation(r, actor, operation)
+	}
+	if err != nil {
+		h.Log.For(r).Errorf("%s /admin/gc: %v", r.Method, err)
+		InternalError(w, r)
+		return
+	}
+	if remove {
+		h.Log.For(r).Infof("POST /admin/gc: removed %d unreferenced content files", report.Removed)
+	}
+	raw := MarshalJSONFor(r, report)
+	w.Header().Set(ContentLength, fmt.Sprintf("%d", len(raw)))
+	w.Header().Set(ContentType, MediaTypeJSON)
+	w.Header().Set(CacheControl, CacheControlNoCache)
+	w.WriteHeader(200)
+	w.Write(raw)
+}
+
+// newConfirmation returns a token that lets actor carry out operation; see
+// NewConfirmation.
+func (h AdminHandler) newConfirmation(r *http.Request, actor uint64, operation string) (string, error) {
+	var token string
+	err := h.Repo.UpdateContext(r.Context(), repo.CONFIRMATION, func(tx *repo.Tx) error {
+		var err error
+		token, err = NewConfirmation(tx, actor, operation)
+		return err
+	})
+	return token, err
+}
+
+// spendConfirmation uses up the token given as "confirm" for operation,
+// responding with 400 and returning false if it is not good.  The admin
+// operations are not repo transactions, so the token is spent in one of
+// its own first, even if the operation then fails.
+func (h AdminHandler) spendConfirmation(w http.ResponseWriter, r *http.Request, actor uint64, operation string) bool {
+	confirm := r.URL.Query().Get("confirm")
+	if confirm == "" {
+		http.Error(w, "Parameter 'confirm' must be the token from a dry run of this request; GET it with the same parameters", 400)
+		return false
+	}
+	err := h.Repo.UpdateContext(r.Context(), repo.CONFIRMATION, func(tx *repo.Tx) error {
+		return UseConfirmation(tx, confirm, actor, operation)
+	})
+	if errors.Is(err, ErrBadConfirmation) {
+		http.Error(w, "Parameter 'confirm' must be an unused, unexpired token from a dry run of this request", 400)
+		return false
+	}
+	if err != nil {
+		h.Log.For(r).Errorf("%s %s: %v", r.Method, r.URL.Path, err)
+		InternalError(w, r)
+		return false
+	}
+	return true
+}
+
+// IsLocalRequest reports whether r arrived directly over the loopback
+// interface.  Requests relayed by a proxy are never considered local: the
+// proxy's own address may well be a loopback one.
+func IsLocalRequest(r *http.Request) bool {
+	if _, ok := r.Header[XForwardedFor]; ok {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cloud9-tools/cloud9/repo"
+)
+
+func TestAdminLoopback(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	addTestUser(t, auth, "alice", false)
+	h := AdminHandler{Repo: rp, Auth: auth, Metrics: &Metrics{}}
+
+	local := func() *http.Request {
+		r := newTestRequest(GET, "/admin/stats", "")
+		r.RemoteAddr = "127.0.0.1:1234"
+		return r
+	}
+	expectStatus(t, serve(h, local(), ""), 401)
+	expectStatus(t, serve(h, local(), "alice"), 403)
+	expectStatus(t, serve(h, local(), "root"), 200)
+
+	h.TrustLoopback = true
+	expectStatus(t, serve(h, local(), ""), 200)
+	r := local()
+	r.Header.Set(XForwardedFor, "203.0.113.9")
+	expectStatus(t, serve(h, r, ""), 401)
+	expectStatus(t, serve(h, newTestRequest(GET, "/admin/stats", ""), ""), 401)
+}
+
+func TestAdminStats(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	h := AdminHandler{Repo: rp, Auth: auth}
+
+	w := serve(h, newTestRequest(GET, "/admin/stats", ""), "root")
+	expectStatus(t, w, 200)
+	var stats map[string]repo.BucketStats
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if n := stats["user"].KeyN; n != 1 {
+		t.Errorf("user has %d keys, want 1", n)
+	}
+	if _, ok := stats["blob"]; !ok {
+		t.Errorf("no stats for blob in %s", w.Body.String())
+	}
+
+	r := newTestRequest(GET, "/admin/stats", "")
+	r.Header.Set(IfNoneMatch, w.Header().Get(ETag))
+	expectStatus(t, serve(h, r, "root"), 304)
+}
+
+func TestAdminGC(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	h := AdminHandler{Repo: rp, Auth: auth}
+	bh := BlobHandler{repo: rp, Auth: auth}
+	expectStatus(t, serve(bh, newTestRequest(POST, "/blob", "kept"), "root"), 201)
+	key, err := rp.StoreContent([]byte("garbage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp.ReleaseContent(key)
+
+	expectStatus(t, serve(h, newTestRequest(POST, "/admin/gc", ""), "root"), 400)
+	w := serve(h, newTestRequest(GET, "/admin/gc", ""), "root")
+	expectStatus(t, w, 200)
+	var report GCReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Checked != 2 || report.Unreferenced != 1 || report.Removed != 0 || report.Confirm == "" {
+		t.Fatalf("GET /admin/gc gave %s", w.Body.String())
+	}
+	if _, err := rp.LoadContent(key); err != nil {
+		t.Fatalf("the dry run removed content: %v", err)
+	}
+
+	w = serve(h, newTestRequest(POST, "/admin/gc?confirm="+report.Confirm, ""), "root")
+	expectStatus(t, w, 200)
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil || report.Removed != 1 {
+		t.Fatalf("POST /admin/gc gave %s", w.Body.String())
+	}
+	if _, err := rp.LoadContent(key); !os.IsNotExist(err) {
+		t.Errorf("unreferenced content was kept: %v", err)
+	}
+	expectStatus(t, serve(bh, newTestRequest(GET, "/blob/1", ""), ""), 200)
+}
+
+func TestAdminScrubQuarantine(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	h := AdminHandler{Repo: rp, Auth: auth}
+	bh := BlobHandler{repo: rp, Auth: auth}
+	expectStatus(t, serve(bh, newTestRequest(POST, "/blob", "rotten"), "root"), 201)
+	key := strings.TrimPrefix(DigestFor([]byte("rotten")), "sha256:")
+	path := filepath.Join(rp.Dir(), repo.ContentDir, repo.ContentPath(key, rp.ContentFanout()))
+	if err := ioutil.WriteFile(path, []byte("rotted"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	expectStatus(t, serve(h, newTestRequest(POST, "/admin/scrub?quarantine=1", ""), "root"), 400)
+	w := serve(h, newTestRequest(GET, "/admin/scrub", ""), "root")
+	expectStatus(t, w, 200)
+	var report ScrubReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Corrupt) != 1 || report.Corrupt[0].Quarantined || report.Confirm == "" {
+		t.Fatalf("GET /admin/scrub gave %s", w.Body.String())
+	}
+
+	// The token is for the same blobs only.
+	expectStatus(t, serve(h, newTestRequest(POST, "/admin/scrub?quarantine=1&limit=5&confirm="+report.Confirm, ""), "root"), 400)
+	w = serve(h, newTestRequest(POST, "/admin/scrub?quarantine=1&confirm="+report.Confirm, ""), "root")
+	expectStatus(t, w, 200)
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil || len(report.Corrupt) != 1 || !report.Corrupt[0].Quarantined {
+		t.Fatalf("POST /admin/scrub gave %s", w.Body.String())
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("corrupt content was not moved: %v", err)
+	}
+}
+
+func TestAdminAudit(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	root := addTestUser(t, auth, "root", true)
+	h := AdminHandler{Repo: rp, Auth: auth}
+	groups := GroupHandler{Repo: rp, Auth: auth}
+	getAudit := func(query string) AuditPage {
+		t.Helper()
+		w := serve(h, newTestRequest(GET, "/admin/audit"+query, ""), "root")
+		expectStatus(t, w, 200)
+		var page AuditPage
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+		return page
+	}
+
+	if page := getAudit(""); len(page.Entries) != 0 || page.NextAfter != 0 {
+		t.Fatalf("audit log of a new repo: %+v", page)
+	}
+	w := serve(groups, newTestRequest(POST, "/group", `{"group_name":"g1"}`), "root")
+	expectStatus(t, w, 201)
+	var g Group
+	if err := json.Unmarshal(w.Body.Bytes(), &g); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, serve(groups, newTestRequest(PATCH, "/group/g1", `{"description":"new"}`), "root"), 200)
+	expectStatus(t, serve(groups, newTestRequest(DELETE, "/group/g1", ""), "root"), 204)
+	// Failures are not recorded.
+	expectStatus(t, serve(groups, newTestRequest(DELETE, "/group/g1", ""), "root"), 404)
+	expectStatus(t, serve(groups, newTestRequest(POST, "/group", `{"group_name":"g3"}`), ""), 401)
+
+	page := getAudit("")
+	want := []AuditEntry{
+		{Actor: root.Id, Method: POST, Path: "/group", Type: "group", Target: g.Id, Status: 201},
+		{Actor: root.Id, Method: PATCH, Path: "/group/g1", Type: "group", Target: g.Id, Status: 200},
+		{Actor: root.Id, Method: DELETE, Path: "/group/g1", Type: "group", Target: g.Id, Status: 204},
+	}
+	if len(page.Entries) != len(want) {
+		t.Fatalf("GET /admin/audit gave %d entries, want %d: %+v", len(page.Entries), len(want), page.Entries)
+	}
+	for i, e := range page.Entries {
+		if e.Id == 0 || e.Time == 0 {
+			t.Errorf("entry %d has no id or time: %+v", i, e)
+		}
+		e.Id, e.Time = 0, 0
+		if e != want[i] {
+			t.Errorf("entry %d is %+v, want %+v", i, e, want[i])
+		}
+	}
+
+	// Paging.
+	first := getAudit("?limit=2")
+	if len(first.Entries) != 2 || first.NextAfter != first.Entries[1].Id {
+		t.Fatalf("first page: %+v", first)
+	}
+	rest := getAudit(fmt.Sprintf("?after=%d&limit=2", first.NextAfter))
+	if len(rest.Entries) != 1 || rest.Entries[0].Id != page.Entries[2].Id || rest.NextAfter != 0 {
+		t.Errorf("second page: %+v", rest)
+	}
+	for _, query := range []string{"?limit=0", "?limit=x", fmt.Sprintf("?limit=%d", MaxAuditPageSize+1), "?after=-1"} {
+		expectStatus(t, serve(h, newTestRequest(GET, "/admin/audit"+query, ""), "root"), 400)
+	}
+}
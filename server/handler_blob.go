@@ -2,27 +2,127 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
+	"mime"
 	"net/http"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/golang/protobuf/proto"
+
 	"github.com/cloud9-tools/cloud9/repo"
 )
 
 var (
-	reBlobIdPath         = regexp.MustCompile(`^/blob/([0-9]+)$`)
+	reBlobIdPath         = regexp.MustCompile(`^/blob/([0-9]{1,20})$`)
+	reBlobIdMetaPath     = regexp.MustCompile(`^/blob/([0-9]{1,20})/meta$`)
 	reMultipartMediaType = regexp.MustCompile(`(?i)^multipart/.*$`)
 )
 
-type BlobHandler struct{ repo *repo.Repo }
+// MaxBlobSize is the largest blob that may be uploaded, whether as a whole
+// request body or as one part of a multipart/form-data upload.
+const MaxBlobSize = 32 << 20
+
+// DefaultMaxMultipartParts and DefaultMaxMultipartSize are the defaults
+// for BlobHandler's MaxParts and MaxBatchSize.
+const (
+	DefaultMaxMultipartParts = 100
+	DefaultMaxMultipartSize  = 4 * MaxBlobSize
+)
+
+// BlobHandler serves /blob.  Blobs are sent with "X-Content-Type-Options:
+// nosniff", so that browsers trust their stored content type rather than
+// guess one, and as attachments to be downloaded unless Inline is set.
+// Either way, an uploaded page or script cannot run as the server's own.
+//
+// If Verify is set, GET checks each blob against the digest recorded when
+// it was stored, and answers 500 "Blob content does not match its digest"
+// instead of sending corrupt data.  This costs a SHA-256 of every blob
+// read.
+type BlobHandler struct {
+	repo   *repo.Repo
+	Auth   *Authenticator
+	Cache  CachePolicy
+	Inline bool
+	Verify bool
+	Log    *Logger
+
+	// MaxParts and MaxBatchSize limit the number of parts in a multipart
+	// upload and the bytes they hold between them; zero means no limit.
+	// See CreateBlobs.
+	MaxParts     int
+	MaxBatchSize int64
+}
 
 type BlobReference struct {
-	Id uint64 `json:"id"`
+	Id       uint64 `json:"id"`
+	Field    string `json:"field,omitempty"`
+	FileName string `json:"filename,omitempty"`
+}
+
+type BlobMeta struct {
+	Id          uint64 `protobuf:"varint,5,opt,name=id" json:"id,omitempty"`
+	ContentType string `protobuf:"bytes,1,opt,name=content_type" json:"content_type,omitempty"`
+	Size        uint64 `protobuf:"varint,2,opt,name=size" json:"size"`
+	Digest      string `protobuf:"bytes,3,opt,name=digest" json:"digest,omitempty"`
+	Created     int64  `protobuf:"varint,4,opt,name=created" json:"created,omitempty"`
+	ETag        string `protobuf:"bytes,6,opt,name=etag" json:"etag,omitempty"`
+
+	// External is set when the blob's data is in the repo's content store,
+	// and the BLOB record holds only its content key.  Blobs stored before
+	// the content store existed hold their data in the record itself.
+	External bool `protobuf:"varint,7,opt,name=external" json:"-"`
+}
+
+// NewBlobMeta describes blob as just uploaded with the given content type.
+func NewBlobMeta(contentType string, blob []byte) BlobMeta {
+	return BlobMeta{
+		ContentType: contentType,
+		Size:        uint64(len(blob)),
+		Digest:      DigestFor(blob),
+		Created:     time.Now().Unix(),
+		ETag:        ETagFor(blob),
+	}
+}
+
+// DigestFor returns the content digest of data, in the form
+// "sha256:<hex>".
+func DigestFor(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func (m *BlobMeta) Reset()         { *m = BlobMeta{} }
+func (m *BlobMeta) String() string { return proto.CompactTextString(m) }
+func (*BlobMeta) ProtoMessage()    {}
+
+// genericMediaTypes say nothing about the content; blobs uploaded with one
+// of these get a sniffed type instead.
+var genericMediaTypes = map[string]bool{
+	"":                    true,
+	MediaTypeBinary:       true,
+	MediaTypeWwwForm:      true,
+	"binary/octet-stream": true,
+	"application/unknown": true,
+}
+
+// BlobContentType picks the type to record for an uploaded blob: the type
+// the client gave, unless that was missing or generic, in which case the
+// type is sniffed from the data.
+func BlobContentType(given string, blob []byte) string {
+	mediaType, _, err := mime.ParseMediaType(given)
+	if err != nil || genericMediaTypes[strings.ToLower(mediaType)] {
+		return http.DetectContentType(blob)
+	}
+	return given
 }
 
 func (h BlobHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -39,77 +139,158 @@ func (h BlobHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			h.CreateBlob(w, r)
 
 		default:
-			log.Printf("error: not implemented: %s %s", method, r.URL.Path)
-			http.Error(w, "Internal Server Error", 500)
+			h.Log.For(r).Errorf("not implemented: %s %s", method, r.URL.Path)
+			InternalError(w, r)
 		}
 		return
 	}
 
+	wantMeta := false
 	m := reBlobIdPath.FindStringSubmatch(r.URL.Path)
 	if m == nil {
-		http.NotFound(w, r)
+		m = reBlobIdMetaPath.FindStringSubmatch(r.URL.Path)
+		wantMeta = true
+	}
+	if m == nil {
+		NotFound(w, r)
 		return
 	}
 	blobId, err := strconv.ParseUint(m[1], 10, 64)
 	if err != nil {
-		log.Printf("error: ParseUint %q 10 64: %v\n", m[1], err)
-		http.NotFound(w, r)
+		h.Log.For(r).Debugf("ParseUint %q 10 64: %v", m[1], err)
+		NotFound(w, r)
 		return
 	}
 	if !AllowMethods(w, r, GET) {
 		return
 	}
-	h.GetBlob(w, r, blobId)
+	switch {
+	case wantMeta:
+		h.GetBlobMeta(w, r, blobId)
+	case r.Method == HEAD:
+		h.HeadBlob(w, r, blobId)
+	default:
+		h.GetBlob(w, r, blobId)
+	}
+}
+
+func blobReferenceResource(ref BlobReference) JSONAPIResource {
+	return NewJSONAPIResource("blob", ref.Id, fmt.Sprintf("/blob/%d", ref.Id), ref)
+}
+
+// EncodeBlobReference marshals ref for the response to r; see EncodeJSON.
+func EncodeBlobReference(w http.ResponseWriter, r *http.Request, ref BlobReference) ([]byte, string) {
+	return EncodeJSON(w, r, ref, func() *JSONAPIDocument {
+		return NewJSONAPIItem(blobReferenceResource(ref))
+	})
+}
+
+// EncodeBlobReferences marshals refs for the response to r; see EncodeJSON.
+func EncodeBlobReferences(w http.ResponseWriter, r *http.Request, refs []BlobReference) ([]byte, string) {
+	return EncodeJSON(w, r, refs, func() *JSONAPIDocument {
+		data := make([]JSONAPIResource, len(refs))
+		for i, ref := range refs {
+			data[i] = blobReferenceResource(ref)
+		}
+		return NewJSONAPIList("/blob", data)
+	})
 }
 
 func (h BlobHandler) ListBlobs(w http.ResponseWriter, r *http.Request) {
 	blobList := make([]BlobReference, 0)
-	err := h.repo.View(repo.BLOB, func(tx *repo.Tx) error {
+	ctx := r.Context()
+	err := h.repo.ViewContext(r.Context(), repo.BLOB, func(tx *repo.Tx) error {
 		return tx.ForEach(func(id uint64, _ []byte) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
 			blobList = append(blobList, BlobReference{Id: id})
 			return nil
 		})
 	})
+	if err != nil && ctx.Err() != nil {
+		h.Log.For(r).Debugf("GET /blob: client went away: %v", err)
+		return
+	}
 	if err != nil {
-		log.Printf("error: GET /blob: %v\n", err)
-		http.Error(w, "Internal Server Error", 500)
+		h.Log.For(r).Errorf("GET /blob: %v", err)
+		InternalError(w, r)
 		return
 	}
-	raw := MustMarshalJSON(blobList)
-	w.Header().Set(ContentType, MediaTypeJSON)
-	w.Header().Set(CacheControl, CacheControlPublic)
+	raw, contentType := EncodeBlobReferences(w, r, blobList)
+	w.Header().Set(ContentType, contentType)
+	w.Header().Set(CacheControl, h.Cache.list())
 	w.Header().Set(ETag, ETagFor(raw))
 	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(raw))
 }
 
+// CreateBlob serves POST /blob, which only admins may use.
 func (h BlobHandler) CreateBlob(w http.ResponseWriter, r *http.Request) {
-	if len(r.Header[ContentType]) != 1 || reMultipartMediaType.MatchString(r.Header[ContentType][0]) {
+	caller, ok := GetCaller(h.Log, h.Auth, w, r)
+	if !ok {
+		return
+	}
+	if !caller.Admin {
+		http.Error(w, "Forbidden", 403)
+		return
+	}
+	if len(r.Header[ContentType]) > 1 {
 		http.Error(w, "Unsupported Media Type", 415)
 		return
 	}
-	blob, err := ioutil.ReadAll(r.Body)
+	if reMultipartMediaType.MatchString(r.Header.Get(ContentType)) {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get(ContentType))
+		if mediaType != MediaTypeFormData {
+			http.Error(w, "Unsupported Media Type", 415)
+			return
+		}
+		h.CreateBlobs(w, r, caller.Id)
+		return
+	}
+	if digest := knownDigest(r); digest != "" && r.ContentLength == 0 {
+		h.FindBlob(w, r, digest)
+		return
+	}
+	blob, err := ioutil.ReadAll(io.LimitReader(r.Body, MaxBlobSize+1))
 	if err != nil {
-		log.Printf("error: failed to read request body: %v\n", err)
-		http.Error(w, "Internal Server Error", 500)
+		h.Log.For(r).Errorf("failed to read request body: %v", err)
+		InternalError(w, r)
+		return
+	}
+	if len(blob) > MaxBlobSize {
+		http.Error(w, "Request Entity Too Large", 413)
+		return
+	}
+	// With a body, "?digest=" is a check on it rather than a lookup.
+	if digest := r.URL.Query().Get("digest"); digest != "" && !strings.EqualFold(digest, DigestFor(blob)) {
+		http.Error(w, "Parameter 'digest' does not match the uploaded data", 400)
+		return
+	}
+	meta := NewBlobMeta(BlobContentType(r.Header.Get(ContentType), blob), blob)
+	key, err := h.repo.StoreContent(blob)
+	if err != nil {
+		h.Log.For(r).Errorf("POST /blob: %v", err)
+		InternalError(w, r)
 		return
 	}
 	var id uint64
-	err = h.repo.Update(repo.BLOB, func(tx *repo.Tx) error {
+	err = h.repo.UpdateContext(r.Context(), repo.BLOB, func(tx *repo.Tx) error {
 		var err error
-		id, err = tx.AllocateId()
-		if err != nil {
-			return err
-		}
-		return tx.Put(id, blob)
+		id, err = PutBlob(tx, r, caller.Id, key, &meta)
+		return err
 	})
+	h.repo.ReleaseContent(key)
 	if err != nil {
-		log.Printf("error: POST /blob: %v", err)
-		http.Error(w, "Internal Server Error", 500)
+		if err := DiscardBlobContent(h.repo, []string{key}); err != nil {
+			h.Log.For(r).Errorf("POST /blob: failed to discard content: %v", err)
+		}
+		h.Log.For(r).Errorf("POST /blob: %v", err)
+		InternalError(w, r)
 		return
 	}
-	raw := MustMarshalJSON(BlobReference{Id: id})
+	raw, contentType := EncodeBlobReference(w, r, BlobReference{Id: id})
 	w.Header().Set(ContentLength, fmt.Sprintf("%d", len(raw)))
-	w.Header().Set(ContentType, MediaTypeJSON)
+	w.Header().Set(ContentType, contentType)
 	w.Header().Set(CacheControl, CacheControlNoCache)
 	w.Header().Set(ETag, ETagFor(blob))
 	w.Header().Set(Location, fmt.Sprintf("/blob/%d", id))
@@ -117,27 +298,351 @@ func (h BlobHandler) CreateBlob(w http.ResponseWriter, r *http.Request) {
 	w.Write(raw)
 }
 
+// PutBlob records a new blob, whose data is already in the content store
+// under key, within a BLOB transaction, recording the upload in the audit
+// log.  It fills in meta.Id and meta.External.  The data is stored first,
+// by repo.StoreContent, so that the transaction writes only small records.
+// Blobs are indexed by digest, using the digest as the blob's name; when
+// the same content is stored twice, the index keeps the first.
+func PutBlob(tx *repo.Tx, r *http.Request, actor uint64, key string, meta *BlobMeta) (uint64, error) {
+	id, err := tx.AllocateId()
+	if err != nil {
+		return 0, err
+	}
+	meta.Id = id
+	meta.External = true
+	err = tx.Put(id, []byte(key))
+	if err != nil {
+		return 0, err
+	}
+	err = tx.Associate(id, meta.Digest)
+	if errors.Is(err, repo.ErrDuplicate) {
+		err = nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	err = tx.As(repo.BLOBMETA).Put(id, MustMarshalProto(meta))
+	if err != nil {
+		return 0, err
+	}
+	return id, Audit(tx, r, actor, id, 201)
+}
+
+// DiscardBlobContent removes the content stored under keys for blobs that
+// failed to be recorded, keeping any that a blob refers to.  Every blob
+// with content is indexed by its digest, so that is where to look.  The
+// keys must have been released.
+func DiscardBlobContent(rp *repo.Repo, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return rp.Update(repo.BLOB, func(tx *repo.Tx) error {
+		for _, key := range keys {
+			_, err := tx.Lookup("sha256:" + key)
+			if err == nil {
+				continue
+			}
+			if !errors.Is(err, repo.ErrNotFound) {
+				return err
+			}
+			if _, err := rp.DiscardContent(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// knownDigest returns the digest of content the client believes is already
+// stored, given as "?digest=" or as the sole entity tag in If-None-Match.
+func knownDigest(r *http.Request) string {
+	if digest := r.URL.Query().Get("digest"); digest != "" {
+		return strings.ToLower(digest)
+	}
+	inm := strings.TrimSpace(r.Header.Get(IfNoneMatch))
+	if len(inm) > 2 && inm[0] == '"' && inm[len(inm)-1] == '"' && !strings.ContainsAny(inm[1:len(inm)-1], `",`) {
+		return strings.ToLower(inm[1 : len(inm)-1])
+	}
+	return ""
+}
+
+// FindBlob answers an upload that carries only a digest: 200 with the id
+// of a blob with that content, or 404 if the content must be uploaded.
+func (h BlobHandler) FindBlob(w http.ResponseWriter, r *http.Request, digest string) {
+	var id uint64
+	err := h.repo.ViewContext(r.Context(), repo.BLOB, func(tx *repo.Tx) error {
+		var err error
+		id, err = tx.Lookup(digest)
+		return err
+	})
+	if errors.Is(err, repo.ErrNotFound) {
+		http.Error(w, "No blob has that digest; upload the content", 404)
+		return
+	}
+	if err != nil {
+		h.Log.For(r).Errorf("POST /blob digest %q: %v", digest, err)
+		InternalError(w, r)
+		return
+	}
+	raw, contentType := EncodeBlobReference(w, r, BlobReference{Id: id})
+	w.Header().Set(ContentLength, fmt.Sprintf("%d", len(raw)))
+	w.Header().Set(ContentType, contentType)
+	w.Header().Set(CacheControl, CacheControlNoCache)
+	w.Header().Set(Location, fmt.Sprintf("/blob/%d", id))
+	w.WriteHeader(200)
+	w.Write(raw)
+}
+
+// CreateBlobs stores each part of a multipart/form-data body as a separate
+// blob, all in one transaction, and lists them in part order.  If any part
+// is refused, or the transaction fails, the content already stored for the
+// others is removed again.
+func (h BlobHandler) CreateBlobs(w http.ResponseWriter, r *http.Request, actor uint64) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Malformed multipart body: %v", err), 400)
+		return
+	}
+	var keys []string
+	var metas []BlobMeta
+	refs := make([]BlobReference, 0)
+	var total int64
+	stored := false
+	defer func() {
+		for _, key := range keys {
+			h.repo.ReleaseContent(key)
+		}
+		if stored {
+			return
+		}
+		if err := DiscardBlobContent(h.repo, keys); err != nil {
+			h.Log.For(r).Errorf("POST /blob multipart: failed to discard content: %v", err)
+		}
+	}()
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Malformed multipart body: %v", err), 400)
+			return
+		}
+		if h.MaxParts > 0 && len(keys) >= h.MaxParts {
+			part.Close()
+			http.Error(w, fmt.Sprintf("Multipart body has more than %d parts", h.MaxParts), 413)
+			return
+		}
+		blob, err := ioutil.ReadAll(io.LimitReader(part, MaxBlobSize+1))
+		part.Close()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Malformed multipart body: %v", err), 400)
+			return
+		}
+		if len(blob) > MaxBlobSize {
+			http.Error(w, fmt.Sprintf("Part %q is too large", part.FormName()), 413)
+			return
+		}
+		total += int64(len(blob))
+		if h.MaxBatchSize > 0 && total > h.MaxBatchSize {
+			http.Error(w, fmt.Sprintf("Multipart body holds more than %d bytes", h.MaxBatchSize), 413)
+			return
+		}
+		key, err := h.repo.StoreContent(blob)
+		if err != nil {
+			h.Log.For(r).Errorf("POST /blob multipart: %v", err)
+			InternalError(w, r)
+			return
+		}
+		keys = append(keys, key)
+		metas = append(metas, NewBlobMeta(BlobContentType(part.Header.Get(ContentType), blob), blob))
+		refs = append(refs, BlobReference{Field: part.FormName(), FileName: part.FileName()})
+	}
+	if len(keys) == 0 {
+		http.Error(w, "Multipart body has no parts", 400)
+		return
+	}
+	err = h.repo.UpdateContext(r.Context(), repo.BLOB, func(tx *repo.Tx) error {
+		for i, key := range keys {
+			id, err := PutBlob(tx, r, actor, key, &metas[i])
+			if err != nil {
+				return err
+			}
+			refs[i].Id = id
+		}
+		return nil
+	})
+	if err != nil {
+		h.Log.For(r).Errorf("POST /blob multipart: %v", err)
+		InternalError(w, r)
+		return
+	}
+	stored = true
+	raw, contentType := EncodeBlobReferences(w, r, refs)
+	w.Header().Set(ContentLength, fmt.Sprintf("%d", len(raw)))
+	w.Header().Set(ContentType, contentType)
+	w.Header().Set(CacheControl, CacheControlNoCache)
+	w.WriteHeader(201)
+	w.Write(raw)
+}
+
 func (h BlobHandler) GetBlob(w http.ResponseWriter, r *http.Request, blobId uint64) {
 	var blob []byte
-	err := h.repo.View(repo.BLOB, func(tx *repo.Tx) error {
-		var err error
-		blob, err = tx.Get(blobId)
+	meta := BlobMeta{ContentType: MediaTypeBinary}
+	err := h.repo.ViewContext(r.Context(), repo.BLOB, func(tx *repo.Tx) error {
+		value, err := tx.Get(blobId)
 		if err != nil {
 			return err
 		}
+		// bolt only guarantees value until the transaction ends.
+		blob = append([]byte(nil), value...)
+		value, err = tx.As(repo.BLOBMETA).Get(blobId)
+		if errors.Is(err, repo.ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		MustUnmarshalProto(value, &meta)
 		return nil
 	})
-	if _, ok := err.(*repo.NotFoundError); ok {
-		http.NotFound(w, r)
+	if err == nil && meta.External {
+		blob, err = h.repo.LoadContent(string(blob))
+	}
+	if errors.Is(err, repo.ErrNotFound) {
+		NotFound(w, r)
 		return
 	}
 	if err != nil {
-		log.Printf("error: GET /blob %d: %v\n", blobId, err)
-		http.Error(w, "Internal Server Error", 500)
+		h.Log.For(r).Errorf("GET /blob %d: %v", blobId, err)
+		InternalError(w, r)
 		return
 	}
-	w.Header().Set(ContentType, MediaTypeBinary)
-	w.Header().Set(CacheControl, CacheControlPublic)
-	w.Header().Set(ETag, ETagFor(blob))
-	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(blob))
+	if h.Verify && meta.Digest != "" {
+		if digest := DigestFor(blob); digest != meta.Digest {
+			h.Log.For(r).Errorf("GET /blob %d: corrupt: digest is %s, but %s was stored", blobId, digest, meta.Digest)
+			InternalErrorMessage(w, r, "Blob content does not match its digest")
+			return
+		}
+	}
+	etag := ETagFor(blob)
+	if im := r.Header.Get(IfMatch); im != "" && !MatchETag(im, etag) {
+		w.Header().Set(ETag, etag)
+		http.Error(w, "ETag mismatch", 412)
+		return
+	}
+	h.setContentHeaders(w, meta)
+	w.Header().Set(CacheControl, h.Cache.blob())
+	w.Header().Set(ETag, etag)
+	// http.ServeContent answers Range requests, single or multiple, with
+	// 206 (or 416), and honours If-Range against the ETag or, since blobs
+	// never change once stored, their creation time.  Say so even on
+	// responses it would leave without the header, such as a 304.
+	w.Header().Set(AcceptRanges, "bytes")
+	http.ServeContent(w, r, "", blobModTime(meta), bytes.NewReader(blob))
+}
+
+// HeadBlob answers HEAD for a blob from its stored metadata, so that
+// clients can check for a blob without the server copying it.
+func (h BlobHandler) HeadBlob(w http.ResponseWriter, r *http.Request, blobId uint64) {
+	meta, err := h.loadMeta(r.Context(), blobId)
+	if errors.Is(err, repo.ErrNotFound) {
+		NotFound(w, r)
+		return
+	}
+	if err != nil {
+		h.Log.For(r).Errorf("HEAD /blob %d: %v", blobId, err)
+		InternalError(w, r)
+		return
+	}
+	w.Header().Set(ETag, meta.ETag)
+	if im := r.Header.Get(IfMatch); im != "" && !MatchETag(im, meta.ETag) {
+		http.Error(w, "ETag mismatch", 412)
+		return
+	}
+	if inm := r.Header.Get(IfNoneMatch); inm != "" && MatchETag(inm, meta.ETag) {
+		w.WriteHeader(304)
+		return
+	}
+	h.setContentHeaders(w, meta)
+	w.Header().Set(ContentLength, fmt.Sprintf("%d", meta.Size))
+	w.Header().Set(CacheControl, h.Cache.blob())
+	w.Header().Set(AcceptRanges, "bytes")
+	if t := blobModTime(meta); !t.IsZero() {
+		w.Header().Set(LastModified, t.UTC().Format(http.TimeFormat))
+	}
+	w.WriteHeader(200)
+}
+
+// blobModTime returns when a blob was stored, or the zero time if that was
+// not recorded.
+func blobModTime(meta BlobMeta) time.Time {
+	if meta.Created != 0 {
+		return time.Unix(meta.Created, 0)
+	}
+	return time.Time{}
+}
+
+// setContentHeaders describes a blob's content for GET and HEAD.
+func (h BlobHandler) setContentHeaders(w http.ResponseWriter, meta BlobMeta) {
+	w.Header().Set(ContentType, meta.ContentType)
+	w.Header().Set(XContentTypeOptions, "nosniff")
+	if h.Inline {
+		w.Header().Set(ContentDisposition, "inline")
+	} else {
+		w.Header().Set(ContentDisposition, "attachment")
+	}
+}
+
+// loadMeta returns the metadata for a blob, filling in whatever was not
+// recorded when the blob was stored.
+func (h BlobHandler) loadMeta(ctx context.Context, blobId uint64) (BlobMeta, error) {
+	var meta BlobMeta
+	err := h.repo.ViewContext(ctx, repo.BLOB, func(tx *repo.Tx) error {
+		blob, err := tx.Get(blobId)
+		if err != nil {
+			return err
+		}
+		value, err := tx.As(repo.BLOBMETA).Get(blobId)
+		if err == nil {
+			MustUnmarshalProto(value, &meta)
+		} else if !errors.Is(err, repo.ErrNotFound) {
+			return err
+		}
+		if meta.Digest == "" {
+			// Stored before metadata was recorded.
+			meta.Size = uint64(len(blob))
+			meta.Digest = DigestFor(blob)
+		}
+		if meta.ETag == "" {
+			meta.ETag = ETagFor(blob)
+		}
+		if meta.ContentType == "" {
+			meta.ContentType = MediaTypeBinary
+		}
+		meta.Id = blobId
+		return nil
+	})
+	return meta, err
+}
+
+func (h BlobHandler) GetBlobMeta(w http.ResponseWriter, r *http.Request, blobId uint64) {
+	meta, err := h.loadMeta(r.Context(), blobId)
+	if errors.Is(err, repo.ErrNotFound) {
+		NotFound(w, r)
+		return
+	}
+	if err != nil {
+		h.Log.For(r).Errorf("GET /blob %d meta: %v", blobId, err)
+		InternalError(w, r)
+		return
+	}
+	raw, contentType := EncodeJSON(w, r, &meta, func() *JSONAPIDocument {
+		return NewJSONAPIItem(NewJSONAPIResource("blob", blobId, fmt.Sprintf("/blob/%d/meta", blobId), &meta))
+	})
+	w.Header().Set(ContentType, contentType)
+	w.Header().Set(CacheControl, h.Cache.blob())
+	w.Header().Set(ETag, ETagFor(raw))
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(raw))
 }
@@ -0,0 +1,521 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloud9-tools/cloud9/repo"
+)
+
+func TestCreateBlobDigest(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	h := BlobHandler{repo: rp, Auth: auth}
+	content := "hello, world"
+	digest := DigestFor([]byte(content))
+	wrong := DigestFor([]byte("something else"))
+
+	r := newTestRequest(POST, "/blob?digest="+wrong, content)
+	r.Header.Set(ContentType, MediaTypeText)
+	expectStatus(t, serve(h, r, "root"), 400)
+
+	// The same, with a body of unknown length.
+	r = newTestRequest(POST, "/blob?digest="+wrong, content)
+	r.Header.Set(ContentType, MediaTypeText)
+	r.ContentLength = -1
+	expectStatus(t, serve(h, r, "root"), 400)
+
+	r = newTestRequest(POST, "/blob?digest="+digest, content)
+	r.Header.Set(ContentType, MediaTypeText)
+	r.ContentLength = -1
+	expectStatus(t, serve(h, r, "root"), 201)
+
+	// Without a body, the digest looks for the content.
+	expectStatus(t, serve(h, newTestRequest(POST, "/blob?digest="+digest, ""), "root"), 200)
+	expectStatus(t, serve(h, newTestRequest(POST, "/blob?digest="+wrong, ""), "root"), 404)
+}
+
+func TestCreateBlobAuthorization(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "alice", false)
+	h := BlobHandler{repo: rp, Auth: auth}
+	uh := &UploadHandler{Repo: rp, Dir: t.TempDir(), Auth: auth}
+
+	expectStatus(t, serve(h, newTestRequest(POST, "/blob", "data"), ""), 401)
+	expectStatus(t, serve(h, newTestRequest(POST, "/blob", "data"), "alice"), 403)
+	expectStatus(t, serve(uh, newTestRequest(POST, "/blob/uploads", ""), ""), 401)
+	expectStatus(t, serve(uh, newTestRequest(POST, "/blob/uploads", ""), "alice"), 403)
+}
+
+// newMultipartRequest returns a POST /blob with a part for each of parts.
+func newMultipartRequest(parts ...string) *http.Request {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for i, part := range parts {
+		fw, _ := mw.CreateFormFile(fmt.Sprintf("file%d", i), fmt.Sprintf("file%d.txt", i))
+		fw.Write([]byte(part))
+	}
+	mw.Close()
+	r := newTestRequest(POST, "/blob", "")
+	r.Body = ioutil.NopCloser(&body)
+	r.ContentLength = int64(body.Len())
+	r.Header.Set(ContentType, mw.FormDataContentType())
+	return r
+}
+
+func TestCreateBlobsLimits(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	h := BlobHandler{repo: rp, Auth: auth, MaxParts: 2, MaxBatchSize: 10}
+	stored := func(content string) bool {
+		_, err := rp.LoadContent(strings.TrimPrefix(DigestFor([]byte(content)), "sha256:"))
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		return err == nil
+	}
+
+	expectStatus(t, serve(h, newMultipartRequest("kept"), "root"), 201)
+	expectStatus(t, serve(h, newMultipartRequest("kept", "one", "two"), "root"), 413)
+	expectStatus(t, serve(h, newMultipartRequest("kept", "eleven byte"), "root"), 413)
+	if !stored("kept") {
+		t.Error("content of an existing blob was discarded")
+	}
+	if stored("one") || stored("two") {
+		t.Error("content of a refused batch was kept")
+	}
+	expectStatus(t, serve(h, newMultipartRequest("one", "two"), "root"), 201)
+	if !stored("one") || !stored("two") {
+		t.Error("content of a stored batch is missing")
+	}
+}
+
+// createTestBlob stores content through h as root, with the given content
+// type if any, and returns the new blob's path.
+func createTestBlob(t *testing.T, h BlobHandler, contentType, content string) string {
+	t.Helper()
+	r := newTestRequest(POST, "/blob", content)
+	r.Header.Del(ContentType)
+	if contentType != "" {
+		r.Header.Set(ContentType, contentType)
+	}
+	w := serve(h, r, "root")
+	expectStatus(t, w, 201)
+	return w.Header().Get(Location)
+}
+
+func TestBlobContentType(t *testing.T) {
+	for _, test := range []struct {
+		given, data, want string
+	}{
+		{"", "<html><body>hi</body></html>", "text/html; charset=utf-8"},
+		{MediaTypeBinary, "%PDF-1.4", "application/pdf"},
+		{"Application/Octet-Stream", "plain words", "text/plain; charset=utf-8"},
+		{"not a type;;", "\x89PNG\r\n\x1a\n", "image/png"},
+		{"image/svg+xml", "<svg/>", "image/svg+xml"},
+		{"text/plain; charset=latin1", "<html>", "text/plain; charset=latin1"},
+	} {
+		if got := BlobContentType(test.given, []byte(test.data)); got != test.want {
+			t.Errorf("BlobContentType(%q, %q) = %q, want %q", test.given, test.data, got, test.want)
+		}
+	}
+
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	h := BlobHandler{repo: rp, Auth: auth}
+	for _, test := range []struct {
+		given, want string
+	}{
+		{"", "text/plain; charset=utf-8"},
+		{"text/csv", "text/csv"},
+	} {
+		path := createTestBlob(t, h, test.given, "a,b,c\n")
+		for _, method := range []string{GET, HEAD} {
+			w := serve(h, newTestRequest(method, path, ""), "")
+			expectStatus(t, w, 200)
+			if got := w.Header().Get(ContentType); got != test.want {
+				t.Errorf("%s %s sent with %q: %s is %q, want %q", method, path, test.given, ContentType, got, test.want)
+			}
+			if got := w.Header().Get(XContentTypeOptions); got != "nosniff" {
+				t.Errorf("%s %s: %s is %q, want nosniff", method, path, XContentTypeOptions, got)
+			}
+		}
+	}
+}
+
+func TestBlobDisposition(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	for _, test := range []struct {
+		inline bool
+		want   string
+	}{
+		{false, "attachment"},
+		{true, "inline"},
+	} {
+		h := BlobHandler{repo: rp, Auth: auth, Inline: test.inline}
+		path := createTestBlob(t, h, "text/html", "<script>alert(1)</script>")
+		ranged := newTestRequest(GET, path, "")
+		ranged.Header.Set(Range, "bytes=0-7")
+		for _, r := range []*http.Request{newTestRequest(GET, path, ""), newTestRequest(HEAD, path, ""), ranged} {
+			w := serve(h, r, "")
+			if w.Code != 200 && w.Code != 206 {
+				t.Fatalf("%s %s: status %d", r.Method, path, w.Code)
+			}
+			if got := w.Header().Get(ContentDisposition); got != test.want {
+				t.Errorf("Inline %t: %s %s: %s is %q, want %q", test.inline, r.Method, path, ContentDisposition, got, test.want)
+			}
+			if got := w.Header().Get(XContentTypeOptions); got != "nosniff" {
+				t.Errorf("Inline %t: %s %s: %s is %q, want nosniff", test.inline, r.Method, path, XContentTypeOptions, got)
+			}
+		}
+	}
+}
+
+func TestGetBlobIfMatch(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	h := BlobHandler{repo: rp, Auth: auth}
+	path := createTestBlob(t, h, MediaTypeText, "hello")
+	w := serve(h, newTestRequest(GET, path, ""), "")
+	expectStatus(t, w, 200)
+	etag := w.Header().Get(ETag)
+
+	for _, test := range []struct {
+		ifMatch string
+		status  int
+	}{
+		{etag, 200},
+		{"*", 200},
+		{`"other", ` + etag, 200},
+		{`"other"`, 412},
+	} {
+		for _, method := range []string{GET, HEAD} {
+			r := newTestRequest(method, path, "")
+			r.Header.Set(IfMatch, test.ifMatch)
+			w := serve(h, r, "")
+			expectStatus(t, w, test.status)
+			if w.Header().Get(ETag) != etag {
+				t.Errorf("%s with If-Match %s: %s is %q, want %s", method, test.ifMatch, ETag, w.Header().Get(ETag), etag)
+			}
+		}
+	}
+}
+
+func TestGetBlobMeta(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	h := BlobHandler{repo: rp, Auth: auth}
+	content := "hello, world"
+	before := time.Now().Unix()
+	path := createTestBlob(t, h, MediaTypeText, content)
+
+	w := serve(h, newTestRequest(GET, path+"/meta", ""), "")
+	expectStatus(t, w, 200)
+	var meta BlobMeta
+	if err := json.Unmarshal(w.Body.Bytes(), &meta); err != nil {
+		t.Fatal(err)
+	}
+	if meta.Size != uint64(len(content)) || meta.Digest != DigestFor([]byte(content)) || meta.ContentType != MediaTypeText {
+		t.Errorf("GET %s/meta gave %s", path, w.Body.String())
+	}
+	if meta.Created < before || meta.Created > time.Now().Unix() {
+		t.Errorf("created at %d, want about %d", meta.Created, before)
+	}
+	if path != fmt.Sprintf("/blob/%d", meta.Id) {
+		t.Errorf("GET %s/meta gave id %d", path, meta.Id)
+	}
+
+	expectStatus(t, serve(h, newTestRequest(GET, "/blob/999/meta", ""), ""), 404)
+
+	// One stored before metadata was recorded.
+	var id uint64
+	err := rp.Update(repo.BLOB, func(tx *repo.Tx) error {
+		var err error
+		if id, err = tx.AllocateId(); err != nil {
+			return err
+		}
+		return tx.Put(id, []byte(content))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = serve(h, newTestRequest(GET, fmt.Sprintf("/blob/%d/meta", id), ""), "")
+	expectStatus(t, w, 200)
+	meta = BlobMeta{}
+	if err := json.Unmarshal(w.Body.Bytes(), &meta); err != nil {
+		t.Fatal(err)
+	}
+	if meta.Size != uint64(len(content)) || meta.Digest != DigestFor([]byte(content)) || meta.ContentType != MediaTypeBinary {
+		t.Errorf("GET /blob/%d/meta gave %s", id, w.Body.String())
+	}
+}
+
+func TestCreateBlobs(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	h := BlobHandler{repo: rp, Auth: auth}
+
+	w := serve(h, newMultipartRequest("first", "second"), "root")
+	expectStatus(t, w, 201)
+	var refs []BlobReference
+	if err := json.Unmarshal(w.Body.Bytes(), &refs); err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 2 {
+		t.Fatalf("POST /blob gave %s, want two blobs", w.Body.String())
+	}
+	for i, content := range []string{"first", "second"} {
+		ref := refs[i]
+		if ref.Field != fmt.Sprintf("file%d", i) || ref.FileName != fmt.Sprintf("file%d.txt", i) {
+			t.Errorf("part %d is %+v", i, ref)
+		}
+		path := fmt.Sprintf("/blob/%d", ref.Id)
+		w := serve(h, newTestRequest(GET, path, ""), "")
+		expectStatus(t, w, 200)
+		if w.Body.String() != content {
+			t.Errorf("GET %s gave %q, want %q", path, w.Body.String(), content)
+		}
+	}
+
+	expectStatus(t, serve(h, newMultipartRequest(), "root"), 400)
+	r := newMultipartRequest("x")
+	r.Header.Set(ContentType, "multipart/form-data; boundary=wrong")
+	expectStatus(t, serve(h, r, "root"), 400)
+}
+
+func TestFindBlobByDigest(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	h := BlobHandler{repo: rp, Auth: auth}
+	path := createTestBlob(t, h, MediaTypeText, "hello")
+	digest := DigestFor([]byte("hello"))
+
+	find := func(query, inm string) *httptest.ResponseRecorder {
+		r := newTestRequest(POST, "/blob"+query, "")
+		if inm != "" {
+			r.Header.Set(IfNoneMatch, inm)
+		}
+		return serve(h, r, "root")
+	}
+	for _, w := range []*httptest.ResponseRecorder{
+		find("?digest="+digest, ""),
+		find("?digest="+strings.ToUpper(digest), ""),
+		find("", `"`+digest+`"`),
+	} {
+		expectStatus(t, w, 200)
+		if got := w.Header().Get(Location); got != path {
+			t.Errorf("found %s, want %s", got, path)
+		}
+	}
+	// A list of tags, or a weak one, is not a digest, so the empty body is
+	// stored as it is.
+	expectStatus(t, find("", `"`+digest+`", "other"`), 201)
+	expectStatus(t, find("", `W/"`+digest+`"`), 201)
+}
+
+func TestHeadBlob(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	h := BlobHandler{repo: rp, Auth: auth}
+	path := createTestBlob(t, h, MediaTypeText, "hello")
+	get := serve(h, newTestRequest(GET, path, ""), "")
+	expectStatus(t, get, 200)
+
+	w := serve(h, newTestRequest(HEAD, path, ""), "")
+	expectStatus(t, w, 200)
+	if w.Body.Len() != 0 {
+		t.Errorf("HEAD %s sent a body", path)
+	}
+	for _, header := range []string{ContentLength, ETag, LastModified, ContentType} {
+		if got, want := w.Header().Get(header), get.Header().Get(header); got != want {
+			t.Errorf("HEAD %s: %s is %q, but GET gave %q", path, header, got, want)
+		}
+	}
+
+	r := newTestRequest(HEAD, path, "")
+	r.Header.Set(IfNoneMatch, get.Header().Get(ETag))
+	expectStatus(t, serve(h, r, ""), 304)
+	expectStatus(t, serve(h, newTestRequest(HEAD, "/blob/999", ""), ""), 404)
+}
+
+// corruptTestBlob overwrites the stored content of the blob that was
+// created with content.
+func corruptTestBlob(t *testing.T, rp *repo.Repo, content, with string) {
+	t.Helper()
+	key := strings.TrimPrefix(DigestFor([]byte(content)), "sha256:")
+	path := filepath.Join(rp.Dir(), repo.ContentDir, repo.ContentPath(key, rp.ContentFanout()))
+	if err := ioutil.WriteFile(path, []byte(with), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetBlobVerify(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	var log bytes.Buffer
+	h := BlobHandler{repo: rp, Auth: auth, Log: NewLogger(&log, ERROR)}
+	good := createTestBlob(t, h, MediaTypeText, "sound")
+	bad := createTestBlob(t, h, MediaTypeText, "rotten")
+	corruptTestBlob(t, rp, "rotten", "rotted")
+
+	// Without Verify, the damage goes unnoticed.
+	w := serve(h, newTestRequest(GET, bad, ""), "")
+	expectStatus(t, w, 200)
+	if w.Body.String() != "rotted" {
+		t.Errorf("GET %s gave %q", bad, w.Body.String())
+	}
+
+	h.Verify = true
+	w = serve(h, newTestRequest(GET, good, ""), "")
+	expectStatus(t, w, 200)
+	if w.Body.String() != "sound" {
+		t.Errorf("GET %s gave %q", good, w.Body.String())
+	}
+	ranged := newTestRequest(GET, bad, "")
+	ranged.Header.Set(Range, "bytes=0-1")
+	for _, r := range []*http.Request{newTestRequest(GET, bad, ""), ranged} {
+		w := serve(h, r, "")
+		expectStatus(t, w, 500)
+		if !strings.Contains(w.Body.String(), "Blob content does not match its digest") {
+			t.Errorf("GET %s gave %q", bad, w.Body.String())
+		}
+	}
+	if !strings.Contains(log.String(), "corrupt") {
+		t.Errorf("the corruption was not logged: %q", log.String())
+	}
+}
+
+func TestGetBlobRange(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	h := BlobHandler{repo: rp, Auth: auth}
+	path := createTestBlob(t, h, MediaTypeText, "0123456789abcdef")
+
+	for _, test := range []struct {
+		rng, contentRange, body string
+		status                  int
+	}{
+		{"", "", "0123456789abcdef", 200},
+		{"bytes=2-5", "bytes 2-5/16", "2345", 206},
+		{"bytes=-4", "bytes 12-15/16", "cdef", 206},
+		{"bytes=10-", "bytes 10-15/16", "abcdef", 206},
+		{"bytes=14-99", "bytes 14-15/16", "ef", 206},
+		{"bytes=20-30", "bytes */16", "", 416},
+	} {
+		r := newTestRequest(GET, path, "")
+		if test.rng != "" {
+			r.Header.Set(Range, test.rng)
+		}
+		w := serve(h, r, "")
+		expectStatus(t, w, test.status)
+		if got := w.Header().Get(ContentRange); got != test.contentRange {
+			t.Errorf("Range %q: %s %q, want %q", test.rng, ContentRange, got, test.contentRange)
+		}
+		if test.status != 416 && w.Body.String() != test.body {
+			t.Errorf("Range %q: body %q, want %q", test.rng, w.Body.String(), test.body)
+		}
+		if got := w.Header().Get(AcceptRanges); got != "bytes" {
+			t.Errorf("Range %q: %s %q, want bytes", test.rng, AcceptRanges, got)
+		}
+	}
+
+	// Several ranges come back as multipart/byteranges.
+	r := newTestRequest(GET, path, "")
+	r.Header.Set(Range, "bytes=0-1,4-5")
+	w := serve(h, r, "")
+	expectStatus(t, w, 206)
+	mediaType, params, err := mime.ParseMediaType(w.Header().Get(ContentType))
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("%s %q", ContentType, w.Header().Get(ContentType))
+	}
+	mr := multipart.NewReader(w.Body, params["boundary"])
+	for _, want := range []struct{ contentRange, body string }{
+		{"bytes 0-1/16", "01"},
+		{"bytes 4-5/16", "45"},
+	} {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(part)
+		if got := part.Header.Get(ContentRange); got != want.contentRange || string(body) != want.body {
+			t.Errorf("part %s %q, want %s %q", got, body, want.contentRange, want.body)
+		}
+	}
+
+	// Even a 304 says that ranges are accepted.
+	r = newTestRequest(GET, path, "")
+	r.Header.Set(IfNoneMatch, serve(h, newTestRequest(GET, path, ""), "").Header().Get(ETag))
+	w = serve(h, r, "")
+	expectStatus(t, w, 304)
+	if got := w.Header().Get(AcceptRanges); got != "bytes" {
+		t.Errorf("304: %s %q, want bytes", AcceptRanges, got)
+	}
+}
+
+func TestGetBlobIfRange(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	h := BlobHandler{repo: rp, Auth: auth}
+	path := createTestBlob(t, h, MediaTypeText, "0123456789")
+	w := serve(h, newTestRequest(GET, path, ""), "")
+	expectStatus(t, w, 200)
+	etag := w.Header().Get(ETag)
+	lastModified := w.Header().Get(LastModified)
+	modTime, err := http.ParseTime(lastModified)
+	if err != nil {
+		t.Fatalf("%s %q: %v", LastModified, lastModified, err)
+	}
+	if d := time.Since(modTime); d < -time.Minute || d > time.Minute {
+		t.Errorf("%s %q is not about now", LastModified, lastModified)
+	}
+
+	for _, test := range []struct {
+		ifRange string
+		status  int
+	}{
+		{etag, 206},
+		{`"other"`, 200},
+		{"W/" + etag, 200},
+		{lastModified, 206},
+		{modTime.Add(-time.Hour).Format(http.TimeFormat), 200},
+	} {
+		r := newTestRequest(GET, path, "")
+		r.Header.Set(Range, "bytes=5-")
+		r.Header.Set(IfRange, test.ifRange)
+		w := serve(h, r, "")
+		expectStatus(t, w, test.status)
+		want := "0123456789"
+		if test.status == 206 {
+			want = "56789"
+		}
+		if w.Body.String() != want {
+			t.Errorf("If-Range %q: body %q, want %q", test.ifRange, w.Body.String(), want)
+		}
+	}
+}
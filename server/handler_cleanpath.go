@@ -0,0 +1,49 @@
+package server
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+// CleanPathHandler rejects request paths that are not already clean with
+// 400 Bad Request, before any route sees them.  Dot segments, repeated
+// slashes, backslashes, control characters and percent-encoded slashes are
+// all refused, so "/user/%2e%2e" or "/blob/1%2Fmeta" cannot be mistaken
+// for another route.
+type CleanPathHandler struct{ H http.Handler }
+
+func (handler CleanPathHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !IsCleanPath(r) {
+		http.Error(w, "Bad Request: malformed path", 400)
+		return
+	}
+	handler.H.ServeHTTP(w, r)
+}
+
+// IsCleanPath reports whether r's path is absolute and already in the form
+// path.Clean would give it (allowing one trailing slash), with no encoded
+// slashes or unprintable characters.
+func IsCleanPath(r *http.Request) bool {
+	p := r.URL.Path
+	if p == "" || p[0] != '/' {
+		return false
+	}
+	if strings.Contains(p, `\`) {
+		return false
+	}
+	for _, ch := range p {
+		if ch < 0x20 || ch == 0x7f {
+			return false
+		}
+	}
+	raw := strings.ToLower(r.URL.RawPath)
+	if strings.Contains(raw, "%2f") || strings.Contains(raw, "%5c") {
+		return false
+	}
+	clean := path.Clean(p)
+	if clean != "/" && strings.HasSuffix(p, "/") {
+		clean += "/"
+	}
+	return clean == p
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestIsCleanPath(t *testing.T) {
+	for _, test := range []struct {
+		uri   string
+		clean bool
+	}{
+		{"/", true},
+		{"/user/alice", true},
+		{"/blob/uploads/", true},
+		{"/user/alice?x=/../", true},
+		{"/user/caf%C3%A9", true},
+		{"", false},
+		{"user", false},
+		{"/user/../admin", false},
+		{"/user/%2e%2e", false},
+		{"/user/./alice", false},
+		{"//user", false},
+		{"/user//alice", false},
+		{"/user/alice//", false},
+		{"/blob/1%2Fmeta", false},
+		{"/blob/1%2fmeta", false},
+		{`/user\alice`, false},
+		{"/user/a%5Cb", false},
+		{"/user/a%00b", false},
+		{"/user/a%0Ab", false},
+		{"/user/a%7Fb", false},
+	} {
+		u, err := url.Parse(test.uri)
+		if err != nil {
+			t.Fatalf("%q: %v", test.uri, err)
+		}
+		if got := IsCleanPath(&http.Request{URL: u}); got != test.clean {
+			t.Errorf("IsCleanPath(%q) = %v, want %v", test.uri, got, test.clean)
+		}
+	}
+}
+
+func TestCleanPathHandler(t *testing.T) {
+	h := CleanPathHandler{http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(204)
+	})}
+	expectStatus(t, serve(h, newTestRequest(GET, "/user/alice", ""), ""), 204)
+	expectStatus(t, serve(h, newTestRequest(GET, "/user/%2e%2e/admin", ""), ""), 400)
+}
@@ -0,0 +1,233 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultEventHistory is how many recent events an EventBroker keeps
+	// for clients resuming with Last-Event-ID.
+	DefaultEventHistory = 1000
+
+	// eventSubscriberQueue is how many events may wait for one slow
+	// client before it is cut off, to resume when it reconnects.
+	eventSubscriberQueue = 64
+
+	eventHeartbeat = 30 * time.Second
+)
+
+// EventBroker is an EventSink that relays events to the clients of GET
+// /events.  It numbers the events, and keeps the most recent ones so that
+// a client that reconnects with the number of the last event it saw can be
+// sent those it missed.
+//
+// Numbers are only meaningful to the process that assigned them, so each
+// is prefixed with a value unique to the EventBroker.
+type EventBroker struct {
+	epoch string
+
+	mu      sync.Mutex
+	seq     uint64
+	history []numberedEvent // ring buffer, by seq modulo its length
+	subs    map[chan numberedEvent]bool
+	closed  bool
+}
+
+type numberedEvent struct {
+	Seq   uint64
+	Event Event
+}
+
+// NewEventBroker returns an EventBroker keeping the last size events.
+func NewEventBroker(size int) *EventBroker {
+	if size <= 0 {
+		size = 1
+	}
+	return &EventBroker{
+		epoch:   strconv.FormatInt(time.Now().UnixNano(), 36),
+		history: make([]numberedEvent, size),
+		subs:    make(map[chan numberedEvent]bool),
+	}
+}
+
+// Emit relays e to every subscriber.  A subscriber whose queue is full is
+// dropped, closing its channel.
+func (b *EventBroker) Emit(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	b.seq++
+	ne := numberedEvent{b.seq, e}
+	b.history[b.seq%uint64(len(b.history))] = ne
+	for ch := range b.subs {
+		select {
+		case ch <- ne:
+		default:
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Subscribe returns the events held that follow the one with the given id
+// (as formatted by EventId), and a channel of those to come.  If the id is
+// not empty but the events that followed it are not all held, gap is set.
+// The channel is closed if the subscriber falls too far behind or the
+// EventBroker is closed; Unsubscribe releases it.
+func (b *EventBroker) Subscribe(lastId string) (backlog []numberedEvent, ch chan numberedEvent, gap bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ch = make(chan numberedEvent, eventSubscriberQueue)
+	if b.closed {
+		close(ch)
+		return nil, ch, false
+	}
+	b.subs[ch] = true
+	if lastId == "" {
+		return nil, ch, false
+	}
+	last, ok := b.parseId(lastId)
+	if !ok || last > b.seq {
+		return nil, ch, true
+	}
+	oldest := uint64(1)
+	if n := uint64(len(b.history)); b.seq > n {
+		oldest = b.seq - n + 1
+	}
+	if last+1 < oldest {
+		gap = true
+		last = oldest - 1
+	}
+	for seq := last + 1; seq <= b.seq; seq++ {
+		backlog = append(backlog, b.history[seq%uint64(len(b.history))])
+	}
+	return backlog, ch, gap
+}
+
+// Unsubscribe stops sending to ch.
+func (b *EventBroker) Unsubscribe(ch chan numberedEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subs[ch] {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+// Close ends every subscription, so that streams end and the server can
+// shut down.
+func (b *EventBroker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for ch := range b.subs {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+// EventId formats the number of an event for the SSE "id" field.
+func (b *EventBroker) EventId(seq uint64) string {
+	return b.epoch + "-" + strconv.FormatUint(seq, 10)
+}
+
+func (b *EventBroker) parseId(id string) (uint64, bool) {
+	i := strings.LastIndexByte(id, '-')
+	if i < 0 || id[:i] != b.epoch {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(id[i+1:], 10, 64)
+	return seq, err == nil
+}
+
+// EventsHandler serves GET /events, a stream of Server-Sent Events
+// describing changes to users and groups as they commit.  Each message's
+// data is an Event as JSON.  A client reconnecting with Last-Event-ID (or
+// ?last_event_id) is first sent the events it missed; if some of those are
+// no longer held, or the server has restarted, it is sent a "reset" event,
+// after which it should reload whatever it was tracking.
+type EventsHandler struct {
+	Broker *EventBroker
+	Log    *Logger
+}
+
+func (h EventsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/events" {
+		NotFound(w, r)
+		return
+	}
+	if !AllowMethods(w, r, GET) {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		h.Log.For(r).Errorf("GET /events: %T is not an http.Flusher", w)
+		InternalError(w, r)
+		return
+	}
+	// The stream outlives the server's WriteTimeout.
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	lastId := r.Header.Get(LastEventId)
+	if lastId == "" {
+		lastId = r.URL.Query().Get("last_event_id")
+	}
+	backlog, ch, gap := h.Broker.Subscribe(lastId)
+	defer h.Broker.Unsubscribe(ch)
+
+	w.Header().Set(ContentType, MediaTypeEventStream)
+	w.Header().Set(CacheControl, CacheControlNoCache)
+	w.Header().Set(XAccelBuffering, "no")
+	w.WriteHeader(200)
+	if gap {
+		fmt.Fprintf(w, "event: reset\ndata: {}\n\n")
+	}
+	for _, ne := range backlog {
+		if !h.write(w, r, ne) {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ne, ok := <-ch:
+			if !ok {
+				return
+			}
+			if !h.write(w, r, ne) {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprintf(w, ": ping\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// write sends ne as one message.  Its data is kept to one line, so
+// ?pretty is ignored, but ?string_ids applies.
+func (h EventsHandler) write(w http.ResponseWriter, r *http.Request, ne numberedEvent) bool {
+	data, err := json.Marshal(ne.Event)
+	Must(err)
+	if WantStringIds(r) {
+		data, err = StringifyIds(data)
+		Must(err)
+	}
+	_, err = fmt.Fprintf(w, "id: %s\ndata: %s\n\n", h.Broker.EventId(ne.Seq), data)
+	return err == nil
+}
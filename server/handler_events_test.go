@@ -0,0 +1,159 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventBroker(t *testing.T) {
+	b := NewEventBroker(3)
+	for id := uint64(1); id <= 5; id++ {
+		b.Emit(Event{Type: "user", Action: EventUpdate, Id: id})
+	}
+	seqs := func(backlog []numberedEvent) string {
+		var s []string
+		for _, ne := range backlog {
+			s = append(s, fmt.Sprint(ne.Seq))
+		}
+		return strings.Join(s, " ")
+	}
+	for _, test := range []struct {
+		lastId  string
+		backlog string
+		gap     bool
+	}{
+		{"", "", false},
+		{b.EventId(5), "", false},
+		{b.EventId(3), "4 5", false},
+		{b.EventId(2), "3 4 5", false},
+		{b.EventId(1), "3 4 5", true},
+		{b.EventId(6), "", true},
+		{"other-3", "", true},
+		{"garbage", "", true},
+	} {
+		backlog, ch, gap := b.Subscribe(test.lastId)
+		if got := seqs(backlog); got != test.backlog || gap != test.gap {
+			t.Errorf("Subscribe(%q) gave %q, gap %t; want %q, gap %t", test.lastId, got, gap, test.backlog, test.gap)
+		}
+		b.Unsubscribe(ch)
+		if _, ok := <-ch; ok {
+			t.Errorf("Unsubscribe left the channel open")
+		}
+	}
+
+	// A subscriber that falls behind is cut off; others carry on.
+	_, slow, _ := b.Subscribe("")
+	_, fast, _ := b.Subscribe("")
+	for i := 0; i < eventSubscriberQueue+1; i++ {
+		b.Emit(Event{Type: "group", Action: EventCreate, Id: uint64(i)})
+		<-fast
+	}
+	n := 0
+	for range slow {
+		n++
+	}
+	if n != eventSubscriberQueue {
+		t.Errorf("slow subscriber got %d events before being cut off, want %d", n, eventSubscriberQueue)
+	}
+	b.Unsubscribe(slow)
+
+	b.Close()
+	if _, ok := <-fast; ok {
+		t.Error("Close left a subscription open")
+	}
+	_, ch, _ := b.Subscribe("")
+	if _, ok := <-ch; ok {
+		t.Error("Subscribe after Close gave an open channel")
+	}
+	b.Emit(Event{})
+}
+
+// readEvent reads one message from an event stream, skipping comments,
+// and returns its fields.
+func readEvent(t *testing.T, r *bufio.Reader) map[string]string {
+	t.Helper()
+	fields := make(map[string]string)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading event stream: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			if len(fields) > 0 {
+				return fields
+			}
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		kv := strings.SplitN(line, ": ", 2)
+		fields[kv[0]] = kv[1]
+	}
+}
+
+func TestEventsHandler(t *testing.T) {
+	b := NewEventBroker(10)
+	ts := httptest.NewServer(EventsHandler{Broker: b})
+	defer ts.Close()
+	defer b.Close()
+	open := func(lastId string) (*http.Response, *bufio.Reader) {
+		t.Helper()
+		req, err := http.NewRequest(GET, ts.URL+"/events?string_ids", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lastId != "" {
+			req.Header.Set(LastEventId, lastId)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != 200 {
+			t.Fatalf("GET /events gave %s", resp.Status)
+		}
+		return resp, bufio.NewReader(resp.Body)
+	}
+
+	resp, events := open("")
+	if got := resp.Header.Get(ContentType); got != MediaTypeEventStream {
+		t.Errorf("%s %q, want %q", ContentType, got, MediaTypeEventStream)
+	}
+	if got := resp.Header.Get(CacheControl); got != CacheControlNoCache {
+		t.Errorf("%s %q", CacheControl, got)
+	}
+	b.Emit(Event{Type: "user", Action: EventCreate, Id: 7, Time: time.Unix(0, 0)})
+	e := readEvent(t, events)
+	if e["id"] != b.EventId(1) || !strings.Contains(e["data"], `"id":"7"`) || !strings.Contains(e["data"], `"action":"create"`) {
+		t.Errorf("got event %q", e)
+	}
+	resp.Body.Close()
+
+	// Events missed while disconnected are sent on reconnecting.
+	b.Emit(Event{Type: "group", Action: EventUpdate, Id: 8})
+	b.Emit(Event{Type: "group", Action: EventDelete, Id: 9})
+	resp, events = open(e["id"])
+	for _, want := range []string{`"id":"8"`, `"id":"9"`} {
+		if e := readEvent(t, events); !strings.Contains(e["data"], want) {
+			t.Errorf("got event %q, want %s", e, want)
+		}
+	}
+	resp.Body.Close()
+
+	// A client that cannot be caught up is told to start over.
+	resp, events = open("stale-1")
+	if e := readEvent(t, events); e["event"] != "reset" {
+		t.Errorf("got event %q, want a reset", e)
+	}
+	resp.Body.Close()
+
+	w := serve(EventsHandler{Broker: b}, newTestRequest(POST, "/events", ""), "")
+	expectStatus(t, w, 405)
+}
@@ -4,11 +4,10 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"regexp"
+	"sort"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/golang/protobuf/proto"
@@ -17,10 +16,12 @@ import (
 )
 
 var (
-	reGroupIdPath      = regexp.MustCompile(`^/group/([0-9]+)$`)
-	reGroupNamePath    = regexp.MustCompile(`^/group/([A-Za-z][0-9A-Za-z]*)$`)
-	reGroupName        = regexp.MustCompile(`^[A-Za-z][0-9A-Za-z]*$`)
-	reGroupDescription = regexp.MustCompile(`^[\pL\pM\pN\pP\pS\pZ]*$`)
+	reGroupIdPath       = regexp.MustCompile(`^/group/([0-9]{1,20})$`)
+	reGroupNamePath     = regexp.MustCompile(`^/group/([A-Za-z][0-9A-Za-z]*)$`)
+	reGroupIdChildren   = regexp.MustCompile(`^/group/([0-9]{1,20})/children$`)
+	reGroupNameChildren = regexp.MustCompile(`^/group/([A-Za-z][0-9A-Za-z]*)/children$`)
+	reGroupName         = regexp.MustCompile(`^[A-Za-z][0-9A-Za-z]*$`)
+	reGroupDescription  = regexp.MustCompile(`^[\pL\pM\pN\pP\pS\pZ]*$`)
 )
 
 type Group struct {
@@ -28,12 +29,17 @@ type Group struct {
 	GroupName   string   `protobuf:"bytes,2,opt,name=group_name" json:"group_name,omitempty"`
 	Description string   `protobuf:"bytes,3,opt,name=description" json:"description,omitempty"`
 	Users       []uint64 `protobuf:"varint,4,rep,name=users" json:"users,omitempty"`
+	Updated     int64    `protobuf:"varint,5,opt,name=updated" json:"updated,omitempty"`
+	ParentId    uint64   `protobuf:"varint,6,opt,name=parent_id" json:"parent_id,omitempty"`
 }
 
 func (m *Group) Reset()         { *m = Group{} }
 func (m *Group) String() string { return proto.CompactTextString(m) }
 func (*Group) ProtoMessage()    {}
 
+// DefaultMaxGroupMembers is the default limit on the size of a group.
+const DefaultMaxGroupMembers = 10000
+
 type GroupLifetime bool
 
 const (
@@ -41,10 +47,27 @@ const (
 	ExistingGroup GroupLifetime = true
 )
 
+// GroupDelta changes a group.  ParentId places the group beneath another in
+// a hierarchy, or at the top if zero; the parent must exist, and must not
+// be the group itself or one of its descendants.  Users replaces the member list outright,
+// while AddUsers and RemoveUsers change it relative to whatever it holds
+// when the change is applied.  Because adding and removing members
+// commute, a PATCH carrying only AddUsers and RemoveUsers may safely omit
+// If-Match: concurrent changes of that kind all take effect, with the
+// last writer winning for any id that is both added and removed.
 type GroupDelta struct {
-	GroupName   *string   `json:"group_name"`
-	Description *string   `json:"description"`
-	Users       *[]uint64 `json:"users"`
+	GroupName   *string `json:"group_name"`
+	Description *string `json:"description"`
+	Users       *IdList `json:"users"`
+	AddUsers    *IdList `json:"add_users"`
+	RemoveUsers *IdList `json:"remove_users"`
+	ParentId    *Id     `json:"parent_id"`
+
+	// maxMembers limits the size of the member list; zero means no limit.
+	maxMembers int
+
+	// reserved holds the names new groups may not take.
+	reserved ReservedNames
 }
 
 func (d *GroupDelta) Validate(lifetime GroupLifetime) error {
@@ -59,6 +82,8 @@ func (d *GroupDelta) Validate(lifetime GroupLifetime) error {
 			return errors.New("Field 'group_name' must be set")
 		case !reGroupName.MatchString(*d.GroupName):
 			return errors.New("Field 'group_name' must start with a letter and consist of letters and numbers")
+		case d.reserved.Contains(*d.GroupName):
+			return &ReservedNameError{Field: "group_name", Name: *d.GroupName}
 		}
 	}
 	if d.Description != nil {
@@ -69,16 +94,100 @@ func (d *GroupDelta) Validate(lifetime GroupLifetime) error {
 			return errors.New("Field 'description' must not contain control characters")
 		}
 	}
-	if d.Users != nil {
-		for _, id := range *d.Users {
+	if d.Users != nil && (d.AddUsers != nil || d.RemoveUsers != nil) {
+		return errors.New("Field 'users' cannot be combined with 'add_users' or 'remove_users'")
+	}
+	for _, field := range []struct {
+		name string
+		ids  *IdList
+	}{{"users", d.Users}, {"add_users", d.AddUsers}, {"remove_users", d.RemoveUsers}} {
+		if field.ids == nil {
+			continue
+		}
+		if d.maxMembers > 0 && len(*field.ids) > d.maxMembers {
+			return &LimitError{Field: field.name, Limit: d.maxMembers}
+		}
+		for _, id := range *field.ids {
 			if id == 0 {
-				return errors.New("Field 'users' must contain valid user IDs")
+				return fmt.Errorf("Field '%s' must contain valid user IDs", field.name)
+			}
+		}
+	}
+	if d.AddUsers != nil && d.RemoveUsers != nil {
+		remove := make(map[uint64]bool, len(*d.RemoveUsers))
+		for _, id := range *d.RemoveUsers {
+			remove[id] = true
+		}
+		for _, id := range *d.AddUsers {
+			if remove[id] {
+				return fmt.Errorf("User %d cannot be both added and removed", id)
+			}
+		}
+	}
+	return nil
+}
+
+// Verify checks the group that results from applying d.
+func (d *GroupDelta) Verify(obj Resource) error {
+	g := obj.(*Group)
+	if d.maxMembers > 0 && len(g.Users) > d.maxMembers {
+		return &LimitError{Field: "users", Limit: d.maxMembers}
+	}
+	if g.ParentId != 0 && g.ParentId == g.Id {
+		return errors.New("Field 'parent_id' must not be the group's own id")
+	}
+	return nil
+}
+
+// Check verifies that g's parent exists and is not g or a descendant of g.
+func (d *GroupDelta) Check(tx *repo.Tx, obj Resource) error {
+	g := obj.(*Group)
+	if d.ParentId == nil || g.ParentId == 0 {
+		return nil
+	}
+	seen := make(map[uint64]bool)
+	for id := g.ParentId; id != 0; {
+		if id == g.Id {
+			return errors.New("Field 'parent_id' must not be the group itself or one of its descendants")
+		}
+		if seen[id] {
+			// An existing loop above g, which g does not join.
+			return nil
+		}
+		seen[id] = true
+		value, err := tx.Get(id)
+		if errors.Is(err, repo.ErrNotFound) {
+			if id == g.ParentId {
+				return errors.New("Field 'parent_id' must refer to an existing group")
 			}
+			return nil
+		}
+		if err != nil {
+			return err
 		}
+		var parent Group
+		MustUnmarshalProto(value, &parent)
+		id = parent.ParentId
 	}
 	return nil
 }
 
+// normalizeMembers returns ids as a set, sorted so that equal memberships
+// store and serialize identically.
+func normalizeMembers(ids []uint64) []uint64 {
+	tmp := make([]uint64, len(ids))
+	copy(tmp, ids)
+	sort.Slice(tmp, func(i, j int) bool { return tmp[i] < tmp[j] })
+	n := 0
+	for i, id := range tmp {
+		if i == 0 || id != tmp[n-1] {
+			tmp[n] = id
+			n++
+		}
+	}
+	return tmp[:n]
+}
+
 func (d *GroupDelta) Apply(g *Group) {
 	if d.GroupName != nil {
 		g.GroupName = *d.GroupName
@@ -86,262 +195,304 @@ func (d *GroupDelta) Apply(g *Group) {
 	if d.Description != nil {
 		g.Description = *d.Description
 	}
+	if d.ParentId != nil {
+		g.ParentId = uint64(*d.ParentId)
+	}
 	if d.Users != nil {
-		tmp := make([]uint64, len(*d.Users))
-		copy(tmp, *d.Users)
-		g.Users = tmp
+		g.Users = normalizeMembers(*d.Users)
+	}
+	if d.AddUsers != nil {
+		g.Users = normalizeMembers(append(g.Users, *d.AddUsers...))
+	}
+	if d.RemoveUsers != nil {
+		remove := make(map[uint64]bool, len(*d.RemoveUsers))
+		for _, id := range *d.RemoveUsers {
+			remove[id] = true
+		}
+		kept := make([]uint64, 0, len(g.Users))
+		for _, id := range g.Users {
+			if !remove[id] {
+				kept = append(kept, id)
+			}
+		}
+		g.Users = kept
 	}
 }
 
-type GroupHandler struct{ Repo *repo.Repo }
+func (m *Group) ResourceId() uint64         { return m.Id }
+func (m *Group) SetResourceId(id uint64)    { m.Id = id }
+func (m *Group) ResourceName() string       { return m.GroupName }
+func (m *Group) ResourceUpdated() int64     { return m.Updated }
+func (m *Group) SetResourceUpdated(t int64) { m.Updated = t }
 
-func (h GroupHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.URL.Path == "/group" || r.URL.Path == "/group/" {
-		if !AllowMethods(w, r, GET, POST) {
-			return
-		}
-		method := strings.ToUpper(r.Method)
-		switch {
-		case method == GET || method == HEAD:
-			h.ListGroups(w, r)
+func (d *GroupDelta) ValidateFor(existing bool) error { return d.Validate(GroupLifetime(existing)) }
+func (d *GroupDelta) ApplyTo(obj Resource)            { d.Apply(obj.(*Group)) }
 
-		case method == POST:
-			h.CreateGroup(w, r)
+type groupKind struct {
+	maxMembers int
+	reparent   bool
+	reserved   ReservedNames
+}
 
-		default:
-			log.Printf("error: not implemented: %s %s", method, r.URL.Path)
-			http.Error(w, "Internal Server Error", 500)
-		}
-		return
-	}
+func (groupKind) Type() repo.ObjectType    { return repo.GROUP }
+func (groupKind) IdPath() *regexp.Regexp   { return reGroupIdPath }
+func (groupKind) NamePath() *regexp.Regexp { return reGroupNamePath }
+func (groupKind) New() Resource            { return &Group{} }
+func (k groupKind) NewDelta() ResourceDelta {
+	return &GroupDelta{maxMembers: k.maxMembers, reserved: k.reserved}
+}
 
-	var groupId uint64
-	var groupName string
-	if m := reGroupIdPath.FindStringSubmatch(r.URL.Path); m != nil {
-		var err error
-		groupId, err = strconv.ParseUint(m[1], 10, 64)
-		if err != nil {
-			log.Printf("error: ParseUint %q 10 64: %v\n", m[1], err)
-			http.NotFound(w, r)
-			return
-		}
+// MayCreate and MayChange let only admins create, change or delete groups.
+func (groupKind) MayCreate(caller *User, obj Resource) bool {
+	return caller != nil && caller.Admin
+}
+func (groupKind) MayChange(caller *User, obj Resource) bool {
+	return caller != nil && caller.Admin
+}
+
+// Remove deals with the children of a group being deleted: it refuses, or
+// if k.reparent is set, moves them to the group's own parent.
+func (k groupKind) Remove(tx *repo.Tx, r *http.Request, actor uint64, obj Resource) error {
+	g := obj.(*Group)
+	children, err := groupChildren(tx, g.Id)
+	if err != nil {
+		return err
 	}
-	if m := reGroupNamePath.FindStringSubmatch(r.URL.Path); m != nil {
-		groupName = m[1]
+	if len(children) == 0 {
+		return nil
 	}
-	if groupId == 0 && groupName == "" {
-		http.NotFound(w, r)
-		return
+	if !k.reparent {
+		return &ConflictError{fmt.Sprintf("Group %d has child groups; move or delete them first", g.Id)}
 	}
-	if !AllowMethods(w, r, GET, PUT, DELETE) {
-		return
+	now := time.Now().Unix()
+	for _, child := range children {
+		child.ParentId = g.ParentId
+		child.Updated = now
+		if err := tx.Put(child.Id, MustMarshalProto(child)); err != nil {
+			return err
+		}
+		if err := Audit(tx, r, actor, child.Id, 200); err != nil {
+			return err
+		}
 	}
-	method := strings.ToUpper(r.Method)
-	switch {
-	case method == GET || method == HEAD:
-		h.GetGroup(w, r, groupId, groupName)
+	return nil
+}
 
-	case method == PUT:
-		h.PutGroup(w, r, groupId, groupName)
+// groupChildren returns the groups whose parent is id, in id order.
+func groupChildren(tx *repo.Tx, id uint64) ([]*Group, error) {
+	var children []*Group
+	err := tx.ForEachDecoded(func() proto.Message {
+		return &Group{}
+	}, func(_ uint64, msg proto.Message, err error) error {
+		if err != nil {
+			return err
+		}
+		if g := msg.(*Group); g.ParentId == id {
+			children = append(children, g)
+		}
+		return nil
+	})
+	return children, err
+}
 
-	case method == DELETE:
-		h.DeleteGroup(w, r, groupId, groupName)
+// GroupHandler serves /group.  Deleting a group that has child groups is
+// refused with 409, unless Reparent is set, in which case the children move
+// to the deleted group's parent.
+type GroupHandler struct {
+	Repo       *repo.Repo
+	Auth       *Authenticator
+	MaxMembers int
+	Reparent   bool
+	Cache      CachePolicy
+	Objects    *ObjectCache
+	ETags      *ETagCache
+	Log        *Logger
 
-	default:
-		log.Printf("error: not implemented: %s %s", method, r.URL.Path)
-		http.Error(w, "Internal Server Error", 500)
-	}
-}
+	// Reserved holds the names new groups may not take.
+	Reserved ReservedNames
 
-func (h GroupHandler) ListGroups(w http.ResponseWriter, r *http.Request) {
-	groupList := make([]Group, 0)
-	err := h.Repo.View(repo.GROUP, func(tx *repo.Tx) error {
-		return tx.ForEach(func(_ uint64, raw []byte) error {
-			var g Group
-			MustUnmarshalProto(raw, &g)
-			groupList = append(groupList, g)
-			return nil
-		})
-	})
-	if err != nil {
-		log.Printf("error: GET /group: %v\n", err)
-		http.Error(w, "Internal Server Error", 500)
-		return
-	}
-	raw := MustMarshalJSON(groupList)
-	w.Header().Set(ContentType, MediaTypeJSON)
-	w.Header().Set(CacheControl, CacheControlPublic)
-	w.Header().Set(ETag, ETagFor(raw))
-	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(raw))
+	// MaxPageSize caps the page size of listings; see ResourceHandler.
+	MaxPageSize int
 }
 
-func (h GroupHandler) CreateGroup(w http.ResponseWriter, r *http.Request) {
-	var delta GroupDelta
-	if !GetJSONBody(w, r, &delta) {
-		return
-	}
-	if err := delta.Validate(NewGroup); err != nil {
-		http.Error(w, err.Error(), 400)
+func (h GroupHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// "tree" is reserved, but a group may have taken the name before it
+	// was.  Reading /group/tree gets the tree; such a group can still be
+	// read by id, and changed or deleted by name.
+	if r.URL.Path == "/group/tree" && (r.Method == GET || r.Method == HEAD || r.Method == OPTIONS) {
+		if !AllowMethods(w, r, GET) {
+			return
+		}
+		h.Tree(w, r)
 		return
 	}
-	var g Group
-	delta.Apply(&g)
-	err := h.Repo.Update(repo.GROUP, func(tx *repo.Tx) error {
+	rh := ResourceHandler{groupKind{h.MaxMembers, h.Reparent, h.Reserved}, h.Repo, h.Auth, h.Cache, h.Objects, h.ETags, h.Log, h.MaxPageSize}
+	var id uint64
+	var name string
+	var children bool
+	if m := reGroupIdChildren.FindStringSubmatch(r.URL.Path); m != nil {
 		var err error
-		g.Id, err = tx.AllocateId()
+		id, err = strconv.ParseUint(m[1], 10, 64)
 		if err != nil {
-			return err
-		}
-		err = tx.Associate(g.Id, g.GroupName)
-		if err != nil {
-			return err
+			h.Log.For(r).Debugf("ParseUint %q 10 64: %v", m[1], err)
+			NotFound(w, r)
+			return
 		}
-		return tx.Put(g.Id, MustMarshalProto(&g))
-	})
-	if _, ok := err.(*repo.DuplicateError); ok {
-		http.Error(w, "There is already a group with that name.", 409)
-		return
+		children = true
 	}
-	if err != nil {
-		log.Printf("error: POST /group: %v", err)
-		http.Error(w, "Internal Server Error", 500)
+	if m := reGroupNameChildren.FindStringSubmatch(r.URL.Path); m != nil {
+		name = m[1]
+		children = true
+	}
+	if children {
+		if !AllowMethods(w, r, GET) {
+			return
+		}
+		h.Children(rh, w, r, id, name)
 		return
 	}
-	raw := MustMarshalJSON(&g)
-	w.Header().Set(ContentLength, fmt.Sprintf("%d", len(raw)))
-	w.Header().Set(ContentType, MediaTypeJSON)
-	w.Header().Set(CacheControl, CacheControlNoCache)
-	w.Header().Set(ETag, ETagFor(raw))
-	w.Header().Set(Location, fmt.Sprintf("/group/%s", g.GroupName))
-	w.WriteHeader(201)
-	w.Write(raw)
+	rh.ServeHTTP(w, r)
 }
 
-func (h GroupHandler) GetGroup(w http.ResponseWriter, r *http.Request, groupId uint64, groupName string) {
-	var g Group
-	err := h.Repo.View(repo.GROUP, func(tx *repo.Tx) error {
-		var err error
-		if groupId == 0 {
-			groupId, err = tx.Lookup(groupName)
-			if err != nil {
-				return err
-			}
-		}
-		value, err := tx.Get(groupId)
+// Children serves GET /group/{ref}/children, the groups whose parent is the
+// given group.
+func (h GroupHandler) Children(rh ResourceHandler, w http.ResponseWriter, r *http.Request, id uint64, name string) {
+	var list []*Group
+	err := h.Repo.ViewContext(r.Context(), repo.GROUP, func(tx *repo.Tx) error {
+		obj, err := rh.load(tx, id, name)
 		if err != nil {
 			return err
 		}
-		MustUnmarshalProto(value, &g)
-		return nil
+		list, err = groupChildren(tx, obj.ResourceId())
+		return err
 	})
-	if _, ok := err.(*repo.NotFoundError); ok {
-		http.NotFound(w, r)
+	if errors.Is(err, repo.ErrNotFound) {
+		NotFound(w, r)
 		return
 	}
 	if err != nil {
-		log.Printf("error: GET /group %d %q: %v\n", groupId, groupName, err)
-		http.Error(w, "Internal Server Error", 500)
+		h.Log.For(r).Errorf("GET /group %d %q children: %v", id, name, err)
+		InternalError(w, r)
 		return
 	}
-	raw := MustMarshalJSON(&g)
-	w.Header().Set(ContentType, MediaTypeJSON)
-	w.Header().Set(CacheControl, CacheControlPublic)
+	if list == nil {
+		list = make([]*Group, 0)
+	}
+	raw, contentType := EncodeJSON(w, r, list, func() *JSONAPIDocument {
+		data := make([]JSONAPIResource, len(list))
+		for i, g := range list {
+			data[i] = rh.jsonAPIResource(g)
+		}
+		return NewJSONAPIList(r.URL.Path, data)
+	})
+	w.Header().Set(ContentType, contentType)
+	w.Header().Set(CacheControl, h.Cache.list())
 	w.Header().Set(ETag, ETagFor(raw))
 	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(raw))
 }
 
-func (h GroupHandler) PutGroup(w http.ResponseWriter, r *http.Request, groupId uint64, groupName string) {
-	var delta GroupDelta
-	if !GetJSONBody(w, r, &delta) {
-		return
-	}
-	if err := delta.Validate(ExistingGroup); err != nil {
-		http.Error(w, err.Error(), 400)
-		return
+// MaxGroupTreeDepth limits how deep GET /group/tree descends.  Groups
+// further down are left out, and their ancestor at the limit is marked
+// Truncated.
+const MaxGroupTreeDepth = 32
+
+// GroupTree is the body of GET /group/tree.  Roots holds the groups with
+// no parent, or whose parent no longer exists, with their descendants
+// nested beneath them.  Groups whose ancestry loops back on itself are
+// reachable from no root, and are listed by id in Cyclic instead.
+type GroupTree struct {
+	Roots  []*GroupTreeNode `json:"roots"`
+	Cyclic []uint64         `json:"cyclic,omitempty"`
+}
+
+type GroupTreeNode struct {
+	*Group
+	Children  []*GroupTreeNode `json:"children,omitempty"`
+	Truncated bool             `json:"truncated,omitempty"`
+}
+
+// BuildGroupTree arranges groups, given in id order, by their ParentId.
+func BuildGroupTree(groups []*Group) *GroupTree {
+	byId := make(map[uint64]*Group, len(groups))
+	for _, g := range groups {
+		byId[g.Id] = g
 	}
-	var g Group
-	var done bool
-	err := h.Repo.Update(repo.GROUP, func(tx *repo.Tx) error {
-		var err error
-		if groupId == 0 {
-			groupId, err = tx.Lookup(groupName)
-			if err != nil {
-				return err
-			}
+	children := make(map[uint64][]*Group)
+	var roots []*Group
+	for _, g := range groups {
+		if _, ok := byId[g.ParentId]; ok && g.ParentId != g.Id {
+			children[g.ParentId] = append(children[g.ParentId], g)
+		} else {
+			roots = append(roots, g)
 		}
-		value, err := tx.Get(groupId)
-		if err != nil {
-			return err
+	}
+
+	reached := make(map[uint64]bool, len(groups))
+	var build func(g *Group, depth int) *GroupTreeNode
+	build = func(g *Group, depth int) *GroupTreeNode {
+		reached[g.Id] = true
+		node := &GroupTreeNode{Group: g}
+		if depth >= MaxGroupTreeDepth {
+			node.Truncated = len(children[g.Id]) > 0
+			return node
 		}
-		MustUnmarshalProto(value, &g)
-		actualETag := ETagFor(MustMarshalJSON(&g))
-		expectETag := r.Header.Get(IfMatch)
-		if expectETag == "" {
-			w.Header().Set(ETag, actualETag)
-			http.Error(w, "Header 'If-Match' is required", 428)
-			done = true
-			return nil
+		for _, child := range children[g.Id] {
+			node.Children = append(node.Children, build(child, depth+1))
 		}
-		if expectETag != actualETag {
-			w.Header().Set(ETag, actualETag)
-			http.Error(w, "ETag mismatch", 412)
-			done = true
-			return nil
+		return node
+	}
+	tree := &GroupTree{Roots: make([]*GroupTreeNode, 0, len(roots))}
+	for _, g := range roots {
+		tree.Roots = append(tree.Roots, build(g, 1))
+	}
+
+	// A group below the depth limit is unreached too, but not cyclic.
+	var mark func(id uint64)
+	mark = func(id uint64) {
+		for _, child := range children[id] {
+			if !reached[child.Id] {
+				reached[child.Id] = true
+				mark(child.Id)
+			}
 		}
-		delta.Apply(&g)
-		return tx.Put(groupId, MustMarshalProto(&g))
-	})
-	if _, ok := err.(*repo.NotFoundError); ok {
-		http.NotFound(w, r)
-		return
 	}
-	if err != nil {
-		log.Printf("error: PUT /group %d %q: %v\n", groupId, groupName, err)
-		http.Error(w, "Internal Server Error", 500)
-		return
+	for _, g := range groups {
+		if reached[g.Id] {
+			mark(g.Id)
+		}
 	}
-	if done {
-		return
+	for _, g := range groups {
+		if !reached[g.Id] {
+			tree.Cyclic = append(tree.Cyclic, g.Id)
+		}
 	}
-	raw := MustMarshalJSON(&g)
-	w.Header().Set(ContentLength, fmt.Sprintf("%d", len(raw)))
-	w.Header().Set(ContentType, MediaTypeJSON)
-	w.Header().Set(CacheControl, CacheControlNoCache)
-	w.Header().Set(ETag, ETagFor(raw))
-	w.WriteHeader(200)
-	w.Write(raw)
+	return tree
 }
 
-func (h GroupHandler) DeleteGroup(w http.ResponseWriter, r *http.Request, groupId uint64, groupName string) {
-	err := h.Repo.Update(repo.GROUP, func(tx *repo.Tx) error {
-		var err error
-		if groupId == 0 {
-			groupId, err = tx.Lookup(groupName)
+// Tree serves GET /group/tree, the groups arranged by parent, read in one
+// transaction.
+func (h GroupHandler) Tree(w http.ResponseWriter, r *http.Request) {
+	var groups []*Group
+	err := h.Repo.ViewContext(r.Context(), repo.GROUP, func(tx *repo.Tx) error {
+		return tx.ForEachDecoded(func() proto.Message {
+			return &Group{}
+		}, func(_ uint64, msg proto.Message, err error) error {
 			if err != nil {
-				return err
+				h.Log.For(r).Errorf("GET /group/tree: skipping: %v", err)
+				return nil
 			}
-		}
-		value, err := tx.Get(groupId)
-		if err != nil {
-			return err
-		}
-		var g Group
-		MustUnmarshalProto(value, &g)
-		err = tx.Delete(groupId)
-		if err != nil {
-			return err
-		}
-		return tx.Unassociate(g.GroupName)
+			groups = append(groups, msg.(*Group))
+			return nil
+		})
 	})
-	if _, ok := err.(*repo.NotFoundError); ok {
-		http.NotFound(w, r)
-		return
-	}
 	if err != nil {
-		log.Printf("error: DELETE /group %d %q: %v\n", groupId, groupName, err)
-		http.Error(w, "Internal Server Error", 500)
+		h.Log.For(r).Errorf("GET /group/tree: %v", err)
+		InternalError(w, r)
 		return
 	}
-	w.Header().Set(ContentLength, "0")
-	w.WriteHeader(204)
+	raw := MarshalJSONFor(r, BuildGroupTree(groups))
+	w.Header().Set(ContentType, MediaTypeJSON)
+	w.Header().Set(CacheControl, h.Cache.list())
+	w.Header().Set(ETag, ETagFor(raw))
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(raw))
 }
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/cloud9-tools/cloud9/repo"
+)
+
+func TestGroupNamedTree(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	h := GroupHandler{Repo: rp, Auth: auth, Reserved: NewReservedNames(DefaultReservedNames)}
+
+	w := serve(h, newTestRequest(POST, "/group", `{"group_name":"Tree"}`), "root")
+	expectStatus(t, w, 409)
+
+	// One made before the name was reserved.
+	err := rp.Update(repo.GROUP, func(tx *repo.Tx) error {
+		id, err := tx.AllocateId()
+		if err != nil {
+			return err
+		}
+		if err := tx.Associate(id, "tree"); err != nil {
+			return err
+		}
+		return tx.Put(id, MustMarshalProto(&Group{Id: id, GroupName: "tree"}))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = serve(h, newTestRequest(GET, "/group/tree", ""), "")
+	expectStatus(t, w, 200)
+	var tree GroupTree
+	if err := json.Unmarshal(w.Body.Bytes(), &tree); err != nil || len(tree.Roots) != 1 {
+		t.Fatalf("GET /group/tree gave %s, want the tree", w.Body.String())
+	}
+	w = serve(h, newTestRequest(PATCH, "/group/tree", `{"description":"old"}`), "root")
+	expectStatus(t, w, 200)
+	w = serve(h, newTestRequest(DELETE, "/group/tree", ""), "root")
+	expectStatus(t, w, 204)
+}
+
+func TestGroupWriteAuthorization(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	addTestUser(t, auth, "alice", false)
+	h := GroupHandler{Repo: rp, Auth: auth}
+	addTestGroups(t, h, 1)
+
+	for _, user := range []string{"", "alice"} {
+		status := 403
+		if user == "" {
+			status = 401
+		}
+		expectStatus(t, serve(h, newTestRequest(POST, "/group", `{"group_name":"g2"}`), user), status)
+		expectStatus(t, serve(h, newTestRequest(PATCH, "/group/g1", `{"description":"x"}`), user), status)
+		r := newTestRequest(PUT, "/group/g1", `{"description":"x"}`)
+		r.Header.Set(IfUnmodifiedSince, "Fri, 01 Jan 2100 00:00:00 GMT")
+		expectStatus(t, serve(h, r, user), status)
+		expectStatus(t, serve(h, newTestRequest(DELETE, "/group/g1", ""), user), status)
+	}
+	expectStatus(t, serve(h, newTestRequest(GET, "/group/g1", ""), ""), 200)
+}
+
+func TestGroupListSkipsUndecodable(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	h := GroupHandler{Repo: rp, Auth: auth, Log: NewLogger(io.Discard, ERROR)}
+	addTestGroups(t, h, 2)
+	err := rp.Update(repo.GROUP, func(tx *repo.Tx) error {
+		id, err := tx.AllocateId()
+		if err != nil {
+			return err
+		}
+		if err := tx.Associate(id, "g0"); err != nil {
+			return err
+		}
+		return tx.Put(id, []byte{0xff, 0xff})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/group", "/group?sort=id"} {
+		w := serve(h, newTestRequest(GET, path, ""), "")
+		expectStatus(t, w, 200)
+		var list []Group
+		if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+			t.Fatal(err)
+		}
+		if len(list) != 2 || list[0].GroupName != "g1" || list[1].GroupName != "g2" {
+			t.Errorf("GET %s listed %s, want g1 and g2", path, w.Body.String())
+		}
+	}
+}
+
+// groupMembers returns the members of the group at path.
+func groupMembers(t *testing.T, h GroupHandler, path string) []uint64 {
+	t.Helper()
+	w := serve(h, newTestRequest(GET, path, ""), "")
+	expectStatus(t, w, 200)
+	var g Group
+	if err := json.Unmarshal(w.Body.Bytes(), &g); err != nil {
+		t.Fatal(err)
+	}
+	return g.Users
+}
+
+func TestGroupMemberLimit(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	h := GroupHandler{Repo: rp, Auth: auth, MaxMembers: 2}
+
+	expectStatus(t, serve(h, newTestRequest(POST, "/group", `{"group_name":"g1","users":[1,2,3]}`), "root"), 422)
+	expectStatus(t, serve(h, newTestRequest(POST, "/group", `{"group_name":"g1","users":[1,2]}`), "root"), 201)
+	expectStatus(t, serve(h, newTestRequest(PATCH, "/group/g1", `{"add_users":[3]}`), "root"), 422)
+	// Members already present do not count twice.
+	expectStatus(t, serve(h, newTestRequest(PATCH, "/group/g1", `{"add_users":[2]}`), "root"), 200)
+	if got := groupMembers(t, h, "/group/g1"); len(got) != 2 {
+		t.Errorf("members are %v, want 2 of them", got)
+	}
+}
+
+func TestGroupMembersDeduplicated(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	h := GroupHandler{Repo: rp, Auth: auth}
+
+	expectStatus(t, serve(h, newTestRequest(POST, "/group", `{"group_name":"g1","users":[1,1,2,1]}`), "root"), 201)
+	if got := groupMembers(t, h, "/group/g1"); len(got) != 2 {
+		t.Errorf("members are %v, want 1 and 2 once each", got)
+	}
+	expectStatus(t, serve(h, newTestRequest(PATCH, "/group/g1", `{"add_users":[2,3,3]}`), "root"), 200)
+	if got := groupMembers(t, h, "/group/g1"); len(got) != 3 {
+		t.Errorf("members are %v, want 1, 2 and 3 once each", got)
+	}
+}
+
+func TestGroupMembersSorted(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	h := GroupHandler{Repo: rp, Auth: auth}
+
+	expectStatus(t, serve(h, newTestRequest(POST, "/group", `{"group_name":"g1","users":[30,10,20]}`), "root"), 201)
+	expectStatus(t, serve(h, newTestRequest(POST, "/group", `{"group_name":"g2","users":[20,30,10]}`), "root"), 201)
+	expectStatus(t, serve(h, newTestRequest(PATCH, "/group/g2", `{"add_users":[5]}`), "root"), 200)
+	if got := fmt.Sprint(groupMembers(t, h, "/group/g1")); got != "[10 20 30]" {
+		t.Errorf("g1 members are %s, want [10 20 30]", got)
+	}
+	if got := fmt.Sprint(groupMembers(t, h, "/group/g2")); got != "[5 10 20 30]" {
+		t.Errorf("g2 members are %s, want [5 10 20 30]", got)
+	}
+}
+
+func TestGroupAddRemoveUsers(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	h := GroupHandler{Repo: rp, Auth: auth}
+	expectStatus(t, serve(h, newTestRequest(POST, "/group", `{"group_name":"g1","users":[1,2]}`), "root"), 201)
+	w := serve(h, newTestRequest(GET, "/group/g1", ""), "")
+	stale := w.Header().Get(ETag)
+
+	// Each applies to what the group holds by then, with no If-Match.
+	expectStatus(t, serve(h, newTestRequest(PATCH, "/group/g1", `{"add_users":[3]}`), "root"), 200)
+	expectStatus(t, serve(h, newTestRequest(PATCH, "/group/g1", `{"remove_users":[1,9]}`), "root"), 200)
+	expectStatus(t, serve(h, newTestRequest(PATCH, "/group/g1", `{"add_users":[4],"remove_users":[2]}`), "root"), 200)
+	if got := fmt.Sprint(groupMembers(t, h, "/group/g1")); got != "[3 4]" {
+		t.Errorf("members are %s, want [3 4]", got)
+	}
+
+	for _, body := range []string{
+		`{"users":[1],"add_users":[2]}`,
+		`{"add_users":[2],"remove_users":[2]}`,
+		`{"remove_users":[0]}`,
+	} {
+		expectStatus(t, serve(h, newTestRequest(PATCH, "/group/g1", body), "root"), 400)
+	}
+	r := newTestRequest(PATCH, "/group/g1", `{"add_users":[5]}`)
+	r.Header.Set(IfMatch, stale)
+	expectStatus(t, serve(h, r, "root"), 412)
+}
+
+func TestGroupParent(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	h := GroupHandler{Repo: rp, Auth: auth}
+	addTestGroups(t, h, 4)
+	children := func(ref string) []uint64 {
+		t.Helper()
+		w := serve(h, newTestRequest(GET, "/group/"+ref+"/children", ""), "")
+		expectStatus(t, w, 200)
+		var list []Group
+		if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+			t.Fatal(err)
+		}
+		ids := make([]uint64, 0, len(list))
+		for _, g := range list {
+			ids = append(ids, g.Id)
+		}
+		return ids
+	}
+
+	// g1 > g2 > g3, and g1 > g4.
+	expectStatus(t, serve(h, newTestRequest(PATCH, "/group/g2", `{"parent_id":1}`), "root"), 200)
+	expectStatus(t, serve(h, newTestRequest(PATCH, "/group/g3", `{"parent_id":2}`), "root"), 200)
+	expectStatus(t, serve(h, newTestRequest(PATCH, "/group/g4", `{"parent_id":1}`), "root"), 200)
+	if got := fmt.Sprint(children("g1")); got != "[2 4]" {
+		t.Errorf("children of g1: %s", got)
+	}
+	if got := fmt.Sprint(children("2")); got != "[3]" {
+		t.Errorf("children of g2: %s", got)
+	}
+	if got := children("g3"); len(got) != 0 {
+		t.Errorf("children of g3: %v", got)
+	}
+	expectStatus(t, serve(h, newTestRequest(GET, "/group/g9/children", ""), ""), 404)
+
+	for _, test := range []struct{ ref, body string }{
+		{"g1", `{"parent_id":1}`},
+		{"g1", `{"parent_id":3}`},
+		{"g2", `{"parent_id":3}`},
+		{"g1", `{"parent_id":99}`},
+	} {
+		w := serve(h, newTestRequest(PATCH, "/group/"+test.ref, test.body), "root")
+		expectStatus(t, w, 400)
+	}
+	expectStatus(t, serve(h, newTestRequest(POST, "/group", `{"group_name":"g5","parent_id":99}`), "root"), 400)
+	expectStatus(t, serve(h, newTestRequest(POST, "/group", `{"group_name":"g5","parent_id":3}`), "root"), 201)
+
+	// Moving g3 to the top is fine.
+	expectStatus(t, serve(h, newTestRequest(PATCH, "/group/g3", `{"parent_id":0}`), "root"), 200)
+	if got := children("g2"); len(got) != 0 {
+		t.Errorf("children of g2 after moving g3: %v", got)
+	}
+}
+
+func TestGroupDeleteParent(t *testing.T) {
+	for _, reparent := range []bool{false, true} {
+		rp := newTestRepo(t)
+		auth := newTestAuth(rp)
+		addTestUser(t, auth, "root", true)
+		h := GroupHandler{Repo: rp, Auth: auth, Reparent: reparent}
+		addTestGroups(t, h, 3)
+		expectStatus(t, serve(h, newTestRequest(PATCH, "/group/g2", `{"parent_id":1}`), "root"), 200)
+		expectStatus(t, serve(h, newTestRequest(PATCH, "/group/g3", `{"parent_id":2}`), "root"), 200)
+
+		w := serve(h, newTestRequest(DELETE, "/group/g2", ""), "root")
+		if !reparent {
+			expectStatus(t, w, 409)
+			continue
+		}
+		expectStatus(t, w, 204)
+		w = serve(h, newTestRequest(GET, "/group/g3", ""), "")
+		expectStatus(t, w, 200)
+		var g Group
+		if err := json.Unmarshal(w.Body.Bytes(), &g); err != nil {
+			t.Fatal(err)
+		}
+		if g.ParentId != 1 {
+			t.Errorf("g3 moved to parent %d, want 1", g.ParentId)
+		}
+	}
+}
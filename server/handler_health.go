@@ -0,0 +1,53 @@
+package server
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/cloud9-tools/cloud9/repo"
+)
+
+// Draining records that the server has begun shutting down.  It starts
+// out false and, once set, stays set.
+type Draining struct{ flag int32 }
+
+func (d *Draining) Set()        { atomic.StoreInt32(&d.flag, 1) }
+func (d *Draining) IsSet() bool { return atomic.LoadInt32(&d.flag) != 0 }
+
+// HealthHandler answers readiness checks at /readyz and /healthz: 200
+// while the server is accepting work, and 503 once it has begun shutting
+// down, so that load balancers stop routing to it while the requests in
+// progress drain.  If Repo is set, as for /readyz, it also answers 503
+// while the repo cannot be read.
+//
+// If Live is set, it answers liveness checks instead, at /livez: 200 even
+// while draining, since a server that is shutting down cleanly should not
+// be restarted.  Liveness never touches the repo, so that a slow disk does
+// not get the server restarted either.
+type HealthHandler struct {
+	Draining *Draining
+	Live     bool
+	Repo     *repo.Repo
+	Log      *Logger
+}
+
+func (h HealthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !AllowMethods(w, r, GET) {
+		return
+	}
+	w.Header().Set(CacheControl, CacheControlNoCache)
+	if !h.Live && h.Draining.IsSet() {
+		http.Error(w, "Shutting down", 503)
+		return
+	}
+	if !h.Live && h.Repo != nil {
+		if err := h.Repo.Ping(r.Context()); err != nil {
+			h.Log.For(r).Warnf("GET %s: %v", r.URL.Path, err)
+			http.Error(w, "Repository unavailable", 503)
+			return
+		}
+	}
+	w.Header().Set(ContentType, MediaTypeText)
+	w.WriteHeader(200)
+	w.Write([]byte("ok\r\n"))
+}
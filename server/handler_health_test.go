@@ -0,0 +1,151 @@
+package server
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHealthHandler(t *testing.T) {
+	rp := newTestRepo(t)
+	var draining Draining
+	ready := HealthHandler{&draining, false, rp, NewLogger(io.Discard, ERROR)}
+	live := HealthHandler{&draining, true, nil, nil}
+
+	expectStatus(t, serve(ready, newTestRequest(GET, "/readyz", ""), ""), 200)
+	expectStatus(t, serve(live, newTestRequest(GET, "/livez", ""), ""), 200)
+	draining.Set()
+	expectStatus(t, serve(ready, newTestRequest(GET, "/readyz", ""), ""), 503)
+	expectStatus(t, serve(live, newTestRequest(GET, "/livez", ""), ""), 200)
+
+	ready.Draining = new(Draining)
+	rp.Close()
+	expectStatus(t, serve(ready, newTestRequest(GET, "/readyz", ""), ""), 503)
+}
+
+func TestPreStopDelay(t *testing.T) {
+	srv, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.Log = NewLogger(io.Discard, ERROR)
+	srv.PreStopDelay = 200 * time.Millisecond
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "http://" + l.Addr().String()
+	errch := make(chan error, 1)
+	go func() { errch <- srv.ServeMulti([]net.Listener{l}, nil) }()
+
+	if status := getStatus(t, url+"/healthz"); status != 200 {
+		t.Errorf("before Stop: /healthz gave %d, want 200", status)
+	}
+	stopped := time.Now()
+	srv.Stop()
+	// Still serving, but no longer ready once Stop has been seen.
+	for status := getStatus(t, url+"/healthz"); status != 503; status = getStatus(t, url+"/healthz") {
+		if time.Since(stopped) > srv.PreStopDelay/2 {
+			t.Fatalf("during the delay: /healthz gave %d, want 503", status)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if status := getStatus(t, url+"/livez"); status != 200 {
+		t.Errorf("during the delay: /livez gave %d, want 200", status)
+	}
+	if err := <-errch; err != nil {
+		t.Errorf("ServeMulti: %v", err)
+	}
+	if d := time.Since(stopped); d < srv.PreStopDelay {
+		t.Errorf("stopped after %v, before the delay of %v", d, srv.PreStopDelay)
+	}
+}
+
+func TestDrainingOnListenerFailure(t *testing.T) {
+	var d Draining
+	if d.IsSet() {
+		t.Error("new Draining is set")
+	}
+	d.Set()
+	d.Set()
+	if !d.IsSet() {
+		t.Error("Draining not set after Set")
+	}
+
+	srv, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.Log = NewLogger(io.Discard, ERROR)
+	srv.ShutdownTimeout = time.Second
+	var ls []net.Listener
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ls = append(ls, l)
+	}
+	errch := make(chan error, 1)
+	go func() { errch <- srv.ServeMulti(ls[:1], ls[1:]) }()
+	if status := getStatus(t, "http://"+ls[0].Addr().String()+"/readyz"); status != 200 {
+		t.Fatalf("/readyz gave %d, want 200", status)
+	}
+	if srv.draining.IsSet() {
+		t.Error("draining while serving")
+	}
+
+	// Losing one listener takes the whole server down, so it is no longer
+	// ready either.
+	ls[1].Close()
+	select {
+	case err := <-errch:
+		if err == nil {
+			t.Error("ServeMulti returned nil after a listener failed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeMulti did not return")
+	}
+	if !srv.draining.IsSet() {
+		t.Error("not draining after a listener failed")
+	}
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	srv, urls := startTestServer(t, 1, 0, nil)
+	check := func(path string, want int) {
+		t.Helper()
+		resp, err := http.Get(urls[0] + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("GET %s gave %d, want %d", path, resp.StatusCode, want)
+		}
+		if got := resp.Header.Get(CacheControl); got != CacheControlNoCache {
+			t.Errorf("GET %s: %s %q, want %q", path, CacheControl, got, CacheControlNoCache)
+		}
+	}
+	for _, path := range []string{"/livez", "/readyz", "/healthz"} {
+		check(path, 200)
+		resp, err := http.Post(urls[0]+path, MediaTypeText, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 405 {
+			t.Errorf("POST %s gave %d, want 405", path, resp.StatusCode)
+		}
+	}
+
+	// Only readiness depends on the repo.
+	srv.Repo.Close()
+	check("/readyz", 503)
+	check("/livez", 200)
+	check("/healthz", 200)
+}
@@ -1,15 +1,21 @@
 package server
 
 import (
-	"log"
 	"net/http"
+
+	"github.com/cloud9-tools/cloud9/repo"
 )
 
-type HomeHandler struct{}
+// HomeHandler serves the home page.  Until the first user is created, it
+// says so instead of greeting.
+type HomeHandler struct {
+	Repo *repo.Repo
+	Log  *Logger
+}
 
 func (h HomeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path != "/" {
-		log.Printf("not found: %q", r.URL.String())
+		h.Log.For(r).Debugf("not found: %q", r.URL.Path)
 		http.NotFound(w, r)
 		return
 	}
@@ -17,5 +23,20 @@ func (h HomeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	var page Page
-	RenderHTML(w, r, "home", &page, CacheControlPrivate)
+	err := h.Repo.ViewContext(r.Context(), repo.USER, func(tx *repo.Tx) error {
+		lastId, err := tx.LastId()
+		page.FirstRun = lastId == 0
+		return err
+	})
+	if err != nil {
+		h.Log.For(r).Errorf("GET /: %v", err)
+		InternalError(w, r)
+		return
+	}
+	// The first-run page must not outlive the creation of the first user.
+	cacheCtrl := CacheControlPrivate
+	if page.FirstRun {
+		cacheCtrl = CacheControlNoCache
+	}
+	RenderHTML(w, r, "home", &page, cacheCtrl)
 }
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestHomeNotFoundLogsPath(t *testing.T) {
+	var buf bytes.Buffer
+	h := HomeHandler{Repo: newTestRepo(t), Log: NewLogger(&buf, DEBUG)}
+	w := serve(h, newTestRequest(GET, "/nowhere?token=sekrit", ""), "")
+	expectStatus(t, w, 404)
+	if got := buf.String(); !strings.Contains(got, `"/nowhere"`) || strings.Contains(got, "sekrit") {
+		t.Errorf("logged %q, want the path alone", got)
+	}
+}
+
+func TestHomeFirstRun(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	h := HomeHandler{Repo: rp}
+	get := func(wantFirstRun bool) {
+		t.Helper()
+		w := serve(h, newTestRequest(GET, "/", ""), "")
+		expectStatus(t, w, 200)
+		body := w.Body.String()
+		if got := strings.Contains(body, "no users yet"); got != wantFirstRun {
+			t.Errorf("first-run prompt shown: %t, want %t", got, wantFirstRun)
+		}
+		if got := strings.Contains(body, "POST /login"); got == wantFirstRun {
+			t.Errorf("login prompt shown: %t, want %t", got, !wantFirstRun)
+		}
+		want := CacheControlPrivate
+		if wantFirstRun {
+			want = CacheControlNoCache
+		}
+		if got := w.Header().Get(CacheControl); got != want {
+			t.Errorf("%s %q, want %q", CacheControl, got, want)
+		}
+	}
+
+	get(true)
+	addTestUser(t, auth, "root", true)
+	get(false)
+
+	// Deleting every user does not make it a fresh install again.
+	expectStatus(t, serve(UserHandler{Repo: rp, Auth: auth}, newTestRequest(DELETE, "/user/root", ""), "root"), 204)
+	get(false)
+}
+
+func TestHomeInternalErrorIsGeneric(t *testing.T) {
+	var buf bytes.Buffer
+	rp := newTestRepo(t)
+	h := HomeHandler{Repo: rp, Log: NewLogger(&buf, DEBUG)}
+	rp.Close()
+	r := newTestRequest(GET, "/", "")
+	r.Header.Set(XRequestId, "abc123")
+	w := serve(RequestIdHandler{h}, r, "")
+	expectStatus(t, w, 500)
+	if got, want := w.Body.String(), "Internal Server Error (request id abc123)\n"; got != want {
+		t.Errorf("got body %q, want %q", got, want)
+	}
+	if buf.Len() == 0 {
+		t.Error("the failure was not logged")
+	}
+}
@@ -0,0 +1,40 @@
+package server
+
+import "net/http"
+
+// ConcurrencyLimitHandler allows at most a fixed number of requests to be in
+// H at once.  Requests beyond that either wait for a slot (if Queue is set)
+// or are turned away with 503.
+type ConcurrencyLimitHandler struct {
+	H     http.Handler
+	Queue bool
+	sem   chan struct{}
+}
+
+func NewConcurrencyLimitHandler(h http.Handler, max int, queue bool) *ConcurrencyLimitHandler {
+	return &ConcurrencyLimitHandler{
+		H:     h,
+		Queue: queue,
+		sem:   make(chan struct{}, max),
+	}
+}
+
+func (handler *ConcurrencyLimitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if handler.Queue {
+		select {
+		case handler.sem <- struct{}{}:
+		case <-r.Context().Done():
+			return
+		}
+	} else {
+		select {
+		case handler.sem <- struct{}{}:
+		default:
+			w.Header().Set(RetryAfter, "1")
+			http.Error(w, "Service Unavailable", 503)
+			return
+		}
+	}
+	defer func() { <-handler.sem }()
+	handler.H.ServeHTTP(w, r)
+}
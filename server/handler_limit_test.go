@@ -0,0 +1,69 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// blockingHandler holds each request until release is closed, signalling on
+// entered as each one comes in.
+type blockingHandler struct {
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (h blockingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.entered <- struct{}{}
+	<-h.release
+	w.WriteHeader(204)
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	for _, queue := range []bool{false, true} {
+		b := blockingHandler{make(chan struct{}, 3), make(chan struct{})}
+		h := NewConcurrencyLimitHandler(b, 2, queue)
+		codes := make(chan int, 3)
+		run := func(ctx context.Context) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, newTestRequest(GET, "/", "").WithContext(ctx))
+			codes <- w.Code
+		}
+		go run(context.Background())
+		go run(context.Background())
+		<-b.entered
+		<-b.entered
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go run(ctx)
+		if !queue {
+			if code := <-codes; code != 503 {
+				t.Errorf("over the limit: got %d, want 503", code)
+			}
+		} else {
+			select {
+			case <-b.entered:
+				t.Errorf("queued request ran over the limit")
+			case <-time.After(10 * time.Millisecond):
+			}
+			cancel()
+			<-codes
+		}
+		cancel()
+		close(b.release)
+		for i := 0; i < 2; i++ {
+			if code := <-codes; code != 204 {
+				t.Errorf("within the limit: got %d, want 204", code)
+			}
+		}
+
+		// The slots are free again.
+		h.H = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(204) })
+		go run(context.Background())
+		if code := <-codes; code != 204 {
+			t.Errorf("after the others finished: got %d, want 204", code)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+)
+
+type LoginHandler struct {
+	Auth *Authenticator
+	Log  *Logger
+}
+
+func (h LoginHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/login" {
+		NotFound(w, r)
+		return
+	}
+	if !AllowMethods(w, r, POST) {
+		return
+	}
+	u, ok := GetCaller(h.Log, h.Auth, w, r)
+	if !ok {
+		return
+	}
+	raw := MarshalJSONFor(r, u)
+	w.Header().Set(ContentLength, fmt.Sprintf("%d", len(raw)))
+	w.Header().Set(ContentType, MediaTypeJSON)
+	w.Header().Set(CacheControl, CacheControlNoCache)
+	w.Header().Set(ETag, ETagFor(raw))
+	w.WriteHeader(200)
+	w.Write(raw)
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestLogin(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "alice", false)
+	h := LoginHandler{Auth: auth}
+
+	expectStatus(t, serve(h, newTestRequest(GET, "/login", ""), "alice"), 405)
+	expectStatus(t, serve(h, newTestRequest(POST, "/login", ""), ""), 401)
+	w := serve(h, newTestRequest(POST, "/login", ""), "alice")
+	expectStatus(t, w, 200)
+	var u User
+	if err := json.Unmarshal(w.Body.Bytes(), &u); err != nil || u.UserName != "alice" {
+		t.Errorf("POST /login gave %s, want alice", w.Body.String())
+	}
+	if len(u.PasswordHash) != 0 {
+		t.Errorf("POST /login gave away the password hash")
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	auth.SetLockout(3, time.Minute)
+	addTestUser(t, auth, "alice", false)
+	addTestUser(t, auth, "bob", false)
+	h := LoginHandler{Auth: auth, Log: NewLogger(io.Discard, ERROR)}
+
+	wrong := func(user string) int {
+		r := newTestRequest(POST, "/login", "")
+		r.SetBasicAuth(user, "not"+testPassword)
+		return serve(h, r, "").Code
+	}
+	// A good password clears the failures so far.
+	wrong("alice")
+	wrong("alice")
+	expectStatus(t, serve(h, newTestRequest(POST, "/login", ""), "alice"), 200)
+	wrong("alice")
+	expectStatus(t, serve(h, newTestRequest(POST, "/login", ""), "alice"), 200)
+
+	for i := 0; i < 3; i++ {
+		if code := wrong("alice"); code != 401 {
+			t.Fatalf("bad password %d gave %d, want 401", i+1, code)
+		}
+	}
+	// Without the password, a locked account looks like any other, and
+	// trying does not lift the lockout.
+	for _, user := range []string{"alice", "nobody"} {
+		if code := wrong(user); code != 401 {
+			t.Errorf("bad password for %s while locked out gave %d, want 401", user, code)
+		}
+	}
+	w := serve(h, newTestRequest(POST, "/login", ""), "alice")
+	expectStatus(t, w, 429)
+	if w.Header().Get(RetryAfter) == "" {
+		t.Errorf("locked out with no %s", RetryAfter)
+	}
+	// Others are not affected.
+	expectStatus(t, serve(h, newTestRequest(POST, "/login", ""), "bob"), 200)
+
+	// Nor is anyone once the lockout is disabled.
+	auth.SetLockout(0, time.Minute)
+	for i := 0; i < 5; i++ {
+		wrong("bob")
+	}
+	expectStatus(t, serve(h, newTestRequest(POST, "/login", ""), "bob"), 200)
+}
@@ -0,0 +1,28 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+// MethodOverrideHandler lets clients stuck behind proxies that only pass GET
+// and POST tunnel other methods through a POST, using the
+// "X-HTTP-Method-Override" header.  A header, unlike a form field, cannot be
+// set by a cross-site HTML form, and reading it leaves the body alone.
+type MethodOverrideHandler struct{ H http.Handler }
+
+var overridableMethods = map[string]bool{
+	PUT:    true,
+	PATCH:  true,
+	DELETE: true,
+}
+
+func (handler MethodOverrideHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.ToUpper(r.Method) == POST {
+		override := strings.ToUpper(strings.TrimSpace(r.Header.Get(XHTTPMethodOverride)))
+		if overridableMethods[override] {
+			r.Method = override
+		}
+	}
+	handler.H.ServeHTTP(w, r)
+}
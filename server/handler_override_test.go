@@ -0,0 +1,59 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMethodOverrideHandler(t *testing.T) {
+	var got string
+	h := MethodOverrideHandler{http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Method
+	})}
+	for _, test := range []struct {
+		method, header, form, want string
+	}{
+		{POST, "", "", POST},
+		{POST, "delete", "", DELETE},
+		{POST, " PATCH ", "", PATCH},
+		{POST, "", "_method=PUT", POST},
+		{POST, "DELETE", "_method=PUT", DELETE},
+		{POST, "GET", "", POST},
+		{POST, "CONNECT", "", POST},
+		{GET, "DELETE", "", GET},
+	} {
+		r := httptest.NewRequest(test.method, "/group/g1", strings.NewReader(test.form))
+		if test.form != "" {
+			r.Header.Set(ContentType, MediaTypeWwwForm)
+		}
+		if test.header != "" {
+			r.Header.Set(XHTTPMethodOverride, test.header)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		if got != test.want {
+			t.Errorf("%s with %q and %q became %s, want %s", test.method, test.header, test.form, got, test.want)
+		}
+	}
+}
+
+func TestMethodOverrideLeavesBody(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	h := MethodOverrideHandler{BlobHandler{repo: rp, Auth: auth}}
+	content := "_method=DELETE&a=b"
+	r := newTestRequest(POST, "/blob", content)
+	r.Header.Set(ContentType, MediaTypeWwwForm)
+	w := serve(h, r, "root")
+	expectStatus(t, w, 201)
+
+	w = serve(h, newTestRequest(GET, w.Header().Get(Location), ""), "root")
+	expectStatus(t, w, 200)
+	body, _ := ioutil.ReadAll(w.Body)
+	if string(body) != content {
+		t.Errorf("stored %q, want %q", body, content)
+	}
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+var reRequestId = regexp.MustCompile(`^[0-9A-Za-z._-]{1,128}$`)
+
+type requestIdKey struct{}
+
+// RequestIdHandler tags each request with an id, taken from the
+// "X-Request-Id" header if the client sent a sane one and generated
+// otherwise.  The id is echoed in the response and included in log lines.
+type RequestIdHandler struct{ H http.Handler }
+
+func (handler RequestIdHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := r.Header.Get(XRequestId)
+	if !reRequestId.MatchString(id) {
+		id = NewRequestId()
+	}
+	w.Header().Set(XRequestId, id)
+	r = r.WithContext(context.WithValue(r.Context(), requestIdKey{}, id))
+	handler.H.ServeHTTP(w, r)
+}
+
+// RequestId returns the id assigned to r by RequestIdHandler, or "".
+func RequestId(r *http.Request) string {
+	id, _ := r.Context().Value(requestIdKey{}).(string)
+	return id
+}
+
+// NewRequestId returns a random (version 4) UUID.
+func NewRequestId() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
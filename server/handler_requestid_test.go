@@ -0,0 +1,95 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var reUUID = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestRequestIdHandler(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(&buf, INFO)
+	var seen string
+	h := RequestIdHandler{http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = RequestId(r)
+		logger.For(r).Infof("hello")
+	})}
+
+	for _, test := range []struct {
+		sent string
+		keep bool
+	}{
+		{"abc-123.X_y", true},
+		{strings.Repeat("a", 128), true},
+		{"", false},
+		{strings.Repeat("a", 129), false},
+		{"a b", false},
+		{"a\nb", false},
+	} {
+		buf.Reset()
+		r := newTestRequest(GET, "/", "")
+		if test.sent != "" {
+			r.Header[XRequestId] = []string{test.sent}
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		got := w.Header().Get(XRequestId)
+		switch {
+		case got != seen:
+			t.Errorf("sent %q: responded with id %q, but the handler saw %q", test.sent, got, seen)
+		case test.keep && got != test.sent:
+			t.Errorf("sent %q: got id %q, want it kept", test.sent, got)
+		case !test.keep && !reUUID.MatchString(got):
+			t.Errorf("sent %q: got id %q, want a new UUID", test.sent, got)
+		}
+		if !strings.Contains(buf.String(), "["+got+"] hello") {
+			t.Errorf("sent %q: logged %q, without the id", test.sent, buf.String())
+		}
+	}
+	if RequestId(newTestRequest(GET, "/", "")) != "" {
+		t.Errorf("RequestId of an untagged request is not empty")
+	}
+	if NewRequestId() == NewRequestId() {
+		t.Errorf("NewRequestId repeated itself")
+	}
+}
+
+func TestErrorsGiveRequestId(t *testing.T) {
+	rp := newTestRepo(t)
+	var log bytes.Buffer
+	h := RequestIdHandler{UserHandler{Repo: rp, Log: NewLogger(&log, ERROR)}}
+
+	// Not found: the JSON body has the id.
+	r := newTestRequest(GET, "/user/7", "")
+	r.Header.Set(XRequestId, "req-404")
+	w := serve(h, r, "")
+	expectStatus(t, w, 404)
+	if body := w.Body.String(); !strings.Contains(body, `"request_id":"req-404"`) || !strings.Contains(body, `"code":"not_found"`) {
+		t.Errorf("404 body %s", body)
+	}
+
+	// Internal error: the body and the log line have the same id.
+	rp.Close()
+	r = newTestRequest(GET, "/user/7", "")
+	r.Header.Set(XRequestId, "req-500")
+	w = serve(h, r, "")
+	expectStatus(t, w, 500)
+	if body := w.Body.String(); !strings.Contains(body, "(request id req-500)") {
+		t.Errorf("500 body %q does not give the request id", body)
+	}
+	if !strings.Contains(log.String(), "[req-500] ") {
+		t.Errorf("log %q does not give the request id", log.String())
+	}
+
+	// Without an id, there is nothing to add.
+	w = httptest.NewRecorder()
+	InternalError(w, newTestRequest(GET, "/", ""))
+	if got := strings.TrimSpace(w.Body.String()); got != "Internal Server Error" {
+		t.Errorf("untagged 500 body %q", got)
+	}
+}
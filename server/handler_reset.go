@@ -0,0 +1,228 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/cloud9-tools/cloud9/repo"
+)
+
+const PasswordResetTokenLifetime = 1 * time.Hour
+
+type PasswordResetRequest struct {
+	EMail *string `json:"email"`
+}
+
+type PasswordResetConfirm struct {
+	Token    *string `json:"token"`
+	Password *string `json:"password"`
+}
+
+type PasswordResetHandler struct {
+	Repo     *repo.Repo
+	Auth     *Authenticator
+	Notifier Notifier
+	Limiter  *RateLimiter
+	Log      *Logger
+
+	// PublicURL is the base of the links in reset messages; without it,
+	// resets are refused.  See CloudServer.PublicURL.
+	PublicURL string
+}
+
+func (h PasswordResetHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/password-reset/request":
+		if !AllowMethods(w, r, POST) {
+			return
+		}
+		h.RequestReset(w, r)
+
+	case "/password-reset/confirm":
+		if !AllowMethods(w, r, POST) {
+			return
+		}
+		h.ConfirmReset(w, r)
+
+	default:
+		NotFound(w, r)
+	}
+}
+
+// RequestReset mails a reset token to every user with the given e-mail
+// address.  To avoid revealing which addresses are registered, it always
+// answers 202 and sends the mail in the background; but if h.PublicURL is
+// unset, there is no link to send, and it answers 503.
+func (h PasswordResetHandler) RequestReset(w http.ResponseWriter, r *http.Request) {
+	var req PasswordResetRequest
+	if !GetJSONBody(h.Log, w, r, &req) {
+		return
+	}
+	if req.EMail == nil || !reEMail.MatchString(*req.EMail) {
+		http.Error(w, "Field 'email' must be a valid e-mail address", 400)
+		return
+	}
+	if h.PublicURL == "" {
+		h.Log.For(r).Errorf("POST /password-reset/request: no public URL is configured for the link")
+		http.Error(w, "Password reset is not available", 503)
+		return
+	}
+	if !AllowAuthAttempt(h.Limiter, w, r, *req.EMail) {
+		return
+	}
+	// Matching users are found by reading them all, which takes only the
+	// read lock; the write lock is held just to store their tokens.
+	var matches []uint64
+	err := h.Repo.ViewContext(r.Context(), repo.USER, func(tx *repo.Tx) error {
+		return tx.ForEachDecoded(func() proto.Message {
+			return &User{}
+		}, func(id uint64, msg proto.Message, err error) error {
+			if err != nil {
+				h.Log.For(r).Errorf("POST /password-reset/request: skipping: %v", err)
+				return nil
+			}
+			if u := msg.(*User); strings.EqualFold(u.EMail, *req.EMail) {
+				matches = append(matches, id)
+			}
+			return nil
+		})
+	})
+	type reset struct {
+		u     User
+		token string
+	}
+	var resets []reset
+	if err == nil && len(matches) > 0 {
+		err = h.Repo.UpdateContext(r.Context(), repo.USER, func(tx *repo.Tx) error {
+			resets = nil
+			return tx.GetEach(matches, func(id uint64, value []byte, err error) error {
+				if errors.Is(err, repo.ErrNotFound) {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				var u User
+				MustUnmarshalProto(value, &u)
+				if !strings.EqualFold(u.EMail, *req.EMail) {
+					// Changed since it was found.
+					return nil
+				}
+				token, t, err := NewToken(u.Id, u.EMail, PasswordResetTokenLifetime)
+				if err != nil {
+					return err
+				}
+				if err := tx.As(repo.RESET).Put(u.Id, MustMarshalProto(t)); err != nil {
+					return err
+				}
+				resets = append(resets, reset{u, token})
+				return nil
+			})
+		})
+	}
+	if err != nil {
+		h.Log.For(r).Errorf("POST /password-reset/request: %v", err)
+		InternalError(w, r)
+		return
+	}
+	base := strings.TrimSuffix(h.PublicURL, "/")
+	go (func() {
+		for _, x := range resets {
+			body := fmt.Sprintf("Hello %s,\r\n\r\nTo choose a new password, POST the following token to %s/password-reset/confirm:\r\n\r\n%s\r\n\r\nThis token expires in %v.  If you did not ask to reset your password, you can ignore this message.\r\n", x.u.UserName, base, x.token, PasswordResetTokenLifetime)
+			if err := h.Notifier.Send(x.u.EMail, "Reset your password", body); err != nil {
+				h.Log.For(r).Errorf("POST /password-reset/request: user %d: %v", x.u.Id, err)
+			}
+		}
+	})()
+	w.Header().Set(ContentLength, "0")
+	w.WriteHeader(202)
+}
+
+func (h PasswordResetHandler) ConfirmReset(w http.ResponseWriter, r *http.Request) {
+	var req PasswordResetConfirm
+	if !GetJSONBody(h.Log, w, r, &req) {
+		return
+	}
+	if req.Token == nil {
+		http.Error(w, "Field 'token' must be set", 400)
+		return
+	}
+	if req.Password == nil {
+		http.Error(w, "Field 'password' must be set", 400)
+		return
+	}
+	if err := ValidatePassword("password", *req.Password); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	userId, secret, err := ParseToken(*req.Token)
+	if err != nil {
+		http.Error(w, "Invalid or expired token", 400)
+		return
+	}
+	// Limit guesses at each user's token as well as from each address,
+	// since an attacker may have many addresses.  No name or e-mail
+	// address looks like this key.
+	if !AllowAuthAttempt(h.Limiter, w, r, fmt.Sprintf("#%d", userId)) {
+		return
+	}
+	hash, err := h.Auth.HashPassword(*req.Password)
+	if err != nil {
+		h.Log.For(r).Errorf("POST /password-reset/confirm %d: %v", userId, err)
+		InternalError(w, r)
+		return
+	}
+	now := time.Now()
+	var invalid bool
+	err = h.Repo.UpdateContext(r.Context(), repo.USER, func(tx *repo.Tx) error {
+		value, err := tx.As(repo.RESET).Get(userId)
+		if err != nil {
+			return err
+		}
+		var t Token
+		MustUnmarshalProto(value, &t)
+		value, err = tx.Get(userId)
+		if err != nil {
+			return err
+		}
+		var u User
+		MustUnmarshalProto(value, &u)
+		if !t.Check(secret, now) || t.EMail != u.EMail {
+			invalid = true
+			return nil
+		}
+		u.PasswordHash = hash
+		if err := tx.Put(userId, MustMarshalProto(&u)); err != nil {
+			return err
+		}
+		err = tx.As(repo.LOCKOUT).Delete(userId)
+		if err != nil && !errors.Is(err, repo.ErrNotFound) {
+			return err
+		}
+		err = tx.As(repo.RESET).Delete(userId)
+		if err != nil {
+			return err
+		}
+		return Audit(tx, r, userId, userId, 204)
+	})
+	if errors.Is(err, repo.ErrNotFound) {
+		invalid = true
+		err = nil
+	}
+	if err != nil {
+		h.Log.For(r).Errorf("POST /password-reset/confirm %d: %v", userId, err)
+		InternalError(w, r)
+		return
+	}
+	if invalid {
+		http.Error(w, "Invalid or expired token", 400)
+		return
+	}
+	w.Header().Set(ContentLength, "0")
+	w.WriteHeader(204)
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var reTestToken = regexp.MustCompile(`\b[0-9]+\.[A-Za-z0-9_-]{32}`)
+
+func TestPasswordReset(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "alice", false)
+	n := make(testNotifier, 1)
+	h := PasswordResetHandler{Repo: rp, Auth: auth, Notifier: n, PublicURL: "https://cloud9.example.com/"}
+
+	r := newTestRequest(POST, "/password-reset/request", `{"email":"ALICE@example.com"}`)
+	r.Host = "attacker.example.net"
+	expectStatus(t, serve(h, r, ""), 202)
+	m := expectMessage(t, n)
+	if m.To != "alice@example.com" {
+		t.Errorf("reset mailed to %q", m.To)
+	}
+	if !strings.Contains(m.Body, "https://cloud9.example.com/password-reset/confirm") || strings.Contains(m.Body, "attacker") {
+		t.Errorf("reset message does not link to the public URL: %q", m.Body)
+	}
+	token := reTestToken.FindString(m.Body)
+
+	// Unknown addresses get the same answer, and no mail.
+	expectStatus(t, serve(h, newTestRequest(POST, "/password-reset/request", `{"email":"nobody@example.com"}`), ""), 202)
+
+	body := `{"token":"` + token + `","password":"brandnewpassword"}`
+	expectStatus(t, serve(h, newTestRequest(POST, "/password-reset/confirm", body), ""), 204)
+	expectStatus(t, serve(h, newTestRequest(POST, "/password-reset/confirm", body), ""), 400)
+	select {
+	case m := <-n:
+		t.Errorf("unexpected message to %s", m.To)
+	default:
+	}
+}
+
+func TestPasswordResetNeedsPublicURL(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "alice", false)
+	n := make(testNotifier, 1)
+	h := PasswordResetHandler{Repo: rp, Auth: auth, Notifier: n}
+
+	r := newTestRequest(POST, "/password-reset/request", `{"email":"alice@example.com"}`)
+	expectStatus(t, serve(h, r, ""), 503)
+	if len(n) != 0 {
+		t.Error("reset mailed without a public URL")
+	}
+}
+
+func TestPasswordResetConfirmLimit(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	alice := addTestUser(t, auth, "alice", false)
+	h := PasswordResetHandler{Repo: rp, Auth: auth, Limiter: NewRateLimiter(3, time.Hour)}
+
+	// Each guess comes from a new address, but they are all at alice's token.
+	body := fmt.Sprintf(`{"token":"%d.%s","password":"brandnewpassword"}`, alice.Id, strings.Repeat("A", 32))
+	for i := 0; i < 4; i++ {
+		r := newTestRequest(POST, "/password-reset/confirm", body)
+		r.RemoteAddr = fmt.Sprintf("192.0.2.%d:1234", 10+i)
+		status := 400
+		if i == 3 {
+			status = 429
+		}
+		expectStatus(t, serve(h, r, ""), status)
+	}
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/cloud9-tools/cloud9/repo"
+)
+
+// Resolution is the body of GET /resolve.
+type Resolution struct {
+	Id uint64 `json:"id"`
+}
+
+// ResolveHandler serves GET /resolve?type=user&name=alice, which looks a
+// user or group up by name and returns just its id.  Names match without
+// regard to case, as they do in paths.
+type ResolveHandler struct {
+	Repo *repo.Repo
+	Log  *Logger
+}
+
+func (h ResolveHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/resolve" {
+		NotFound(w, r)
+		return
+	}
+	if !AllowMethods(w, r, GET) {
+		return
+	}
+	query := r.URL.Query()
+	var ot repo.ObjectType
+	switch query.Get("type") {
+	case "user":
+		ot = repo.USER
+	case "group":
+		ot = repo.GROUP
+	default:
+		http.Error(w, "Parameter 'type' must be 'user' or 'group'", 400)
+		return
+	}
+	name := query.Get("name")
+	if name == "" {
+		http.Error(w, "Parameter 'name' is required", 400)
+		return
+	}
+	var result Resolution
+	err := h.Repo.ViewContext(r.Context(), ot, func(tx *repo.Tx) error {
+		var err error
+		result.Id, err = tx.Lookup(name)
+		return err
+	})
+	if errors.Is(err, repo.ErrNotFound) {
+		NotFound(w, r)
+		return
+	}
+	if err != nil {
+		h.Log.For(r).Errorf("GET /resolve %s %q: %v", ot, name, err)
+		InternalError(w, r)
+		return
+	}
+	raw := MarshalJSONFor(r, &result)
+	w.Header().Set(ContentType, MediaTypeJSON)
+	w.Header().Set(CacheControl, CacheControlNoCache)
+	w.Header().Set(ETag, ETagFor(raw))
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(raw))
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	alice := addTestUser(t, auth, "Alice", false)
+	addTestGroups(t, GroupHandler{Repo: rp, Auth: auth}, 2)
+	h := ResolveHandler{Repo: rp}
+
+	for _, test := range []struct {
+		query string
+		id    uint64
+	}{
+		{"type=user&name=Alice", alice.Id},
+		{"type=user&name=alice", alice.Id},
+		{"type=user&name=ALICE", alice.Id},
+		{"type=group&name=g2", 2},
+		{"type=group&name=G1", 1},
+	} {
+		w := serve(h, newTestRequest(GET, "/resolve?"+test.query, ""), "")
+		expectStatus(t, w, 200)
+		var got Resolution
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Id != test.id {
+			t.Errorf("GET /resolve?%s gave %d, want %d", test.query, got.Id, test.id)
+		}
+	}
+
+	for _, test := range []struct {
+		query  string
+		status int
+	}{
+		{"type=user&name=bob", 404},
+		{"type=group&name=alice", 404},
+		{"type=user&name=g1", 404},
+		{"type=blob&name=alice", 400},
+		{"name=alice", 400},
+		{"type=user", 400},
+	} {
+		expectStatus(t, serve(h, newTestRequest(GET, "/resolve?"+test.query, ""), ""), test.status)
+	}
+	expectStatus(t, serve(h, newTestRequest(POST, "/resolve?type=user&name=alice", ""), ""), 405)
+	expectStatus(t, serve(h, newTestRequest(GET, "/resolve/alice", ""), ""), 404)
+}
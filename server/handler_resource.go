@@ -0,0 +1,1029 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/cloud9-tools/cloud9/repo"
+)
+
+// Resource is an object that ResourceHandler can serve: a protobuf record
+// with an id, a unique name and a modification time (in Unix seconds, zero
+// if unknown), kept in its kind's bucket.
+type Resource interface {
+	proto.Message
+	ResourceId() uint64
+	SetResourceId(id uint64)
+	ResourceName() string
+	ResourceUpdated() int64
+	SetResourceUpdated(t int64)
+}
+
+// lastModified returns obj's modification time for http.ServeContent,
+// which omits "Last-Modified" for the zero time.
+func lastModified(obj Resource) time.Time {
+	if t := obj.ResourceUpdated(); t != 0 {
+		return time.Unix(t, 0)
+	}
+	return time.Time{}
+}
+
+// ResourceDelta is a partial update decoded from a JSON request body.
+type ResourceDelta interface {
+	ValidateFor(existing bool) error
+	ApplyTo(obj Resource)
+}
+
+// LimitError is returned by ResourceDelta.ValidateFor when a field is well
+// formed but too large to accept.  It is answered with 422 rather than 400.
+type LimitError struct {
+	Field string
+	Limit int
+}
+
+func (err *LimitError) Error() string {
+	return fmt.Sprintf("Field '%s' must have at most %d entries", err.Field, err.Limit)
+}
+
+// ReservedNameError is returned by ResourceDelta.ValidateFor when a new
+// object asks for a reserved name.  It is answered with 409, as though the
+// name were taken.
+type ReservedNameError struct {
+	Field string
+	Name  string
+}
+
+func (err *ReservedNameError) Error() string {
+	return fmt.Sprintf("Field '%s' must not be %q, which is reserved", err.Field, err.Name)
+}
+
+// validationStatus returns the status for a ResourceDelta validation error.
+func validationStatus(err error) int {
+	var limitErr *LimitError
+	var reservedErr *ReservedNameError
+	switch {
+	case errors.As(err, &limitErr):
+		return 422
+	case errors.As(err, &reservedErr):
+		return 409
+	}
+	return 400
+}
+
+// DefaultReservedNames are the names of the server's own paths, and others
+// likely to be mistaken for something official.
+var DefaultReservedNames = []string{
+	"admin", "administrator", "api", "blob", "children", "events", "group", "healthz",
+	"livez", "login", "me", "readyz", "resolve", "root", "system", "tree",
+	"uploads", "user", "verify",
+}
+
+// ReservedNames is a set of names that new users and groups may not take,
+// compared without regard to case.  A nil ReservedNames reserves nothing.
+type ReservedNames map[string]bool
+
+func NewReservedNames(names []string) ReservedNames {
+	rn := make(ReservedNames, len(names))
+	for _, name := range names {
+		if name = strings.TrimSpace(name); name != "" {
+			rn[strings.ToLower(name)] = true
+		}
+	}
+	return rn
+}
+
+func (rn ReservedNames) Contains(name string) bool {
+	return rn[strings.ToLower(name)]
+}
+
+// ResourceKind describes one kind of Resource: the bucket it lives in, the
+// paths that name one object, and how to allocate objects and deltas.
+// IdPath and NamePath must each capture the id or name as their first
+// submatch.
+type ResourceKind interface {
+	Type() repo.ObjectType
+	IdPath() *regexp.Regexp
+	NamePath() *regexp.Regexp
+	New() Resource
+	NewDelta() ResourceDelta
+}
+
+// ResourceVerifier is implemented by deltas whose validity depends on the
+// object they are applied to.  Verify is called after ApplyTo and before
+// the object is stored.
+type ResourceVerifier interface {
+	Verify(obj Resource) error
+}
+
+// ResourceChecker is implemented by deltas whose validity depends on other
+// objects of the same type.  Check is called after Verify, within the
+// transaction that stores obj; an error prevents the change and is answered
+// as a validation error.
+type ResourceChecker interface {
+	Check(tx *repo.Tx, obj Resource) error
+}
+
+// ResourceRemover is implemented by kinds that must tidy up other objects of
+// the same type when one is deleted.  Remove is called within the deleting
+// transaction, before obj is deleted; a *ConflictError prevents the
+// deletion.
+type ResourceRemover interface {
+	Remove(tx *repo.Tx, r *http.Request, actor uint64, obj Resource) error
+}
+
+// ConflictError is returned by ResourceRemover.Remove when an object cannot
+// be deleted as things stand.  It is answered with 409.
+type ConflictError struct {
+	Message string
+}
+
+func (err *ConflictError) Error() string { return err.Message }
+
+// ResourceAuthorizer is implemented by kinds whose objects not everyone may
+// create or change.  The caller is nil for a request without credentials.
+// MayCreate is called within the transaction that creates obj, once it has
+// its id, and MayChange within the one that changes or deletes it.  Kinds
+// without it may be changed by anyone.
+type ResourceAuthorizer interface {
+	MayCreate(caller *User, obj Resource) bool
+	MayChange(caller *User, obj Resource) bool
+}
+
+// ResourcePreparer is implemented by kinds that must finish a new object
+// before it is stored, outside the transaction.
+type ResourcePreparer interface {
+	Prepare(delta ResourceDelta, obj Resource) error
+}
+
+// ResourceInitializer is implemented by kinds whose new objects depend on
+// what is already stored.  Initialize is called within the transaction that
+// stores obj, after any checks, and may change obj.
+type ResourceInitializer interface {
+	Initialize(tx *repo.Tx, obj Resource) error
+}
+
+// MaxMultiGetIds limits how many objects one GET or DELETE
+// /<type>?ids=... may name.
+const MaxMultiGetIds = 100
+
+// MultiGetResult is the body of GET /<type>?ids=...: the objects found, in
+// the order asked for, and the ids of any that were not.
+type MultiGetResult struct {
+	Found   []Resource `json:"found"`
+	Missing []uint64   `json:"missing"`
+}
+
+// BulkDeleteResult is the body of DELETE /<type>?ids=...: the outcome for
+// each id, in the order given, as the status a single DELETE would have
+// had.  For a dry run, GET /<type>?ids=...&dry_run=1, the outcomes are
+// those the deletion would have had just then, and Confirm is the token
+// that allows it.
+type BulkDeleteResult struct {
+	Results []BulkDeleteItem `json:"results"`
+	DryRun  bool             `json:"dry_run,omitempty"`
+	Confirm string           `json:"confirm,omitempty"`
+}
+
+// errDryRun rolls back the transaction of a dry run.
+var errDryRun = errors.New("dry run")
+
+// errDenied rolls back the transaction of a creation that
+// ResourceAuthorizer.MayCreate refuses.
+var errDenied = errors.New("denied")
+
+type BulkDeleteItem struct {
+	Id     uint64 `json:"id"`
+	Status int    `json:"status"`
+}
+
+// ResourceHandler serves the collection at "/<type>" (GET lists, or with
+// "?ids=1,2,3" gets the objects with those ids; POST creates; DELETE with
+// "?ids=" deletes several objects at once, for admins, after a dry run with
+// GET; see BulkDelete) and the objects at "/<type>/<id>" and
+// "/<type>/<name>" (GET, PUT, PATCH, DELETE).  PUT and PATCH both merge
+// the fields present in the body into the object.  PUT requires a precondition, either If-Match or
+// If-Unmodified-Since, while PATCH only checks one when it is given.  If
+// both are given, If-Match decides.
+//
+// Each request reads or writes in a single repo transaction, and a write
+// is committed before its response is sent.  So a client that has seen a
+// write succeed will see its effect in every later request, whether it
+// looks the object up by id, by name or in the list.  That holds with an
+// ObjectCache and ETagCache too, since the repo drops changed objects from
+// them before the write's Update returns.
+type ResourceHandler struct {
+	Kind    ResourceKind
+	Repo    *repo.Repo
+	Auth    *Authenticator
+	Cache   CachePolicy
+	Objects *ObjectCache
+	ETags   *ETagCache
+	Log     *Logger
+
+	// MaxPageSize, if positive, caps the limit a listing may ask for;
+	// see List.
+	MaxPageSize int
+}
+
+// DefaultMaxPageSize is the default for ResourceHandler.MaxPageSize.
+const DefaultMaxPageSize = 1000
+
+func (h ResourceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	base := "/" + h.Kind.Type().String()
+	if r.URL.Path == base || r.URL.Path == base+"/" {
+		if !AllowMethods(w, r, GET, POST, DELETE) {
+			return
+		}
+		method := strings.ToUpper(r.Method)
+		switch {
+		case (method == GET || method == HEAD) && r.URL.Query().Get("ids") != "" && boolParam(r, "dry_run"):
+			h.BulkDelete(w, r, true)
+
+		case (method == GET || method == HEAD) && r.URL.Query().Get("ids") != "":
+			h.MultiGet(w, r)
+
+		case method == GET || method == HEAD:
+			h.List(w, r)
+
+		case method == POST:
+			h.Create(w, r)
+
+		case method == DELETE:
+			h.BulkDelete(w, r, false)
+
+		default:
+			h.Log.For(r).Errorf("not implemented: %s %s", method, r.URL.Path)
+			InternalError(w, r)
+		}
+		return
+	}
+
+	id, name, ok := h.ParsePath(w, r)
+	if !ok {
+		return
+	}
+	if !AllowMethods(w, r, GET, PUT, PATCH, DELETE) {
+		return
+	}
+	method := strings.ToUpper(r.Method)
+	switch {
+	case method == GET || method == HEAD:
+		h.Get(w, r, id, name)
+
+	case method == PUT:
+		h.Put(w, r, id, name)
+
+	case method == PATCH:
+		h.Patch(w, r, id, name)
+
+	case method == DELETE:
+		h.Delete(w, r, id, name)
+
+	default:
+		h.Log.For(r).Errorf("not implemented: %s %s", method, r.URL.Path)
+		InternalError(w, r)
+	}
+}
+
+// ParsePath extracts the id or name of the object r refers to.  If neither
+// path matches, it responds 404 and returns false.
+func (h ResourceHandler) ParsePath(w http.ResponseWriter, r *http.Request) (uint64, string, bool) {
+	if m := h.Kind.IdPath().FindStringSubmatch(r.URL.Path); m != nil {
+		id, err := strconv.ParseUint(m[1], 10, 64)
+		if err != nil {
+			h.Log.For(r).Debugf("ParseUint %q 10 64: %v", m[1], err)
+			NotFound(w, r)
+			return 0, "", false
+		}
+		return id, "", true
+	}
+	if m := h.Kind.NamePath().FindStringSubmatch(r.URL.Path); m != nil {
+		return 0, m[1], true
+	}
+	NotFound(w, r)
+	return 0, "", false
+}
+
+// load reads the object with the given id, or with the given name if id is
+// zero, within tx.
+func (h ResourceHandler) load(tx *repo.Tx, id uint64, name string) (Resource, error) {
+	var err error
+	if id == 0 {
+		id, err = tx.Lookup(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	value, err := tx.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	obj := h.Kind.New()
+	MustUnmarshalProto(value, obj)
+	return obj, nil
+}
+
+// encode marshals obj for the response to r; see EncodeJSON.
+func (h ResourceHandler) encode(w http.ResponseWriter, r *http.Request, obj Resource) ([]byte, string) {
+	return EncodeJSON(w, r, obj, func() *JSONAPIDocument {
+		return NewJSONAPIItem(h.jsonAPIResource(obj))
+	})
+}
+
+// ResourceETag returns the ETag of obj, computed over its compact JSON
+// encoding whatever form a response gives it in, so that a client may send
+// it in If-Match whether it read the object pretty-printed, with string
+// ids or as JSON:API.
+func ResourceETag(obj Resource) string {
+	return ETagFor(MustMarshalJSON(obj))
+}
+
+func (h ResourceHandler) jsonAPIResource(obj Resource) JSONAPIResource {
+	ot := h.Kind.Type().String()
+	return NewJSONAPIResource(ot, obj.ResourceId(), fmt.Sprintf("/%s/%d", ot, obj.ResourceId()), obj)
+}
+
+// List serves GET /<type>: every object, in id order, or in name order
+// (ignoring case) with "?sort=name".  With "?name_prefix=", it lists only
+// those whose names start with the prefix, ignoring case, in name order
+// unless "?sort=id" is given.  Name order is read from the name index, not
+// sorted in memory, and a prefix costs in proportion to the matches rather
+// than to all objects.
+//
+// With "?limit=", it returns one page of at most that many objects; a
+// "Link" header then gives the first page and, if there may be more, the
+// next, whose "?after=" is the id or lower-case name of the last object
+// on this page.  "X-Total-Count" always gives the number of objects
+// listed across all pages.
+//
+// A limit above h.MaxPageSize is quietly lowered to it.  Whenever the
+// listing is paged, "X-Page-Size" gives the limit applied; a client that
+// sees one smaller than it asked for was capped, and should follow the
+// "next" link for the rest.  Without "?limit=", the listing is not paged,
+// as before there were pages, and holds every object.
+func (h ResourceHandler) List(w http.ResponseWriter, r *http.Request) {
+	ot := h.Kind.Type()
+	list := make([]Resource, 0)
+	ctx := r.Context()
+	q := r.URL.Query()
+	prefix := q.Get("name_prefix")
+	order := q.Get("sort")
+	switch order {
+	case "":
+		order = "id"
+		if prefix != "" {
+			order = "name"
+		}
+	case "id", "name":
+	default:
+		http.Error(w, "Parameter 'sort' must be id or name", 400)
+		return
+	}
+	limit := 0
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			http.Error(w, "Parameter 'limit' must be a positive integer", 400)
+			return
+		}
+		limit = n
+	}
+	if h.MaxPageSize > 0 && limit > h.MaxPageSize {
+		limit = h.MaxPageSize
+	}
+	after := q.Get("after")
+	var afterId uint64
+	if after != "" && order == "id" {
+		var err error
+		afterId, err = strconv.ParseUint(after, 10, 64)
+		if err != nil {
+			http.Error(w, "Parameter 'after' must be an id", 400)
+			return
+		}
+	}
+	after = strings.ToLower(after)
+
+	// One object past the page tells whether there is a next one.
+	more := false
+	full := func() bool {
+		if limit > 0 && len(list) > limit {
+			list, more = list[:limit], true
+			return true
+		}
+		return false
+	}
+	var total int
+	err := h.Repo.ViewContext(r.Context(), ot, func(tx *repo.Tx) error {
+		add := func(_ uint64, msg proto.Message, err error) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err != nil {
+				h.Log.For(r).Errorf("GET /%s: skipping: %v", ot, err)
+				return nil
+			}
+			list = append(list, msg.(Resource))
+			if full() {
+				return repo.ErrStopIteration
+			}
+			return nil
+		}
+		decode := func(id uint64, raw []byte) error {
+			obj := h.Kind.New()
+			if err := proto.Unmarshal(raw, obj); err != nil {
+				return add(id, nil, &repo.DecodeError{Type: ot, Id: id, Err: err})
+			}
+			return add(id, obj, nil)
+		}
+		get := func(_ string, id uint64) error {
+			raw, err := tx.Get(id)
+			if err != nil {
+				return err
+			}
+			return decode(id, raw)
+		}
+		var err error
+		switch {
+		case prefix == "":
+			total, err = tx.Count()
+		default:
+			err = tx.ForEachName(prefix, func(string, uint64) error {
+				total++
+				return nil
+			})
+		}
+		if err != nil {
+			return err
+		}
+		switch {
+		case prefix == "" && order == "id":
+			return tx.Scan(afterId, 0, decode)
+		case order == "id":
+			// Matching names are not in id order, so gather their ids
+			// first.
+			var ids []uint64
+			err := tx.ForEachName(prefix, func(_ string, id uint64) error {
+				if id > afterId {
+					ids = append(ids, id)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+			return tx.GetEach(ids, func(id uint64, raw []byte, err error) error {
+				if err != nil {
+					return err
+				}
+				return decode(id, raw)
+			})
+		default:
+			return tx.ForEachNameAfter(prefix, after, get)
+		}
+	})
+	if err != nil && ctx.Err() != nil {
+		h.Log.For(r).Debugf("GET /%s: client went away: %v", ot, err)
+		return
+	}
+	if err != nil {
+		h.Log.For(r).Errorf("GET /%s: %v", ot, err)
+		InternalError(w, r)
+		return
+	}
+	raw, contentType := EncodeJSON(w, r, list, func() *JSONAPIDocument {
+		data := make([]JSONAPIResource, len(list))
+		for i, obj := range list {
+			data[i] = h.jsonAPIResource(obj)
+		}
+		return NewJSONAPIList("/"+ot.String(), data)
+	})
+	if limit > 0 {
+		var links []string
+		links = append(links, pageLink(r, "", "first"))
+		if more {
+			last := list[len(list)-1]
+			cursor := strconv.FormatUint(last.ResourceId(), 10)
+			if order == "name" {
+				cursor = strings.ToLower(last.ResourceName())
+			}
+			links = append(links, pageLink(r, cursor, "next"))
+		}
+		w.Header().Set(Link, strings.Join(links, ", "))
+		w.Header().Set(XPageSize, strconv.Itoa(limit))
+	}
+	w.Header().Set(XTotalCount, strconv.Itoa(total))
+	w.Header().Set(ContentType, contentType)
+	w.Header().Set(CacheControl, h.Cache.list())
+	// The ETag covers the bytes sent, after filtering, ordering and
+	// paging, so it changes with every parameter that changes them.
+	// Caches key on the whole URL, query included, so only the request
+	// headers EncodeJSON negotiates on need to be in Vary.  The paging
+	// headers are not covered, but a 304 carries fresh ones.
+	w.Header().Set(ETag, ETagFor(raw))
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(raw))
+}
+
+// pageLink formats a "Link" header entry for the page of r's listing that
+// follows cursor, or for the first page if cursor is "".
+func pageLink(r *http.Request, cursor, rel string) string {
+	q := r.URL.Query()
+	q.Del("after")
+	if cursor != "" {
+		q.Set("after", cursor)
+	}
+	u := url.URL{Path: r.URL.Path, RawQuery: q.Encode()}
+	return fmt.Sprintf("<%s>; rel=%q", u.String(), rel)
+}
+
+// parseIds returns the distinct ids listed in r's "ids" parameter, in
+// order.  If the list is missing, malformed or too long, it responds 400
+// and returns false.
+func parseIds(w http.ResponseWriter, r *http.Request) ([]uint64, bool) {
+	param := r.URL.Query().Get("ids")
+	if param == "" {
+		http.Error(w, "Parameter 'ids' is required", 400)
+		return nil, false
+	}
+	var ids []uint64
+	seen := make(map[uint64]bool)
+	for _, s := range strings.Split(param, ",") {
+		id, err := strconv.ParseUint(strings.TrimSpace(s), 10, 64)
+		if err != nil || id == 0 {
+			http.Error(w, "Parameter 'ids' must be a comma-separated list of ids", 400)
+			return nil, false
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) > MaxMultiGetIds {
+		http.Error(w, fmt.Sprintf("Parameter 'ids' must list at most %d ids", MaxMultiGetIds), 400)
+		return nil, false
+	}
+	return ids, true
+}
+
+// MultiGet serves GET /<type>?ids=..., reading all the objects in one
+// transaction.
+func (h ResourceHandler) MultiGet(w http.ResponseWriter, r *http.Request) {
+	ot := h.Kind.Type()
+	ids, ok := parseIds(w, r)
+	if !ok {
+		return
+	}
+	result := MultiGetResult{Found: make([]Resource, 0, len(ids)), Missing: make([]uint64, 0)}
+	err := h.Repo.ViewContext(r.Context(), ot, func(tx *repo.Tx) error {
+		return tx.GetEach(ids, func(id uint64, value []byte, err error) error {
+			if errors.Is(err, repo.ErrNotFound) {
+				result.Missing = append(result.Missing, id)
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			obj := h.Kind.New()
+			MustUnmarshalProto(value, obj)
+			result.Found = append(result.Found, obj)
+			return nil
+		})
+	})
+	if err != nil {
+		h.Log.For(r).Errorf("GET /%s ids: %v", ot, err)
+		InternalError(w, r)
+		return
+	}
+	raw, contentType := EncodeJSON(w, r, &result, func() *JSONAPIDocument {
+		data := make([]JSONAPIResource, len(result.Found))
+		for i, obj := range result.Found {
+			data[i] = h.jsonAPIResource(obj)
+		}
+		strs := make([]string, len(ids))
+		for i, id := range ids {
+			strs[i] = strconv.FormatUint(id, 10)
+		}
+		self := fmt.Sprintf("/%s?ids=%s", ot, strings.Join(strs, ","))
+		return &JSONAPIDocument{
+			Data:  data,
+			Links: map[string]string{"self": self},
+			Meta:  map[string]interface{}{"missing": result.Missing},
+		}
+	})
+	w.Header().Set(ContentType, contentType)
+	w.Header().Set(CacheControl, h.Cache.list())
+	w.Header().Set(ETag, ETagFor(raw))
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(raw))
+}
+
+func (h ResourceHandler) Create(w http.ResponseWriter, r *http.Request) {
+	ot := h.Kind.Type()
+	caller, ok := GetOptionalCaller(h.Log, h.Auth, w, r)
+	if !ok {
+		return
+	}
+	delta := h.Kind.NewDelta()
+	if !GetJSONBody(h.Log, w, r, delta) {
+		return
+	}
+	if err := delta.ValidateFor(false); err != nil {
+		http.Error(w, err.Error(), validationStatus(err))
+		return
+	}
+	obj := h.Kind.New()
+	delta.ApplyTo(obj)
+	if v, ok := delta.(ResourceVerifier); ok {
+		if err := v.Verify(obj); err != nil {
+			http.Error(w, err.Error(), validationStatus(err))
+			return
+		}
+	}
+	obj.SetResourceUpdated(time.Now().Unix())
+	if p, ok := h.Kind.(ResourcePreparer); ok {
+		if err := p.Prepare(delta, obj); err != nil {
+			h.Log.For(r).Errorf("POST /%s: %v", ot, err)
+			InternalError(w, r)
+			return
+		}
+	}
+	actor := UserId(caller)
+	var checkErr error
+	err := h.Repo.UpdateContext(r.Context(), ot, func(tx *repo.Tx) error {
+		id, err := tx.AllocateId()
+		if err != nil {
+			return err
+		}
+		obj.SetResourceId(id)
+		if a, ok := h.Kind.(ResourceAuthorizer); ok && !a.MayCreate(caller, obj) {
+			return errDenied
+		}
+		if c, ok := delta.(ResourceChecker); ok {
+			if checkErr = c.Check(tx, obj); checkErr != nil {
+				return checkErr
+			}
+		}
+		if i, ok := h.Kind.(ResourceInitializer); ok {
+			if err := i.Initialize(tx, obj); err != nil {
+				return err
+			}
+		}
+		err = tx.Associate(id, obj.ResourceName())
+		if err != nil {
+			return err
+		}
+		err = tx.Put(id, MustMarshalProto(obj))
+		if err != nil {
+			return err
+		}
+		return Audit(tx, r, actor, id, 201)
+	})
+	if errors.Is(err, errDenied) {
+		Deny(w, caller)
+		return
+	}
+	if errors.Is(err, repo.ErrDuplicate) {
+		http.Error(w, fmt.Sprintf("There is already a %s with that name.", ot), 409)
+		return
+	}
+	if checkErr != nil && errors.Is(err, checkErr) {
+		http.Error(w, err.Error(), validationStatus(err))
+		return
+	}
+	if err != nil {
+		h.Log.For(r).Errorf("POST /%s: %v", ot, err)
+		InternalError(w, r)
+		return
+	}
+	raw, contentType := h.encode(w, r, obj)
+	w.Header().Set(ContentLength, fmt.Sprintf("%d", len(raw)))
+	w.Header().Set(ContentType, contentType)
+	w.Header().Set(CacheControl, CacheControlNoCache)
+	w.Header().Set(ETag, ResourceETag(obj))
+	w.Header().Set(Location, fmt.Sprintf("/%s/%s", ot, obj.ResourceName()))
+	w.WriteHeader(201)
+	w.Write(raw)
+}
+
+func (h ResourceHandler) Get(w http.ResponseWriter, r *http.Request, id uint64, name string) {
+	ot := h.Kind.Type()
+	mediaType := NegotiateJSON(w, r)
+	objects, etags := h.Objects, h.ETags
+	if WantPretty(r) || WantStringIds(r) {
+		// The caches hold only the default encodings.
+		objects, etags = nil, nil
+	}
+	if inm := r.Header.Get(IfNoneMatch); inm != "" && id != 0 {
+		if etag, ok := etags.Get(ot, id, mediaType); ok && MatchETag(inm, etag) {
+			w.Header().Set(CacheControl, h.Cache.object())
+			w.Header().Set(ETag, etag)
+			w.WriteHeader(304)
+			return
+		}
+	}
+	if raw, etag, modified, ok := objects.Get(ot, id, name, mediaType); ok {
+		h.serveObject(w, r, raw, mediaType, etag, modified)
+		return
+	}
+	gen := objects.Generation()
+	etagGen := etags.Generation()
+	var obj Resource
+	err := h.Repo.ViewContext(r.Context(), ot, func(tx *repo.Tx) error {
+		var err error
+		obj, err = h.load(tx, id, name)
+		return err
+	})
+	if errors.Is(err, repo.ErrNotFound) {
+		NotFound(w, r)
+		return
+	}
+	if err != nil {
+		h.Log.For(r).Errorf("GET /%s %d %q: %v", ot, id, name, err)
+		InternalError(w, r)
+		return
+	}
+	raw, contentType := h.encode(w, r, obj)
+	etag := ResourceETag(obj)
+	objects.Add(gen, ot, obj, contentType, raw, etag)
+	etags.Add(etagGen, ot, obj.ResourceId(), contentType, etag)
+	h.serveObject(w, r, raw, contentType, etag, lastModified(obj))
+}
+
+func (h ResourceHandler) serveObject(w http.ResponseWriter, r *http.Request, raw []byte, contentType, etag string, modified time.Time) {
+	w.Header().Set(ContentType, contentType)
+	w.Header().Set(CacheControl, h.Cache.object())
+	w.Header().Set(ETag, etag)
+	http.ServeContent(w, r, "", modified, bytes.NewReader(raw))
+}
+
+func (h ResourceHandler) Put(w http.ResponseWriter, r *http.Request, id uint64, name string) {
+	h.update(w, r, id, name, true)
+}
+
+func (h ResourceHandler) Patch(w http.ResponseWriter, r *http.Request, id uint64, name string) {
+	h.update(w, r, id, name, false)
+}
+
+func (h ResourceHandler) update(w http.ResponseWriter, r *http.Request, id uint64, name string, requirePrecondition bool) {
+	ot := h.Kind.Type()
+	caller, ok := GetOptionalCaller(h.Log, h.Auth, w, r)
+	if !ok {
+		return
+	}
+	delta := h.Kind.NewDelta()
+	if !GetJSONBody(h.Log, w, r, delta) {
+		return
+	}
+	if err := delta.ValidateFor(true); err != nil {
+		http.Error(w, err.Error(), validationStatus(err))
+		return
+	}
+	var obj Resource
+	var done bool
+	actor := UserId(caller)
+	err := h.Repo.UpdateContext(r.Context(), ot, func(tx *repo.Tx) error {
+		var err error
+		obj, err = h.load(tx, id, name)
+		if err != nil {
+			return err
+		}
+		if a, ok := h.Kind.(ResourceAuthorizer); ok && !a.MayChange(caller, obj) {
+			Deny(w, caller)
+			done = true
+			return nil
+		}
+		actualETag := ResourceETag(obj)
+		expectETag := r.Header.Get(IfMatch)
+		since, sinceErr := http.ParseTime(r.Header.Get(IfUnmodifiedSince))
+		switch {
+		case expectETag != "":
+			if expectETag != actualETag {
+				w.Header().Set(ETag, actualETag)
+				http.Error(w, "ETag mismatch", 412)
+				done = true
+				return nil
+			}
+		case sinceErr == nil:
+			if obj.ResourceUpdated() == 0 || obj.ResourceUpdated() > since.Unix() {
+				w.Header().Set(ETag, actualETag)
+				if t := lastModified(obj); !t.IsZero() {
+					w.Header().Set(LastModified, t.UTC().Format(http.TimeFormat))
+				}
+				http.Error(w, "Modified since "+since.UTC().Format(http.TimeFormat), 412)
+				done = true
+				return nil
+			}
+		case requirePrecondition:
+			w.Header().Set(ETag, actualETag)
+			http.Error(w, "Header 'If-Match' or 'If-Unmodified-Since' is required", 428)
+			done = true
+			return nil
+		}
+		delta.ApplyTo(obj)
+		if v, ok := delta.(ResourceVerifier); ok {
+			if err := v.Verify(obj); err != nil {
+				http.Error(w, err.Error(), validationStatus(err))
+				done = true
+				return nil
+			}
+		}
+		if c, ok := delta.(ResourceChecker); ok {
+			if err := c.Check(tx, obj); err != nil {
+				http.Error(w, err.Error(), validationStatus(err))
+				done = true
+				return nil
+			}
+		}
+		obj.SetResourceUpdated(time.Now().Unix())
+		err = tx.Put(obj.ResourceId(), MustMarshalProto(obj))
+		if err != nil {
+			return err
+		}
+		return Audit(tx, r, actor, obj.ResourceId(), 200)
+	})
+	if errors.Is(err, repo.ErrNotFound) {
+		NotFound(w, r)
+		return
+	}
+	if err != nil {
+		h.Log.For(r).Errorf("%s /%s %d %q: %v", r.Method, ot, id, name, err)
+		InternalError(w, r)
+		return
+	}
+	if done {
+		return
+	}
+	raw, contentType := h.encode(w, r, obj)
+	w.Header().Set(ContentLength, fmt.Sprintf("%d", len(raw)))
+	w.Header().Set(ContentType, contentType)
+	w.Header().Set(CacheControl, CacheControlNoCache)
+	w.Header().Set(ETag, ResourceETag(obj))
+	w.Header().Set(LastModified, lastModified(obj).UTC().Format(http.TimeFormat))
+	w.WriteHeader(200)
+	w.Write(raw)
+}
+
+func (h ResourceHandler) Delete(w http.ResponseWriter, r *http.Request, id uint64, name string) {
+	ot := h.Kind.Type()
+	caller, ok := GetOptionalCaller(h.Log, h.Auth, w, r)
+	if !ok {
+		return
+	}
+	actor := UserId(caller)
+	var denied bool
+	err := h.Repo.UpdateContext(r.Context(), ot, func(tx *repo.Tx) error {
+		obj, err := h.load(tx, id, name)
+		if err != nil {
+			return err
+		}
+		if a, ok := h.Kind.(ResourceAuthorizer); ok && !a.MayChange(caller, obj) {
+			denied = true
+			return nil
+		}
+		if rm, ok := h.Kind.(ResourceRemover); ok {
+			if err := rm.Remove(tx, r, actor, obj); err != nil {
+				return err
+			}
+		}
+		err = tx.Delete(obj.ResourceId())
+		if err != nil {
+			return err
+		}
+		err = tx.Unassociate(obj.ResourceName())
+		if err != nil {
+			return err
+		}
+		return Audit(tx, r, actor, obj.ResourceId(), 204)
+	})
+	if errors.Is(err, repo.ErrNotFound) {
+		NotFound(w, r)
+		return
+	}
+	var conflict *ConflictError
+	if errors.As(err, &conflict) {
+		http.Error(w, conflict.Error(), 409)
+		return
+	}
+	if err != nil {
+		h.Log.For(r).Errorf("DELETE /%s %d %q: %v", ot, id, name, err)
+		InternalError(w, r)
+		return
+	}
+	if denied {
+		Deny(w, caller)
+		return
+	}
+	w.Header().Set(ContentLength, "0")
+	w.WriteHeader(204)
+}
+
+// BulkDelete serves DELETE /<type>?ids=..., deleting the objects and their
+// names in one transaction.  Only admins may use it.  Ids with no object
+// are reported as 404 without preventing the other deletions.
+//
+// So that a script cannot delete by mistake, it takes two requests.  A dry
+// run, GET /<type>?ids=...&dry_run=1, deletes nothing; the response gives
+// the outcomes the deletion would have, and a confirmation token.  The
+// DELETE with "&confirm=<token>" then deletes.  The token is good once,
+// for ConfirmationTokenLifetime, for the same caller and the same ids.
+func (h ResourceHandler) BulkDelete(w http.ResponseWriter, r *http.Request, dryRun bool) {
+	ot := h.Kind.Type()
+	caller, ok := GetCaller(h.Log, h.Auth, w, r)
+	if !ok {
+		return
+	}
+	if !caller.Admin {
+		http.Error(w, "Forbidden", 403)
+		return
+	}
+	ids, ok := parseIds(w, r)
+	if !ok {
+		return
+	}
+	confirm := r.URL.Query().Get("confirm")
+	if !dryRun && confirm == "" {
+		http.Error(w, "Parameter 'confirm' must be the token from a dry run of this request; GET it with the same 'ids' and 'dry_run=1'", 400)
+		return
+	}
+	strIds := make([]string, len(ids))
+	for i, id := range ids {
+		strIds[i] = strconv.FormatUint(id, 10)
+	}
+	operation := fmt.Sprintf("DELETE /%s?ids=%s", ot, strings.Join(strIds, ","))
+	var result BulkDeleteResult
+	err := h.Repo.UpdateContext(r.Context(), ot, func(tx *repo.Tx) error {
+		if !dryRun {
+			if err := UseConfirmation(tx, confirm, caller.Id, operation); err != nil {
+				return err
+			}
+		}
+		result.Results = make([]BulkDeleteItem, 0, len(ids))
+		for _, id := range ids {
+			obj, err := h.load(tx, id, "")
+			if errors.Is(err, repo.ErrNotFound) {
+				result.Results = append(result.Results, BulkDeleteItem{id, 404})
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if rm, ok := h.Kind.(ResourceRemover); ok {
+				err := rm.Remove(tx, r, caller.Id, obj)
+				var conflict *ConflictError
+				if errors.As(err, &conflict) {
+					result.Results = append(result.Results, BulkDeleteItem{id, 409})
+					continue
+				}
+				if err != nil {
+					return err
+				}
+			}
+			if err := tx.Delete(id); err != nil {
+				return err
+			}
+			if err := tx.Unassociate(obj.ResourceName()); err != nil {
+				return err
+			}
+			if err := Audit(tx, r, caller.Id, id, 204); err != nil {
+				return err
+			}
+			result.Results = append(result.Results, BulkDeleteItem{id, 204})
+		}
+		if dryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if errors.Is(err, errDryRun) {
+		err = h.Repo.UpdateContext(r.Context(), repo.CONFIRMATION, func(tx *repo.Tx) error {
+			var err error
+			result.Confirm, err = NewConfirmation(tx, caller.Id, operation)
+			return err
+		})
+		result.DryRun = true
+	}
+	if errors.Is(err, ErrBadConfirmation) {
+		http.Error(w, "Parameter 'confirm' must be an unused, unexpired token from a dry run of this request", 400)
+		return
+	}
+	if err != nil {
+		h.Log.For(r).Errorf("%s /%s ids: %v", r.Method, ot, err)
+		InternalError(w, r)
+		return
+	}
+	raw := MarshalJSONFor(r, &result)
+	w.Header().Set(ContentLength, fmt.Sprintf("%d", len(raw)))
+	w.Header().Set(ContentType, MediaTypeJSON)
+	w.Header().Set(CacheControl, CacheControlNoCache)
+	w.WriteHeader(200)
+	w.Write(raw)
+}
@@ -0,0 +1,532 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloud9-tools/cloud9/repo"
+)
+
+// addTestGroups creates groups named g1 to gn through h.
+func addTestGroups(t *testing.T, h GroupHandler, n int) {
+	t.Helper()
+	for i := 1; i <= n; i++ {
+		body := fmt.Sprintf(`{"group_name":"g%d"}`, i)
+		expectStatus(t, serve(h, newTestRequest(POST, "/group", body), "root"), 201)
+	}
+}
+
+func TestListPaging(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	h := GroupHandler{Repo: rp, Auth: auth}
+	addTestGroups(t, h, 5)
+
+	path := "/group?limit=2"
+	var names []string
+	for pages := 0; path != ""; pages++ {
+		if pages > 3 {
+			t.Fatal("too many pages")
+		}
+		w := serve(h, newTestRequest(GET, path, ""), "")
+		expectStatus(t, w, 200)
+		if got := w.Header().Get(XTotalCount); got != "5" {
+			t.Errorf("%s: %s is %q, want 5", path, XTotalCount, got)
+		}
+		if got := w.Header().Get(XPageSize); got != "2" {
+			t.Errorf("%s: %s is %q, want 2", path, XPageSize, got)
+		}
+		link := w.Header().Get(Link)
+		if !strings.Contains(link, `</group?limit=2>; rel="first"`) {
+			t.Errorf("%s: %s is %q, with no first page", path, Link, link)
+		}
+		var page []Group
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+		for _, g := range page {
+			names = append(names, g.GroupName)
+		}
+		path = ""
+		if i := strings.Index(link, `>; rel="next"`); i >= 0 {
+			path = link[strings.LastIndex(link[:i], "<")+1 : i]
+		}
+	}
+	if got := strings.Join(names, ","); got != "g1,g2,g3,g4,g5" {
+		t.Errorf("listed %s across the pages", got)
+	}
+
+	// Deleting keeps the total up to date.
+	expectStatus(t, serve(h, newTestRequest(DELETE, "/group/g3", ""), "root"), 204)
+	w := serve(h, newTestRequest(GET, "/group", ""), "")
+	if got := w.Header().Get(XTotalCount); got != "4" {
+		t.Errorf("%s is %q after a delete, want 4", XTotalCount, got)
+	}
+}
+
+func TestListMaxPageSize(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	h := GroupHandler{Repo: rp, Auth: auth, MaxPageSize: 2}
+	addTestGroups(t, h, 3)
+
+	w := serve(h, newTestRequest(GET, "/group?limit=100", ""), "")
+	expectStatus(t, w, 200)
+	var page []Group
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 2 || w.Header().Get(XPageSize) != "2" {
+		t.Errorf("limit=100 gave %d groups and %s %q, want 2 and 2", len(page), XPageSize, w.Header().Get(XPageSize))
+	}
+	if link := w.Header().Get(Link); !strings.Contains(link, `rel="next"`) {
+		t.Errorf("capped page has %s %q, with no next page", Link, link)
+	}
+
+	// Unpaged listings are not capped.
+	w = serve(h, newTestRequest(GET, "/group", ""), "")
+	expectStatus(t, w, 200)
+	page = nil
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 3 || w.Header().Get(XPageSize) != "" {
+		t.Errorf("unpaged listing gave %d groups and %s %q, want 3 and none", len(page), XPageSize, w.Header().Get(XPageSize))
+	}
+}
+
+func TestListClientGone(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	var buf bytes.Buffer
+	h := GroupHandler{Repo: rp, Auth: auth, Log: NewLogger(&buf, DEBUG)}
+	addTestGroups(t, h, 3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w := serve(h, newTestRequest(GET, "/group", "").WithContext(ctx), "")
+	if w.Body.Len() != 0 {
+		t.Errorf("responded %d %q to a client that went away", w.Code, w.Body.String())
+	}
+	if got := buf.String(); !strings.Contains(got, "client went away") || strings.Contains(got, "error: ") {
+		t.Errorf("logged %q, want the client going away at debug level", got)
+	}
+}
+
+func TestReadYourWrites(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	h := GroupHandler{Repo: rp, Auth: auth}
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 8; i++ {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			w := serve(h, newTestRequest(POST, "/group", `{"group_name":"`+name+`"}`), "root")
+			if w.Code != 201 {
+				t.Errorf("POST %s: got status %d", name, w.Code)
+				return
+			}
+			var g Group
+			if err := json.Unmarshal(w.Body.Bytes(), &g); err != nil {
+				t.Error(err)
+				return
+			}
+			for _, path := range []string{fmt.Sprintf("/group/%d", g.Id), "/group/" + name} {
+				if w := serve(h, newTestRequest(GET, path, ""), ""); w.Code != 200 {
+					t.Errorf("GET %s right after creating it: got status %d", path, w.Code)
+				}
+			}
+			w = serve(h, newTestRequest(GET, "/group", ""), "")
+			if !strings.Contains(w.Body.String(), `"`+name+`"`) {
+				t.Errorf("%s missing from the list right after creating it: %s", name, w.Body.String())
+			}
+		}(fmt.Sprintf("g%d", i))
+	}
+	wg.Wait()
+}
+
+func TestIfMatchAnyEncoding(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	h := GroupHandler{Repo: rp, Auth: auth}
+	addTestGroups(t, h, 1)
+
+	for i, c := range []struct{ query, accept string }{
+		{"", ""},
+		{"?pretty", ""},
+		{"?string_ids", ""},
+		{"", MediaTypeJSONAPI},
+	} {
+		r := newTestRequest(GET, "/group/g1"+c.query, "")
+		if c.accept != "" {
+			r.Header.Set(Accept, c.accept)
+		}
+		w := serve(h, r, "")
+		expectStatus(t, w, 200)
+		etag := w.Header().Get(ETag)
+
+		r = newTestRequest(PATCH, "/group/g1", fmt.Sprintf(`{"description":"version %d"}`, i))
+		r.Header.Set(IfMatch, etag)
+		w = serve(h, r, "root")
+		expectStatus(t, w, 200)
+		if w.Header().Get(ETag) == etag {
+			t.Errorf("ETag %s unchanged by PATCH", etag)
+		}
+	}
+}
+
+func TestPatchMerge(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	h := GroupHandler{Repo: rp, Auth: auth}
+	expectStatus(t, serve(h, newTestRequest(POST, "/group", `{"group_name":"g1","description":"first"}`), "root"), 201)
+	w := serve(h, newTestRequest(GET, "/group/g1", ""), "")
+	stale := w.Header().Get(ETag)
+
+	expectStatus(t, serve(h, newTestRequest(PUT, "/group/g1", `{"description":"put"}`), "root"), 428)
+	w = serve(h, newTestRequest(PATCH, "/group/g1", `{"description":"patched"}`), "root")
+	expectStatus(t, w, 200)
+	var g Group
+	if err := json.Unmarshal(w.Body.Bytes(), &g); err != nil {
+		t.Fatal(err)
+	}
+	if g.GroupName != "g1" || g.Description != "patched" {
+		t.Errorf("PATCH gave %s, want g1 with the new description", w.Body.String())
+	}
+
+	r := newTestRequest(PATCH, "/group/g1", `{"description":"stale"}`)
+	r.Header.Set(IfMatch, stale)
+	w = serve(h, r, "root")
+	expectStatus(t, w, 412)
+	current := w.Header().Get(ETag)
+	r = newTestRequest(PATCH, "/group/g1", `{"description":"current"}`)
+	r.Header.Set(IfMatch, current)
+	expectStatus(t, serve(h, r, "root"), 200)
+}
+
+func TestIfUnmodifiedSince(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	h := GroupHandler{Repo: rp, Auth: auth}
+	before := time.Now().Add(-time.Minute)
+	addTestGroups(t, h, 1)
+
+	w := serve(h, newTestRequest(GET, "/group/g1", ""), "")
+	expectStatus(t, w, 200)
+	modified, err := http.ParseTime(w.Header().Get(LastModified))
+	if err != nil || modified.Before(before.Truncate(time.Second)) {
+		t.Fatalf("%s is %q, want about now", LastModified, w.Header().Get(LastModified))
+	}
+
+	put := func(since time.Time) *httptest.ResponseRecorder {
+		r := newTestRequest(PUT, "/group/g1", `{"description":"new"}`)
+		r.Header.Set(IfUnmodifiedSince, since.UTC().Format(http.TimeFormat))
+		return serve(h, r, "root")
+	}
+	w = put(before)
+	expectStatus(t, w, 412)
+	if w.Header().Get(LastModified) == "" {
+		t.Errorf("412 with no %s", LastModified)
+	}
+	expectStatus(t, put(time.Now().Add(time.Minute)), 200)
+
+	// A group stored before update times were kept is never unmodified.
+	err = rp.Update(repo.GROUP, func(tx *repo.Tx) error {
+		id, err := tx.Lookup("g1")
+		if err != nil {
+			return err
+		}
+		return tx.Put(id, MustMarshalProto(&Group{Id: id, GroupName: "g1"}))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, put(time.Now().Add(time.Minute)), 412)
+}
+
+func TestMultiGet(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	alice := addTestUser(t, auth, "alice", false)
+	bob := addTestUser(t, auth, "bob", false)
+	h := UserHandler{Repo: rp, Auth: auth}
+
+	path := fmt.Sprintf("/user?ids=%d,999,%d,%d", bob.Id, alice.Id, bob.Id)
+	w := serve(h, newTestRequest(GET, path, ""), "alice")
+	expectStatus(t, w, 200)
+	var result struct {
+		Found   []User   `json:"found"`
+		Missing []uint64 `json:"missing"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Found) != 2 || result.Found[0].UserName != "bob" || result.Found[1].UserName != "alice" {
+		t.Errorf("GET %s found %s, want bob then alice", path, w.Body.String())
+	}
+	if len(result.Missing) != 1 || result.Missing[0] != 999 {
+		t.Errorf("GET %s missed %v, want [999]", path, result.Missing)
+	}
+
+	tooMany := make([]string, MaxMultiGetIds+1)
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprint(i + 1)
+	}
+	for _, ids := range []string{"1,x", "1,,2", "-1", strings.Join(tooMany, ",")} {
+		expectStatus(t, serve(h, newTestRequest(GET, "/user?ids="+ids, ""), "alice"), 400)
+	}
+}
+
+func TestBulkDeleteConfirmation(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	addTestUser(t, auth, "alice", false)
+	h := GroupHandler{Repo: rp, Auth: auth}
+	addTestGroups(t, h, 3)
+
+	expectStatus(t, serve(h, newTestRequest(DELETE, "/group?ids=1,2,9", ""), "root"), 400)
+	expectStatus(t, serve(h, newTestRequest(GET, "/group?ids=1,2,9&dry_run=1", ""), "alice"), 403)
+
+	w := serve(h, newTestRequest(GET, "/group?ids=1,2,9&dry_run=1", ""), "root")
+	expectStatus(t, w, 200)
+	var preview BulkDeleteResult
+	if err := json.Unmarshal(w.Body.Bytes(), &preview); err != nil {
+		t.Fatal(err)
+	}
+	if !preview.DryRun || preview.Confirm == "" || len(preview.Results) != 3 || preview.Results[2].Status != 404 {
+		t.Fatalf("dry run gave %s", w.Body.String())
+	}
+	expectStatus(t, serve(h, newTestRequest(GET, "/group/g1", ""), ""), 200)
+
+	// The token is for these ids, and this caller, only.
+	expectStatus(t, serve(h, newTestRequest(DELETE, "/group?ids=1,2,3&confirm="+preview.Confirm, ""), "root"), 400)
+	w = serve(h, newTestRequest(DELETE, "/group?ids=1,2,9&confirm="+preview.Confirm, ""), "root")
+	expectStatus(t, w, 200)
+	expectStatus(t, serve(h, newTestRequest(GET, "/group/g1", ""), ""), 404)
+	expectStatus(t, serve(h, newTestRequest(GET, "/group/g3", ""), ""), 200)
+
+	// And good once.
+	expectStatus(t, serve(h, newTestRequest(DELETE, "/group?ids=1,2,9&confirm="+preview.Confirm, ""), "root"), 400)
+}
+
+func TestBulkDeleteResults(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	h := GroupHandler{Repo: rp, Auth: auth}
+	addTestGroups(t, h, 3)
+	expectStatus(t, serve(h, newTestRequest(PATCH, "/group/g2", `{"parent_id":1}`), "root"), 200)
+
+	ids := "1,3,99"
+	w := serve(h, newTestRequest(GET, "/group?dry_run=1&ids="+ids, ""), "root")
+	expectStatus(t, w, 200)
+	var result BulkDeleteResult
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	w = serve(h, newTestRequest(DELETE, "/group?ids="+ids+"&confirm="+result.Confirm, ""), "root")
+	expectStatus(t, w, 200)
+	result = BulkDeleteResult{}
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, item := range result.Results {
+		got = append(got, fmt.Sprintf("%d:%d", item.Id, item.Status))
+	}
+	if strings.Join(got, " ") != "1:409 3:204 99:404" {
+		t.Errorf("DELETE /group?ids=%s gave %v", ids, got)
+	}
+	expectStatus(t, serve(h, newTestRequest(GET, "/group/g1", ""), ""), 200)
+	expectStatus(t, serve(h, newTestRequest(GET, "/group/g3", ""), ""), 404)
+	// The name is free again.
+	expectStatus(t, serve(h, newTestRequest(POST, "/group", `{"group_name":"g3"}`), "root"), 201)
+}
+
+func TestReservedNames(t *testing.T) {
+	rn := NewReservedNames([]string{" Admin ", "", "blob"})
+	for name, want := range map[string]bool{"admin": true, "ADMIN": true, "Blob": true, "alice": false, "": false} {
+		if got := rn.Contains(name); got != want {
+			t.Errorf("Contains(%q) = %t, want %t", name, got, want)
+		}
+	}
+	if ReservedNames(nil).Contains("admin") {
+		t.Error("a nil ReservedNames reserves admin")
+	}
+
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	reserved := NewReservedNames(DefaultReservedNames)
+	users := UserHandler{Repo: rp, Auth: auth, Reserved: reserved}
+	groups := GroupHandler{Repo: rp, Auth: auth, Reserved: reserved}
+	for _, name := range []string{"admin", "Blob", "ME", "user"} {
+		w := serve(users, newTestRequest(POST, "/user", `{"user_name":"`+name+`","email":"x@example.com"}`), "root")
+		expectStatus(t, w, 409)
+		if !strings.Contains(w.Body.String(), "reserved") {
+			t.Errorf("POST /user %s: %s", name, w.Body.String())
+		}
+		expectStatus(t, serve(groups, newTestRequest(POST, "/group", `{"group_name":"`+name+`"}`), "root"), 409)
+	}
+	expectStatus(t, serve(users, newTestRequest(POST, "/user", `{"user_name":"alice","email":"alice@example.com"}`), "root"), 201)
+	expectStatus(t, serve(groups, newTestRequest(POST, "/group", `{"group_name":"admins"}`), "root"), 201)
+
+	// The list is configurable.
+	users.Reserved = NewReservedNames([]string{"alice2"})
+	expectStatus(t, serve(users, newTestRequest(POST, "/user", `{"user_name":"admin","email":"admin@example.com"}`), "root"), 201)
+	expectStatus(t, serve(users, newTestRequest(POST, "/user", `{"user_name":"Alice2","email":"alice2@example.com"}`), "root"), 409)
+}
+
+// listGroupNames returns the names of the groups listed by GET path, in
+// order, and the X-Total-Count.
+func listGroupNames(t *testing.T, h GroupHandler, path string) (string, string) {
+	t.Helper()
+	w := serve(h, newTestRequest(GET, path, ""), "")
+	expectStatus(t, w, 200)
+	var list []Group
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, g := range list {
+		names = append(names, g.GroupName)
+	}
+	return strings.Join(names, ","), w.Header().Get(XTotalCount)
+}
+
+// addNamedTestGroups creates groups with the given names, in order, so
+// that their ids follow that order.
+func addNamedTestGroups(t *testing.T, h GroupHandler, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		body := fmt.Sprintf(`{"group_name":%q}`, name)
+		expectStatus(t, serve(h, newTestRequest(POST, "/group", body), "root"), 201)
+	}
+}
+
+func TestListNamePrefix(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	h := GroupHandler{Repo: rp, Auth: auth}
+	addNamedTestGroups(t, h, "beta", "Alpha", "alphabet", "gamma", "alp")
+
+	for _, test := range []struct{ path, names, total string }{
+		{"/group?name_prefix=al", "alp,Alpha,alphabet", "3"},
+		{"/group?name_prefix=AL", "alp,Alpha,alphabet", "3"},
+		{"/group?name_prefix=alpha", "Alpha,alphabet", "2"},
+		{"/group?name_prefix=alz", "", "0"},
+		{"/group?name_prefix=al&sort=id", "Alpha,alphabet,alp", "3"},
+		{"/group?name_prefix=al&limit=2", "alp,Alpha", "3"},
+		{"/group?name_prefix=al&limit=2&after=alpha", "alphabet", "3"},
+		{"/group?name_prefix=al&sort=id&limit=1&after=2", "alphabet", "3"},
+		{"/group", "beta,Alpha,alphabet,gamma,alp", "5"},
+	} {
+		names, total := listGroupNames(t, h, test.path)
+		if names != test.names || total != test.total {
+			t.Errorf("GET %s listed %q of %s, want %q of %s", test.path, names, total, test.names, test.total)
+		}
+	}
+
+	// Deleting keeps the index, and so the listing, current.
+	expectStatus(t, serve(h, newTestRequest(DELETE, "/group/alp", ""), "root"), 204)
+	if names, total := listGroupNames(t, h, "/group?name_prefix=al"); names != "Alpha,alphabet" || total != "2" {
+		t.Errorf("after a delete, listed %q of %s", names, total)
+	}
+}
+
+func TestListSortByName(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	h := GroupHandler{Repo: rp, Auth: auth}
+	addNamedTestGroups(t, h, "delta", "Bravo", "alpha", "charlie", "Echo")
+
+	for _, test := range []struct{ path, names string }{
+		{"/group?sort=name", "alpha,Bravo,charlie,delta,Echo"},
+		{"/group?sort=id", "delta,Bravo,alpha,charlie,Echo"},
+		{"/group?sort=name&limit=2", "alpha,Bravo"},
+		{"/group?sort=name&limit=2&after=bravo", "charlie,delta"},
+		{"/group?sort=name&after=Delta", "Echo"},
+	} {
+		if names, total := listGroupNames(t, h, test.path); names != test.names || total != "5" {
+			t.Errorf("GET %s listed %q of %s, want %q of 5", test.path, names, total, test.names)
+		}
+	}
+	expectStatus(t, serve(h, newTestRequest(GET, "/group?sort=size", ""), ""), 400)
+
+	// The next link carries on from the name of the last on the page.
+	w := serve(h, newTestRequest(GET, "/group?sort=name&limit=3", ""), "")
+	expectStatus(t, w, 200)
+	if link := w.Header().Get(Link); !strings.Contains(link, "after=charlie") {
+		t.Errorf("%s %q does not continue after charlie", Link, link)
+	}
+}
+
+func TestListETag(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	h := GroupHandler{Repo: rp, Auth: auth}
+	addNamedTestGroups(t, h, "b", "a", "c")
+	etag := func(path string) string {
+		t.Helper()
+		w := serve(h, newTestRequest(GET, path, ""), "")
+		expectStatus(t, w, 200)
+		if got, want := w.Header().Get(ETag), ETagFor(w.Body.Bytes()); got != want {
+			t.Errorf("GET %s: %s %s does not match the body, which has %s", path, ETag, got, want)
+		}
+		return w.Header().Get(ETag)
+	}
+
+	// Every query that changes the bytes changes the ETag.
+	seen := make(map[string]string)
+	for _, path := range []string{
+		"/group",
+		"/group?sort=name",
+		"/group?limit=2",
+		"/group?limit=2&after=2",
+		"/group?name_prefix=a",
+		"/group?pretty",
+	} {
+		tag := etag(path)
+		if other, ok := seen[tag]; ok {
+			t.Errorf("GET %s and GET %s have the same %s", path, other, ETag)
+		}
+		seen[tag] = path
+		if again := etag(path); again != tag {
+			t.Errorf("GET %s: %s changed from %s to %s with nothing else", path, ETag, tag, again)
+		}
+		r := newTestRequest(GET, path, "")
+		r.Header.Set(IfNoneMatch, tag)
+		expectStatus(t, serve(h, r, ""), 304)
+	}
+
+	// So does a change to a listed object, but only on pages showing it.
+	before := etag("/group?limit=2")
+	expectStatus(t, serve(h, newTestRequest(PATCH, "/group/c", `{"description":"x"}`), "root"), 200)
+	if etag("/group") == seen["/group"] {
+		t.Error("changing a group did not change the list's ETag")
+	}
+	if after := etag("/group?limit=2"); after != before {
+		t.Error("changing a group on the next page changed this page's ETag")
+	}
+}
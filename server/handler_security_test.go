@@ -0,0 +1,63 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSecurityHeadersHandler(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	all := []string{StrictTransportSecurity, XContentTypeOptions, XFrameOptions, ContentSecurityPolicy}
+
+	w := serve(SecurityHeadersHandler{H: ok}, newTestRequest(GET, "/", ""), "")
+	for _, name := range all {
+		if v := w.Header().Get(name); v != "" {
+			t.Errorf("zero SecurityHeaders sent %s: %s", name, v)
+		}
+	}
+
+	for _, test := range []struct {
+		headers SecurityHeaders
+		want    map[string]string
+	}{
+		{
+			SecurityHeaders{HSTSMaxAge: 365 * 24 * time.Hour},
+			map[string]string{StrictTransportSecurity: "max-age=31536000"},
+		},
+		{
+			SecurityHeaders{HSTSMaxAge: time.Hour, HSTSIncludeSubdomains: true, NoSniff: true},
+			map[string]string{StrictTransportSecurity: "max-age=3600; includeSubDomains", XContentTypeOptions: "nosniff"},
+		},
+		{
+			SecurityHeaders{HSTSIncludeSubdomains: true, FrameOptions: "DENY", ContentSecurityPolicy: "default-src 'self'"},
+			map[string]string{XFrameOptions: "DENY", ContentSecurityPolicy: "default-src 'self'"},
+		},
+	} {
+		w := serve(SecurityHeadersHandler{ok, test.headers}, newTestRequest(GET, "/", ""), "")
+		for _, name := range all {
+			if got := w.Header().Get(name); got != test.want[name] {
+				t.Errorf("%+v: %s %q, want %q", test.headers, name, got, test.want[name])
+			}
+		}
+	}
+}
+
+func TestServerSecurityHeaders(t *testing.T) {
+	_, urls := startTestServer(t, 1, 0, func(srv *CloudServer) {
+		srv.SecurityHeaders = SecurityHeaders{NoSniff: true, FrameOptions: "SAMEORIGIN"}
+	})
+	for _, path := range []string{"/", "/healthz", "/nonexistent"} {
+		resp, err := http.Get(urls[0] + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.Header.Get(XContentTypeOptions) != "nosniff" || resp.Header.Get(XFrameOptions) != "SAMEORIGIN" {
+			t.Errorf("GET %s: headers %v", path, resp.Header)
+		}
+		if v := resp.Header.Get(StrictTransportSecurity); v != "" {
+			t.Errorf("GET %s: %s %q sent though not configured", path, StrictTransportSecurity, v)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package server
+
+import "net/http"
+
+// ServerHeaderHandler sets the "Server" response header to Value.  If Value
+// is empty, no "Server" header is sent at all.
+type ServerHeaderHandler struct {
+	H     http.Handler
+	Value string
+}
+
+func (handler ServerHeaderHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if handler.Value != "" {
+		w.Header().Set(Server, handler.Value)
+	} else {
+		w.Header().Del(Server)
+	}
+	handler.H.ServeHTTP(w, r)
+}
@@ -0,0 +1,24 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServerHeaderHandler(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(204)
+	})
+	for _, value := range []string{DefaultServerHeader, "example/1.0", ""} {
+		w := httptest.NewRecorder()
+		ServerHeaderHandler{ok, value}.ServeHTTP(w, newTestRequest(GET, "/", ""))
+		got, sent := w.Header()[Server]
+		switch {
+		case value == "" && sent:
+			t.Errorf("sent %s %q, want none", Server, got)
+		case value != "" && w.Header().Get(Server) != value:
+			t.Errorf("sent %s %q, want %q", Server, got, value)
+		}
+	}
+}
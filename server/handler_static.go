@@ -313,5 +313,11 @@ func init() {
 			ETag:     ETagFor(icoFavicon),
 			Data:     icoFavicon,
 		},
+		&StaticHandler{
+			Path:     "/openapi.json",
+			MimeType: MediaTypeJSON,
+			ETag:     ETagFor([]byte(openAPIDocument)),
+			Data:     []byte(openAPIDocument),
+		},
 	}
 }
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerName names the tracer that TracingHandler's spans come from.
+const TracerName = "github.com/cloud9-tools/cloud9/server"
+
+// TracingHandler records a span for each request, continuing the trace
+// that the client's headers carry, as read by Propagator.  The span is
+// named for the method and the route, the pattern in Mux that the request
+// matched, and records the response status.  The request passed to H
+// carries the span, so repo transactions started with its context become
+// child spans.
+type TracingHandler struct {
+	H          http.Handler
+	Mux        *http.ServeMux
+	Tracer     trace.Tracer
+	Propagator propagation.TextMapPropagator
+}
+
+func (handler TracingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := handler.Propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	_, route := handler.Mux.Handler(r)
+	name := r.Method
+	if route != "" {
+		name += " " + route
+	}
+	ctx, span := handler.Tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("http.route", route),
+			attribute.String("url.path", r.URL.Path),
+			attribute.String("cloud9.request_id", RequestId(r)),
+		))
+	defer span.End()
+	sw := &statusWriter{ResponseWriter: w}
+	handler.H.ServeHTTP(sw, r.WithContext(ctx))
+	if sw.status == 0 {
+		sw.status = 200
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", sw.status))
+	if sw.status >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(sw.status))
+	}
+}
+
+// statusWriter remembers the status of the response written through it.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = 200
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush passes flushes through, for /events.
+func (w *statusWriter) Flush() {
+	if w.status == 0 {
+		w.status = 200
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
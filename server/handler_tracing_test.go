@@ -0,0 +1,116 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"testing"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// spanAttr returns the value of the attribute key of s, or "" if it has
+// none.
+func spanAttr(s sdktrace.ReadOnlySpan, key string) string {
+	for _, kv := range s.Attributes() {
+		if string(kv.Key) == key {
+			return kv.Value.Emit()
+		}
+	}
+	return ""
+}
+
+func TestTracingHandler(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "alice", false)
+	rp.SetTracerProvider(tp)
+	mux := http.NewServeMux()
+	mux.Handle("/user/", UserHandler{Repo: rp, Auth: auth, Log: NewLogger(io.Discard, ERROR)})
+	h := RequestIdHandler{TracingHandler{mux, mux, tp.Tracer(TracerName), propagation.TraceContext{}}}
+	// get serves path, and returns the request's span and its children.
+	get := func(path, traceparent string, status int) (sdktrace.ReadOnlySpan, []sdktrace.ReadOnlySpan) {
+		t.Helper()
+		before := len(sr.Ended())
+		r := newTestRequest(GET, path, "")
+		if traceparent != "" {
+			r.Header.Set("Traceparent", traceparent)
+		}
+		expectStatus(t, serve(h, r, ""), status)
+		spans := sr.Ended()[before:]
+		var server sdktrace.ReadOnlySpan
+		for _, s := range spans {
+			if s.SpanKind() == trace.SpanKindServer {
+				server = s
+			}
+		}
+		if server == nil {
+			t.Fatalf("GET %s: no server span among %d", path, len(spans))
+		}
+		var children []sdktrace.ReadOnlySpan
+		for _, s := range spans {
+			if s != server && s.Parent().SpanID() == server.SpanContext().SpanID() {
+				children = append(children, s)
+			}
+		}
+		return server, children
+	}
+
+	// The trace the client started carries on.
+	server, children := get("/user/alice", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", 200)
+	if server.Name() != "GET /user/" {
+		t.Errorf("span named %q, want %q", server.Name(), "GET /user/")
+	}
+	if got := server.SpanContext().TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("span in trace %s, not the client's", got)
+	}
+	if got := server.Parent().SpanID().String(); got != "00f067aa0ba902b7" {
+		t.Errorf("span's parent is %s, not the client's", got)
+	}
+	for key, want := range map[string]string{
+		"http.request.method":       GET,
+		"http.route":                "/user/",
+		"url.path":                  "/user/alice",
+		"http.response.status_code": "200",
+	} {
+		if got := spanAttr(server, key); got != want {
+			t.Errorf("attribute %s is %q, want %q", key, got, want)
+		}
+	}
+	if spanAttr(server, "cloud9.request_id") == "" {
+		t.Error("span has no request id")
+	}
+	if len(children) != 1 || children[0].Name() != "repo.View" || spanAttr(children[0], "cloud9.object_type") != "user" {
+		t.Errorf("child spans %v, want one repo.View of users", children)
+	}
+
+	// Without a trace to continue, one is started.  A 404 is not an
+	// error, for the request or the transaction.
+	server, children = get("/user/nobody", "", 404)
+	if !server.SpanContext().TraceID().IsValid() || server.Parent().IsValid() {
+		t.Error("request without a traceparent did not start a trace")
+	}
+	if got := spanAttr(server, "http.response.status_code"); got != "404" {
+		t.Errorf("status code attribute %q, want 404", got)
+	}
+	for _, s := range append(children, server) {
+		if s.Status().Code == codes.Error {
+			t.Errorf("span %s marked as an error", s.Name())
+		}
+	}
+
+	// A 500 is, and so is the failed transaction.
+	rp.Close()
+	server, children = get("/user/alice", "", 500)
+	if server.Status().Code != codes.Error {
+		t.Error("span of a 500 not marked as an error")
+	}
+	if len(children) != 1 || children[0].Status().Code != codes.Error {
+		t.Error("span of a failed transaction not marked as an error")
+	}
+}
@@ -1,23 +1,81 @@
 package server
 
 import (
+	"fmt"
 	"net"
 	"net/http"
 	"strings"
 )
 
-type UnproxyHandler struct{ H http.Handler }
+// UnproxyHandler takes the client address from X-Forwarded-For, but only
+// for requests from one of the Trusted proxies: anyone else could name any
+// address there.  The client is the last address in the header that is not
+// itself a trusted proxy.  With no Trusted proxies, the header is ignored.
+type UnproxyHandler struct {
+	H       http.Handler
+	Trusted []*net.IPNet
+}
 
 func (handler UnproxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// TODO: Parse this more thoroughly
 	if xff, ok := r.Header[XForwardedFor]; ok {
-		_, port, err := net.SplitHostPort(r.RemoteAddr)
+		host, port, err := net.SplitHostPort(r.RemoteAddr)
 		if err != nil {
-			port = "0"
+			host, port = r.RemoteAddr, "0"
+		}
+		if handler.trusts(host) {
+			xff = strings.Split(strings.Join(xff, ","), ",")
+			for i := len(xff) - 1; i >= 0 && handler.trusts(host); i-- {
+				hop := strings.Trim(xff[i], " \t")
+				if net.ParseIP(hop) == nil {
+					break
+				}
+				host = hop
+			}
+			r.RemoteAddr = net.JoinHostPort(host, port)
 		}
-		xff = strings.Split(strings.Join(xff, ","), ",")
-		host := strings.Trim(xff[len(xff)-1], " \t")
-		r.RemoteAddr = net.JoinHostPort(host, port)
 	}
 	handler.H.ServeHTTP(w, r)
 }
+
+func (handler UnproxyHandler) trusts(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range handler.Trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseTrustedProxies parses a comma-separated list of addresses and CIDR
+// blocks, such as "10.0.0.0/8,::1".
+func ParseTrustedProxies(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an IP address", item)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
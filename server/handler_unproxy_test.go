@@ -0,0 +1,42 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestUnproxyHandler(t *testing.T) {
+	trusted, err := ParseTrustedProxies("10.0.0.0/8, 192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got string
+	h := UnproxyHandler{http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.RemoteAddr
+	}), trusted}
+
+	for _, test := range []struct {
+		peer, xff, want string
+	}{
+		{"198.51.100.7:1234", "203.0.113.9", "198.51.100.7:1234"},
+		{"192.0.2.1:1234", "203.0.113.9", "203.0.113.9:1234"},
+		{"192.0.2.1:1234", "203.0.113.9, 10.1.2.3", "203.0.113.9:1234"},
+		{"192.0.2.1:1234", "127.0.0.1, 203.0.113.9", "203.0.113.9:1234"},
+		{"192.0.2.1:1234", "junk", "192.0.2.1:1234"},
+		{"192.0.2.1:1234", "", "192.0.2.1:1234"},
+	} {
+		r := newTestRequest(GET, "/", "")
+		r.RemoteAddr = test.peer
+		if test.xff != "" {
+			r.Header.Set(XForwardedFor, test.xff)
+		}
+		serve(h, r, "")
+		if got != test.want {
+			t.Errorf("from %s with %q: got client %s, want %s", test.peer, test.xff, got, test.want)
+		}
+	}
+
+	if _, err := ParseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Error("ParseTrustedProxies accepted a bad CIDR block")
+	}
+}
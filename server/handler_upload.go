@@ -0,0 +1,498 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloud9-tools/cloud9/repo"
+)
+
+var (
+	reUploadId             = regexp.MustCompile(`^[0-9a-f]{32}$`)
+	reUploadIdPath         = regexp.MustCompile(`^/blob/uploads/([0-9a-f]{32})$`)
+	reUploadIdCompletePath = regexp.MustCompile(`^/blob/uploads/([0-9a-f]{32})/complete$`)
+	reContentRange         = regexp.MustCompile(`^bytes ([0-9]{1,19})-([0-9]{1,19})/([0-9]{1,19}|\*)$`)
+)
+
+const (
+	DefaultUploadTTL         = 24 * time.Hour
+	DefaultMaxUploadsPerUser = 10
+
+	// uploadSweepInterval is how often CreateUpload looks for sessions
+	// that have expired.
+	uploadSweepInterval = time.Minute
+)
+
+// UploadHandler implements resumable blob uploads.  A client creates a
+// session, appends the data in chunks with PATCH and Content-Range, and
+// then completes the session to turn the data into an ordinary blob.
+// Each session is kept in Dir as "<id>.part", holding the bytes received
+// so far, and "<id>.json", holding the UploadSession.  Only admins may
+// upload.
+//
+// A session that receives nothing for TTL expires, and is removed.  Each
+// user may have at most MaxPerUser sessions at once.  Zero means no limit
+// for either.
+type UploadHandler struct {
+	Repo       *repo.Repo
+	Dir        string
+	Auth       *Authenticator
+	Log        *Logger
+	TTL        time.Duration
+	MaxPerUser int
+
+	mu        sync.Mutex
+	locks     map[string]*uploadLock
+	lastSweep time.Time
+	createMu  sync.Mutex
+}
+
+type UploadSession struct {
+	Id      string `json:"id"`
+	URL     string `json:"url"`
+	Offset  int64  `json:"offset"`
+	Created int64  `json:"created"`
+	Owner   uint64 `json:"owner,omitempty"`
+}
+
+// uploadLock serializes the requests on one session.  It is held while
+// the session's files are read or written, but not while a completed
+// upload is stored; completing marks the session meanwhile, so that other
+// requests leave it alone.
+type uploadLock struct {
+	sync.Mutex
+	refs       int
+	completing bool
+}
+
+type UploadComplete struct {
+	Digest      *string `json:"digest"`
+	ContentType *string `json:"content_type"`
+}
+
+func (h *UploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	caller, ok := GetCaller(h.Log, h.Auth, w, r)
+	if !ok {
+		return
+	}
+	if !caller.Admin {
+		http.Error(w, "Forbidden", 403)
+		return
+	}
+	if r.URL.Path == "/blob/uploads" || r.URL.Path == "/blob/uploads/" {
+		if !AllowMethods(w, r, POST) {
+			return
+		}
+		h.CreateUpload(w, r, caller.Id)
+		return
+	}
+	if m := reUploadIdCompletePath.FindStringSubmatch(r.URL.Path); m != nil {
+		if !AllowMethods(w, r, POST) {
+			return
+		}
+		h.CompleteUpload(w, r, m[1], caller.Id)
+		return
+	}
+	m := reUploadIdPath.FindStringSubmatch(r.URL.Path)
+	if m == nil {
+		NotFound(w, r)
+		return
+	}
+	if !AllowMethods(w, r, GET, PATCH, DELETE) {
+		return
+	}
+	switch r.Method {
+	case GET, HEAD:
+		h.GetUpload(w, r, m[1])
+
+	case PATCH:
+		h.AppendUpload(w, r, m[1])
+
+	case DELETE:
+		h.DeleteUpload(w, r, m[1])
+
+	default:
+		h.Log.For(r).Errorf("not implemented: %s %s", r.Method, r.URL.Path)
+		InternalError(w, r)
+	}
+}
+
+func (h *UploadHandler) partPath(id string) string {
+	return filepath.Join(h.Dir, id+".part")
+}
+
+func (h *UploadHandler) sessionPath(id string) string {
+	return filepath.Join(h.Dir, id+".json")
+}
+
+// lock locks the session with the given id, whether or not it exists.
+func (h *UploadHandler) lock(id string) *uploadLock {
+	h.mu.Lock()
+	if h.locks == nil {
+		h.locks = make(map[string]*uploadLock)
+	}
+	l := h.locks[id]
+	if l == nil {
+		l = &uploadLock{}
+		h.locks[id] = l
+	}
+	l.refs++
+	h.mu.Unlock()
+	l.Lock()
+	return l
+}
+
+func (h *UploadHandler) unlock(id string, l *uploadLock) {
+	l.Unlock()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if l.refs--; l.refs == 0 {
+		delete(h.locks, id)
+	}
+}
+
+// loadSession reads the session with the given id, with Offset set to the
+// number of bytes received so far.  An expired session is removed, and
+// reported as not existing.  The caller must hold the session's lock.
+func (h *UploadHandler) loadSession(id string) (*UploadSession, error) {
+	raw, err := ioutil.ReadFile(h.sessionPath(id))
+	if err != nil {
+		return nil, err
+	}
+	var session UploadSession
+	if err := json.Unmarshal(raw, &session); err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(h.partPath(id))
+	if err != nil {
+		return nil, err
+	}
+	if h.TTL > 0 && time.Since(fi.ModTime()) > h.TTL {
+		if err := h.removeSession(id); err != nil {
+			return nil, err
+		}
+		return nil, os.ErrNotExist
+	}
+	session.Offset = fi.Size()
+	return &session, nil
+}
+
+// sweep removes the expired sessions, and returns how many of the others
+// owner has.
+func (h *UploadHandler) sweep(owner uint64) (int, error) {
+	names, err := filepath.Glob(filepath.Join(h.Dir, "*.json"))
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, name := range names {
+		id := strings.TrimSuffix(filepath.Base(name), ".json")
+		if !reUploadId.MatchString(id) {
+			continue
+		}
+		l := h.lock(id)
+		var session *UploadSession
+		err = nil
+		if !l.completing {
+			session, err = h.loadSession(id)
+		}
+		h.unlock(id, l)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if session != nil && session.Owner == owner {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (h *UploadHandler) removeSession(id string) error {
+	err1 := os.Remove(h.partPath(id))
+	err2 := os.Remove(h.sessionPath(id))
+	if err1 != nil && !os.IsNotExist(err1) {
+		return err1
+	}
+	if err2 != nil && !os.IsNotExist(err2) {
+		return err2
+	}
+	return nil
+}
+
+func (h *UploadHandler) writeSession(w http.ResponseWriter, session *UploadSession, status int) {
+	raw := MustMarshalJSON(session)
+	if session.Offset > 0 {
+		w.Header().Set(Range, fmt.Sprintf("bytes=0-%d", session.Offset-1))
+	}
+	w.Header().Set(ContentLength, fmt.Sprintf("%d", len(raw)))
+	w.Header().Set(ContentType, MediaTypeJSON)
+	w.Header().Set(CacheControl, CacheControlNoCache)
+	w.WriteHeader(status)
+	w.Write(raw)
+}
+
+// CreateUpload starts a session for owner.  Counting owner's sessions
+// means reading them all, which also finds those that have expired; other
+// than that, expired sessions are looked for at most once a minute.
+func (h *UploadHandler) CreateUpload(w http.ResponseWriter, r *http.Request, owner uint64) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	id := hex.EncodeToString(b[:])
+	session := &UploadSession{
+		Id:      id,
+		URL:     "/blob/uploads/" + id,
+		Created: time.Now().Unix(),
+		Owner:   owner,
+	}
+	h.createMu.Lock()
+	defer h.createMu.Unlock()
+	if h.MaxPerUser > 0 || (h.TTL > 0 && time.Since(h.lastSweep) >= uploadSweepInterval) {
+		h.lastSweep = time.Now()
+		n, err := h.sweep(owner)
+		if err != nil {
+			h.Log.For(r).Errorf("POST /blob/uploads: %v", err)
+			InternalError(w, r)
+			return
+		}
+		if h.MaxPerUser > 0 && n >= h.MaxPerUser {
+			http.Error(w, fmt.Sprintf("Too many unfinished uploads; complete or delete one of your %d first", n), 429)
+			return
+		}
+	}
+	l := h.lock(id)
+	defer h.unlock(id, l)
+	err := os.MkdirAll(h.Dir, 0700)
+	if err == nil {
+		err = ioutil.WriteFile(h.partPath(id), nil, 0600)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(h.sessionPath(id), MustMarshalJSON(session), 0600)
+	}
+	if err != nil {
+		h.removeSession(id)
+		h.Log.For(r).Errorf("POST /blob/uploads: %v", err)
+		InternalError(w, r)
+		return
+	}
+	w.Header().Set(Location, session.URL)
+	h.writeSession(w, session, 201)
+}
+
+func (h *UploadHandler) GetUpload(w http.ResponseWriter, r *http.Request, id string) {
+	l := h.lock(id)
+	session, err := h.loadSession(id)
+	h.unlock(id, l)
+	if os.IsNotExist(err) {
+		NotFound(w, r)
+		return
+	}
+	if err != nil {
+		h.Log.For(r).Errorf("GET /blob/uploads/%s: %v", id, err)
+		InternalError(w, r)
+		return
+	}
+	h.writeSession(w, session, 200)
+}
+
+// AppendUpload adds one chunk to an upload.  The chunk must start at or
+// before the current end of the data; bytes already received are skipped,
+// so a chunk that is retried after a lost response is harmless.
+func (h *UploadHandler) AppendUpload(w http.ResponseWriter, r *http.Request, id string) {
+	m := reContentRange.FindStringSubmatch(r.Header.Get(ContentRange))
+	if m == nil {
+		http.Error(w, "Header 'Content-Range' must be of the form 'bytes first-last/total'", 400)
+		return
+	}
+	first, err1 := strconv.ParseInt(m[1], 10, 64)
+	last, err2 := strconv.ParseInt(m[2], 10, 64)
+	if err1 != nil || err2 != nil || first > last {
+		http.Error(w, "Header 'Content-Range' is not a valid range", 400)
+		return
+	}
+	if m[3] != "*" {
+		total, err := strconv.ParseInt(m[3], 10, 64)
+		if err != nil || last >= total {
+			http.Error(w, "Header 'Content-Range' is not a valid range", 400)
+			return
+		}
+	}
+	if last >= MaxBlobSize {
+		http.Error(w, "Request Entity Too Large", 413)
+		return
+	}
+	chunk, err := ioutil.ReadAll(io.LimitReader(r.Body, last-first+2))
+	if err != nil {
+		h.Log.For(r).Errorf("failed to read request body: %v", err)
+		InternalError(w, r)
+		return
+	}
+	if int64(len(chunk)) != last-first+1 {
+		http.Error(w, "Body length does not match header 'Content-Range'", 400)
+		return
+	}
+
+	l := h.lock(id)
+	defer h.unlock(id, l)
+	if l.completing {
+		http.Error(w, "Upload is being completed", 409)
+		return
+	}
+	session, err := h.loadSession(id)
+	if os.IsNotExist(err) {
+		NotFound(w, r)
+		return
+	}
+	if err != nil {
+		h.Log.For(r).Errorf("PATCH /blob/uploads/%s: %v", id, err)
+		InternalError(w, r)
+		return
+	}
+	if first > session.Offset {
+		if session.Offset > 0 {
+			w.Header().Set(Range, fmt.Sprintf("bytes=0-%d", session.Offset-1))
+		}
+		http.Error(w, fmt.Sprintf("Chunk must start at or before offset %d", session.Offset), 416)
+		return
+	}
+	if last >= session.Offset {
+		f, err := os.OpenFile(h.partPath(id), os.O_WRONLY|os.O_APPEND, 0600)
+		if err == nil {
+			_, err = f.Write(chunk[session.Offset-first:])
+			if err2 := f.Close(); err == nil {
+				err = err2
+			}
+		}
+		if err != nil {
+			h.Log.For(r).Errorf("PATCH /blob/uploads/%s: %v", id, err)
+			InternalError(w, r)
+			return
+		}
+		session.Offset = last + 1
+	}
+	h.writeSession(w, session, 200)
+}
+
+func (h *UploadHandler) DeleteUpload(w http.ResponseWriter, r *http.Request, id string) {
+	l := h.lock(id)
+	defer h.unlock(id, l)
+	if l.completing {
+		http.Error(w, "Upload is being completed", 409)
+		return
+	}
+	if _, err := os.Stat(h.sessionPath(id)); os.IsNotExist(err) {
+		NotFound(w, r)
+		return
+	}
+	if err := h.removeSession(id); err != nil {
+		h.Log.For(r).Errorf("DELETE /blob/uploads/%s: %v", id, err)
+		InternalError(w, r)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// CompleteUpload turns the data received so far into a blob, provided it
+// matches the digest the client expects.  The session is then removed.
+// The session's lock is released while the blob is stored, so that
+// sweeps and GETs of the session need not wait for the repo's write lock;
+// the session is marked as being completed meanwhile.
+func (h *UploadHandler) CompleteUpload(w http.ResponseWriter, r *http.Request, id string, actor uint64) {
+	var req UploadComplete
+	if !GetJSONBody(h.Log, w, r, &req) {
+		return
+	}
+	if req.Digest == nil {
+		http.Error(w, "Missing required field 'digest'", 400)
+		return
+	}
+
+	l := h.lock(id)
+	defer h.unlock(id, l)
+	if l.completing {
+		http.Error(w, "Upload is being completed", 409)
+		return
+	}
+	_, err := h.loadSession(id)
+	if os.IsNotExist(err) {
+		NotFound(w, r)
+		return
+	}
+	var blob []byte
+	if err == nil {
+		blob, err = ioutil.ReadFile(h.partPath(id))
+	}
+	if err != nil {
+		h.Log.For(r).Errorf("POST /blob/uploads/%s/complete: %v", id, err)
+		InternalError(w, r)
+		return
+	}
+	if !strings.EqualFold(*req.Digest, DigestFor(blob)) {
+		http.Error(w, "Field 'digest' does not match the uploaded data", 400)
+		return
+	}
+	l.completing = true
+	l.Unlock()
+	blobId, err := h.storeUpload(r, id, actor, req, blob)
+	l.Lock()
+	l.completing = false
+	if err != nil {
+		h.Log.For(r).Errorf("POST /blob/uploads/%s/complete: %v", id, err)
+		InternalError(w, r)
+		return
+	}
+	if err := h.removeSession(id); err != nil {
+		h.Log.For(r).Warnf("upload %s: failed to clean up: %v", id, err)
+	}
+	raw, contentType := EncodeBlobReference(w, r, BlobReference{Id: blobId})
+	w.Header().Set(ContentLength, fmt.Sprintf("%d", len(raw)))
+	w.Header().Set(ContentType, contentType)
+	w.Header().Set(CacheControl, CacheControlNoCache)
+	w.Header().Set(ETag, ETagFor(blob))
+	w.Header().Set(Location, fmt.Sprintf("/blob/%d", blobId))
+	w.WriteHeader(201)
+	w.Write(raw)
+}
+
+// storeUpload stores the data of a completed upload as a blob.
+func (h *UploadHandler) storeUpload(r *http.Request, id string, actor uint64, req UploadComplete, blob []byte) (uint64, error) {
+	given := ""
+	if req.ContentType != nil {
+		given = *req.ContentType
+	}
+	meta := NewBlobMeta(BlobContentType(given, blob), blob)
+	key, err := h.Repo.StoreContent(blob)
+	if err != nil {
+		return 0, err
+	}
+	var blobId uint64
+	err = h.Repo.UpdateContext(r.Context(), repo.BLOB, func(tx *repo.Tx) error {
+		var err error
+		blobId, err = PutBlob(tx, r, actor, key, &meta)
+		return err
+	})
+	h.Repo.ReleaseContent(key)
+	if err != nil {
+		if err := DiscardBlobContent(h.Repo, []string{key}); err != nil {
+			h.Log.For(r).Errorf("POST /blob/uploads/%s/complete: failed to discard content: %v", id, err)
+		}
+		return 0, err
+	}
+	return blobId, nil
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// newTestUpload starts an upload as root and returns its URL.
+func newTestUpload(t *testing.T, h *UploadHandler) string {
+	t.Helper()
+	w := serve(h, newTestRequest(POST, "/blob/uploads", ""), "root")
+	expectStatus(t, w, 201)
+	var session UploadSession
+	if err := json.Unmarshal(w.Body.Bytes(), &session); err != nil {
+		t.Fatal(err)
+	}
+	return session.URL
+}
+
+// patchChunk sends data as the chunk starting at first.
+func patchChunk(h *UploadHandler, url string, first int, data string) int {
+	r := newTestRequest(PATCH, url, data)
+	r.Header.Set(ContentRange, fmt.Sprintf("bytes %d-%d/*", first, first+len(data)-1))
+	return serve(h, r, "root").Code
+}
+
+func TestUploadChunks(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	h := &UploadHandler{Repo: rp, Dir: t.TempDir(), Auth: auth}
+	url := newTestUpload(t, h)
+
+	for _, test := range []struct {
+		first  int
+		data   string
+		status int
+	}{
+		{0, "hello", 200},
+		{8, "rld", 416},   // out of order: leaves a gap
+		{0, "hello", 200}, // duplicate: already received
+		{3, "lo, wo", 200},
+		{5, ", wo", 200},
+		{9, "rld", 200},
+	} {
+		if status := patchChunk(h, url, test.first, test.data); status != test.status {
+			t.Fatalf("chunk %q at %d: got status %d, want %d", test.data, test.first, status, test.status)
+		}
+	}
+	w := serve(h, newTestRequest(GET, url, ""), "root")
+	expectStatus(t, w, 200)
+	var session UploadSession
+	if err := json.Unmarshal(w.Body.Bytes(), &session); err != nil || session.Offset != 12 {
+		t.Fatalf("GET %s gave %s, want an offset of 12", url, w.Body.String())
+	}
+	body := `{"digest":"` + DigestFor([]byte("hello, world")) + `"}`
+	expectStatus(t, serve(h, newTestRequest(POST, url+"/complete", body), "root"), 201)
+	expectStatus(t, serve(h, newTestRequest(GET, url, ""), "root"), 404)
+}
+
+func TestUploadLimits(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	h := &UploadHandler{Repo: rp, Dir: t.TempDir(), Auth: auth, TTL: time.Hour, MaxPerUser: 2}
+
+	first := newTestUpload(t, h)
+	newTestUpload(t, h)
+	expectStatus(t, serve(h, newTestRequest(POST, "/blob/uploads", ""), "root"), 429)
+
+	// Once the first has been idle for longer than the TTL, it is gone,
+	// and makes room for another.
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(h.partPath(first[len("/blob/uploads/"):]), old, old); err != nil {
+		t.Fatal(err)
+	}
+	newTestUpload(t, h)
+	expectStatus(t, serve(h, newTestRequest(GET, first, ""), "root"), 404)
+	expectStatus(t, serve(h, newTestRequest(POST, "/blob/uploads", ""), "root"), 429)
+}
+
+func TestUploadCompleteAndDelete(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	h := &UploadHandler{Repo: rp, Dir: t.TempDir(), Auth: auth}
+	url := newTestUpload(t, h)
+
+	expectStatus(t, serve(h, newTestRequest(PATCH, url, "hello"), "root"), 400)
+	r := newTestRequest(PATCH, url, "hello")
+	r.Header.Set(ContentRange, "bytes 0-9/*")
+	expectStatus(t, serve(h, r, "root"), 400)
+	if status := patchChunk(h, url, 0, "hello"); status != 200 {
+		t.Fatalf("PATCH %s: got status %d, want 200", url, status)
+	}
+
+	complete := func(body string) *httptest.ResponseRecorder {
+		return serve(h, newTestRequest(POST, url+"/complete", body), "root")
+	}
+	expectStatus(t, complete(`{}`), 400)
+	expectStatus(t, complete(`{"digest":"`+DigestFor([]byte("hell"))+`"}`), 400)
+	w := complete(`{"digest":"` + DigestFor([]byte("hello")) + `"}`)
+	expectStatus(t, w, 201)
+	bh := BlobHandler{repo: rp, Auth: auth}
+	w = serve(bh, newTestRequest(GET, w.Header().Get(Location), ""), "")
+	expectStatus(t, w, 200)
+	if w.Body.String() != "hello" {
+		t.Errorf("completed upload holds %q, want hello", w.Body.String())
+	}
+
+	url = newTestUpload(t, h)
+	patchChunk(h, url, 0, "gone")
+	expectStatus(t, serve(h, newTestRequest(DELETE, url, ""), "root"), 204)
+	expectStatus(t, serve(h, newTestRequest(GET, url, ""), "root"), 404)
+	expectStatus(t, serve(h, newTestRequest(DELETE, url, ""), "root"), 404)
+	if status := patchChunk(h, url, 0, "gone"); status != 404 {
+		t.Errorf("PATCH of a deleted upload: got status %d, want 404", status)
+	}
+}
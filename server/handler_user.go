@@ -1,15 +1,16 @@
 package server
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
-	"log"
 	"net/http"
+	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/golang/protobuf/proto"
 
@@ -17,20 +18,37 @@ import (
 )
 
 var (
-	reUserIdPath      = regexp.MustCompile(`^/user/([0-9]+)$`)
-	reUserNamePath    = regexp.MustCompile(`^/user/([A-Za-z][0-9A-Za-z]*)$`)
-	reUserName        = regexp.MustCompile(`^[A-Za-z][0-9A-Za-z]*$`)
-	reUserDisplayName = regexp.MustCompile(`^[\pL\pM\pN\pP\pS\pZ]+$`)
-	reEMail           = regexp.MustCompile(`(?i)^[0-9a-z_.+-]+@[0-9a-z][0-9a-z_-]*(?:\.[0-9a-z][0-9a-z_-]*)+$`)
-	reURL             = regexp.MustCompile(`(?i)^https?://(?:[0-9a-z][0-9a-z_-]*(?:\.[0-9a-z][0-9a-z_-]*)+|\d+\.\d+\.\d+\.\d+|\[[0-9a-f:.]+\])(?::[1-9]\d*)?(?:/\PC*)?$`)
+	reUserIdPath         = regexp.MustCompile(`^/user/([0-9]{1,20})$`)
+	reUserNamePath       = regexp.MustCompile(`^/user/([A-Za-z][0-9A-Za-z]*)$`)
+	reUserIdActionPath   = regexp.MustCompile(`^/user/([0-9]{1,20})/(password|send-verification|disable|enable)$`)
+	reUserNameActionPath = regexp.MustCompile(`^/user/([A-Za-z][0-9A-Za-z]*)/(password|send-verification|disable|enable)$`)
+	reUserName           = regexp.MustCompile(`^[A-Za-z][0-9A-Za-z]*$`)
+	reUserDisplayName    = regexp.MustCompile(`^[\pL\pM\pN\pP\pS\pZ]+$`)
+	reEMail              = regexp.MustCompile(`(?i)^[0-9a-z_.+-]+@[0-9a-z][0-9a-z_-]*(?:\.[0-9a-z][0-9a-z_-]*)+$`)
+	reMetadataKey        = regexp.MustCompile(`^[A-Za-z][0-9A-Za-z_.-]*$`)
+	reMetadataValue      = regexp.MustCompile(`^[\pL\pM\pN\pP\pS\pZ]*$`)
+	rePhone              = regexp.MustCompile(`^\+[1-9][0-9]{1,14}$`)
+	reURL                = regexp.MustCompile(`(?i)^https?://(?:[0-9a-z][0-9a-z_-]*(?:\.[0-9a-z][0-9a-z_-]*)+|\d+\.\d+\.\d+\.\d+|\[[0-9a-f:.]+\])(?::[1-9]\d*)?(?:/\PC*)?$`)
 )
 
+// User is a user account.  UserName keeps the case it was created with, but
+// is unique, and found in paths, without regard to case.  A Disabled user
+// keeps their record and group memberships but cannot authenticate.
 type User struct {
-	Id          uint64 `protobuf:"varint,1,opt,name=id" json:"id,omitempty"`
-	UserName    string `protobuf:"bytes,2,opt,name=user_name" json:"user_name,omitempty"`
-	DisplayName string `protobuf:"bytes,3,opt,name=display_name" json:"display_name,omitempty"`
-	EMail       string `protobuf:"bytes,4,opt,name=email" json:"email,omitempty"`
-	URL         string `protobuf:"bytes,5,opt,name=url" json:"url,omitempty"`
+	Id            uint64 `protobuf:"varint,1,opt,name=id" json:"id,omitempty"`
+	UserName      string `protobuf:"bytes,2,opt,name=user_name" json:"user_name,omitempty"`
+	DisplayName   string `protobuf:"bytes,3,opt,name=display_name" json:"display_name,omitempty"`
+	EMail         string `protobuf:"bytes,4,opt,name=email" json:"email,omitempty"`
+	URL           string `protobuf:"bytes,5,opt,name=url" json:"url,omitempty"`
+	PasswordHash  []byte `protobuf:"bytes,6,opt,name=password_hash" json:"-"`
+	Admin         bool   `protobuf:"varint,7,opt,name=admin" json:"admin,omitempty"`
+	EMailVerified bool   `protobuf:"varint,8,opt,name=email_verified" json:"email_verified,omitempty"`
+	Updated       int64  `protobuf:"varint,9,opt,name=updated" json:"updated,omitempty"`
+	Phone         string `protobuf:"bytes,10,opt,name=phone" json:"phone,omitempty"`
+	Timezone      string `protobuf:"bytes,11,opt,name=timezone" json:"timezone,omitempty"`
+
+	Metadata map[string]string `protobuf:"bytes,12,rep,name=metadata" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value" json:"metadata,omitempty"`
+	Disabled bool              `protobuf:"varint,13,opt,name=disabled" json:"disabled,omitempty"`
 }
 
 func (m *User) Reset()         { *m = User{} }
@@ -44,11 +62,61 @@ const (
 	ExistingUser UserLifetime = true
 )
 
+// Limits on User.Metadata.
+const (
+	MaxMetadataKeys        = 64
+	MaxMetadataKeyLength   = 64
+	MaxMetadataValueLength = 1024
+)
+
+// UserDelta changes a user.  Metadata is merged into the user's metadata
+// rather than replacing it: each key given is set, or removed if its value
+// is null, and keys not given are left alone.
 type UserDelta struct {
 	UserName    *string `json:"user_name"`
 	DisplayName *string `json:"display_name"`
 	EMail       *string `json:"email"`
 	URL         *string `json:"url"`
+	Phone       *string `json:"phone"`
+	Timezone    *string `json:"timezone"`
+	Password    *string `json:"password"`
+
+	Metadata map[string]*string `json:"metadata"`
+
+	// displayName derives the display name set by an empty
+	// "display_name"; nil means DisplayNameFromUserName.
+	displayName DisplayNamePolicy
+
+	// reserved holds the names new users may not take.
+	reserved ReservedNames
+}
+
+// DisplayNamePolicy derives a user's display name from their user name,
+// for when the display name is set to "".
+type DisplayNamePolicy func(userName string) string
+
+// DisplayNameFromUserName is the default DisplayNamePolicy: the display
+// name is the user name.
+func DisplayNameFromUserName(userName string) string { return userName }
+
+// DisplayNameTitle makes the display name the user name with its first
+// letter in upper case.
+func DisplayNameTitle(userName string) string {
+	if userName == "" {
+		return ""
+	}
+	r, n := utf8.DecodeRuneInString(userName)
+	return string(unicode.ToTitle(r)) + userName[n:]
+}
+
+// DisplayNameBlank leaves the display name blank.
+func DisplayNameBlank(string) string { return "" }
+
+// DisplayNamePolicies names the built-in policies, for configuration.
+var DisplayNamePolicies = map[string]DisplayNamePolicy{
+	"username": DisplayNameFromUserName,
+	"title":    DisplayNameTitle,
+	"blank":    DisplayNameBlank,
 }
 
 func (d *UserDelta) Validate(lifetime UserLifetime) error {
@@ -66,6 +134,8 @@ func (d *UserDelta) Validate(lifetime UserLifetime) error {
 			return errors.New("Field 'user_name' must be set")
 		case !reUserName.MatchString(*d.UserName):
 			return errors.New("Field 'user_name' must start with a letter and consist of letters and numbers")
+		case d.reserved.Contains(*d.UserName):
+			return &ReservedNameError{Field: "user_name", Name: *d.UserName}
 		}
 	}
 	if d.DisplayName != nil {
@@ -92,155 +162,297 @@ func (d *UserDelta) Validate(lifetime UserLifetime) error {
 			return errors.New("Field 'url' must be a valid HTTP(S) URL")
 		}
 	}
+	if d.Phone != nil {
+		switch {
+		case *d.Phone == "":
+			// pass
+		case !rePhone.MatchString(*d.Phone):
+			return errors.New("Field 'phone' must be an international number in E.164 form, such as +15551234567")
+		}
+	}
+	if d.Timezone != nil {
+		switch {
+		case *d.Timezone == "":
+			// pass
+		case !validTimezone(*d.Timezone):
+			return errors.New("Field 'timezone' must be an IANA time zone name, such as Europe/Paris")
+		}
+	}
+	if len(d.Metadata) > MaxMetadataKeys {
+		return &LimitError{Field: "metadata", Limit: MaxMetadataKeys}
+	}
+	for k, v := range d.Metadata {
+		switch {
+		case len(k) > MaxMetadataKeyLength:
+			return fmt.Errorf("Field 'metadata' must have keys of at most %d bytes", MaxMetadataKeyLength)
+		case !reMetadataKey.MatchString(k):
+			return errors.New("Field 'metadata' must have keys that start with a letter and consist of letters, numbers, '_', '.' and '-'")
+		case v == nil:
+			// pass
+		case len(*v) > MaxMetadataValueLength:
+			return fmt.Errorf("Field 'metadata' must have values of at most %d bytes", MaxMetadataValueLength)
+		case !reMetadataValue.MatchString(*v):
+			return errors.New("Field 'metadata' must not contain control characters")
+		}
+	}
+	if d.Password != nil {
+		if lifetime == ExistingUser {
+			return errors.New("Field 'password' cannot be changed here")
+		}
+		if err := ValidatePassword("password", *d.Password); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+type PasswordChange struct {
+	Old *string `json:"old"`
+	New *string `json:"new"`
+}
+
 func (d *UserDelta) Apply(u *User) {
 	if d.UserName != nil {
 		u.UserName = *d.UserName
 	}
 	if d.DisplayName != nil {
 		if *d.DisplayName == "" {
-			u.DisplayName = u.UserName
+			policy := d.displayName
+			if policy == nil {
+				policy = DisplayNameFromUserName
+			}
+			u.DisplayName = policy(u.UserName)
 		} else {
 			u.DisplayName = *d.DisplayName
 		}
 	}
 	if d.EMail != nil {
+		if *d.EMail != u.EMail {
+			u.EMailVerified = false
+		}
 		u.EMail = *d.EMail
 	}
 	if d.URL != nil {
 		u.URL = *d.URL
 	}
+	if d.Phone != nil {
+		u.Phone = *d.Phone
+	}
+	if d.Timezone != nil {
+		u.Timezone = *d.Timezone
+	}
+	for k, v := range d.Metadata {
+		if v == nil {
+			delete(u.Metadata, k)
+			continue
+		}
+		if u.Metadata == nil {
+			u.Metadata = make(map[string]string)
+		}
+		u.Metadata[k] = *v
+	}
+	if len(u.Metadata) == 0 {
+		u.Metadata = nil
+	}
 }
 
-type UserHandler struct{ Repo *repo.Repo }
+// Verify checks the user that results from applying d.
+func (d *UserDelta) Verify(obj Resource) error {
+	u := obj.(*User)
+	if len(u.Metadata) > MaxMetadataKeys {
+		return &LimitError{Field: "metadata", Limit: MaxMetadataKeys}
+	}
+	return nil
+}
 
-func (h UserHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.URL.Path == "/user" || r.URL.Path == "/user/" {
-		if !AllowMethods(w, r, GET, POST) {
-			return
-		}
-		method := strings.ToUpper(r.Method)
-		switch {
-		case method == GET || method == HEAD:
-			h.ListUsers(w, r)
+// validTimezone reports whether name is in the time zone database.  "Local"
+// is refused, as it means whatever zone the server happens to be in.
+func validTimezone(name string) bool {
+	if name == "Local" {
+		return false
+	}
+	_, err := time.LoadLocation(name)
+	return err == nil
+}
 
-		case method == POST:
-			h.CreateUser(w, r)
+func (m *User) ResourceId() uint64         { return m.Id }
+func (m *User) SetResourceId(id uint64)    { m.Id = id }
+func (m *User) ResourceName() string       { return m.UserName }
+func (m *User) ResourceUpdated() int64     { return m.Updated }
+func (m *User) SetResourceUpdated(t int64) { m.Updated = t }
 
-		default:
-			log.Printf("error: not implemented: %s %s", method, r.URL.Path)
-			http.Error(w, "Internal Server Error", 500)
-		}
-		return
+func (d *UserDelta) ValidateFor(existing bool) error { return d.Validate(UserLifetime(existing)) }
+func (d *UserDelta) ApplyTo(obj Resource)            { d.Apply(obj.(*User)) }
+
+type userKind struct {
+	auth        *Authenticator
+	displayName DisplayNamePolicy
+	reserved    ReservedNames
+}
+
+func (userKind) Type() repo.ObjectType    { return repo.USER }
+func (userKind) IdPath() *regexp.Regexp   { return reUserIdPath }
+func (userKind) NamePath() *regexp.Regexp { return reUserNamePath }
+func (userKind) New() Resource            { return &User{} }
+func (k userKind) NewDelta() ResourceDelta {
+	return &UserDelta{displayName: k.displayName, reserved: k.reserved}
+}
+
+// MayCreate lets admins create users, and anyone create the first user
+// of a fresh install; see Initialize.
+func (userKind) MayCreate(caller *User, obj Resource) bool {
+	return (caller != nil && caller.Admin) || obj.ResourceId() == firstUserId
+}
+
+// MayChange lets users change or delete themselves, and admins anyone.
+func (userKind) MayChange(caller *User, obj Resource) bool {
+	return caller != nil && (caller.Admin || caller.Id == obj.ResourceId())
+}
+
+// Prepare hashes the password a new user was created with, if any.
+func (k userKind) Prepare(delta ResourceDelta, obj Resource) error {
+	d, u := delta.(*UserDelta), obj.(*User)
+	if d.Password == nil {
+		return nil
+	}
+	var err error
+	u.PasswordHash, err = k.auth.HashPassword(*d.Password)
+	return err
+}
+
+// firstUserId is the id of the first user ever created.  Ids are never
+// reused, so it is given out only once, even if every user is deleted.
+const firstUserId = 1
+
+// Initialize makes the first user of a fresh install an admin, so that
+// there is someone to manage the others.  Later users are created as
+// usual, by admins.
+func (userKind) Initialize(tx *repo.Tx, obj Resource) error {
+	if obj.ResourceId() == firstUserId {
+		obj.(*User).Admin = true
 	}
+	return nil
+}
+
+type UserHandler struct {
+	Repo     *repo.Repo
+	Auth     *Authenticator
+	Notifier Notifier
+	Cache    CachePolicy
+	Objects  *ObjectCache
+	ETags    *ETagCache
+	Log      *Logger
 
+	// DisplayName derives display names set to ""; nil means
+	// DisplayNameFromUserName.
+	DisplayName DisplayNamePolicy
+
+	// Reserved holds the names new users may not take.
+	Reserved ReservedNames
+
+	// MaxPageSize caps the page size of listings; see ResourceHandler.
+	MaxPageSize int
+
+	// PublicURL is the base of verification links; without it, they are
+	// not sent.  See CloudServer.PublicURL.
+	PublicURL string
+}
+
+func (h UserHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/me" {
+		h.Me(w, r)
+		return
+	}
 	var userId uint64
 	var userName string
-	if m := reUserIdPath.FindStringSubmatch(r.URL.Path); m != nil {
+	var action string
+	if m := reUserIdActionPath.FindStringSubmatch(r.URL.Path); m != nil {
 		var err error
 		userId, err = strconv.ParseUint(m[1], 10, 64)
 		if err != nil {
-			log.Printf("error: ParseUint %q 10 64: %v\n", m[1], err)
-			http.NotFound(w, r)
+			h.Log.For(r).Debugf("ParseUint %q 10 64: %v", m[1], err)
+			NotFound(w, r)
 			return
 		}
+		action = m[2]
 	}
-	if m := reUserNamePath.FindStringSubmatch(r.URL.Path); m != nil {
+	if m := reUserNameActionPath.FindStringSubmatch(r.URL.Path); m != nil {
 		userName = m[1]
+		action = m[2]
 	}
-	if userId == 0 && userName == "" {
-		http.NotFound(w, r)
-		return
-	}
-	if !AllowMethods(w, r, GET, PUT, DELETE) {
+	if action != "" {
+		if !AllowMethods(w, r, POST) {
+			return
+		}
+		switch action {
+		case "password":
+			h.ChangePassword(w, r, userId, userName)
+		case "send-verification":
+			h.SendVerification(w, r, userId, userName)
+		case "disable":
+			h.SetDisabled(w, r, userId, userName, true)
+		case "enable":
+			h.SetDisabled(w, r, userId, userName, false)
+		}
 		return
 	}
-	method := strings.ToUpper(r.Method)
-	switch {
-	case method == GET || method == HEAD:
-		h.GetUser(w, r, userId, userName)
-
-	case method == PUT:
-		h.PutUser(w, r, userId, userName)
 
-	case method == DELETE:
-		h.DeleteUser(w, r, userId, userName)
-
-	default:
-		log.Printf("error: not implemented: %s %s", method, r.URL.Path)
-		http.Error(w, "Internal Server Error", 500)
-	}
+	ResourceHandler{userKind{h.Auth, h.DisplayName, h.Reserved}, h.Repo, h.Auth, h.Cache, h.Objects, h.ETags, h.Log, h.MaxPageSize}.ServeHTTP(w, r)
 }
 
-func (h UserHandler) ListUsers(w http.ResponseWriter, r *http.Request) {
-	userList := make([]User, 0)
-	err := h.Repo.View(repo.USER, func(tx *repo.Tx) error {
-		return tx.ForEach(func(_ uint64, raw []byte) error {
-			var u User
-			MustUnmarshalProto(raw, &u)
-			userList = append(userList, u)
-			return nil
-		})
-	})
-	if err != nil {
-		log.Printf("error: GET /user: %v\n", err)
-		http.Error(w, "Internal Server Error", 500)
+// Me serves GET, PUT and PATCH /me, which act on the caller's own user as
+// they would on /user/{id}.  The response depends on the credentials, so
+// it may be kept only by the client, and only with revalidation.
+func (h UserHandler) Me(w http.ResponseWriter, r *http.Request) {
+	if !AllowMethods(w, r, GET, PUT, PATCH) {
+		return
+	}
+	AddVary(w.Header(), Authorization)
+	caller, ok := GetCaller(h.Log, h.Auth, w, r)
+	if !ok {
 		return
 	}
-	raw := MustMarshalJSON(userList)
-	w.Header().Set(ContentType, MediaTypeJSON)
-	w.Header().Set(CacheControl, CacheControlPublic)
-	w.Header().Set(ETag, ETagFor(raw))
-	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(raw))
+	rh := ResourceHandler{userKind{h.Auth, h.DisplayName, h.Reserved}, h.Repo, h.Auth, CachePolicy{Object: CacheControlPrivateNoCache}, h.Objects, h.ETags, h.Log, h.MaxPageSize}
+	w.Header().Set(ContentLocation, fmt.Sprintf("/user/%d", caller.Id))
+	switch strings.ToUpper(r.Method) {
+	case GET, HEAD:
+		rh.Get(w, r, caller.Id, "")
+	case PUT:
+		rh.Put(w, r, caller.Id, "")
+	case PATCH:
+		rh.Patch(w, r, caller.Id, "")
+	}
 }
 
-func (h UserHandler) CreateUser(w http.ResponseWriter, r *http.Request) {
-	var delta UserDelta
-	if !GetJSONBody(w, r, &delta) {
+func (h UserHandler) ChangePassword(w http.ResponseWriter, r *http.Request, userId uint64, userName string) {
+	caller, ok := GetCaller(h.Log, h.Auth, w, r)
+	if !ok {
 		return
 	}
-	if err := delta.Validate(NewUser); err != nil {
+	var change PasswordChange
+	if !GetJSONBody(h.Log, w, r, &change) {
+		return
+	}
+	if change.New == nil {
+		http.Error(w, "Field 'new' must be set", 400)
+		return
+	}
+	if err := ValidatePassword("new", *change.New); err != nil {
 		http.Error(w, err.Error(), 400)
 		return
 	}
-	var u User
-	delta.Apply(&u)
-	err := h.Repo.Update(repo.USER, func(tx *repo.Tx) error {
-		var err error
-		u.Id, err = tx.AllocateId()
-		if err != nil {
-			return err
-		}
-		err = tx.Associate(u.Id, u.UserName)
-		if err != nil {
-			return err
-		}
-		return tx.Put(u.Id, MustMarshalProto(&u))
-	})
-	if _, ok := err.(*repo.DuplicateError); ok {
-		http.Error(w, "There is already a user with that name.", 409)
+	if !caller.Admin && change.Old == nil {
+		http.Error(w, "Field 'old' must be set", 400)
 		return
 	}
+	hash, err := h.Auth.HashPassword(*change.New)
 	if err != nil {
-		log.Printf("error: POST /user: %v", err)
-		http.Error(w, "Internal Server Error", 500)
+		h.Log.For(r).Errorf("POST /user %d %q password: %v", userId, userName, err)
+		InternalError(w, r)
 		return
 	}
-	raw := MustMarshalJSON(&u)
-	w.Header().Set(ContentLength, fmt.Sprintf("%d", len(raw)))
-	w.Header().Set(ContentType, MediaTypeJSON)
-	w.Header().Set(CacheControl, CacheControlNoCache)
-	w.Header().Set(ETag, ETagFor(raw))
-	w.Header().Set(Location, fmt.Sprintf("/user/%s", u.UserName))
-	w.WriteHeader(201)
-	w.Write(raw)
-}
-
-func (h UserHandler) GetUser(w http.ResponseWriter, r *http.Request, userId uint64, userName string) {
-	var u User
-	err := h.Repo.View(repo.USER, func(tx *repo.Tx) error {
+	var forbidden bool
+	err = h.Repo.UpdateContext(r.Context(), repo.USER, func(tx *repo.Tx) error {
 		var err error
 		if userId == 0 {
 			userId, err = tx.Lookup(userName)
@@ -252,37 +464,50 @@ func (h UserHandler) GetUser(w http.ResponseWriter, r *http.Request, userId uint
 		if err != nil {
 			return err
 		}
+		var u User
 		MustUnmarshalProto(value, &u)
-		return nil
+		if !caller.Admin && (caller.Id != u.Id || !CheckPassword(u.PasswordHash, *change.Old)) {
+			forbidden = true
+			return nil
+		}
+		u.PasswordHash = hash
+		err = tx.Put(userId, MustMarshalProto(&u))
+		if err != nil {
+			return err
+		}
+		return Audit(tx, r, caller.Id, userId, 204)
 	})
-	if _, ok := err.(*repo.NotFoundError); ok {
-		http.NotFound(w, r)
+	if errors.Is(err, repo.ErrNotFound) {
+		NotFound(w, r)
 		return
 	}
 	if err != nil {
-		log.Printf("error: GET /user %d %q: %v\n", userId, userName, err)
-		http.Error(w, "Internal Server Error", 500)
+		h.Log.For(r).Errorf("POST /user %d %q password: %v", userId, userName, err)
+		InternalError(w, r)
+		return
+	}
+	if forbidden {
+		http.Error(w, "Forbidden", 403)
 		return
 	}
-	raw := MustMarshalJSON(&u)
-	w.Header().Set(ContentType, MediaTypeJSON)
-	w.Header().Set(CacheControl, CacheControlPublic)
-	w.Header().Set(ETag, ETagFor(raw))
-	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(raw))
+	w.Header().Set(ContentLength, "0")
+	w.WriteHeader(204)
 }
 
-func (h UserHandler) PutUser(w http.ResponseWriter, r *http.Request, userId uint64, userName string) {
-	var delta UserDelta
-	if !GetJSONBody(w, r, &delta) {
+func (h UserHandler) SendVerification(w http.ResponseWriter, r *http.Request, userId uint64, userName string) {
+	caller, ok := GetCaller(h.Log, h.Auth, w, r)
+	if !ok {
 		return
 	}
-	if err := delta.Validate(ExistingUser); err != nil {
-		http.Error(w, err.Error(), 400)
+	if h.PublicURL == "" {
+		h.Log.For(r).Errorf("POST /user %d %q send-verification: no public URL is configured for the link", userId, userName)
+		http.Error(w, "E-mail verification is not available", 503)
 		return
 	}
 	var u User
-	var done bool
-	err := h.Repo.Update(repo.USER, func(tx *repo.Tx) error {
+	var token string
+	var forbidden, verified bool
+	err := h.Repo.UpdateContext(r.Context(), repo.USER, func(tx *repo.Tx) error {
 		var err error
 		if userId == 0 {
 			userId, err = tx.Lookup(userName)
@@ -295,46 +520,63 @@ func (h UserHandler) PutUser(w http.ResponseWriter, r *http.Request, userId uint
 			return err
 		}
 		MustUnmarshalProto(value, &u)
-		actualETag := ETagFor(MustMarshalJSON(&u))
-		expectETag := r.Header.Get(IfMatch)
-		if expectETag == "" {
-			w.Header().Set(ETag, actualETag)
-			http.Error(w, "Header 'If-Match' is required", 428)
-			done = true
+		if !caller.Admin && caller.Id != u.Id {
+			forbidden = true
 			return nil
 		}
-		if expectETag != actualETag {
-			w.Header().Set(ETag, actualETag)
-			http.Error(w, "ETag mismatch", 412)
-			done = true
+		if u.EMailVerified {
+			verified = true
 			return nil
 		}
-		delta.Apply(&u)
-		return tx.Put(userId, MustMarshalProto(&u))
+		var t *Token
+		token, t, err = NewToken(u.Id, u.EMail, VerificationTokenLifetime)
+		if err != nil {
+			return err
+		}
+		return tx.As(repo.VERIFICATION).Put(u.Id, MustMarshalProto(t))
 	})
-	if _, ok := err.(*repo.NotFoundError); ok {
-		http.NotFound(w, r)
+	if errors.Is(err, repo.ErrNotFound) {
+		NotFound(w, r)
 		return
 	}
 	if err != nil {
-		log.Printf("error: PUT /user %d %q: %v\n", userId, userName, err)
-		http.Error(w, "Internal Server Error", 500)
+		h.Log.For(r).Errorf("POST /user %d %q send-verification: %v", userId, userName, err)
+		InternalError(w, r)
+		return
+	}
+	if forbidden {
+		http.Error(w, "Forbidden", 403)
+		return
+	}
+	if verified {
+		http.Error(w, "E-mail address is already verified", 409)
 		return
 	}
-	if done {
+	link := strings.TrimSuffix(h.PublicURL, "/") + "/verify?token=" + url.QueryEscape(token)
+	body := fmt.Sprintf("Hello %s,\r\n\r\nTo verify your e-mail address, please visit:\r\n\r\n%s\r\n\r\nThis link expires in %v.\r\n", u.UserName, link, VerificationTokenLifetime)
+	if err := h.Notifier.Send(u.EMail, "Verify your e-mail address", body); err != nil {
+		h.Log.For(r).Errorf("POST /user %d %q send-verification: %v", userId, userName, err)
+		InternalError(w, r)
 		return
 	}
-	raw := MustMarshalJSON(&u)
-	w.Header().Set(ContentLength, fmt.Sprintf("%d", len(raw)))
-	w.Header().Set(ContentType, MediaTypeJSON)
-	w.Header().Set(CacheControl, CacheControlNoCache)
-	w.Header().Set(ETag, ETagFor(raw))
-	w.WriteHeader(200)
-	w.Write(raw)
+	w.Header().Set(ContentLength, "0")
+	w.WriteHeader(204)
 }
 
-func (h UserHandler) DeleteUser(w http.ResponseWriter, r *http.Request, userId uint64, userName string) {
-	err := h.Repo.Update(repo.USER, func(tx *repo.Tx) error {
+// SetDisabled serves POST /user/{ref}/disable and /enable, which only
+// admins may use.  Admins cannot disable themselves, lest nobody be left to
+// undo it.
+func (h UserHandler) SetDisabled(w http.ResponseWriter, r *http.Request, userId uint64, userName string, disabled bool) {
+	caller, ok := GetCaller(h.Log, h.Auth, w, r)
+	if !ok {
+		return
+	}
+	if !caller.Admin {
+		http.Error(w, "Forbidden", 403)
+		return
+	}
+	var self bool
+	err := h.Repo.UpdateContext(r.Context(), repo.USER, func(tx *repo.Tx) error {
 		var err error
 		if userId == 0 {
 			userId, err = tx.Lookup(userName)
@@ -348,19 +590,32 @@ func (h UserHandler) DeleteUser(w http.ResponseWriter, r *http.Request, userId u
 		}
 		var u User
 		MustUnmarshalProto(value, &u)
-		err = tx.Delete(userId)
+		if disabled && u.Id == caller.Id {
+			self = true
+			return nil
+		}
+		if u.Disabled == disabled {
+			return nil
+		}
+		u.Disabled = disabled
+		u.Updated = time.Now().Unix()
+		err = tx.Put(userId, MustMarshalProto(&u))
 		if err != nil {
 			return err
 		}
-		return tx.Unassociate(u.UserName)
+		return Audit(tx, r, caller.Id, userId, 204)
 	})
-	if _, ok := err.(*repo.NotFoundError); ok {
-		http.NotFound(w, r)
+	if errors.Is(err, repo.ErrNotFound) {
+		NotFound(w, r)
 		return
 	}
 	if err != nil {
-		log.Printf("error: DELETE /user %d %q: %v\n", userId, userName, err)
-		http.Error(w, "Internal Server Error", 500)
+		h.Log.For(r).Errorf("POST /user %d %q disable=%t: %v", userId, userName, disabled, err)
+		InternalError(w, r)
+		return
+	}
+	if self {
+		http.Error(w, "You cannot disable your own account", 409)
 		return
 	}
 	w.Header().Set(ContentLength, "0")
@@ -0,0 +1,389 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestUserWriteAuthorization(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	addTestUser(t, auth, "alice", false)
+	addTestUser(t, auth, "bob", false)
+	h := UserHandler{Repo: rp, Auth: auth}
+
+	for _, method := range []string{PUT, PATCH} {
+		r := newTestRequest(method, "/user/root", `{"email":"mallory@example.com"}`)
+		r.Header.Set(IfUnmodifiedSince, "Fri, 01 Jan 2100 00:00:00 GMT")
+		w := serve(h, r, "")
+		expectStatus(t, w, 401)
+		if w.Header().Get(WWWAuthenticate) == "" {
+			t.Errorf("anonymous %s: no %s header", method, WWWAuthenticate)
+		}
+
+		r = newTestRequest(method, "/user/alice", `{"email":"mallory@example.com"}`)
+		r.Header.Set(IfUnmodifiedSince, "Fri, 01 Jan 2100 00:00:00 GMT")
+		expectStatus(t, serve(h, r, "bob"), 403)
+	}
+	expectStatus(t, serve(h, newTestRequest(DELETE, "/user/alice", ""), ""), 401)
+	expectStatus(t, serve(h, newTestRequest(DELETE, "/user/alice", ""), "bob"), 403)
+
+	w := serve(h, newTestRequest(GET, "/user/alice", ""), "")
+	expectStatus(t, w, 200)
+	if body := w.Body.String(); !strings.Contains(body, "alice@example.com") {
+		t.Errorf("alice was changed: %s", body)
+	}
+
+	// Users may change themselves, and admins anyone.
+	expectStatus(t, serve(h, newTestRequest(PATCH, "/user/alice", `{"phone":"+15550100"}`), "alice"), 200)
+	expectStatus(t, serve(h, newTestRequest(PATCH, "/user/bob", `{"phone":"+15550101"}`), "root"), 200)
+	expectStatus(t, serve(h, newTestRequest(DELETE, "/user/bob", ""), "bob"), 204)
+	expectStatus(t, serve(h, newTestRequest(DELETE, "/user/alice", ""), "root"), 204)
+}
+
+func TestUserBootstrap(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	h := UserHandler{Repo: rp, Auth: auth}
+	home := HomeHandler{Repo: rp}
+	newUser := func(name string) string {
+		return `{"user_name":"` + name + `","email":"` + name + `@example.com","password":"` + testPassword + `"}`
+	}
+	firstRun := func() bool {
+		w := serve(home, newTestRequest(GET, "/", ""), "")
+		expectStatus(t, w, 200)
+		return strings.Contains(w.Body.String(), "no users yet")
+	}
+
+	if !firstRun() {
+		t.Error("home page of a fresh install does not ask for the first user")
+	}
+	w := serve(h, newTestRequest(POST, "/user", newUser("root")), "")
+	expectStatus(t, w, 201)
+	if !strings.Contains(w.Body.String(), `"admin":true`) {
+		t.Errorf("first user is not an admin: %s", w.Body.String())
+	}
+	if firstRun() {
+		t.Error("home page still asks for the first user")
+	}
+
+	// After that, only admins create users, and not as admins.
+	expectStatus(t, serve(h, newTestRequest(POST, "/user", newUser("alice")), ""), 401)
+	w = serve(h, newTestRequest(POST, "/user", newUser("alice")), "root")
+	expectStatus(t, w, 201)
+	if strings.Contains(w.Body.String(), `"admin":true`) {
+		t.Errorf("second user is an admin: %s", w.Body.String())
+	}
+	expectStatus(t, serve(h, newTestRequest(POST, "/user", newUser("bob")), "alice"), 403)
+
+	// Deleting every user does not reopen the bootstrap.
+	expectStatus(t, serve(h, newTestRequest(DELETE, "/user/alice", ""), "alice"), 204)
+	expectStatus(t, serve(h, newTestRequest(DELETE, "/user/root", ""), "root"), 204)
+	expectStatus(t, serve(h, newTestRequest(POST, "/user", newUser("mallory")), ""), 401)
+	if firstRun() {
+		t.Error("home page asks for the first user again")
+	}
+}
+
+func TestSendVerificationLink(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "alice", false)
+	n := make(testNotifier, 1)
+	h := UserHandler{Repo: rp, Auth: auth, Notifier: n}
+
+	expectStatus(t, serve(h, newTestRequest(POST, "/user/alice/send-verification", ""), "alice"), 503)
+
+	h.PublicURL = "https://cloud9.example/"
+	r := newTestRequest(POST, "/user/alice/send-verification", "")
+	r.Host = "evil.example"
+	expectStatus(t, serve(h, r, "alice"), 204)
+	m := expectMessage(t, n)
+	if !strings.Contains(m.Body, "https://cloud9.example/verify?token=") || strings.Contains(m.Body, "evil.example") {
+		t.Errorf("the mail does not link to the public URL: %s", m.Body)
+	}
+}
+
+func TestDisplayNamePolicy(t *testing.T) {
+	for _, test := range []struct {
+		policy DisplayNamePolicy
+		want   string
+	}{
+		{nil, "alice"},
+		{DisplayNameFromUserName, "alice"},
+		{DisplayNameTitle, "Alice"},
+		{DisplayNameBlank, ""},
+	} {
+		empty := ""
+		u := &User{UserName: "alice", DisplayName: "Alice Liddell"}
+		d := &UserDelta{DisplayName: &empty, displayName: test.policy}
+		d.Apply(u)
+		if u.DisplayName != test.want {
+			t.Errorf("display name %q, want %q", u.DisplayName, test.want)
+		}
+	}
+	if got := DisplayNameTitle("élodie"); got != "Élodie" {
+		t.Errorf("DisplayNameTitle(élodie) = %q", got)
+	}
+
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	h := UserHandler{Repo: rp, Auth: auth, DisplayName: DisplayNameTitle}
+	expectStatus(t, serve(h, newTestRequest(POST, "/user", `{"user_name":"bob","display_name":"","email":"bob@example.com"}`), "root"), 201)
+	if u := getTestUser(t, h, "bob"); u.DisplayName != "Bob" {
+		t.Errorf("new user's display name %q, want Bob", u.DisplayName)
+	}
+	expectStatus(t, serve(h, newTestRequest(PATCH, "/user/bob", `{"display_name":"Robert"}`), "root"), 200)
+	expectStatus(t, serve(h, newTestRequest(PATCH, "/user/bob", `{"display_name":""}`), "root"), 200)
+	if u := getTestUser(t, h, "bob"); u.DisplayName != "Bob" {
+		t.Errorf("reset display name %q, want Bob", u.DisplayName)
+	}
+}
+
+func getTestUser(t *testing.T, h UserHandler, name string) *User {
+	t.Helper()
+	w := serve(h, newTestRequest(GET, "/user/"+name, ""), "root")
+	expectStatus(t, w, 200)
+	u := &User{}
+	if err := json.Unmarshal(w.Body.Bytes(), u); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestUserContactFields(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	addTestUser(t, auth, "alice", false)
+	h := UserHandler{Repo: rp, Auth: auth}
+
+	expectStatus(t, serve(h, newTestRequest(PATCH, "/user/alice", `{"phone":"+15551234567","timezone":"Europe/Paris"}`), "alice"), 200)
+	if u := getTestUser(t, h, "alice"); u.Phone != "+15551234567" || u.Timezone != "Europe/Paris" {
+		t.Errorf("phone %q, timezone %q", u.Phone, u.Timezone)
+	}
+	for _, body := range []string{
+		`{"phone":"5551234567"}`,
+		`{"phone":"+0551234567"}`,
+		`{"phone":"+1 555 123 4567"}`,
+		`{"phone":"+1234567890123456"}`,
+		`{"timezone":"Mars/Olympus_Mons"}`,
+		`{"timezone":"Local"}`,
+		`{"timezone":"../../etc/passwd"}`,
+	} {
+		w := serve(h, newTestRequest(PATCH, "/user/alice", body), "alice")
+		expectStatus(t, w, 400)
+		field := strings.SplitN(body, `"`, 3)[1]
+		if !strings.Contains(w.Body.String(), "'"+field+"'") {
+			t.Errorf("PATCH %s: error does not name the field: %s", body, w.Body.String())
+		}
+	}
+	if u := getTestUser(t, h, "alice"); u.Phone != "+15551234567" || u.Timezone != "Europe/Paris" {
+		t.Errorf("rejected changes were made: phone %q, timezone %q", u.Phone, u.Timezone)
+	}
+
+	// The other fields are left alone, and "" clears them.
+	expectStatus(t, serve(h, newTestRequest(PATCH, "/user/alice", `{"timezone":""}`), "alice"), 200)
+	if u := getTestUser(t, h, "alice"); u.Phone != "+15551234567" || u.Timezone != "" {
+		t.Errorf("phone %q, timezone %q", u.Phone, u.Timezone)
+	}
+}
+
+func TestUserMetadata(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	addTestUser(t, auth, "alice", false)
+	h := UserHandler{Repo: rp, Auth: auth}
+	patch := func(body string, status int) {
+		t.Helper()
+		expectStatus(t, serve(h, newTestRequest(PATCH, "/user/alice", body), "alice"), status)
+	}
+	expect := func(want map[string]string) {
+		t.Helper()
+		u := getTestUser(t, h, "alice")
+		if len(u.Metadata) != len(want) {
+			t.Fatalf("metadata %v, want %v", u.Metadata, want)
+		}
+		for k, v := range want {
+			if u.Metadata[k] != v {
+				t.Fatalf("metadata %v, want %v", u.Metadata, want)
+			}
+		}
+	}
+
+	patch(`{"metadata":{"department":"R&D","location":"Paris"}}`, 200)
+	expect(map[string]string{"department": "R&D", "location": "Paris"})
+	patch(`{"metadata":{"location":"Lyon"}}`, 200)
+	expect(map[string]string{"department": "R&D", "location": "Lyon"})
+	patch(`{"metadata":{"department":null,"missing":null}}`, 200)
+	expect(map[string]string{"location": "Lyon"})
+	patch(`{"phone":"+15550100"}`, 200)
+	expect(map[string]string{"location": "Lyon"})
+
+	patch(`{"metadata":{"1st":"x"}}`, 400)
+	patch(`{"metadata":{"`+strings.Repeat("k", MaxMetadataKeyLength+1)+`":"x"}}`, 400)
+	patch(`{"metadata":{"note":"`+strings.Repeat("v", MaxMetadataValueLength+1)+`"}}`, 400)
+	patch(`{"metadata":{"note":"a\u0007b"}}`, 400)
+	expect(map[string]string{"location": "Lyon"})
+
+	// The limit on keys counts those already set.
+	var keys []string
+	for i := 1; i < MaxMetadataKeys; i++ {
+		keys = append(keys, fmt.Sprintf(`"k%d":"v"`, i))
+	}
+	patch(`{"metadata":{`+strings.Join(keys, ",")+`}}`, 200)
+	patch(`{"metadata":{"one":"too many"}}`, 422)
+	patch(`{"metadata":{"location":null,"one":"replaces it"}}`, 200)
+}
+
+func TestUserNameCase(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	h := UserHandler{Repo: rp, Auth: auth}
+
+	expectStatus(t, serve(h, newTestRequest(POST, "/user", `{"user_name":"Alice","email":"alice@example.com"}`), "root"), 201)
+	for _, name := range []string{"Alice", "alice", "ALICE"} {
+		if u := getTestUser(t, h, name); u.UserName != "Alice" {
+			t.Errorf("GET /user/%s gave user_name %q, want Alice", name, u.UserName)
+		}
+	}
+	expectStatus(t, serve(h, newTestRequest(POST, "/user", `{"user_name":"alice","email":"other@example.com"}`), "root"), 409)
+	expectStatus(t, serve(h, newTestRequest(POST, "/user", `{"user_name":"ALICE","email":"other@example.com"}`), "root"), 409)
+
+	// Changing the user through another case keeps the name as created.
+	expectStatus(t, serve(h, newTestRequest(PATCH, "/user/aLiCe", `{"display_name":"Alice L."}`), "root"), 200)
+	if u := getTestUser(t, h, "alice"); u.UserName != "Alice" || u.DisplayName != "Alice L." {
+		t.Errorf("user_name %q, display_name %q", u.UserName, u.DisplayName)
+	}
+
+	// Once deleted, the name is free in any case.
+	expectStatus(t, serve(h, newTestRequest(DELETE, "/user/alice", ""), "root"), 204)
+	expectStatus(t, serve(h, newTestRequest(POST, "/user", `{"user_name":"aLICE","email":"alice@example.com"}`), "root"), 201)
+	if u := getTestUser(t, h, "Alice"); u.UserName != "aLICE" {
+		t.Errorf("user_name %q, want aLICE", u.UserName)
+	}
+}
+
+func TestMe(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	alice := addTestUser(t, auth, "alice", false)
+	h := UserHandler{Repo: rp, Auth: auth}
+
+	w := serve(h, newTestRequest(GET, "/me", ""), "")
+	expectStatus(t, w, 401)
+	if w.Header().Get(WWWAuthenticate) == "" {
+		t.Errorf("anonymous GET /me: no %s header", WWWAuthenticate)
+	}
+	expectStatus(t, serve(h, newTestRequest(PATCH, "/me", `{"phone":"+15550100"}`), ""), 401)
+
+	w = serve(h, newTestRequest(GET, "/me", ""), "alice")
+	expectStatus(t, w, 200)
+	var u User
+	if err := json.Unmarshal(w.Body.Bytes(), &u); err != nil {
+		t.Fatal(err)
+	}
+	if u.Id != alice.Id || u.UserName != "alice" {
+		t.Errorf("GET /me as alice gave %d %q", u.Id, u.UserName)
+	}
+	if got, want := w.Header().Get(ContentLocation), fmt.Sprintf("/user/%d", alice.Id); got != want {
+		t.Errorf("%s %q, want %q", ContentLocation, got, want)
+	}
+	if !strings.Contains(w.Header().Get(Vary), Authorization) {
+		t.Errorf("%s %q does not include %s", Vary, w.Header().Get(Vary), Authorization)
+	}
+	if got := w.Header().Get(CacheControl); got != CacheControlPrivateNoCache {
+		t.Errorf("%s %q, want %q", CacheControl, got, CacheControlPrivateNoCache)
+	}
+	etag := w.Header().Get(ETag)
+
+	expectStatus(t, serve(h, newTestRequest(PATCH, "/me", `{"phone":"+15550100"}`), "alice"), 200)
+	if u := getTestUser(t, h, "alice"); u.Phone != "+15550100" {
+		t.Errorf("PATCH /me did not change alice: phone %q", u.Phone)
+	}
+	if u := getTestUser(t, h, "root"); u.Phone != "" {
+		t.Errorf("PATCH /me changed root: phone %q", u.Phone)
+	}
+
+	// PUT /me takes the same preconditions as PUT /user/{id}.
+	r := newTestRequest(PUT, "/me", `{"email":"alice@example.org"}`)
+	r.Header.Set(IfMatch, etag)
+	expectStatus(t, serve(h, r, "alice"), 412)
+	w = serve(h, newTestRequest(GET, "/me", ""), "alice")
+	r = newTestRequest(PUT, "/me", `{"email":"alice@example.org"}`)
+	r.Header.Set(IfMatch, w.Header().Get(ETag))
+	expectStatus(t, serve(h, r, "alice"), 200)
+	if u := getTestUser(t, h, "alice"); u.EMail != "alice@example.org" {
+		t.Errorf("PUT /me did not change alice: email %q", u.EMail)
+	}
+
+	expectStatus(t, serve(h, newTestRequest(DELETE, "/me", ""), "alice"), 405)
+}
+
+func TestDisableUser(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	alice := addTestUser(t, auth, "alice", false)
+	addTestUser(t, auth, "bob", false)
+	h := UserHandler{Repo: rp, Auth: auth}
+	login := LoginHandler{Auth: auth}
+	groups := GroupHandler{Repo: rp, Auth: auth}
+	addTestGroups(t, groups, 1)
+	expectStatus(t, serve(groups, newTestRequest(PATCH, "/group/g1", fmt.Sprintf(`{"users":[%d]}`, alice.Id)), "root"), 200)
+
+	expectStatus(t, serve(h, newTestRequest(POST, "/user/alice/disable", ""), ""), 401)
+	expectStatus(t, serve(h, newTestRequest(POST, "/user/alice/disable", ""), "bob"), 403)
+	expectStatus(t, serve(h, newTestRequest(POST, "/user/root/disable", ""), "root"), 409)
+	expectStatus(t, serve(h, newTestRequest(POST, "/user/nobody/disable", ""), "root"), 404)
+	expectStatus(t, serve(h, newTestRequest(POST, "/user/alice/disable", ""), "root"), 204)
+	expectStatus(t, serve(h, newTestRequest(POST, fmt.Sprintf("/user/%d/disable", alice.Id), ""), "root"), 204)
+
+	// Alice cannot authenticate, even with the right password, but a wrong
+	// one gives nothing away.
+	expectStatus(t, serve(login, newTestRequest(POST, "/login", ""), "alice"), 403)
+	expectStatus(t, serve(h, newTestRequest(PATCH, "/me", `{"phone":"+15550100"}`), "alice"), 403)
+	r := newTestRequest(POST, "/login", "")
+	r.SetBasicAuth("alice", "not"+testPassword)
+	expectStatus(t, serve(login, r, ""), 401)
+
+	// Her record and memberships are kept.
+	if u := getTestUser(t, h, "alice"); !u.Disabled {
+		t.Error("alice is not marked disabled")
+	}
+	w := serve(h, newTestRequest(GET, "/user", ""), "root")
+	expectStatus(t, w, 200)
+	if !strings.Contains(w.Body.String(), `"alice"`) {
+		t.Errorf("GET /user does not list alice: %s", w.Body.String())
+	}
+	if got := groupMembers(t, groups, "/group/g1"); len(got) != 1 || got[0] != alice.Id {
+		t.Errorf("members of g1 %v, want [%d]", got, alice.Id)
+	}
+
+	expectStatus(t, serve(h, newTestRequest(POST, "/user/alice/enable", ""), "bob"), 403)
+	expectStatus(t, serve(h, newTestRequest(POST, "/user/alice/enable", ""), "root"), 204)
+	expectStatus(t, serve(login, newTestRequest(POST, "/login", ""), "alice"), 200)
+	if u := getTestUser(t, h, "alice"); u.Disabled {
+		t.Error("alice is still marked disabled")
+	}
+}
+
+func TestUserDuplicateNameIsGeneric(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	addTestUser(t, auth, "alice", false)
+	h := UserHandler{Repo: rp, Auth: auth}
+	w := serve(h, newTestRequest(POST, "/user", `{"user_name":"alice","email":"alice2@example.com"}`), "root")
+	expectStatus(t, w, 409)
+	if got, want := w.Body.String(), "There is already a user with that name.\n"; got != want {
+		t.Errorf("got body %q, want %q", got, want)
+	}
+}
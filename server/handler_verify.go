@@ -0,0 +1,73 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/cloud9-tools/cloud9/repo"
+)
+
+const VerificationTokenLifetime = 24 * time.Hour
+
+type VerifyHandler struct {
+	Repo *repo.Repo
+	Log  *Logger
+}
+
+func (h VerifyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/verify" {
+		NotFound(w, r)
+		return
+	}
+	if !AllowMethods(w, r, GET) {
+		return
+	}
+	userId, secret, err := ParseToken(r.URL.Query().Get("token"))
+	if err != nil {
+		http.Error(w, "Invalid or expired token", 400)
+		return
+	}
+	now := time.Now()
+	var invalid bool
+	err = h.Repo.UpdateContext(r.Context(), repo.USER, func(tx *repo.Tx) error {
+		value, err := tx.As(repo.VERIFICATION).Get(userId)
+		if err != nil {
+			return err
+		}
+		var t Token
+		MustUnmarshalProto(value, &t)
+		value, err = tx.Get(userId)
+		if err != nil {
+			return err
+		}
+		var u User
+		MustUnmarshalProto(value, &u)
+		if !t.Check(secret, now) || t.EMail != u.EMail {
+			invalid = true
+			return nil
+		}
+		u.EMailVerified = true
+		if err := tx.Put(userId, MustMarshalProto(&u)); err != nil {
+			return err
+		}
+		return tx.As(repo.VERIFICATION).Delete(userId)
+	})
+	if errors.Is(err, repo.ErrNotFound) {
+		invalid = true
+		err = nil
+	}
+	if err != nil {
+		h.Log.For(r).Errorf("GET /verify %d: %v", userId, err)
+		InternalError(w, r)
+		return
+	}
+	if invalid {
+		http.Error(w, "Invalid or expired token", 400)
+		return
+	}
+	w.Header().Set(ContentType, MediaTypeText)
+	w.Header().Set(CacheControl, CacheControlNoCache)
+	w.WriteHeader(200)
+	w.Write([]byte("Your e-mail address has been verified.\r\n"))
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Graceful restarts.  On SIGUSR2, ServeMulti starts a new copy of the
+// running program with the same command line, passing it the listening
+// sockets, and then stops accepting and drains as it does on SIGTERM.
+// The new process cannot open the repository until the old one has
+// closed it, but the sockets stay open throughout, so connections made in
+// the meantime wait in the listen queue instead of being refused.
+//
+// The sockets are passed as file descriptors 3, 4, ... and their count
+// in the environment variable named by ListenFDsEnv.  They are in the
+// order ServeMulti was given them: public listeners first, then admin
+// listeners.  ListenAndServeMulti adopts them in the same order in place
+// of binding its addresses, so the new process must be asked to listen on
+// the same addresses as the old one, which rerunning the command line
+// does.
+
+// ListenFDsEnv names the environment variable that tells a new process
+// how many listening sockets it has inherited.
+const ListenFDsEnv = "C9_LISTEN_FDS"
+
+// firstListenFD is the first inherited descriptor, after stdin, stdout and
+// stderr.
+const firstListenFD = 3
+
+// InheritedListeners returns the listening sockets passed down by a
+// parent process, or nil if there are none.  It unsets ListenFDsEnv, so
+// that only the first call adopts them.
+func InheritedListeners() ([]net.Listener, error) {
+	s := os.Getenv(ListenFDsEnv)
+	if s == "" {
+		return nil, nil
+	}
+	os.Unsetenv(ListenFDsEnv)
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("%s: invalid count %q", ListenFDsEnv, s)
+	}
+	ls := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		fd := firstListenFD + i
+		f := os.NewFile(uintptr(fd), fmt.Sprintf("listener%d", i))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return nil, fmt.Errorf("%s: fd %d: %v", ListenFDsEnv, fd, err)
+		}
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
+
+// StartSuccessor starts a new copy of the running program with the same
+// arguments, passing it ls.
+func StartSuccessor(ls []net.Listener) (*os.Process, error) {
+	files := []*os.File{os.Stdin, os.Stdout, os.Stderr}
+	defer (func() {
+		for _, f := range files[firstListenFD:] {
+			f.Close()
+		}
+	})()
+	for _, l := range ls {
+		fl, ok := l.(interface {
+			File() (*os.File, error)
+		})
+		if !ok {
+			return nil, fmt.Errorf("cannot pass listener on %v", l.Addr())
+		}
+		f, err := fl.File()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, ListenFDsEnv+"=") {
+			env = append(env, kv)
+		}
+	}
+	env = append(env, fmt.Sprintf("%s=%d", ListenFDsEnv, len(ls)))
+	return os.StartProcess(exe, os.Args, &os.ProcAttr{Env: env, Files: files})
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+// handoffTestEnv names the environment variable that makes
+// TestHandoffHelper act as the process a test has started.
+const handoffTestEnv = "C9_HANDOFF_TEST"
+
+// TestHandoffHelper is not a test, but the child process of the tests
+// below, doing what handoffTestEnv says.
+func TestHandoffHelper(t *testing.T) {
+	mode := os.Getenv(handoffTestEnv)
+	if mode == "" {
+		return
+	}
+	switch mode {
+	case "list":
+		ls, err := InheritedListeners()
+		if err != nil {
+			fmt.Println("error:", err)
+			os.Exit(1)
+		}
+		for _, l := range ls {
+			fmt.Println(l.Addr())
+		}
+	case "restart":
+		ls, err := InheritedListeners()
+		if err != nil {
+			fmt.Println("error:", err)
+			os.Exit(1)
+		}
+		if len(ls) > 0 {
+			fmt.Println("inherited", ls[0].Addr())
+			break
+		}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err == nil {
+			fmt.Println("listening", l.Addr())
+			var p *os.Process
+			if p, err = StartSuccessor([]net.Listener{l}); err == nil {
+				_, err = p.Wait()
+			}
+		}
+		if err != nil {
+			fmt.Println("error:", err)
+			os.Exit(1)
+		}
+	case "serve":
+		srv, err := New(os.Getenv("C9_HANDOFF_TEST_DIR"))
+		if err == nil {
+			srv.Log = NewLogger(io.Discard, ERROR)
+			err = srv.ListenAndServeMulti([]ListenAddr{
+				{"tcp", "127.0.0.1:0", true},
+				{"tcp", "127.0.0.1:0", false},
+			})
+		}
+		if err != nil {
+			fmt.Println("error:", err)
+			os.Exit(1)
+		}
+	}
+	os.Exit(0)
+}
+
+// handoffCommand returns a command running TestHandoffHelper in mode,
+// passing it ls as inherited listeners.
+func handoffCommand(t *testing.T, mode string, ls ...net.Listener) *exec.Cmd {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHandoffHelper$")
+	cmd.Env = append(os.Environ(), handoffTestEnv+"="+mode)
+	for _, l := range ls {
+		f, err := l.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { f.Close() })
+		cmd.ExtraFiles = append(cmd.ExtraFiles, f)
+	}
+	if len(ls) > 0 {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%d", ListenFDsEnv, len(ls)))
+	}
+	return cmd
+}
+
+// listenTest returns n listeners on the loopback interface, closed when
+// the test ends.
+func listenTest(t *testing.T, n int) []net.Listener {
+	t.Helper()
+	var ls []net.Listener
+	for i := 0; i < n; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { l.Close() })
+		ls = append(ls, l)
+	}
+	return ls
+}
+
+func TestInheritedListeners(t *testing.T) {
+	if ls, err := InheritedListeners(); ls != nil || err != nil {
+		t.Fatalf("with no %s: %v, %v", ListenFDsEnv, ls, err)
+	}
+	for _, s := range []string{"x", "-1"} {
+		os.Setenv(ListenFDsEnv, s)
+		if _, err := InheritedListeners(); err == nil || !strings.Contains(err.Error(), "invalid count") {
+			t.Errorf("with %s=%s: %v", ListenFDsEnv, s, err)
+		}
+		if v, ok := os.LookupEnv(ListenFDsEnv); ok {
+			t.Errorf("%s is still %q", ListenFDsEnv, v)
+		}
+	}
+
+	ls := listenTest(t, 2)
+	out, err := handoffCommand(t, "list", ls...).Output()
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	want := fmt.Sprintf("%v\n%v\n", ls[0].Addr(), ls[1].Addr())
+	if string(out) != want {
+		t.Errorf("inherited %q, want %q", out, want)
+	}
+
+	// A descriptor that is not a socket.
+	f, err := os.Open(os.Args[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	cmd := handoffCommand(t, "list")
+	cmd.ExtraFiles = []*os.File{f}
+	cmd.Env = append(cmd.Env, ListenFDsEnv+"=1")
+	out, err = cmd.Output()
+	if err == nil || !strings.Contains(string(out), "fd 3") {
+		t.Errorf("inheriting a file gave %v: %s", err, out)
+	}
+}
+
+func TestStartSuccessor(t *testing.T) {
+	out, err := handoffCommand(t, "restart").Output()
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) != 2 || strings.TrimPrefix(lines[0], "listening ") != strings.TrimPrefix(lines[1], "inherited ") {
+		t.Errorf("got %q, want the successor to inherit the listener", out)
+	}
+}
+
+func TestListenAndServeMultiInherited(t *testing.T) {
+	ls := listenTest(t, 2)
+	cmd := handoffCommand(t, "serve", ls...)
+	cmd.Env = append(cmd.Env, "C9_HANDOFF_TEST_DIR="+t.TempDir())
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+	go func() {
+		// Only failures are printed.
+		if s := bufio.NewScanner(stdout); s.Scan() {
+			t.Errorf("child: %s", s.Text())
+		}
+	}()
+	for _, l := range ls {
+		l.Close()
+	}
+
+	// The first inherited listener is public, whatever the order of the
+	// addresses, and the second is admin.
+	public, admin := "http://"+ls[0].Addr().String(), "http://"+ls[1].Addr().String()
+	client := http.Client{Timeout: 5 * time.Second}
+	for _, test := range []struct {
+		url  string
+		want int
+	}{
+		{public + "/livez", 200},
+		{admin + "/livez", 404},
+	} {
+		resp, err := client.Get(test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.want {
+			t.Errorf("GET %s: got status %d, want %d", test.url, resp.StatusCode, test.want)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloud9-tools/cloud9/repo"
+)
+
+const testPassword = "sekritsekrit"
+
+// newTestRepo opens a repo in a temporary directory that is removed when
+// the test ends.
+func newTestRepo(t testing.TB) *repo.Repo {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "cloud9-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	rp, err := repo.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { rp.Close() })
+	return rp
+}
+
+// newTestAuth returns an Authenticator for rp with the cheapest bcrypt
+// cost, so that tests don't spend their time hashing.
+func newTestAuth(rp *repo.Repo) *Authenticator {
+	return &Authenticator{Repo: rp, PasswordCost: 4}
+}
+
+// addTestUser stores a user with password testPassword directly in the
+// repo, bypassing the HTTP API and its bootstrap rules.
+func addTestUser(t testing.TB, auth *Authenticator, name string, admin bool) *User {
+	t.Helper()
+	hash, err := auth.HashPassword(testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &User{UserName: name, EMail: name + "@example.com", PasswordHash: hash, Admin: admin}
+	err = auth.Repo.Update(repo.USER, func(tx *repo.Tx) error {
+		id, err := tx.AllocateId()
+		if err != nil {
+			return err
+		}
+		u.Id = id
+		if err := tx.Associate(id, name); err != nil {
+			return err
+		}
+		return tx.Put(id, MustMarshalProto(u))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// newTestRequest returns a request from a remote peer.  A non-empty body
+// is sent as JSON.
+func newTestRequest(method, path, body string) *http.Request {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		r.Header.Set(ContentType, MediaTypeJSON)
+	}
+	r.RemoteAddr = "192.0.2.1:1234"
+	return r
+}
+
+// serve runs r through h and returns the recorded response.  If user is
+// not empty, r carries that user's credentials.
+func serve(h http.Handler, r *http.Request, user string) *httptest.ResponseRecorder {
+	if user != "" {
+		r.SetBasicAuth(user, testPassword)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// expectStatus fails the test if w does not have the given status.
+func expectStatus(t *testing.T, w *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	if w.Code != status {
+		t.Fatalf("got status %d, want %d; body: %s", w.Code, status, w.Body.String())
+	}
+}
+
+// testMessage is a message sent through a testNotifier.
+type testMessage struct {
+	To, Subject, Body string
+}
+
+// testNotifier passes the messages it is asked to send to a channel.
+type testNotifier chan testMessage
+
+func (n testNotifier) Send(to, subject, body string) error {
+	n <- testMessage{to, subject, body}
+	return nil
+}
+
+// expectMessage waits for n to be sent a message.
+func expectMessage(t *testing.T, n testNotifier) testMessage {
+	t.Helper()
+	select {
+	case m := <-n:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message was sent")
+		return testMessage{}
+	}
+}
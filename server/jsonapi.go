@@ -0,0 +1,80 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// JSON:API envelopes.  Responses describing users, groups and blobs are
+// bare JSON by default; a client whose "Accept" header prefers
+// MediaTypeJSONAPI gets the same objects wrapped as JSON:API resource
+// objects instead, under "data", with "self" links.
+
+// JSONAPIResource is a JSON:API resource object.  Attributes holds the
+// object's own JSON fields, less its id.
+type JSONAPIResource struct {
+	Type       string                     `json:"type"`
+	Id         string                     `json:"id"`
+	Attributes map[string]json.RawMessage `json:"attributes,omitempty"`
+	Links      map[string]string          `json:"links,omitempty"`
+}
+
+// JSONAPIDocument is a JSON:API top-level document.  Data is a
+// JSONAPIResource or a slice of them.
+type JSONAPIDocument struct {
+	Data  interface{}            `json:"data"`
+	Links map[string]string      `json:"links,omitempty"`
+	Meta  map[string]interface{} `json:"meta,omitempty"`
+}
+
+// NewJSONAPIResource wraps v, an object of the given type and id whose
+// canonical URL is self.
+func NewJSONAPIResource(typ string, id uint64, self string, v interface{}) JSONAPIResource {
+	var attrs map[string]json.RawMessage
+	MustUnmarshalJSON(MustMarshalJSON(v), &attrs)
+	delete(attrs, "id")
+	return JSONAPIResource{
+		Type:       typ,
+		Id:         strconv.FormatUint(id, 10),
+		Attributes: attrs,
+		Links:      map[string]string{"self": self},
+	}
+}
+
+// NewJSONAPIItem returns a document holding the single resource res.
+func NewJSONAPIItem(res JSONAPIResource) *JSONAPIDocument {
+	return &JSONAPIDocument{Data: res, Links: res.Links}
+}
+
+// NewJSONAPIList returns a document holding the list at path.  Lists are
+// served whole, so the pagination links all name the one page.
+func NewJSONAPIList(path string, list []JSONAPIResource) *JSONAPIDocument {
+	return &JSONAPIDocument{
+		Data: list,
+		Links: map[string]string{
+			"self":  path,
+			"first": path,
+			"last":  path,
+		},
+	}
+}
+
+// EncodeJSON marshals v for the response to r, returning the body and its
+// media type.  If the client prefers MediaTypeJSONAPI, the body is the
+// document returned by doc instead.  See MarshalJSONFor for "?pretty".
+func EncodeJSON(w http.ResponseWriter, r *http.Request, v interface{}, doc func() *JSONAPIDocument) ([]byte, string) {
+	if NegotiateJSON(w, r) == MediaTypeJSONAPI {
+		return MarshalJSONFor(r, doc()), MediaTypeJSONAPI
+	}
+	return MarshalJSONFor(r, v), MediaTypeJSON
+}
+
+// NegotiateJSON returns the media type EncodeJSON uses for the response to
+// r: MediaTypeJSONAPI if the client prefers it, otherwise MediaTypeJSON.
+func NegotiateJSON(w http.ResponseWriter, r *http.Request) string {
+	if NegotiateContentType(w, r, MediaTypeJSON, MediaTypeJSONAPI) == MediaTypeJSONAPI {
+		return MediaTypeJSONAPI
+	}
+	return MediaTypeJSON
+}
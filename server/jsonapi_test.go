@@ -0,0 +1,63 @@
+package server
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestJSONAPIEnvelope(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	h := GroupHandler{Repo: rp, Auth: auth}
+	addTestGroups(t, h, 2)
+
+	get := func(path, accept string) []byte {
+		t.Helper()
+		r := newTestRequest(GET, path, "")
+		r.Header.Set(Accept, accept)
+		w := serve(h, r, "")
+		expectStatus(t, w, 200)
+		want := MediaTypeJSON
+		if accept == MediaTypeJSONAPI {
+			want = MediaTypeJSONAPI
+		}
+		if got := w.Header().Get(ContentType); got != want {
+			t.Errorf("GET %s with Accept %q: %s is %q, want %q", path, accept, ContentType, got, want)
+		}
+		if got := w.Header().Get(Vary); got != Accept {
+			t.Errorf("GET %s: %s is %q", path, Vary, got)
+		}
+		return w.Body.Bytes()
+	}
+
+	var g Group
+	if err := json.Unmarshal(get("/group/g1", MediaTypeJSON), &g); err != nil || g.GroupName != "g1" {
+		t.Errorf("bare JSON gave %+v, %v", g, err)
+	}
+
+	var item struct {
+		Data  JSONAPIResource   `json:"data"`
+		Links map[string]string `json:"links"`
+	}
+	if err := json.Unmarshal(get("/group/g1", MediaTypeJSONAPI), &item); err != nil {
+		t.Fatal(err)
+	}
+	self := "/group/" + item.Data.Id
+	if item.Data.Type != "group" || item.Data.Links["self"] != self || item.Links["self"] != self {
+		t.Errorf("item is %+v", item)
+	}
+	if string(item.Data.Attributes["group_name"]) != `"g1"` || item.Data.Attributes["id"] != nil {
+		t.Errorf("attributes are %s", MustMarshalJSON(item.Data.Attributes))
+	}
+
+	var list struct {
+		Data []JSONAPIResource `json:"data"`
+	}
+	if err := json.Unmarshal(get("/group", MediaTypeJSONAPI), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Data) != 2 || list.Data[1].Type != "group" || string(list.Data[1].Attributes["group_name"]) != `"g2"` {
+		t.Errorf("list is %+v", list)
+	}
+}
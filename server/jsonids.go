@@ -0,0 +1,164 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Ids are uint64s, but JavaScript parses JSON numbers as doubles, which
+// lose precision above 2^53.  Clients may therefore ask for ids as strings
+// with "?string_ids", and ids in request bodies may be given either way.
+
+// idKeys are the JSON object keys whose values, or whose array elements,
+// are ids.
+var idKeys = map[string]bool{
+	"actor":        true,
+	"add_users":    true,
+	"cyclic":       true,
+	"id":           true,
+	"missing":      true,
+	"next_after":   true,
+	"parent_id":    true,
+	"remove_users": true,
+	"target":       true,
+	"users":        true,
+}
+
+// WantStringIds reports whether r asks for ids as strings, with
+// "?string_ids" or "?string_ids=true".
+func WantStringIds(r *http.Request) bool {
+	return boolParam(r, "string_ids")
+}
+
+// StringifyIds rewrites the JSON document raw so that the integers under
+// idKeys are strings.  Everything else, including key order, is kept.
+func StringifyIds(raw []byte) ([]byte, error) {
+	d := json.NewDecoder(bytes.NewReader(raw))
+	d.UseNumber()
+	var buf bytes.Buffer
+	if err := stringifyValue(d, &buf, false); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// stringifyValue copies the next value from d to buf, quoting integers if
+// isId is set.
+func stringifyValue(d *json.Decoder, buf *bytes.Buffer, isId bool) error {
+	tok, err := d.Token()
+	if err != nil {
+		return err
+	}
+	switch tok {
+	case json.Delim('{'):
+		buf.WriteByte('{')
+		for i := 0; d.More(); i++ {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			key, err := d.Token()
+			if err != nil {
+				return err
+			}
+			writeJSONToken(buf, key)
+			buf.WriteByte(':')
+			if err := stringifyValue(d, buf, idKeys[key.(string)]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+		_, err = d.Token()
+		return err
+
+	case json.Delim('['):
+		buf.WriteByte('[')
+		for i := 0; d.More(); i++ {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := stringifyValue(d, buf, isId); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+		_, err = d.Token()
+		return err
+	}
+	if n, ok := tok.(json.Number); ok && isId && !strings.ContainsAny(string(n), ".eE") {
+		buf.WriteString(strconv.Quote(string(n)))
+		return nil
+	}
+	writeJSONToken(buf, tok)
+	return nil
+}
+
+func writeJSONToken(buf *bytes.Buffer, tok json.Token) {
+	if n, ok := tok.(json.Number); ok {
+		buf.WriteString(string(n))
+		return
+	}
+	raw, err := json.Marshal(tok)
+	Must(err)
+	buf.Write(raw)
+}
+
+// Id is an id in a request body, given as a JSON number or a string.
+type Id uint64
+
+func (id *Id) UnmarshalJSON(raw []byte) error {
+	v, err := parseJSONId(raw)
+	if err != nil {
+		return err
+	}
+	*id = Id(v)
+	return nil
+}
+
+// IdList is a list of ids in a request body, each given as a JSON number
+// or a string.
+type IdList []uint64
+
+func (ids *IdList) UnmarshalJSON(raw []byte) error {
+	var elems []json.RawMessage
+	if err := json.Unmarshal(raw, &elems); err != nil {
+		return err
+	}
+	list := make(IdList, len(elems))
+	for i, elem := range elems {
+		v, err := parseJSONId(elem)
+		if err != nil {
+			return err
+		}
+		list[i] = v
+	}
+	*ids = list
+	return nil
+}
+
+// IdSyntaxError is returned by Id and IdList for a value that is not an
+// id.  The JSON decoder does not say which field it came from.
+type IdSyntaxError struct {
+	Value string
+}
+
+func (err *IdSyntaxError) Error() string {
+	return fmt.Sprintf("Ids must be whole numbers, given as JSON numbers or strings, not %s", err.Value)
+}
+
+func parseJSONId(raw []byte) (uint64, error) {
+	s := string(raw)
+	if len(s) >= 2 && s[0] == '"' {
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return 0, err
+		}
+	}
+	v, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, &IdSyntaxError{Value: string(raw)}
+	}
+	return v, nil
+}
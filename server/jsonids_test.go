@@ -0,0 +1,78 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestStringifyIds(t *testing.T) {
+	for _, test := range []struct{ in, out string }{
+		{`{"id":9007199254740993,"users":[1,18446744073709551615]}`, `{"id":"9007199254740993","users":["1","18446744073709551615"]}`},
+		{`{"count":9007199254740993,"id":1.5,"parent_id":null}`, `{"count":9007199254740993,"id":1.5,"parent_id":null}`},
+		{`[{"found":[{"id":2,"name":"id"}],"missing":[3]}]`, `[{"found":[{"id":"2","name":"id"}],"missing":["3"]}]`},
+		{`{"group_name":"x","description":"say \"id\" \\ 1"}`, `{"group_name":"x","description":"say \"id\" \\ 1"}`},
+	} {
+		got, err := StringifyIds([]byte(test.in))
+		if err != nil {
+			t.Errorf("StringifyIds(%s): %v", test.in, err)
+			continue
+		}
+		if string(got) != test.out {
+			t.Errorf("StringifyIds(%s) = %s, want %s", test.in, got, test.out)
+		}
+	}
+	if _, err := StringifyIds([]byte(`{"id":`)); err == nil {
+		t.Error("StringifyIds accepted truncated JSON")
+	}
+}
+
+func TestIdUnmarshal(t *testing.T) {
+	var v struct {
+		Id    Id     `json:"id"`
+		Users IdList `json:"users"`
+	}
+	err := json.Unmarshal([]byte(`{"id":"9007199254740993","users":[9007199254740993,"18446744073709551615"]}`), &v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Id != 9007199254740993 || len(v.Users) != 2 || v.Users[0] != 9007199254740993 || v.Users[1] != 18446744073709551615 {
+		t.Errorf("got %d %v", v.Id, v.Users)
+	}
+	for _, in := range []string{`{"id":-1}`, `{"id":1.5}`, `{"id":"x"}`, `{"users":["18446744073709551616"]}`, `{"users":[true]}`} {
+		err := json.Unmarshal([]byte(in), &v)
+		var idErr *IdSyntaxError
+		if !errors.As(err, &idErr) {
+			t.Errorf("Unmarshal(%s): %v, want an IdSyntaxError", in, err)
+		}
+	}
+}
+
+func TestStringIdsRoundTrip(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	h := GroupHandler{Repo: rp, Auth: auth}
+	addTestGroups(t, h, 1)
+
+	const big = "9007199254740993" // 2^53 + 1, which a double cannot hold
+	expectStatus(t, serve(h, newTestRequest(PATCH, "/group/g1", `{"users":["`+big+`",2]}`), "root"), 200)
+
+	w := serve(h, newTestRequest(GET, "/group/g1?string_ids", ""), "")
+	expectStatus(t, w, 200)
+	if body := w.Body.String(); !strings.Contains(body, `"users":["2","`+big+`"]`) || !strings.Contains(body, `"id":"1"`) {
+		t.Errorf("GET ?string_ids gave %s", body)
+	}
+	w = serve(h, newTestRequest(GET, "/group/g1", ""), "")
+	expectStatus(t, w, 200)
+	if body := w.Body.String(); !strings.Contains(body, `"users":[2,`+big+`]`) {
+		t.Errorf("GET gave %s", body)
+	}
+
+	// What came out as strings goes back in as it is.
+	expectStatus(t, serve(h, newTestRequest(PATCH, "/group/g1", `{"remove_users":["`+big+`"]}`), "root"), 200)
+	if got := groupMembers(t, h, "/group/g1"); len(got) != 1 || got[0] != 2 {
+		t.Errorf("members %v, want [2]", got)
+	}
+}
@@ -1,29 +1,112 @@
 package server
 
 import (
+	"errors"
 	"net"
+	"sync/atomic"
 	"time"
 )
 
-type KeepAliveListener struct{ L net.Listener }
+const (
+	DefaultKeepAlivePeriod  = 1 * time.Minute
+	DefaultAcceptBackoff    = 5 * time.Millisecond
+	DefaultMaxAcceptBackoff = 1 * time.Second
+)
+
+// KeepAliveListener enables TCP keep-alives on the connections L accepts,
+// and counts them.  Period is the keep-alive period, or zero for
+// DefaultKeepAlivePeriod.  NoDelay disables Nagle's algorithm, so that
+// small responses are sent without waiting to be coalesced; otherwise it
+// is enabled.
+//
+// Temporary Accept errors, such as running out of file descriptors under
+// a flood of connections, are retried rather than returned: after waiting
+// Backoff, then twice as long each time it fails again, up to MaxBackoff.
+// Zero means DefaultAcceptBackoff or DefaultMaxAcceptBackoff.  Each retry
+// is logged to Log, if set.
+type KeepAliveListener struct {
+	L          net.Listener
+	Period     time.Duration
+	NoDelay    bool
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	Log        *Logger
+
+	accepted uint64
+	retries  uint64
+}
+
+func (l *KeepAliveListener) Accept() (net.Conn, error) {
+	var delay time.Duration
+	for {
+		c, err := l.L.Accept()
+		if err == nil {
+			l.setup(c)
+			return c, nil
+		}
+		var ne net.Error
+		if !errors.As(err, &ne) || !ne.Temporary() {
+			return c, err
+		}
+		delay = l.nextBackoff(delay)
+		atomic.AddUint64(&l.retries, 1)
+		if l.Log != nil {
+			l.Log.Warnf("accept error: %v; retrying in %v", err, delay)
+		}
+		time.Sleep(delay)
+	}
+}
 
-func (l KeepAliveListener) Accept() (net.Conn, error) {
-	c, err := l.L.Accept()
-	if err != nil {
-		if tc, ok := c.(*net.TCPConn); ok {
-			tc.SetKeepAlive(true)
-			tc.SetKeepAlivePeriod(1 * time.Minute)
+// nextBackoff returns how long to wait after a temporary Accept error,
+// given how long was waited after the previous one in a row, if any.
+func (l *KeepAliveListener) nextBackoff(prev time.Duration) time.Duration {
+	min, max := l.Backoff, l.MaxBackoff
+	if min <= 0 {
+		min = DefaultAcceptBackoff
+	}
+	if max <= 0 {
+		max = DefaultMaxAcceptBackoff
+	}
+	next := 2 * prev
+	if next < min {
+		next = min
+	}
+	if next > max {
+		next = max
+	}
+	return next
+}
+
+func (l *KeepAliveListener) setup(c net.Conn) {
+	atomic.AddUint64(&l.accepted, 1)
+	if tc, ok := c.(*net.TCPConn); ok {
+		period := l.Period
+		if period == 0 {
+			period = DefaultKeepAlivePeriod
 		}
+		tc.SetKeepAlive(true)
+		tc.SetKeepAlivePeriod(period)
+		tc.SetNoDelay(l.NoDelay)
 	}
-	return c, err
 }
 
-func (l KeepAliveListener) Close() error {
+func (l *KeepAliveListener) Close() error {
 	return l.L.Close()
 }
 
-func (l KeepAliveListener) Addr() net.Addr {
+func (l *KeepAliveListener) Addr() net.Addr {
 	return l.L.Addr()
 }
 
+// Accepted returns the number of connections accepted so far.
+func (l *KeepAliveListener) Accepted() uint64 {
+	return atomic.LoadUint64(&l.accepted)
+}
+
+// AcceptRetries returns the number of temporary Accept errors retried so
+// far.
+func (l *KeepAliveListener) AcceptRetries() uint64 {
+	return atomic.LoadUint64(&l.retries)
+}
+
 var _ net.Listener = (*KeepAliveListener)(nil)
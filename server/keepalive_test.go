@@ -0,0 +1,166 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestKeepAliveListenerCounts(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &KeepAliveListener{L: inner}
+	defer l.Close()
+	var m Metrics
+	m.AddListener(l)
+
+	for i := 0; i < 3; i++ {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		s, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Close()
+	}
+	if n := l.Accepted(); n != 3 {
+		t.Errorf("Accepted() = %d, want 3", n)
+	}
+	if n := m.Report().AcceptedConnections; n != 3 {
+		t.Errorf("reported %d accepted connections, want 3", n)
+	}
+}
+
+func TestKeepAliveListenerNoDelay(t *testing.T) {
+	for _, noDelay := range []bool{false, true} {
+		inner, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := &KeepAliveListener{L: inner, NoDelay: noDelay}
+		defer l.Close()
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		s, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		raw, err := s.(*net.TCPConn).SyscallConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var nodelay, keepalive int
+		var operr error
+		err = raw.Control(func(fd uintptr) {
+			nodelay, operr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+			if operr == nil {
+				keepalive, operr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE)
+			}
+		})
+		if err == nil {
+			err = operr
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (nodelay != 0) != noDelay {
+			t.Errorf("with NoDelay %t, TCP_NODELAY is %d", noDelay, nodelay)
+		}
+		if keepalive == 0 {
+			t.Errorf("with NoDelay %t, SO_KEEPALIVE is off", noDelay)
+		}
+	}
+}
+
+// tempError is a temporary net.Error.
+type tempError struct{}
+
+func (tempError) Error() string   { return "too many open files" }
+func (tempError) Timeout() bool   { return false }
+func (tempError) Temporary() bool { return true }
+
+// flakyListener fails each Accept with the next of errs, then accepts
+// from L.
+type flakyListener struct {
+	net.Listener
+	errs []error
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if len(l.errs) > 0 {
+		err := l.errs[0]
+		l.errs = l.errs[1:]
+		return nil, err
+	}
+	return l.Listener.Accept()
+}
+
+func TestKeepAliveListenerBackoff(t *testing.T) {
+	var l KeepAliveListener
+	var got []time.Duration
+	var d time.Duration
+	for i := 0; i < 10; i++ {
+		d = l.nextBackoff(d)
+		got = append(got, d)
+	}
+	if got[0] != DefaultAcceptBackoff || got[1] != 2*DefaultAcceptBackoff || got[9] != DefaultMaxAcceptBackoff {
+		t.Errorf("default backoffs %v", got)
+	}
+	l = KeepAliveListener{Backoff: time.Millisecond, MaxBackoff: 3 * time.Millisecond}
+	got, d = nil, 0
+	for i := 0; i < 4; i++ {
+		d = l.nextBackoff(d)
+		got = append(got, d)
+	}
+	if fmt.Sprint(got) != "[1ms 2ms 3ms 3ms]" {
+		t.Errorf("backoffs %v, want [1ms 2ms 3ms 3ms]", got)
+	}
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var log bytes.Buffer
+	flaky := &flakyListener{inner, []error{tempError{}, tempError{}, tempError{}}}
+	l = KeepAliveListener{L: flaky, Backoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond, Log: NewLogger(&log, WARN)}
+	defer l.Close()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept gave up on temporary errors: %v", err)
+	}
+	s.Close()
+	if n := l.AcceptRetries(); n != 3 {
+		t.Errorf("AcceptRetries() = %d, want 3", n)
+	}
+	if n := strings.Count(log.String(), "too many open files"); n != 3 {
+		t.Errorf("logged %d retries, want 3: %q", n, log.String())
+	}
+
+	// Other errors are returned at once.
+	flaky.errs = []error{errors.New("broken")}
+	if _, err := l.Accept(); err == nil || err.Error() != "broken" {
+		t.Errorf("Accept gave %v, want broken", err)
+	}
+	if n := l.AcceptRetries(); n != 3 {
+		t.Errorf("AcceptRetries() = %d after a permanent error, want 3", n)
+	}
+}
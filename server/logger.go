@@ -0,0 +1,100 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+type LogLevel int32
+
+const (
+	DEBUG LogLevel = iota
+	INFO
+	WARN
+	ERROR
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+var logLevelPrefixes = []string{"debug: ", "", "warning: ", "error: "}
+
+func (lvl LogLevel) String() string {
+	if lvl < DEBUG || lvl > ERROR {
+		return fmt.Sprintf("LogLevel(%d)", int(lvl))
+	}
+	return logLevelNames[lvl]
+}
+
+func ParseLogLevel(s string) (LogLevel, error) {
+	for i, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return LogLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// Logger writes log lines at or above Level to an underlying *log.Logger.
+// A nil *Logger logs to standard error at level INFO.  Once the Logger is
+// in use, Level may only be changed with SetLevel.
+type Logger struct {
+	Level LogLevel
+	L     *log.Logger
+
+	prefix string
+}
+
+var defaultLogger = NewLogger(os.Stderr, INFO)
+
+func NewLogger(w io.Writer, level LogLevel) *Logger {
+	return &Logger{Level: level, L: log.New(w, "", log.LstdFlags)}
+}
+
+// For returns a Logger that tags each line with the request id of r.
+func (l *Logger) For(r *http.Request) *Logger {
+	if l == nil {
+		l = defaultLogger
+	}
+	id := RequestId(r)
+	if id == "" {
+		return l
+	}
+	return &Logger{Level: l.level(), L: l.L, prefix: "[" + id + "] "}
+}
+
+// SetLevel changes l.Level.  Loggers already returned by For keep the
+// level they were created with.
+func (l *Logger) SetLevel(level LogLevel) {
+	atomic.StoreInt32((*int32)(&l.Level), int32(level))
+}
+
+func (l *Logger) level() LogLevel {
+	return LogLevel(atomic.LoadInt32((*int32)(&l.Level)))
+}
+
+func (l *Logger) Enabled(level LogLevel) bool {
+	if l == nil {
+		l = defaultLogger
+	}
+	return level >= l.level()
+}
+
+func (l *Logger) logf(level LogLevel, format string, v ...interface{}) {
+	if l == nil {
+		l = defaultLogger
+	}
+	if level < l.level() {
+		return
+	}
+	l.L.Output(3, l.prefix+logLevelPrefixes[level]+fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Debugf(format string, v ...interface{}) { l.logf(DEBUG, format, v...) }
+func (l *Logger) Infof(format string, v ...interface{})  { l.logf(INFO, format, v...) }
+func (l *Logger) Warnf(format string, v ...interface{})  { l.logf(WARN, format, v...) }
+func (l *Logger) Errorf(format string, v ...interface{}) { l.logf(ERROR, format, v...) }
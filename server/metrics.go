@@ -0,0 +1,78 @@
+package server
+
+import (
+	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cloud9-tools/cloud9/repo"
+)
+
+// Metrics counts the connections a server accepts and the requests it is
+// handling.  The zero value is ready to use.
+type Metrics struct {
+	inFlight int64
+
+	mu        sync.Mutex
+	listeners []*KeepAliveListener
+}
+
+// MetricsReport is the body of GET /admin/metrics.
+type MetricsReport struct {
+	AcceptedConnections uint64 `json:"accepted_connections"`
+	AcceptRetries       uint64 `json:"accept_retries"`
+	InFlightRequests    int64  `json:"in_flight_requests"`
+	Goroutines          int    `json:"goroutines"`
+	HeapAllocBytes      uint64 `json:"heap_alloc_bytes"`
+	HeapObjects         uint64 `json:"heap_objects"`
+	SysBytes            uint64 `json:"sys_bytes"`
+	NumGC               uint32 `json:"num_gc"`
+	GCPauseTotalNs      uint64 `json:"gc_pause_total_ns"`
+
+	RepoUpdates repo.UpdateStats `json:"repo_updates"`
+}
+
+// AddListener includes the connections l accepts in the reported count.
+func (m *Metrics) AddListener(l *KeepAliveListener) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.listeners = append(m.listeners, l)
+}
+
+func (m *Metrics) accepted() (n, retries uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, l := range m.listeners {
+		n += l.Accepted()
+		retries += l.AcceptRetries()
+	}
+	return n, retries
+}
+
+// Handler returns h, counting the requests in progress.
+func (m *Metrics) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&m.inFlight, 1)
+		defer atomic.AddInt64(&m.inFlight, -1)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Report returns the counts so far, with the Go runtime's statistics.
+func (m *Metrics) Report() MetricsReport {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	accepted, retries := m.accepted()
+	return MetricsReport{
+		AcceptedConnections: accepted,
+		AcceptRetries:       retries,
+		InFlightRequests:    atomic.LoadInt64(&m.inFlight),
+		Goroutines:          runtime.NumGoroutine(),
+		HeapAllocBytes:      ms.HeapAlloc,
+		HeapObjects:         ms.HeapObjects,
+		SysBytes:            ms.Sys,
+		NumGC:               ms.NumGC,
+		GCPauseTotalNs:      ms.PauseTotalNs,
+	}
+}
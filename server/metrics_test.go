@@ -0,0 +1,41 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	var m Metrics
+	var inside int64
+	h := m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inside = m.Report().InFlightRequests
+		w.WriteHeader(204)
+	}))
+	expectStatus(t, serve(h, newTestRequest(GET, "/", ""), ""), 204)
+	if inside != 1 {
+		t.Errorf("%d requests in flight during one, want 1", inside)
+	}
+	report := m.Report()
+	if report.InFlightRequests != 0 {
+		t.Errorf("%d requests in flight after it, want 0", report.InFlightRequests)
+	}
+	if report.Goroutines == 0 || report.SysBytes == 0 {
+		t.Errorf("no runtime statistics in %+v", report)
+	}
+
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	admin := AdminHandler{Repo: rp, Auth: auth, Metrics: &m}
+	w := serve(admin, newTestRequest(GET, "/admin/metrics", ""), "root")
+	expectStatus(t, w, 200)
+	var got MetricsReport
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Goroutines == 0 || got.SysBytes == 0 {
+		t.Errorf("GET /admin/metrics gave %s", w.Body.String())
+	}
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Content negotiation.  Every response whose representation depends on a
+// request header must name that header in "Vary", or shared caches will
+// hand one client's representation to another.  The helpers here add the
+// header as a side effect, so handlers that negotiate through them get
+// Vary right without thinking about it.
+
+// AddVary adds fields to the "Vary" header of h, keeping a single header
+// line and skipping fields that are already listed.
+func AddVary(h http.Header, fields ...string) {
+	var list []string
+	seen := make(map[string]bool)
+	for _, line := range h[Vary] {
+		for _, field := range strings.Split(line, ",") {
+			field = strings.TrimSpace(field)
+			if field == "" || seen[strings.ToLower(field)] {
+				continue
+			}
+			seen[strings.ToLower(field)] = true
+			list = append(list, field)
+		}
+	}
+	for _, field := range fields {
+		if seen[strings.ToLower(field)] {
+			continue
+		}
+		seen[strings.ToLower(field)] = true
+		list = append(list, field)
+	}
+	if seen["*"] {
+		list = []string{"*"}
+	}
+	h.Set(Vary, strings.Join(list, ", "))
+}
+
+// NegotiateContentType picks the media type in offers that the client's
+// "Accept" header prefers, earlier offers winning ties.  With no "Accept"
+// header it returns offers[0]; if nothing offered is acceptable it returns
+// "".  It adds "Accept" to the response's "Vary" header.
+func NegotiateContentType(w http.ResponseWriter, r *http.Request, offers ...string) string {
+	AddVary(w.Header(), Accept)
+	accept := strings.Join(r.Header[Accept], ",")
+	if strings.TrimSpace(accept) == "" {
+		return offers[0]
+	}
+	best, bestQ, bestSpecificity := "", 0.0, -1
+	for _, offer := range offers {
+		offerType, _, err := mime.ParseMediaType(offer)
+		if err != nil {
+			continue
+		}
+		q, specificity := 0.0, -1
+		for _, spec := range strings.Split(accept, ",") {
+			mediaRange, params, err := mime.ParseMediaType(strings.TrimSpace(spec))
+			if err != nil {
+				continue
+			}
+			s := matchMediaRange(mediaRange, offerType)
+			if s <= specificity {
+				continue
+			}
+			specificity, q = s, qValue(params)
+		}
+		if q > bestQ || (q == bestQ && q > 0 && specificity > bestSpecificity) {
+			best, bestQ, bestSpecificity = offer, q, specificity
+		}
+	}
+	return best
+}
+
+// AcceptsEncoding reports whether the client's "Accept-Encoding" header
+// allows the given content coding (such as "gzip").  It adds
+// "Accept-Encoding" to the response's "Vary" header.
+func AcceptsEncoding(w http.ResponseWriter, r *http.Request, coding string) bool {
+	AddVary(w.Header(), AcceptEncoding)
+	q, specificity := 0.0, -1
+	for _, spec := range strings.Split(strings.Join(r.Header[AcceptEncoding], ","), ",") {
+		parts := strings.Split(spec, ";")
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		s := -1
+		switch name {
+		case strings.ToLower(coding):
+			s = 1
+		case "*":
+			s = 0
+		}
+		if s <= specificity {
+			continue
+		}
+		params := make(map[string]string)
+		for _, p := range parts[1:] {
+			if i := strings.IndexByte(p, '='); i >= 0 {
+				params[strings.ToLower(strings.TrimSpace(p[:i]))] = strings.TrimSpace(p[i+1:])
+			}
+		}
+		specificity, q = s, qValue(params)
+	}
+	return q > 0
+}
+
+// matchMediaRange returns how specifically mediaRange matches mediaType:
+// 2 for an exact match, 1 for "type/*", 0 for "*/*", and -1 for none.
+func matchMediaRange(mediaRange, mediaType string) int {
+	switch {
+	case mediaRange == mediaType:
+		return 2
+	case mediaRange == "*/*":
+		return 0
+	case strings.HasSuffix(mediaRange, "/*") && strings.HasPrefix(mediaType, mediaRange[:len(mediaRange)-1]):
+		return 1
+	}
+	return -1
+}
+
+func qValue(params map[string]string) float64 {
+	s, ok := params["q"]
+	if !ok {
+		return 1
+	}
+	q, err := strconv.ParseFloat(s, 64)
+	if err != nil || q < 0 || q > 1 {
+		return 0
+	}
+	return q
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAddVary(t *testing.T) {
+	h := make(http.Header)
+	AddVary(h, Accept)
+	AddVary(h, "accept", AcceptEncoding)
+	h.Add(Vary, "Origin, Accept")
+	AddVary(h)
+	if got := h[Vary]; len(got) != 1 || got[0] != "Accept, Accept-Encoding, Origin" {
+		t.Errorf("Vary is %q", got)
+	}
+	AddVary(h, "*")
+	if got := h.Get(Vary); got != "*" {
+		t.Errorf("Vary is %q, want *", got)
+	}
+}
+
+func TestNegotiateContentType(t *testing.T) {
+	offers := []string{MediaTypeJSON, MediaTypeText}
+	for _, test := range []struct {
+		accept, want string
+	}{
+		{"", MediaTypeJSON},
+		{"*/*", MediaTypeJSON},
+		{"text/plain", MediaTypeText},
+		{"text/*", MediaTypeText},
+		{"application/json;q=0.5, text/plain", MediaTypeText},
+		{"*/*;q=0.1, text/plain;q=0.5", MediaTypeText},
+		{"text/*;q=0, */*", MediaTypeJSON},
+		{"text/plain;q=0, text/*", ""},
+		{"image/png", ""},
+		{"application/json;q=bogus, text/plain;q=0.1", MediaTypeText},
+	} {
+		r := newTestRequest(GET, "/", "")
+		if test.accept != "" {
+			r.Header.Set(Accept, test.accept)
+		}
+		w := httptest.NewRecorder()
+		if got := NegotiateContentType(w, r, offers...); got != test.want {
+			t.Errorf("Accept %q: got %q, want %q", test.accept, got, test.want)
+		}
+		if got := w.Header().Get(Vary); got != Accept {
+			t.Errorf("Accept %q: Vary is %q", test.accept, got)
+		}
+	}
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	for _, test := range []struct {
+		accept string
+		want   bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"GZIP;q=0.5", true},
+		{"deflate, br", false},
+		{"*", true},
+		{"gzip;q=0, *", false},
+		{"*;q=0, gzip", true},
+	} {
+		r := newTestRequest(GET, "/", "")
+		r.Header.Set(AcceptEncoding, test.accept)
+		w := httptest.NewRecorder()
+		if got := AcceptsEncoding(w, r, "gzip"); got != test.want {
+			t.Errorf("Accept-Encoding %q: got %v, want %v", test.accept, got, test.want)
+		}
+		if got := w.Header().Get(Vary); got != AcceptEncoding {
+			t.Errorf("Accept-Encoding %q: Vary is %q", test.accept, got)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Notifier sends a message to a user, e.g. by e-mail.
+type Notifier interface {
+	Send(to, subject, body string) error
+}
+
+// NopNotifier discards all messages.
+type NopNotifier struct{}
+
+func (NopNotifier) Send(to, subject, body string) error { return nil }
+
+// SMTPNotifier sends messages as plain text e-mail through an SMTP relay.
+type SMTPNotifier struct {
+	Addr string    // host:port of the relay
+	Auth smtp.Auth // may be nil
+	From string
+}
+
+func (n SMTPNotifier) Send(to, subject, body string) error {
+	if strings.ContainsAny(to, "\r\n") || strings.ContainsAny(subject, "\r\n") {
+		return errors.New("notify: header values must not contain line breaks")
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", n.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", to)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: %s\r\n", MediaTypeText)
+	fmt.Fprintf(&buf, "\r\n")
+	buf.WriteString(body)
+	return smtp.SendMail(n.Addr, n.Auth, n.From, []string{to}, buf.Bytes())
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloud9-tools/cloud9/repo"
+)
+
+// ObjectCache keeps the encoded form of recently read users and groups, so
+// that GET can answer without a transaction or marshalling.  It holds at
+// most a fixed number of objects, discarding the least recently used.  A
+// nil *ObjectCache caches nothing.
+//
+// Entries are dropped when the repo reports a change to their object (see
+// repo.OnChange), before the changing Update returns.  A reader that
+// loaded an object before such a change must not then store it, so Add
+// takes the Generation read before loading, and ignores the object if
+// anything has been dropped since.
+type ObjectCache struct {
+	mu     sync.Mutex
+	max    int
+	gen    uint64
+	lru    *list.List // of *cachedObject, most recently used first
+	byId   map[objectKey]*list.Element
+	byName map[objectName]uint64
+}
+
+type objectKey struct {
+	ot repo.ObjectType
+	id uint64
+}
+
+type objectName struct {
+	ot   repo.ObjectType
+	name string // lower case, as in the repo's name index
+}
+
+type cachedObject struct {
+	key      objectKey
+	name     string
+	modified time.Time
+	etag     string            // the same for every encoding; see ResourceETag
+	reps     map[string][]byte // encodings, by media type
+}
+
+// NewObjectCache returns a cache of up to max objects, or nil if max is not
+// positive.
+func NewObjectCache(max int) *ObjectCache {
+	if max <= 0 {
+		return nil
+	}
+	return &ObjectCache{
+		max:    max,
+		lru:    list.New(),
+		byId:   make(map[objectKey]*list.Element),
+		byName: make(map[objectName]uint64),
+	}
+}
+
+// Generation returns a value to pass to Add for an object about to be
+// loaded.
+func (c *ObjectCache) Generation() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// Get returns the encoding of the object of type ot with the given id, or
+// with the given name if id is zero, as mediaType, its ETag and its
+// modification time.
+func (c *ObjectCache) Get(ot repo.ObjectType, id uint64, name, mediaType string) ([]byte, string, time.Time, bool) {
+	if c == nil {
+		return nil, "", time.Time{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if id == 0 {
+		var ok bool
+		id, ok = c.byName[objectName{ot, strings.ToLower(name)}]
+		if !ok {
+			return nil, "", time.Time{}, false
+		}
+	}
+	e, ok := c.byId[objectKey{ot, id}]
+	if !ok {
+		return nil, "", time.Time{}, false
+	}
+	obj := e.Value.(*cachedObject)
+	raw, ok := obj.reps[mediaType]
+	if !ok {
+		return nil, "", time.Time{}, false
+	}
+	c.lru.MoveToFront(e)
+	return raw, obj.etag, obj.modified, true
+}
+
+// Add records raw as the encoding of obj as mediaType, and etag as its
+// ETag, unless the cache has dropped anything since Generation returned
+// gen.
+func (c *ObjectCache) Add(gen uint64, ot repo.ObjectType, obj Resource, mediaType string, raw []byte, etag string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return
+	}
+	key := objectKey{ot, obj.ResourceId()}
+	if e, ok := c.byId[key]; ok {
+		e.Value.(*cachedObject).reps[mediaType] = raw
+		c.lru.MoveToFront(e)
+		return
+	}
+	name := strings.ToLower(obj.ResourceName())
+	c.byId[key] = c.lru.PushFront(&cachedObject{
+		key:      key,
+		name:     name,
+		modified: lastModified(obj),
+		etag:     etag,
+		reps:     map[string][]byte{mediaType: raw},
+	})
+	c.byName[objectName{ot, name}] = key.id
+	for c.lru.Len() > c.max {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Invalidate drops the object of type ot with the given id.
+func (c *ObjectCache) Invalidate(ot repo.ObjectType, id uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	if e, ok := c.byId[objectKey{ot, id}]; ok {
+		c.remove(e)
+	}
+}
+
+func (c *ObjectCache) remove(e *list.Element) {
+	obj := c.lru.Remove(e).(*cachedObject)
+	delete(c.byId, obj.key)
+	name := objectName{obj.key.ot, obj.name}
+	if c.byName[name] == obj.key.id {
+		delete(c.byName, name)
+	}
+}
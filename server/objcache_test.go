@@ -0,0 +1,81 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cloud9-tools/cloud9/repo"
+)
+
+func TestObjectCache(t *testing.T) {
+	c := NewObjectCache(2)
+	add := func(id uint64, name string) {
+		c.Add(c.Generation(), repo.GROUP, &Group{Id: id, GroupName: name}, MediaTypeJSON, []byte(name), `"`+name+`"`)
+	}
+	has := func(id uint64, name string) bool {
+		_, _, _, ok := c.Get(repo.GROUP, id, name, MediaTypeJSON)
+		return ok
+	}
+	add(1, "One")
+	add(2, "two")
+	if raw, etag, _, ok := c.Get(repo.GROUP, 0, "ONE", MediaTypeJSON); !ok || string(raw) != "One" || etag != `"One"` {
+		t.Errorf("Get by name = %q, %s, %v", raw, etag, ok)
+	}
+	if !has(1, "") || !has(1, "ignored") {
+		t.Error("Get by id failed")
+	}
+	if has(3, "") || has(0, "three") {
+		t.Error("Get found an object never added")
+	}
+	if _, _, _, ok := c.Get(repo.USER, 1, "", MediaTypeJSON); ok {
+		t.Error("Get found a group as a user")
+	}
+	if _, _, _, ok := c.Get(repo.GROUP, 1, "", MediaTypeJSONAPI); ok {
+		t.Error("Get found an encoding never added")
+	}
+
+	// 1 was used more recently than 2, so 2 goes.
+	add(3, "three")
+	if !has(1, "") || has(2, "") || has(0, "two") || !has(3, "") {
+		t.Error("the least recently used object was not the one dropped")
+	}
+
+	// An object loaded before an invalidation is not stored.
+	gen := c.Generation()
+	c.Invalidate(repo.GROUP, 1)
+	if has(1, "") || has(0, "one") {
+		t.Error("Invalidate left the object")
+	}
+	c.Add(gen, repo.GROUP, &Group{Id: 1, GroupName: "one"}, MediaTypeJSON, []byte("stale"), `"stale"`)
+	if has(1, "") {
+		t.Error("Add stored an object loaded before an invalidation")
+	}
+
+	var nilCache *ObjectCache
+	nilCache.Add(0, repo.GROUP, &Group{Id: 1}, MediaTypeJSON, nil, "")
+	if _, _, _, ok := nilCache.Get(repo.GROUP, 1, "", MediaTypeJSON); ok {
+		t.Error("a nil cache found something")
+	}
+}
+
+func TestObjectCacheInvalidatedByWrites(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	objects := NewObjectCache(10)
+	rp.OnChange(func(ot repo.ObjectType, id uint64) { objects.Invalidate(ot, id) })
+	h := GroupHandler{Repo: rp, Auth: auth, Objects: objects}
+	addTestGroups(t, h, 1)
+
+	for _, description := range []string{"first", "second"} {
+		body := `{"description":"` + description + `"}`
+		expectStatus(t, serve(h, newTestRequest(PATCH, "/group/g1", body), "root"), 200)
+		for i := 0; i < 2; i++ {
+			w := serve(h, newTestRequest(GET, "/group/g1", ""), "")
+			expectStatus(t, w, 200)
+			if !strings.Contains(w.Body.String(), description) {
+				t.Errorf("GET %d after setting %q gave %s", i+1, description, w.Body.String())
+			}
+		}
+	}
+}
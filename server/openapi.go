@@ -0,0 +1,871 @@
+package server
+
+// openAPIDocument describes the HTTP API in OpenAPI 3 form.  It is served
+// at /openapi.json and is maintained by hand: when a route, method or
+// request or response body changes, change it here too.
+//
+// Error responses are plain text, as written by http.Error, so they share
+// the "Error" response rather than a schema.
+const openAPIDocument = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "cloud9",
+    "description": "A hybrid centralized-decentralized version control system for the cloud.  JSON bodies describing users, groups and blobs are wrapped as JSON:API documents when the client sends Accept: application/vnd.api+json.  Any JSON response is indented with ?pretty, and gives ids as strings with ?string_ids, for clients whose numbers lose precision above 2^53; ids in request bodies may be numbers or strings.",
+    "version": "1"
+  },
+  "components": {
+    "securitySchemes": {
+      "basic": {"type": "http", "scheme": "basic"}
+    },
+    "parameters": {
+      "ref": {
+        "name": "ref", "in": "path", "required": true,
+        "description": "A numeric id, or a name starting with a letter.",
+        "schema": {"type": "string", "pattern": "^([0-9]{1,20}|[A-Za-z][0-9A-Za-z]*)$"}
+      },
+      "blobId": {
+        "name": "id", "in": "path", "required": true,
+        "schema": {"type": "integer", "format": "uint64"}
+      },
+      "uploadId": {
+        "name": "uploadId", "in": "path", "required": true,
+        "schema": {"type": "string", "pattern": "^[0-9a-f]{32}$"}
+      },
+      "ifMatch": {
+        "name": "If-Match", "in": "header",
+        "description": "The ETag from a previous GET.",
+        "schema": {"type": "string"}
+      },
+      "ifUnmodifiedSince": {
+        "name": "If-Unmodified-Since", "in": "header",
+        "description": "Used when If-Match is absent.",
+        "schema": {"type": "string"}
+      }
+    },
+    "responses": {
+      "Error": {
+        "description": "An error, described in plain text.  For a 500, this gives the request id, also sent as X-Request-Id.",
+        "content": {"text/plain": {"schema": {"type": "string"}}}
+      },
+      "NoContent": {"description": "Success, with no body."},
+      "NotFound": {
+        "description": "No such object.  Sent as plain text if the client prefers it.",
+        "content": {
+          "application/json": {"schema": {"$ref": "#/components/schemas/NotFoundError"}},
+          "text/plain": {"schema": {"type": "string"}}
+        }
+      }
+    },
+    "schemas": {
+      "User": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer", "format": "uint64"},
+          "user_name": {"type": "string"},
+          "display_name": {"type": "string"},
+          "email": {"type": "string"},
+          "url": {"type": "string"},
+          "admin": {"type": "boolean"},
+          "email_verified": {"type": "boolean"},
+          "phone": {"type": "string"},
+          "timezone": {"type": "string"},
+          "disabled": {"type": "boolean", "description": "Set by POST /user/{ref}/disable; the user cannot authenticate."},
+          "metadata": {"type": "object", "additionalProperties": {"type": "string"}},
+          "updated": {"type": "integer", "format": "int64", "description": "Unix seconds."}
+        }
+      },
+      "UserDelta": {
+        "type": "object",
+        "description": "Fields to set; absent fields are left alone.  user_name, email and password are only accepted on creation, where user_name and email are required.",
+        "properties": {
+          "user_name": {"type": "string", "pattern": "^[A-Za-z][0-9A-Za-z]*$"},
+          "display_name": {"type": "string"},
+          "email": {"type": "string"},
+          "url": {"type": "string"},
+          "phone": {"type": "string", "pattern": "^\\+[1-9][0-9]{1,14}$", "description": "E.164, or empty to clear."},
+          "timezone": {"type": "string", "description": "IANA time zone name, such as Europe/Paris, or empty to clear."},
+          "metadata": {"type": "object", "maxProperties": 64, "additionalProperties": {"type": ["string", "null"], "maxLength": 1024}, "description": "Merged into the user's metadata; a null value removes the key."},
+          "password": {"type": "string", "minLength": 8, "maxLength": 72}
+        }
+      },
+      "PasswordChange": {
+        "type": "object",
+        "required": ["new"],
+        "properties": {
+          "old": {"type": "string", "description": "Required unless the caller is an admin."},
+          "new": {"type": "string", "minLength": 8, "maxLength": 72}
+        }
+      },
+      "Group": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer", "format": "uint64"},
+          "group_name": {"type": "string"},
+          "description": {"type": "string"},
+          "users": {"type": "array", "items": {"type": "integer", "format": "uint64"}},
+          "updated": {"type": "integer", "format": "int64", "description": "Unix seconds."},
+          "parent_id": {"type": "integer", "format": "uint64"}
+        }
+      },
+      "IdInput": {
+        "oneOf": [{"type": "integer", "format": "uint64"}, {"type": "string", "pattern": "^[0-9]{1,20}$"}]
+      },
+      "NotFoundError": {
+        "type": "object",
+        "properties": {
+          "code": {"type": "string", "enum": ["not_found"]},
+          "error": {"type": "string"},
+          "request_id": {"type": "string"}
+        }
+      },
+      "Resolution": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer", "format": "uint64"}
+        }
+      },
+      "GroupTree": {
+        "type": "object",
+        "properties": {
+          "roots": {"type": "array", "items": {"$ref": "#/components/schemas/GroupTreeNode"}},
+          "cyclic": {"type": "array", "items": {"type": "integer", "format": "uint64"}, "description": "Groups reachable from no root because their ancestry loops."}
+        }
+      },
+      "GroupTreeNode": {
+        "allOf": [
+          {"$ref": "#/components/schemas/Group"},
+          {
+            "type": "object",
+            "properties": {
+              "children": {"type": "array", "items": {"$ref": "#/components/schemas/GroupTreeNode"}},
+              "truncated": {"type": "boolean", "description": "Children exist beyond the depth limit of 32."}
+            }
+          }
+        ]
+      },
+      "GroupDelta": {
+        "type": "object",
+        "description": "Fields to set; absent fields are left alone.  group_name is required on creation and cannot be changed.  users cannot be combined with add_users or remove_users.",
+        "properties": {
+          "group_name": {"type": "string", "pattern": "^[A-Za-z][0-9A-Za-z]*$"},
+          "description": {"type": "string"},
+          "users": {"type": "array", "items": {"$ref": "#/components/schemas/IdInput"}},
+          "add_users": {"type": "array", "items": {"$ref": "#/components/schemas/IdInput"}},
+          "remove_users": {"type": "array", "items": {"$ref": "#/components/schemas/IdInput"}},
+          "parent_id": {"allOf": [{"$ref": "#/components/schemas/IdInput"}], "description": "The parent group, or 0 for none; it must exist and must not be this group or a descendant."}
+        }
+      },
+      "BlobReference": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer", "format": "uint64"},
+          "field": {"type": "string"},
+          "filename": {"type": "string"}
+        }
+      },
+      "BlobMeta": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer", "format": "uint64"},
+          "content_type": {"type": "string"},
+          "size": {"type": "integer", "format": "uint64"},
+          "digest": {"type": "string", "pattern": "^sha256:[0-9a-f]{64}$"},
+          "created": {"type": "integer", "format": "int64", "description": "Unix seconds."},
+          "etag": {"type": "string"}
+        }
+      },
+      "UploadSession": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "string"},
+          "url": {"type": "string"},
+          "offset": {"type": "integer", "format": "int64"},
+          "created": {"type": "integer", "format": "int64"},
+          "owner": {"type": "integer", "format": "uint64", "description": "The id of the user who started the upload."}
+        }
+      },
+      "UploadComplete": {
+        "type": "object",
+        "required": ["digest"],
+        "properties": {
+          "digest": {"type": "string"},
+          "content_type": {"type": "string"}
+        }
+      },
+      "Metrics": {
+        "type": "object",
+        "properties": {
+          "accepted_connections": {"type": "integer", "format": "uint64"},
+          "accept_retries": {"type": "integer", "format": "uint64"},
+          "in_flight_requests": {"type": "integer", "format": "int64"},
+          "goroutines": {"type": "integer"},
+          "heap_alloc_bytes": {"type": "integer", "format": "uint64"},
+          "heap_objects": {"type": "integer", "format": "uint64"},
+          "sys_bytes": {"type": "integer", "format": "uint64"},
+          "num_gc": {"type": "integer", "format": "uint32"},
+          "gc_pause_total_ns": {"type": "integer", "format": "uint64"},
+          "repo_updates": {
+            "type": "object",
+            "description": "Repository writes, and the longest time one of the latest held the write lock.",
+            "properties": {
+              "updates": {"type": "integer", "format": "uint64"},
+              "slow_updates": {"type": "integer", "format": "uint64"},
+              "longest_recent_ns": {"type": "integer", "format": "int64"}
+            }
+          }
+        }
+      },
+      "BulkDeleteResult": {
+        "type": "object",
+        "properties": {
+          "results": {
+            "type": "array",
+            "items": {
+              "type": "object",
+              "properties": {
+                "id": {"type": "integer", "format": "uint64"},
+                "status": {"type": "integer", "description": "204 if deleted, 404 if there was no such object, 409 if it could not be deleted, such as a group with children."}
+              }
+            }
+          },
+          "dry_run": {"type": "boolean"},
+          "confirm": {"type": "string", "description": "For a dry run, the token that allows the deletion."}
+        }
+      },
+      "MultiGetResult": {
+        "type": "object",
+        "properties": {
+          "found": {"type": "array", "items": {"type": "object"}},
+          "missing": {"type": "array", "items": {"type": "integer", "format": "uint64"}}
+        }
+      },
+      "PasswordResetRequest": {
+        "type": "object",
+        "required": ["email"],
+        "properties": {"email": {"type": "string"}}
+      },
+      "PasswordResetConfirm": {
+        "type": "object",
+        "required": ["token", "password"],
+        "properties": {
+          "token": {"type": "string"},
+          "password": {"type": "string", "minLength": 8, "maxLength": 72}
+        }
+      }
+    }
+  },
+  "paths": {
+    "/login": {
+      "post": {
+        "summary": "Check credentials and return the caller.",
+        "security": [{"basic": []}],
+        "responses": {
+          "200": {"description": "The caller.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/User"}}}},
+          "401": {"$ref": "#/components/responses/Error"},
+          "429": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/verify": {
+      "get": {
+        "summary": "Confirm an e-mail address with a token from a verification message.",
+        "parameters": [{"name": "token", "in": "query", "required": true, "schema": {"type": "string"}}],
+        "responses": {
+          "200": {"description": "The address is verified."},
+          "400": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/password-reset/request": {
+      "post": {
+        "summary": "Mail a password reset token to the owner of an address.",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/PasswordResetRequest"}}}},
+        "responses": {
+          "202": {"description": "Accepted, whether or not the address is known."},
+          "400": {"$ref": "#/components/responses/Error"},
+          "429": {"$ref": "#/components/responses/Error"},
+          "503": {"description": "The server has no public URL configured for the link."}
+        }
+      }
+    },
+    "/password-reset/confirm": {
+      "post": {
+        "summary": "Set a new password using a reset token.",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/PasswordResetConfirm"}}}},
+        "responses": {
+          "204": {"$ref": "#/components/responses/NoContent"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "429": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/user": {
+      "get": {
+        "summary": "List users, or with ids, get several by id.  With ids and dry_run, preview deleting them instead; admins only.",
+        "parameters": [
+          {"name": "ids", "in": "query", "description": "Comma-separated ids, at most 100; the response is then a MultiGetResult.", "schema": {"type": "string"}},
+          {"name": "dry_run", "in": "query", "description": "With ids, delete nothing, but report the outcomes DELETE would have and give a confirmation token for it; the response is then a BulkDeleteResult.", "schema": {"type": "boolean"}},
+          {"name": "name_prefix", "in": "query", "description": "List only those whose names start with this, ignoring case.", "schema": {"type": "string"}},
+          {"name": "sort", "in": "query", "description": "List in id or name order; the default is id, or name with name_prefix.", "schema": {"type": "string", "enum": ["id", "name"]}},
+          {"name": "limit", "in": "query", "description": "Return one page of at most this many; the Link header gives the first and next pages.  Larger limits are capped to the server's maximum page size, given in X-Page-Size.", "schema": {"type": "integer", "minimum": 1}},
+          {"name": "after", "in": "query", "description": "Start after this id, or lower-case name in name order, as given in the next Link.", "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {"description": "All users, or a page of them, or a MultiGetResult, or for a dry run a BulkDeleteResult.", "headers": {"X-Total-Count": {"schema": {"type": "integer"}}, "X-Page-Size": {"schema": {"type": "integer"}}, "Link": {"schema": {"type": "string"}}}, "content": {"application/json": {"schema": {"oneOf": [{"type": "array", "items": {"$ref": "#/components/schemas/User"}}, {"$ref": "#/components/schemas/MultiGetResult"}, {"$ref": "#/components/schemas/BulkDeleteResult"}]}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "post": {
+        "summary": "Create a user; admins only.  On a fresh install, anyone may create the first user, who becomes an admin.",
+        "security": [{"basic": []}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/UserDelta"}}}},
+        "responses": {
+          "201": {"description": "The new user.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/User"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "delete": {
+        "summary": "Delete several users by id; admins only.  A dry run, GET with the same ids and dry_run, must come first, to get a confirmation token.",
+        "parameters": [
+          {"name": "ids", "in": "query", "required": true, "description": "Comma-separated ids, at most 100.", "schema": {"type": "string"}},
+          {"name": "confirm", "in": "query", "required": true, "description": "The token from a dry run for the same ids by the same caller, good once for 5 minutes.", "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {"description": "The outcome for each id.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/BulkDeleteResult"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/me": {
+      "get": {
+        "summary": "Get the caller's own user.",
+        "responses": {
+          "200": {"description": "The user.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/User"}}}},
+          "401": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "put": {
+        "summary": "Change the caller's own user; requires If-Match or If-Unmodified-Since.",
+        "parameters": [{"$ref": "#/components/parameters/ifMatch"}, {"$ref": "#/components/parameters/ifUnmodifiedSince"}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/UserDelta"}}}},
+        "responses": {
+          "200": {"description": "The changed user.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/User"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "412": {"$ref": "#/components/responses/Error"},
+          "422": {"$ref": "#/components/responses/Error"},
+          "428": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "patch": {
+        "summary": "Change the caller's own user, checking preconditions only if given.",
+        "parameters": [{"$ref": "#/components/parameters/ifMatch"}, {"$ref": "#/components/parameters/ifUnmodifiedSince"}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/UserDelta"}}}},
+        "responses": {
+          "200": {"description": "The changed user.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/User"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "412": {"$ref": "#/components/responses/Error"},
+          "422": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/user/{ref}": {
+      "parameters": [{"$ref": "#/components/parameters/ref"}],
+      "get": {
+        "summary": "Get a user.",
+        "responses": {
+          "200": {"description": "The user.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/User"}}}},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      },
+      "put": {
+        "summary": "Change a user, as that user or an admin; requires If-Match or If-Unmodified-Since.",
+        "security": [{"basic": []}],
+        "parameters": [{"$ref": "#/components/parameters/ifMatch"}, {"$ref": "#/components/parameters/ifUnmodifiedSince"}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/UserDelta"}}}},
+        "responses": {
+          "200": {"description": "The changed user.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/User"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "412": {"$ref": "#/components/responses/Error"},
+          "428": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "patch": {
+        "summary": "Change a user, as that user or an admin, checking preconditions only if given.",
+        "security": [{"basic": []}],
+        "parameters": [{"$ref": "#/components/parameters/ifMatch"}, {"$ref": "#/components/parameters/ifUnmodifiedSince"}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/UserDelta"}}}},
+        "responses": {
+          "200": {"description": "The changed user.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/User"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "412": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "delete": {
+        "summary": "Delete a user, as that user or an admin.",
+        "security": [{"basic": []}],
+        "responses": {
+          "204": {"$ref": "#/components/responses/NoContent"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      }
+    },
+    "/user/{ref}/password": {
+      "parameters": [{"$ref": "#/components/parameters/ref"}],
+      "post": {
+        "summary": "Change a user's password, as that user or an admin.",
+        "security": [{"basic": []}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/PasswordChange"}}}},
+        "responses": {
+          "204": {"$ref": "#/components/responses/NoContent"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      }
+    },
+    "/user/{ref}/send-verification": {
+      "parameters": [{"$ref": "#/components/parameters/ref"}],
+      "post": {
+        "summary": "Mail a verification link to a user's address, as that user or an admin.",
+        "security": [{"basic": []}],
+        "responses": {
+          "204": {"$ref": "#/components/responses/NoContent"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "503": {"description": "The server has no public URL configured for the link."}
+        }
+      }
+    },
+    "/user/{ref}/disable": {
+      "parameters": [{"$ref": "#/components/parameters/ref"}],
+      "post": {
+        "summary": "Stop a user from authenticating, keeping their record; admins only.",
+        "security": [{"basic": []}],
+        "responses": {
+          "204": {"$ref": "#/components/responses/NoContent"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "409": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/user/{ref}/enable": {
+      "parameters": [{"$ref": "#/components/parameters/ref"}],
+      "post": {
+        "summary": "Let a disabled user authenticate again; admins only.",
+        "security": [{"basic": []}],
+        "responses": {
+          "204": {"$ref": "#/components/responses/NoContent"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      }
+    },
+    "/group": {
+      "get": {
+        "summary": "List groups, or with ids, get several by id.  With ids and dry_run, preview deleting them instead; admins only.",
+        "parameters": [
+          {"name": "ids", "in": "query", "description": "Comma-separated ids, at most 100; the response is then a MultiGetResult.", "schema": {"type": "string"}},
+          {"name": "dry_run", "in": "query", "description": "With ids, delete nothing, but report the outcomes DELETE would have and give a confirmation token for it; the response is then a BulkDeleteResult.", "schema": {"type": "boolean"}},
+          {"name": "name_prefix", "in": "query", "description": "List only those whose names start with this, ignoring case.", "schema": {"type": "string"}},
+          {"name": "sort", "in": "query", "description": "List in id or name order; the default is id, or name with name_prefix.", "schema": {"type": "string", "enum": ["id", "name"]}},
+          {"name": "limit", "in": "query", "description": "Return one page of at most this many; the Link header gives the first and next pages.  Larger limits are capped to the server's maximum page size, given in X-Page-Size.", "schema": {"type": "integer", "minimum": 1}},
+          {"name": "after", "in": "query", "description": "Start after this id, or lower-case name in name order, as given in the next Link.", "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {"description": "All groups, or a page of them, or a MultiGetResult, or for a dry run a BulkDeleteResult.", "headers": {"X-Total-Count": {"schema": {"type": "integer"}}, "X-Page-Size": {"schema": {"type": "integer"}}, "Link": {"schema": {"type": "string"}}}, "content": {"application/json": {"schema": {"oneOf": [{"type": "array", "items": {"$ref": "#/components/schemas/Group"}}, {"$ref": "#/components/schemas/MultiGetResult"}, {"$ref": "#/components/schemas/BulkDeleteResult"}]}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "post": {
+        "summary": "Create a group; admins only.",
+        "security": [{"basic": []}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/GroupDelta"}}}},
+        "responses": {
+          "201": {"description": "The new group.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Group"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "422": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "delete": {
+        "summary": "Delete several groups by id; admins only.  A dry run, GET with the same ids and dry_run, must come first, to get a confirmation token.",
+        "parameters": [
+          {"name": "ids", "in": "query", "required": true, "description": "Comma-separated ids, at most 100.", "schema": {"type": "string"}},
+          {"name": "confirm", "in": "query", "required": true, "description": "The token from a dry run for the same ids by the same caller, good once for 5 minutes.", "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {"description": "The outcome for each id.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/BulkDeleteResult"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/group/tree": {
+      "get": {
+        "summary": "Get all groups arranged by parent.",
+        "responses": {
+          "200": {"description": "The hierarchy.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/GroupTree"}}}}
+        }
+      }
+    },
+    "/group/{ref}/children": {
+      "parameters": [{"$ref": "#/components/parameters/ref"}],
+      "get": {
+        "summary": "List the groups whose parent is this group.",
+        "responses": {
+          "200": {"description": "The child groups.", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Group"}}}}},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      }
+    },
+    "/group/{ref}": {
+      "parameters": [{"$ref": "#/components/parameters/ref"}],
+      "get": {
+        "summary": "Get a group.",
+        "responses": {
+          "200": {"description": "The group.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Group"}}}},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      },
+      "put": {
+        "summary": "Change a group; admins only.  Requires If-Match or If-Unmodified-Since.",
+        "security": [{"basic": []}],
+        "parameters": [{"$ref": "#/components/parameters/ifMatch"}, {"$ref": "#/components/parameters/ifUnmodifiedSince"}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/GroupDelta"}}}},
+        "responses": {
+          "200": {"description": "The changed group.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Group"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "412": {"$ref": "#/components/responses/Error"},
+          "422": {"$ref": "#/components/responses/Error"},
+          "428": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "patch": {
+        "summary": "Change a group, checking preconditions only if given; admins only.  add_users and remove_users merge with concurrent changes.",
+        "security": [{"basic": []}],
+        "parameters": [{"$ref": "#/components/parameters/ifMatch"}, {"$ref": "#/components/parameters/ifUnmodifiedSince"}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/GroupDelta"}}}},
+        "responses": {
+          "200": {"description": "The changed group.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Group"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "412": {"$ref": "#/components/responses/Error"},
+          "422": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "delete": {
+        "summary": "Delete a group; admins only.  A group with child groups is kept unless the server reparents them.",
+        "security": [{"basic": []}],
+        "responses": {
+          "204": {"$ref": "#/components/responses/NoContent"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "409": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/resolve": {
+      "get": {
+        "summary": "Look up the id of a user or group by name, ignoring case.",
+        "parameters": [
+          {"name": "type", "in": "query", "required": true, "schema": {"type": "string", "enum": ["user", "group"]}},
+          {"name": "name", "in": "query", "required": true, "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {"description": "The id.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Resolution"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      }
+    },
+    "/events": {
+      "get": {
+        "summary": "Stream user and group changes as Server-Sent Events.  Each message carries an Event; reconnecting with Last-Event-ID resumes after it, or starts with a reset event if it is too old.",
+        "parameters": [
+          {"name": "Last-Event-ID", "in": "header", "schema": {"type": "string"}},
+          {"name": "last_event_id", "in": "query", "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {"description": "The event stream.", "content": {"text/event-stream": {"schema": {"type": "string"}}}}
+        }
+      }
+    },
+    "/blob": {
+      "get": {
+        "summary": "List blobs.",
+        "responses": {"200": {"description": "All blobs.", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/BlobReference"}}}}}}
+      },
+      "post": {
+        "summary": "Upload a blob, or each part of a multipart/form-data body as a blob; admins only.  An empty body with ?digest= or If-None-Match looks for existing content instead; with a body, ?digest= must match it.",
+        "security": [{"basic": []}],
+        "parameters": [
+          {"name": "digest", "in": "query", "schema": {"type": "string"}},
+          {"name": "If-None-Match", "in": "header", "schema": {"type": "string"}}
+        ],
+        "requestBody": {"content": {"*/*": {"schema": {"type": "string", "format": "binary"}}}},
+        "responses": {
+          "200": {"description": "Content with that digest is already stored.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/BlobReference"}}}},
+          "201": {"description": "The new blob, or an array of them for a multipart upload.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/BlobReference"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "413": {"$ref": "#/components/responses/Error"},
+          "415": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/blob/{id}": {
+      "parameters": [{"$ref": "#/components/parameters/blobId"}],
+      "get": {
+        "summary": "Download a blob.",
+        "parameters": [{"$ref": "#/components/parameters/ifMatch"}],
+        "responses": {
+          "200": {"description": "The blob.", "content": {"*/*": {"schema": {"type": "string", "format": "binary"}}}},
+          "206": {"description": "Part of the blob."},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "412": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/blob/{id}/meta": {
+      "parameters": [{"$ref": "#/components/parameters/blobId"}],
+      "get": {
+        "summary": "Describe a blob without downloading it.",
+        "responses": {
+          "200": {"description": "The blob's metadata.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/BlobMeta"}}}},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      }
+    },
+    "/blob/uploads": {
+      "post": {
+        "summary": "Start a resumable upload; admins only, as for all of /blob/uploads.  Uploads that receive no data for a while expire, and each user may have only so many at once.",
+        "security": [{"basic": []}],
+        "responses": {
+          "201": {"description": "The new session.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/UploadSession"}}}},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "429": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/blob/uploads/{uploadId}": {
+      "parameters": [{"$ref": "#/components/parameters/uploadId"}],
+      "get": {
+        "summary": "Show how much of an upload has arrived.",
+        "security": [{"basic": []}],
+        "responses": {
+          "200": {"description": "The session.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/UploadSession"}}}},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      },
+      "patch": {
+        "summary": "Append a chunk, placed by Content-Range.",
+        "security": [{"basic": []}],
+        "parameters": [{"name": "Content-Range", "in": "header", "required": true, "schema": {"type": "string"}}],
+        "requestBody": {"required": true, "content": {"*/*": {"schema": {"type": "string", "format": "binary"}}}},
+        "responses": {
+          "200": {"description": "The session.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/UploadSession"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "413": {"$ref": "#/components/responses/Error"},
+          "416": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "delete": {
+        "summary": "Abandon an upload.",
+        "security": [{"basic": []}],
+        "responses": {
+          "204": {"$ref": "#/components/responses/NoContent"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "409": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/blob/uploads/{uploadId}/complete": {
+      "parameters": [{"$ref": "#/components/parameters/uploadId"}],
+      "post": {
+        "summary": "Turn an upload into a blob, checking its digest.",
+        "security": [{"basic": []}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/UploadComplete"}}}},
+        "responses": {
+          "201": {"description": "The new blob.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/BlobReference"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "409": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/admin/stats": {
+      "get": {
+        "summary": "Storage statistics per bucket.  Served only on the admin address, to admins, or to local callers if the server is set to trust them.",
+        "security": [{"basic": []}],
+        "responses": {
+          "200": {"description": "Statistics keyed by bucket name.", "content": {"application/json": {"schema": {"type": "object"}}}},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/admin/metrics": {
+      "get": {
+        "summary": "Connection and request counts and Go runtime statistics.  Served only on the admin address, to admins, or to local callers if the server is set to trust them.",
+        "security": [{"basic": []}],
+        "responses": {
+          "200": {"description": "The current counts.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Metrics"}}}},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/admin/audit": {
+      "get": {
+        "summary": "Page through the audit log.  Served only on the admin address, to admins, or to local callers if the server is set to trust them.",
+        "security": [{"basic": []}],
+        "parameters": [
+          {"name": "after", "in": "query", "schema": {"type": "integer", "format": "uint64"}},
+          {"name": "limit", "in": "query", "schema": {"type": "integer", "minimum": 1, "maximum": 1000}}
+        ],
+        "responses": {
+          "200": {"description": "A page of entries.", "content": {"application/json": {"schema": {"type": "object"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/admin/scrub": {
+      "get": {
+        "summary": "Check blobs against their stored digests, a page at a time, as a dry run for quarantining.  Served only on the admin address, to admins, or to local callers if the server is set to trust them.",
+        "security": [{"basic": []}],
+        "parameters": [
+          {"name": "after", "in": "query", "schema": {"type": "integer", "format": "uint64"}},
+          {"name": "limit", "in": "query", "description": "At most this many blobs; the default is 1000.", "schema": {"type": "integer", "minimum": 1}}
+        ],
+        "responses": {
+          "200": {"description": "The blobs found corrupt, with counts and the cursor to carry on from.  If any are corrupt, confirm is the token for quarantining them with POST and the same after and limit.", "content": {"application/json": {"schema": {"type": "object"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "post": {
+        "summary": "Check blobs against their stored digests, a page at a time.  Served only on the admin address, to admins, or to local callers if the server is set to trust them.",
+        "security": [{"basic": []}],
+        "parameters": [
+          {"name": "after", "in": "query", "schema": {"type": "integer", "format": "uint64"}},
+          {"name": "limit", "in": "query", "description": "At most this many blobs; the default is 1000.", "schema": {"type": "integer", "minimum": 1}},
+          {"name": "quarantine", "in": "query", "description": "Move corrupt content files out of the store.  Needs confirm.", "schema": {"type": "boolean"}},
+          {"name": "confirm", "in": "query", "description": "With quarantine, the token from a GET with the same after and limit by the same caller, good once for 5 minutes.", "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {"description": "The blobs found corrupt, with counts and the cursor to carry on from.", "content": {"application/json": {"schema": {"type": "object"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/admin/gc": {
+      "get": {
+        "summary": "Count the content files that no blob refers to, as a dry run for removing them.  Served only on the admin address, to admins, or to local callers if the server is set to trust them.",
+        "security": [{"basic": []}],
+        "responses": {
+          "200": {"description": "The counts.  If there are any such files, confirm is the token for removing them with POST.", "content": {"application/json": {"schema": {"type": "object"}}}},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "post": {
+        "summary": "Remove the content files that no blob refers to.  Served only on the admin address, to admins, or to local callers if the server is set to trust them.",
+        "security": [{"basic": []}],
+        "parameters": [
+          {"name": "confirm", "in": "query", "required": true, "description": "The token from a GET by the same caller, good once for 5 minutes.", "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {"description": "The counts, with the number removed.", "content": {"application/json": {"schema": {"type": "object"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/healthz": {
+      "get": {
+        "summary": "Readiness check for load balancers.",
+        "responses": {
+          "200": {"description": "The server is accepting work.", "content": {"text/plain": {"schema": {"type": "string"}}}},
+          "503": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/readyz": {
+      "get": {
+        "summary": "Readiness check that also requires the repository to be readable.",
+        "responses": {
+          "200": {"description": "The server is accepting work and can read its repository.", "content": {"text/plain": {"schema": {"type": "string"}}}},
+          "503": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/livez": {
+      "get": {
+        "summary": "Liveness check; succeeds even while the server is shutting down.",
+        "responses": {
+          "200": {"description": "The server is running.", "content": {"text/plain": {"schema": {"type": "string"}}}}
+        }
+      }
+    },
+    "/openapi.json": {
+      "get": {
+        "summary": "This document.",
+        "responses": {"200": {"description": "An OpenAPI 3 document.", "content": {"application/json": {}}}}
+      }
+    }
+  }
+}
+`
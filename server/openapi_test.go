@@ -0,0 +1,70 @@
+package server
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var reOpenAPIRef = regexp.MustCompile(`"\$ref": *"#/([^"]*)"`)
+
+func TestOpenAPIDocument(t *testing.T) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal([]byte(openAPIDocument), &doc); err != nil {
+		t.Fatalf("openAPIDocument is not JSON: %v", err)
+	}
+	if v, _ := doc["openapi"].(string); !strings.HasPrefix(v, "3.") {
+		t.Errorf("openapi is %q, want 3.x", v)
+	}
+
+	// Every reference resolves.
+	for _, m := range reOpenAPIRef.FindAllStringSubmatch(openAPIDocument, -1) {
+		var node interface{} = doc
+		for _, key := range strings.Split(m[1], "/") {
+			obj, _ := node.(map[string]interface{})
+			node = obj[key]
+		}
+		if node == nil {
+			t.Errorf("%s does not resolve", m[0])
+		}
+	}
+
+	paths, _ := doc["paths"].(map[string]interface{})
+	for _, path := range []string{"/user", "/group", "/blob", "/blob/uploads", "/login", "/openapi.json"} {
+		if paths[path] == nil {
+			t.Errorf("%s is not described", path)
+		}
+	}
+	methods := map[string]bool{"get": true, "put": true, "post": true, "delete": true, "patch": true, "head": true, "parameters": true}
+	for path, item := range paths {
+		ops, _ := item.(map[string]interface{})
+		for method, op := range ops {
+			if !methods[method] {
+				t.Errorf("%s has unknown method %q", path, method)
+				continue
+			}
+			if o, ok := op.(map[string]interface{}); ok && method != "parameters" && o["responses"] == nil {
+				t.Errorf("%s %s has no responses", method, path)
+			}
+		}
+	}
+}
+
+func TestOpenAPIServed(t *testing.T) {
+	for _, h := range StaticHandlers {
+		if h.Path != "/openapi.json" {
+			continue
+		}
+		w := serve(h, newTestRequest(GET, "/openapi.json", ""), "")
+		expectStatus(t, w, 200)
+		if got := w.Header().Get(ContentType); got != MediaTypeJSON {
+			t.Errorf("%s is %q", ContentType, got)
+		}
+		if w.Body.String() != openAPIDocument {
+			t.Errorf("served something other than openAPIDocument")
+		}
+		return
+	}
+	t.Error("no handler for /openapi.json")
+}
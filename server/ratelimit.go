@@ -0,0 +1,176 @@
+package server
+
+import (
+	"container/list"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultAuthRateBurst    = 10
+	DefaultAuthRateInterval = 6 * time.Second
+
+	// rateLimiterMaxKeys is the most keys a RateLimiter keeps buckets for.
+	// Past that it forgets the least recently used, so that clients making
+	// up keys cannot grow it without bound.
+	rateLimiterMaxKeys = 65536
+)
+
+// RateLimiter is a token bucket per key: each key may spend up to Burst
+// events at once, and regains one event every Interval.  A Burst of zero, or
+// a nil *RateLimiter, disables the limit.  Once the limiter is in use, the
+// limits may only be changed with SetLimits.
+type RateLimiter struct {
+	Burst    int
+	Interval time.Duration
+
+	mu      sync.Mutex
+	lru     *list.List // of *rateBucket, most recently used first
+	buckets map[string]*list.Element
+}
+
+type rateBucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(burst int, interval time.Duration) *RateLimiter {
+	return &RateLimiter{
+		Burst:    burst,
+		Interval: interval,
+		lru:      list.New(),
+		buckets:  make(map[string]*list.Element),
+	}
+}
+
+// Allow spends one event for key.  If none is available, it returns false
+// and how long until one will be.
+func (rl *RateLimiter) Allow(key string, now time.Time) (bool, time.Duration) {
+	if rl == nil {
+		return true, 0
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if rl.Burst <= 0 || rl.Interval <= 0 {
+		return true, 0
+	}
+	rl.sweep(now)
+	e, ok := rl.buckets[key]
+	if ok {
+		rl.lru.MoveToFront(e)
+	} else {
+		e = rl.lru.PushFront(&rateBucket{key: key, tokens: float64(rl.Burst), last: now})
+		rl.buckets[key] = e
+		for rl.lru.Len() > rateLimiterMaxKeys {
+			rl.remove(rl.lru.Back())
+		}
+	}
+	b := e.Value.(*rateBucket)
+	rl.refill(b, now)
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) * float64(rl.Interval))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// Return gives back an event spent for key, as for an attempt that turned
+// out not to need limiting.
+func (rl *RateLimiter) Return(key string) {
+	if rl == nil {
+		return
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if e, ok := rl.buckets[key]; ok {
+		b := e.Value.(*rateBucket)
+		if b.tokens++; b.tokens > float64(rl.Burst) {
+			b.tokens = float64(rl.Burst)
+		}
+	}
+}
+
+// SetLimits changes the limits.  Buckets keep the events they hold, up to
+// the new burst.
+func (rl *RateLimiter) SetLimits(burst int, interval time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.Burst = burst
+	rl.Interval = interval
+	for e := rl.lru.Front(); e != nil; e = e.Next() {
+		if b := e.Value.(*rateBucket); b.tokens > float64(burst) {
+			b.tokens = float64(burst)
+		}
+	}
+}
+
+func (rl *RateLimiter) refill(b *rateBucket, now time.Time) {
+	b.tokens += float64(now.Sub(b.last)) / float64(rl.Interval)
+	if b.tokens > float64(rl.Burst) {
+		b.tokens = float64(rl.Burst)
+	}
+	b.last = now
+}
+
+// sweep forgets the least recently used keys whose buckets have refilled
+// completely, since those are indistinguishable from keys never seen.  It
+// stops at the first that has not, so that each call costs no more than
+// the keys it forgets.
+func (rl *RateLimiter) sweep(now time.Time) {
+	for e := rl.lru.Back(); e != nil; e = rl.lru.Back() {
+		b := e.Value.(*rateBucket)
+		if b.tokens+float64(now.Sub(b.last))/float64(rl.Interval) < float64(rl.Burst) {
+			return
+		}
+		rl.remove(e)
+	}
+}
+
+func (rl *RateLimiter) remove(e *list.Element) {
+	delete(rl.buckets, rl.lru.Remove(e).(*rateBucket).key)
+}
+
+// authAttemptKeys returns the keys that AllowAuthAttempt limits for an
+// attempt against account from r's client address.
+func authAttemptKeys(r *http.Request, account string) (string, string) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host, "account:" + strings.ToLower(account)
+}
+
+// AllowAuthAttempt checks the rate limits for an authentication attempt
+// against account from r's client address, responding with 429 if either
+// is exhausted.  An empty account only checks the address.
+func AllowAuthAttempt(rl *RateLimiter, w http.ResponseWriter, r *http.Request, account string) bool {
+	ipKey, accountKey := authAttemptKeys(r, account)
+	now := time.Now()
+	ok, wait := rl.Allow(ipKey, now)
+	if ok && account != "" {
+		ok, wait = rl.Allow(accountKey, now)
+	}
+	if !ok {
+		secs := int64(wait/time.Second) + 1
+		w.Header().Set(RetryAfter, strconv.FormatInt(secs, 10))
+		http.Error(w, "Too Many Requests", 429)
+		return false
+	}
+	return true
+}
+
+// ForgiveAuthAttempt gives back what AllowAuthAttempt spent on an attempt
+// that succeeded, so that only failures count against the limits.
+func ForgiveAuthAttempt(rl *RateLimiter, r *http.Request, account string) {
+	ipKey, accountKey := authAttemptKeys(r, account)
+	rl.Return(ipKey)
+	if account != "" {
+		rl.Return(accountKey)
+	}
+}
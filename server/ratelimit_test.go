@@ -0,0 +1,83 @@
+package server
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	rl := NewRateLimiter(2, time.Second)
+	now := time.Unix(1000, 0)
+	for i, want := range []bool{true, true, false} {
+		if ok, _ := rl.Allow("k", now); ok != want {
+			t.Errorf("event %d: Allow = %v, want %v", i+1, ok, want)
+		}
+	}
+	if ok, wait := rl.Allow("k", now.Add(time.Second/2)); ok || wait != time.Second/2 {
+		t.Errorf("half refilled: Allow = %v, %v, want false, 500ms", ok, wait)
+	}
+	if ok, _ := rl.Allow("other", now); !ok {
+		t.Errorf("another key was limited")
+	}
+	if ok, _ := rl.Allow("k", now.Add(time.Second)); !ok {
+		t.Errorf("refilled: Allow = false")
+	}
+
+	// Idle keys are forgotten.
+	later := now.Add(time.Hour)
+	rl.Allow("new", later)
+	if n := len(rl.buckets); n != 1 {
+		t.Errorf("%d buckets after the sweep, want 1", n)
+	}
+
+	// However many keys there are, only the most recent are kept.
+	for i := 0; i < rateLimiterMaxKeys+10; i++ {
+		rl.Allow(strconv.Itoa(i), later)
+	}
+	if n := len(rl.buckets); n != rateLimiterMaxKeys {
+		t.Errorf("%d buckets, want %d", n, rateLimiterMaxKeys)
+	}
+	if _, ok := rl.buckets["new"]; ok {
+		t.Errorf("the least recently used key was kept")
+	}
+	if ok, _ := rl.Allow(strconv.Itoa(rateLimiterMaxKeys+9), later); !ok {
+		t.Errorf("the most recently used key lost its events")
+	}
+	if ok, _ := rl.Allow(strconv.Itoa(rateLimiterMaxKeys+9), later); ok {
+		t.Errorf("the most recently used key was forgotten")
+	}
+
+	rl.SetLimits(0, time.Second)
+	for i := 0; i < 5; i++ {
+		if ok, _ := rl.Allow("k", later); !ok {
+			t.Fatalf("limited with a burst of zero")
+		}
+	}
+	if ok, _ := (*RateLimiter)(nil).Allow("k", later); !ok {
+		t.Errorf("a nil RateLimiter limited")
+	}
+}
+
+func TestAllowAuthAttempt(t *testing.T) {
+	rl := NewRateLimiter(2, time.Hour)
+	attempt := func(addr, account string) bool {
+		r := newTestRequest(POST, "/login", "")
+		r.RemoteAddr = addr
+		w := httptest.NewRecorder()
+		ok := AllowAuthAttempt(rl, w, r, account)
+		if !ok && (w.Code != 429 || w.Header().Get(RetryAfter) == "") {
+			t.Errorf("refused with %d and %s %q", w.Code, RetryAfter, w.Header().Get(RetryAfter))
+		}
+		return ok
+	}
+	// Per address, whatever the account.
+	if !attempt("192.0.2.1:1", "alice") || !attempt("192.0.2.1:2", "bob") || attempt("192.0.2.1:3", "carol") {
+		t.Errorf("the third attempt from one address was allowed")
+	}
+	// Per account, whatever the address, ignoring case.
+	if !attempt("192.0.2.2:1", "dave") || !attempt("192.0.2.3:1", "Dave") || attempt("192.0.2.4:1", "DAVE") {
+		t.Errorf("the third attempt at one account was allowed")
+	}
+}
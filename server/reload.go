@@ -0,0 +1,83 @@
+package server
+
+import "time"
+
+// Settings is the part of the configuration that can be changed while the
+// server is running, by Reconfigure or on SIGHUP.  Everything else, such as
+// the listen addresses, timeouts, cache policy and concurrency limits, is
+// fixed once serving starts.
+type Settings struct {
+	LogLevel           LogLevel
+	MaxLoginFailures   int
+	LoginFailureWindow time.Duration
+	AuthRateBurst      int
+	AuthRateInterval   time.Duration
+
+	// NoSync trades durability for write throughput during a bulk load.
+	// It is unsafe; see repo.Repo.SetNoSync.
+	NoSync bool
+}
+
+// Settings returns the current reloadable settings.
+func (srv *CloudServer) Settings() Settings {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	s := Settings{
+		LogLevel:           INFO,
+		MaxLoginFailures:   srv.MaxLoginFailures,
+		LoginFailureWindow: srv.LoginFailureWindow,
+		AuthRateBurst:      srv.AuthRateBurst,
+		AuthRateInterval:   srv.AuthRateInterval,
+	}
+	if srv.Log != nil {
+		s.LogLevel = srv.Log.level()
+	}
+	if srv.Repo != nil {
+		s.NoSync = srv.Repo.NoSync()
+	}
+	return s
+}
+
+// Reconfigure changes the reloadable settings.  Requests already in
+// progress may finish under the old ones.
+func (srv *CloudServer) Reconfigure(s Settings) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.Log != nil {
+		srv.Log.SetLevel(s.LogLevel)
+	}
+	srv.MaxLoginFailures = s.MaxLoginFailures
+	srv.LoginFailureWindow = s.LoginFailureWindow
+	srv.AuthRateBurst = s.AuthRateBurst
+	srv.AuthRateInterval = s.AuthRateInterval
+	if srv.auth != nil {
+		srv.auth.SetLockout(s.MaxLoginFailures, s.LoginFailureWindow)
+	}
+	if srv.authLimiter != nil {
+		srv.authLimiter.SetLimits(s.AuthRateBurst, s.AuthRateInterval)
+	}
+	if srv.Repo != nil && s.NoSync != srv.Repo.NoSync() {
+		if err := srv.Repo.SetNoSync(s.NoSync); err != nil {
+			srv.Log.Errorf("nosync: %v", err)
+		} else if s.NoSync {
+			srv.Log.Warnf("nosync is on: a crash may lose or corrupt recent writes")
+		} else {
+			srv.Log.Infof("nosync is off: writes are durable again")
+		}
+	}
+}
+
+// reload handles SIGHUP by asking srv.Reload for new settings.
+func (srv *CloudServer) reload() {
+	if srv.Reload == nil {
+		srv.Log.Infof("nothing to reload")
+		return
+	}
+	s := srv.Settings()
+	if err := srv.Reload(&s); err != nil {
+		srv.Log.Errorf("reload: %v", err)
+		return
+	}
+	srv.Reconfigure(s)
+	srv.Log.Infof("reloaded settings: %+v", s)
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestReload(t *testing.T) {
+	srv, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.Log = NewLogger(io.Discard, INFO)
+	auth := srv.authenticator()
+	limiter := srv.authRateLimiter()
+
+	srv.Reload = func(s *Settings) error {
+		if s.LogLevel != INFO || s.MaxLoginFailures != DefaultMaxLoginFailures {
+			t.Errorf("Reload was given %+v", *s)
+		}
+		s.LogLevel = DEBUG
+		s.MaxLoginFailures = 2
+		s.LoginFailureWindow = time.Hour
+		s.AuthRateBurst = 3
+		s.AuthRateInterval = time.Minute
+		return nil
+	}
+	srv.reload()
+	if !srv.Log.Enabled(DEBUG) {
+		t.Error("log level not lowered to debug")
+	}
+	if n, window := auth.lockout(); n != 2 || window != time.Hour {
+		t.Errorf("lockout is %d in %v, want 2 in 1h", n, window)
+	}
+	if limiter.Burst != 3 || limiter.Interval != time.Minute {
+		t.Errorf("rate limit is %d per %v, want 3 per 1m", limiter.Burst, limiter.Interval)
+	}
+	if s := srv.Settings(); s.MaxLoginFailures != 2 || s.AuthRateBurst != 3 {
+		t.Errorf("Settings gives %+v after the reload", s)
+	}
+
+	// A failed reload changes nothing.
+	srv.Reload = func(s *Settings) error {
+		s.MaxLoginFailures = 9
+		return errors.New("bad config")
+	}
+	srv.reload()
+	if n, _ := auth.lockout(); n != 2 {
+		t.Errorf("lockout is %d after a failed reload, want 2", n)
+	}
+}
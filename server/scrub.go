@@ -0,0 +1,135 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"github.com/cloud9-tools/cloud9/repo"
+)
+
+// DefaultScrubBatch is how many blobs Scrub reads per transaction.
+const DefaultScrubBatch = 100
+
+// ScrubReport sums up a Scrub.  If it stopped before the end, NextAfter
+// is the id to pass as after to carry on.  Confirm is set by
+// AdminHandler.Scrub.
+type ScrubReport struct {
+	Checked   int         `json:"checked"`
+	Skipped   int         `json:"skipped"`
+	Corrupt   []ScrubItem `json:"corrupt"`
+	NextAfter uint64      `json:"next_after,omitempty"`
+	Confirm   string      `json:"confirm,omitempty"`
+}
+
+// ScrubItem describes a blob that failed its check.  Missing is set if its
+// content file could not be found; otherwise Actual is the digest of what
+// was read.  Quarantined is set if the file was moved aside.
+type ScrubItem struct {
+	Id          uint64 `json:"id"`
+	Digest      string `json:"digest"`
+	Actual      string `json:"actual,omitempty"`
+	Missing     bool   `json:"missing,omitempty"`
+	Quarantined bool   `json:"quarantined,omitempty"`
+}
+
+// ScrubOptions controls a Scrub.
+type ScrubOptions struct {
+	// After is the id to start after, for resuming.
+	After uint64
+
+	// Limit, if positive, is the most blobs to check before stopping.
+	Limit int
+
+	// Quarantine moves corrupt content files out of the store; see
+	// repo.Repo.QuarantineContent.
+	Quarantine bool
+
+	// Progress, if set, is called with the report so far after each batch.
+	Progress func(report *ScrubReport)
+}
+
+// Scrub checks blobs, in id order, against the digests recorded when they
+// were stored, to find data that has rotted on disk.  Blobs stored before
+// digests were recorded are skipped.  It reads a batch at a time, outside
+// any transaction while hashing, so it does not hold up writes.  If ctx is
+// cancelled, or opts.Limit is reached, it stops with NextAfter set.
+func Scrub(ctx context.Context, r *repo.Repo, opts ScrubOptions) (*ScrubReport, error) {
+	report := &ScrubReport{Corrupt: make([]ScrubItem, 0)}
+	type stored struct {
+		id   uint64
+		meta BlobMeta
+		data []byte // inline data, or the content key if meta.External
+	}
+	after := opts.After
+	for {
+		if err := ctx.Err(); err != nil {
+			report.NextAfter = after
+			return report, err
+		}
+		batch := DefaultScrubBatch
+		if opts.Limit > 0 && opts.Limit-report.Checked-report.Skipped < batch {
+			batch = opts.Limit - report.Checked - report.Skipped
+		}
+		if batch == 0 {
+			report.NextAfter = after
+			return report, nil
+		}
+		var blobs []stored
+		err := r.ViewContext(ctx, repo.BLOB, func(tx *repo.Tx) error {
+			return tx.Scan(after, batch, func(id uint64, value []byte) error {
+				s := stored{id: id, data: append([]byte(nil), value...)}
+				raw, err := tx.As(repo.BLOBMETA).Get(id)
+				if err == nil {
+					MustUnmarshalProto(raw, &s.meta)
+				} else if !errors.Is(err, repo.ErrNotFound) {
+					return err
+				}
+				blobs = append(blobs, s)
+				return nil
+			})
+		})
+		if err != nil {
+			report.NextAfter = after
+			return report, err
+		}
+		if len(blobs) == 0 {
+			return report, nil
+		}
+		for _, s := range blobs {
+			after = s.id
+			if s.meta.Digest == "" {
+				report.Skipped++
+				continue
+			}
+			report.Checked++
+			data, err := s.data, error(nil)
+			if s.meta.External {
+				data, err = r.LoadContent(string(s.data))
+			}
+			item := ScrubItem{Id: s.id, Digest: s.meta.Digest}
+			switch {
+			case os.IsNotExist(err):
+				item.Missing = true
+			case err != nil:
+				report.NextAfter = s.id - 1
+				return report, err
+			default:
+				if item.Actual = DigestFor(data); item.Actual == item.Digest {
+					continue
+				}
+				if opts.Quarantine && s.meta.External {
+					if err := r.QuarantineContent(string(s.data)); err != nil {
+						report.NextAfter = s.id - 1
+						return report, err
+					}
+					item.Quarantined = true
+				}
+			}
+			report.Corrupt = append(report.Corrupt, item)
+		}
+		if opts.Progress != nil {
+			opts.Progress(report)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cloud9-tools/cloud9/repo"
+)
+
+func TestScrub(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	h := BlobHandler{repo: rp, Auth: auth, Log: NewLogger(io.Discard, ERROR)}
+	for i := 1; i <= 4; i++ {
+		createTestBlob(t, h, MediaTypeText, fmt.Sprintf("blob %d", i))
+	}
+	// One stored before digests were recorded.
+	err := rp.Update(repo.BLOB, func(tx *repo.Tx) error {
+		id, err := tx.AllocateId()
+		if err != nil {
+			return err
+		}
+		return tx.Put(id, []byte("legacy"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	corruptTestBlob(t, rp, "blob 2", "blob two")
+	key := strings.TrimPrefix(DigestFor([]byte("blob 4")), "sha256:")
+	if err := os.Remove(filepath.Join(rp.Dir(), repo.ContentDir, repo.ContentPath(key, rp.ContentFanout()))); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Scrub(context.Background(), rp, ScrubOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Checked != 4 || report.Skipped != 1 || report.NextAfter != 0 || len(report.Corrupt) != 2 {
+		t.Fatalf("Scrub gave %+v", report)
+	}
+	if c := report.Corrupt[0]; c.Id != 2 || c.Actual != DigestFor([]byte("blob two")) || c.Missing || c.Quarantined {
+		t.Errorf("first corrupt blob %+v", c)
+	}
+	if c := report.Corrupt[1]; c.Id != 4 || !c.Missing {
+		t.Errorf("second corrupt blob %+v", c)
+	}
+
+	// A limited scrub says where to carry on, and carrying on finds the
+	// rest.
+	var progress int
+	report, err = Scrub(context.Background(), rp, ScrubOptions{Limit: 2, Progress: func(*ScrubReport) { progress++ }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Checked != 2 || report.NextAfter != 2 || len(report.Corrupt) != 1 || progress == 0 {
+		t.Fatalf("Scrub with a limit gave %+v after %d progress reports", report, progress)
+	}
+	report, err = Scrub(context.Background(), rp, ScrubOptions{After: report.NextAfter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Checked != 2 || report.Skipped != 1 || len(report.Corrupt) != 1 || report.Corrupt[0].Id != 4 {
+		t.Fatalf("resumed Scrub gave %+v", report)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	report, err = Scrub(ctx, rp, ScrubOptions{After: 1})
+	if !errors.Is(err, context.Canceled) || report.NextAfter != 1 {
+		t.Errorf("cancelled Scrub gave %+v, %v", report, err)
+	}
+
+	// Quarantining moves the corrupt file aside, so that it is no longer
+	// served.
+	report, err = Scrub(context.Background(), rp, ScrubOptions{Quarantine: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Corrupt) != 2 || !report.Corrupt[0].Quarantined || report.Corrupt[1].Quarantined {
+		t.Fatalf("quarantining Scrub gave %+v", report)
+	}
+	key = strings.TrimPrefix(DigestFor([]byte("blob 2")), "sha256:")
+	if _, err := os.Stat(filepath.Join(rp.Dir(), repo.QuarantineDir, key)); err != nil {
+		t.Error(err)
+	}
+	expectStatus(t, serve(h, newTestRequest(GET, "/blob/2", ""), ""), 500)
+}
@@ -1,83 +1,566 @@
 package server
 
 import (
-	"log"
+	"context"
+	"errors"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sync"
 	"syscall"
 	"time"
 
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/bcrypt"
+
 	"github.com/cloud9-tools/cloud9/repo"
 )
 
 type CloudServer struct {
-	Repo   *repo.Repo
-	stopch chan struct{}
+	Repo *repo.Repo
+	Log  *Logger
+
+	// ServerHeader is sent as the "Server" response header.  If empty, the
+	// header is omitted.
+	ServerHeader string
+
+	// MaxLoginFailures bad passwords within LoginFailureWindow lock an
+	// account for LoginFailureWindow.  Zero disables the lockout.
+	MaxLoginFailures   int
+	LoginFailureWindow time.Duration
+
+	// PasswordCost is the bcrypt cost for new password hashes.  Weaker
+	// hashes are upgraded as their owners log in.
+	PasswordCost int
+
+	// AuthRateBurst and AuthRateInterval limit failed logins, wherever
+	// credentials are given, and password reset attempts, per client
+	// address and per account.
+	AuthRateBurst    int
+	AuthRateInterval time.Duration
+
+	// TrustedProxies are the reverse proxies whose X-Forwarded-For headers
+	// name the client address, which the rate limits above key on.  From
+	// anyone else, the header is ignored.  See UnproxyHandler.
+	TrustedProxies []*net.IPNet
+
+	// TrustLoopbackAdmin lets requests over the loopback interface use the
+	// admin endpoints without credentials; otherwise they need an admin's,
+	// like any others.  See AdminHandler.
+	TrustLoopbackAdmin bool
+
+	// MaxInFlight limits how many requests are handled at once; zero means
+	// no limit.  Excess requests wait if QueueWhenBusy is set, and are
+	// answered with 503 otherwise.
+	MaxInFlight   int
+	QueueWhenBusy bool
+
+	// DisplayNamePolicy derives a user's display name when it is set to
+	// ""; nil means DisplayNameFromUserName.
+	DisplayNamePolicy DisplayNamePolicy
+
+	// MaxGroupMembers limits the size of a group's member list; zero means
+	// no limit.
+	MaxGroupMembers int
+
+	// MaxPageSize caps the page size clients may ask for when listing
+	// users or groups; zero means no cap.  See ResourceHandler.List.
+	MaxPageSize int
+
+	// ReservedNames lists names that new users and groups may not take,
+	// without regard to case; it defaults to DefaultReservedNames.
+	ReservedNames []string
+
+	// ReparentGroups lets a group with child groups be deleted, moving the
+	// children to its parent; otherwise such a deletion is refused.
+	ReparentGroups bool
+
+	// BlobCacheMaxAge and ObjectCacheMaxAge say how long blobs and users
+	// or groups may be cached; zero means they must be revalidated.
+	// Listings use ObjectCacheMaxAge, and may be kept by shared caches only
+	// if PublicLists is set.
+	BlobCacheMaxAge   time.Duration
+	ObjectCacheMaxAge time.Duration
+	PublicLists       bool
+
+	// VerifyBlobs makes GET check each blob against its stored digest, to
+	// catch corruption on disk.  See BlobHandler.
+	VerifyBlobs bool
+
+	// InlineBlobs lets browsers display blobs in place; otherwise they are
+	// sent as attachments, to be downloaded.  See BlobHandler.
+	InlineBlobs bool
+
+	// MaxMultipartParts and MaxMultipartSize limit multipart uploads to
+	// POST /blob: how many parts, and how many bytes between them.  Zero
+	// means no limit.  See BlobHandler.
+	MaxMultipartParts int
+	MaxMultipartSize  int64
+
+	// UploadTTL is how long a resumable upload may go without receiving
+	// data before it is removed, and MaxUploadsPerUser how many each user
+	// may have at once.  Zero means no limit.  See UploadHandler.
+	UploadTTL         time.Duration
+	MaxUploadsPerUser int
+
+	// ObjectCacheSize is how many encoded users and groups to keep in
+	// memory for GET, and ETagCacheSize how many of their ETags to keep
+	// for conditional GET; zero disables either cache.  See ObjectCache
+	// and ETagCache.
+	ObjectCacheSize int
+	ETagCacheSize   int
+
+	// KeepAlivePeriod is the TCP keep-alive period for client connections,
+	// and TCPNoDelay disables Nagle's algorithm on them.  See
+	// KeepAliveListener.
+	KeepAlivePeriod time.Duration
+	TCPNoDelay      bool
+
+	// AcceptBackoff is how long to wait before retrying after a temporary
+	// error accepting a connection, doubling on each further error up to
+	// MaxAcceptBackoff.  See KeepAliveListener.
+	AcceptBackoff    time.Duration
+	MaxAcceptBackoff time.Duration
+
+	// MaxHeaderBytes limits the size of a request's headers, including
+	// the request line; larger requests are refused with 431.  Zero means
+	// http.DefaultMaxHeaderBytes.
+	MaxHeaderBytes int
+
+	// PreStopDelay is how long /healthz and /readyz report the server as
+	// not ready before it stops accepting connections, on SIGINT, SIGTERM
+	// or Stop, so that load balancers can stop routing to it first.  A
+	// second signal ends the delay early.
+	PreStopDelay time.Duration
+
+	// ShutdownTimeout limits how long shutting down waits for requests in
+	// progress to finish.
+	ShutdownTimeout time.Duration
+
+	// SlowUpdate is how long a repository Update may hold the write lock
+	// before a warning is logged, or 0 for no warnings.  Writers queue
+	// behind the lock, so a stuck one stalls every write.
+	SlowUpdate time.Duration
+
+	// TracerProvider, if set, is used to record an OpenTelemetry span for
+	// each request and each repository transaction it makes, and
+	// Propagator to read the trace context from request headers (W3C
+	// Trace Context if nil).  See TracingHandler.
+	TracerProvider trace.TracerProvider
+	Propagator     propagation.TextMapPropagator
+
+	// SecurityHeaders are added to every response; none are by default.
+	SecurityHeaders SecurityHeaders
+
+	// Notifier delivers messages such as e-mail verification links.
+	Notifier Notifier
+
+	// PublicURL is where clients reach the server, such as
+	// "https://cloud9.example.com", for the links in the messages Notifier
+	// delivers.  Without it, none that need a link are sent: the Host
+	// header of a request could be forged to point them elsewhere.
+	PublicURL string
+
+	// Events receives an Event for each user or group created, changed or
+	// deleted, once the change has committed.
+	Events EventSink
+
+	// Reload, if set, is called on SIGHUP with the current Settings, and
+	// may change them.  Unless it returns an error, the changed settings
+	// are then applied as by Reconfigure.
+	Reload func(s *Settings) error
+
+	stopch   chan struct{}
+	draining Draining
+	broker   *EventBroker
+	metrics  Metrics
+
+	// mu guards the reloadable fields and the components built from them.
+	mu          sync.Mutex
+	auth        *Authenticator
+	authLimiter *RateLimiter
+	objects     *ObjectCache
+	etags       *ETagCache
+	cachesMade  bool
 }
 
+const (
+	DefaultServerHeader    = "cloud9"
+	DefaultShutdownTimeout = 30 * time.Second
+	DefaultMaxHeaderBytes  = http.DefaultMaxHeaderBytes
+	DefaultSlowUpdate      = 1 * time.Second
+)
+
 func New(dir string) (*CloudServer, error) {
 	r, err := repo.Open(dir)
 	if err != nil {
 		return nil, err
 	}
-	return &CloudServer{
-		Repo:   r,
-		stopch: make(chan struct{}),
-	}, nil
+	srv := &CloudServer{
+		Repo:               r,
+		Log:                NewLogger(os.Stderr, INFO),
+		ServerHeader:       DefaultServerHeader,
+		MaxLoginFailures:   DefaultMaxLoginFailures,
+		LoginFailureWindow: DefaultLoginFailureWindow,
+		PasswordCost:       bcrypt.DefaultCost,
+		AuthRateBurst:      DefaultAuthRateBurst,
+		AuthRateInterval:   DefaultAuthRateInterval,
+		MaxGroupMembers:    DefaultMaxGroupMembers,
+		MaxPageSize:        DefaultMaxPageSize,
+		ReservedNames:      DefaultReservedNames,
+		BlobCacheMaxAge:    DefaultCacheMaxAge,
+		ObjectCacheMaxAge:  DefaultCacheMaxAge,
+		PublicLists:        true,
+		MaxMultipartParts:  DefaultMaxMultipartParts,
+		MaxMultipartSize:   DefaultMaxMultipartSize,
+		UploadTTL:          DefaultUploadTTL,
+		MaxUploadsPerUser:  DefaultMaxUploadsPerUser,
+		ETagCacheSize:      DefaultETagCacheSize,
+		KeepAlivePeriod:    DefaultKeepAlivePeriod,
+		TCPNoDelay:         true,
+		AcceptBackoff:      DefaultAcceptBackoff,
+		MaxAcceptBackoff:   DefaultMaxAcceptBackoff,
+		MaxHeaderBytes:     DefaultMaxHeaderBytes,
+		ShutdownTimeout:    DefaultShutdownTimeout,
+		SlowUpdate:         DefaultSlowUpdate,
+		Notifier:           NopNotifier{},
+		Events:             NopEventSink{},
+		stopch:             make(chan struct{}),
+		broker:             NewEventBroker(DefaultEventHistory),
+	}
+	r.AddListener(repo.ChangeFunc(srv.emitChange))
+	return srv, nil
+}
+
+// ListenAddr is an address to listen on, as passed to net.Listen.  If
+// Admin is set, the address serves the admin endpoints instead of the
+// public ones; it should not be reachable from outside.
+type ListenAddr struct {
+	Proto string
+	Addr  string
+	Admin bool
 }
 
 func (srv *CloudServer) ListenAndServe(proto, laddr string) error {
-	if laddr == "" {
-		laddr = ":http"
-	}
-	l, err := net.Listen(proto, laddr)
+	return srv.ListenAndServeMulti([]ListenAddr{{proto, laddr, false}})
+}
+
+// ListenAndServeMulti listens on each of addrs and serves them all, as
+// ServeMulti does.  If any address cannot be bound, none are served.
+// Sockets inherited from a parent process (see StartSuccessor) are adopted
+// in place of binding the addresses.
+func (srv *CloudServer) ListenAndServeMulti(addrs []ListenAddr) error {
+	inherited, err := InheritedListeners()
 	if err != nil {
 		return err
 	}
-	log.Printf("listening on %v", l.Addr())
-	return srv.Serve(l)
+	var public, admin []net.Listener
+	closeAll := func() {
+		for _, l := range append(append(public, admin...), inherited...) {
+			l.Close()
+		}
+	}
+	for _, wantAdmin := range []bool{false, true} {
+		for _, a := range addrs {
+			if a.Admin != wantAdmin {
+				continue
+			}
+			var l net.Listener
+			if len(inherited) > 0 {
+				l, inherited = inherited[0], inherited[1:]
+				srv.Log.Infof("adopted listener on %v for %s", l.Addr(), a.Addr)
+			} else {
+				laddr := a.Addr
+				if laddr == "" {
+					laddr = ":http"
+				}
+				l, err = net.Listen(a.Proto, laddr)
+				if err != nil {
+					closeAll()
+					return err
+				}
+			}
+			if a.Admin {
+				srv.Log.Infof("listening on %v (admin)", l.Addr())
+				admin = append(admin, l)
+			} else {
+				srv.Log.Infof("listening on %v", l.Addr())
+				public = append(public, l)
+			}
+		}
+	}
+	for _, l := range inherited {
+		srv.Log.Warnf("closing unused inherited listener on %v", l.Addr())
+		l.Close()
+	}
+	return srv.ServeMulti(public, admin)
 }
 
 func (srv *CloudServer) Serve(l net.Listener) error {
+	return srv.ServeMulti([]net.Listener{l}, nil)
+}
+
+// ServeMulti serves the public endpoints on each of public and the admin
+// endpoints on each of admin, until a signal or Stop shuts the server down
+// (after PreStopDelay) or one of the listeners fails.  Either way every
+// listener is closed and ServeMulti waits up to ShutdownTimeout for
+// requests in progress to finish.  It returns nil if the server was shut
+// down, or else the error from the listener that failed first, since the
+// others only stopped because it did.
+//
+// SIGUSR2 hands the listeners to a new copy of the program, then shuts
+// down; see StartSuccessor.
+func (srv *CloudServer) ServeMulti(public, admin []net.Listener) error {
+	srv.Repo.SetSlowUpdate(srv.SlowUpdate, func(ot repo.ObjectType, held time.Duration) {
+		srv.Log.Warnf("slow %s update held the write lock for %v", ot, held)
+	})
+	srv.Repo.SetTracerProvider(srv.TracerProvider)
+	servers := make(map[net.Listener]*http.Server)
+	var httpservers []*http.Server
+	for _, x := range []struct {
+		ls      []net.Listener
+		handler http.Handler
+	}{{public, srv.Handler()}, {admin, srv.AdminHandler()}} {
+		httpserver := &http.Server{
+			Handler:        x.handler,
+			ReadTimeout:    10 * time.Second,
+			WriteTimeout:   10 * time.Second,
+			MaxHeaderBytes: srv.MaxHeaderBytes,
+		}
+		// End /events streams, which would otherwise hold Shutdown up.
+		httpserver.RegisterOnShutdown(srv.broker.Close)
+		for _, l := range x.ls {
+			servers[l] = httpserver
+		}
+		httpservers = append(httpservers, httpserver)
+	}
+	if len(servers) == 0 {
+		return errors.New("no listeners")
+	}
+
+	closeAll := func() {
+		for l := range servers {
+			l.Close()
+		}
+	}
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR2)
+	defer signal.Stop(sigch)
+	done := make(chan struct{})
+	defer close(done)
+	// stopping is closed before a deliberate shutdown closes the
+	// listeners, so that the errors that follow can be told apart from
+	// a listener failing.
+	stopping := make(chan struct{})
+	go (func() {
+		for {
+			preStop := true
+			select {
+			case sig := <-sigch:
+				srv.Log.Infof("got signal %v", sig)
+				if sig == syscall.SIGHUP {
+					srv.reload()
+					continue
+				}
+				if sig == syscall.SIGUSR2 {
+					p, err := StartSuccessor(append(append([]net.Listener(nil), public...), admin...))
+					if err != nil {
+						srv.Log.Errorf("failed to start successor: %v", err)
+						continue
+					}
+					srv.Log.Infof("handing over to pid %d", p.Pid)
+					preStop = false
+				}
+			case <-srv.stopch:
+			case <-done:
+				return
+			}
+			srv.draining.Set()
+			if preStop && srv.PreStopDelay > 0 {
+				srv.Log.Infof("not ready; shutting down in %v", srv.PreStopDelay)
+				select {
+				case <-time.After(srv.PreStopDelay):
+				case sig := <-sigch:
+					srv.Log.Infof("got signal %v; shutting down now", sig)
+				case <-done:
+					return
+				}
+			}
+			close(stopping)
+			closeAll()
+			return
+		}
+	})()
+
+	errch := make(chan error, len(servers))
+	for l, httpserver := range servers {
+		kl := &KeepAliveListener{
+			L:          l,
+			Period:     srv.KeepAlivePeriod,
+			NoDelay:    srv.TCPNoDelay,
+			Backoff:    srv.AcceptBackoff,
+			MaxBackoff: srv.MaxAcceptBackoff,
+			Log:        srv.Log,
+		}
+		srv.metrics.AddListener(kl)
+		go (func(kl *KeepAliveListener, httpserver *http.Server) {
+			errch <- httpserver.Serve(kl)
+		})(kl, httpserver)
+	}
+	err := <-errch
+	// If a listener failed, the others are about to be closed too.
+	srv.draining.Set()
+	select {
+	case <-stopping:
+		if errors.Is(err, net.ErrClosed) {
+			err = nil
+		}
+	default:
+	}
+	closeAll()
+	for i := 1; i < len(servers); i++ {
+		<-errch
+	}
+	srv.Log.Infof("graceful shutdown")
+	ctx, cancel := context.WithTimeout(context.Background(), srv.ShutdownTimeout)
+	defer cancel()
+	for _, httpserver := range httpservers {
+		if err := httpserver.Shutdown(ctx); err != nil {
+			srv.Log.Warnf("shutdown: %v", err)
+		}
+	}
+	return err
+}
+
+// Handler returns the handler for the server's public endpoints.  The
+// admin endpoints are served separately, by AdminHandler.
+func (srv *CloudServer) Handler() http.Handler {
 	mux := http.NewServeMux()
 	for _, h := range StaticHandlers {
 		mux.Handle(h.Path, h)
 	}
-	mux.Handle("/", HomeHandler{})
-	userHandler := &UserHandler{srv.Repo}
+	auth := srv.authenticator()
+	mux.Handle("/", HomeHandler{srv.Repo, srv.Log})
+	mux.Handle("/healthz", HealthHandler{&srv.draining, false, nil, srv.Log})
+	mux.Handle("/livez", HealthHandler{&srv.draining, true, nil, srv.Log})
+	mux.Handle("/readyz", HealthHandler{&srv.draining, false, srv.Repo, srv.Log})
+	authLimiter := srv.authRateLimiter()
+	mux.Handle("/login", LoginHandler{auth, srv.Log})
+	mux.Handle("/verify", VerifyHandler{srv.Repo, srv.Log})
+	mux.Handle("/password-reset/", PasswordResetHandler{srv.Repo, auth, srv.Notifier, authLimiter, srv.Log, srv.PublicURL})
+	cache := NewCachePolicy(srv.BlobCacheMaxAge, srv.ObjectCacheMaxAge, srv.PublicLists)
+	objects, etags := srv.objectCaches()
+	reserved := NewReservedNames(srv.ReservedNames)
+	userHandler := &UserHandler{srv.Repo, auth, srv.Notifier, cache, objects, etags, srv.Log, srv.DisplayNamePolicy, reserved, srv.MaxPageSize, srv.PublicURL}
 	mux.Handle("/user", userHandler)
 	mux.Handle("/user/", userHandler)
-	groupHandler := &GroupHandler{srv.Repo}
+	mux.Handle("/me", userHandler)
+	groupHandler := &GroupHandler{srv.Repo, auth, srv.MaxGroupMembers, srv.ReparentGroups, cache, objects, etags, srv.Log, reserved, srv.MaxPageSize}
 	mux.Handle("/group", groupHandler)
 	mux.Handle("/group/", groupHandler)
-	blobHandler := &BlobHandler{srv.Repo}
+	mux.Handle("/resolve", ResolveHandler{srv.Repo, srv.Log})
+	mux.Handle("/events", EventsHandler{srv.broker, srv.Log})
+	blobHandler := &BlobHandler{srv.Repo, auth, cache, srv.InlineBlobs, srv.VerifyBlobs, srv.Log, srv.MaxMultipartParts, srv.MaxMultipartSize}
 	mux.Handle("/blob", blobHandler)
 	mux.Handle("/blob/", blobHandler)
+	uploadHandler := &UploadHandler{Repo: srv.Repo, Dir: filepath.Join(srv.Repo.Dir(), "uploads"), Auth: auth, Log: srv.Log, TTL: srv.UploadTTL, MaxPerUser: srv.MaxUploadsPerUser}
+	mux.Handle("/blob/uploads", uploadHandler)
+	mux.Handle("/blob/uploads/", uploadHandler)
+	return srv.wrap(mux)
+}
+
+// AdminHandler returns the handler for the server's admin endpoints, which
+// ServeMulti serves only on the admin listeners.
+func (srv *CloudServer) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/admin/", AdminHandler{srv.Repo, srv.authenticator(), &srv.metrics, srv.Log, srv.TrustLoopbackAdmin})
+	return srv.wrap(mux)
+}
 
-	httpserver := &http.Server{
-		Addr:         l.Addr().String(),
-		Handler:      UnproxyHandler{mux},
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 10 * time.Second,
+// emitChange passes committed changes to users and groups to srv.Events
+// and to the clients of /events.
+func (srv *CloudServer) emitChange(ot repo.ObjectType, action repo.Action, id uint64) {
+	if ot != repo.USER && ot != repo.GROUP {
+		return
+	}
+	e := Event{Type: ot.String(), Action: string(action), Id: id, Time: time.Now()}
+	if srv.Events != nil {
+		srv.Events.Emit(e)
+	}
+	if srv.broker != nil {
+		srv.broker.Emit(e)
 	}
+}
 
-	sigch := make(chan os.Signal)
-	signal.Notify(sigch, syscall.SIGINT, syscall.SIGTERM)
-	defer signal.Stop(sigch)
-	go (func() {
-		select {
-		case sig := <-sigch:
-			log.Printf("got signal %v", sig)
-		case <-srv.stopch:
+// authenticator returns the Authenticator shared by all handlers, so that
+// Reconfigure can reach it.
+func (srv *CloudServer) authenticator() *Authenticator {
+	limiter := srv.authRateLimiter()
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.auth == nil {
+		srv.auth = &Authenticator{
+			Repo:         srv.Repo,
+			MaxFailures:  srv.MaxLoginFailures,
+			Window:       srv.LoginFailureWindow,
+			PasswordCost: srv.PasswordCost,
+			Limiter:      limiter,
 		}
-		l.Close()
-	})()
+	}
+	return srv.auth
+}
 
-	err := httpserver.Serve(KeepAliveListener{L: l})
-	log.Printf("graceful shutdown")
-	return err
+// objectCaches returns the ObjectCache and ETagCache shared by the user
+// and group handlers; either is nil if its size is not positive.  The
+// first call arranges for the repo to keep them up to date.
+func (srv *CloudServer) objectCaches() (*ObjectCache, *ETagCache) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if !srv.cachesMade {
+		objects := NewObjectCache(srv.ObjectCacheSize)
+		etags := NewETagCache(srv.ETagCacheSize)
+		srv.Repo.OnChange(func(ot repo.ObjectType, id uint64) {
+			if ot == repo.USER || ot == repo.GROUP {
+				objects.Invalidate(ot, id)
+				etags.Invalidate(ot, id)
+			}
+		})
+		srv.objects, srv.etags, srv.cachesMade = objects, etags, true
+	}
+	return srv.objects, srv.etags
+}
+
+// authRateLimiter returns the RateLimiter shared by the authentication
+// endpoints.
+func (srv *CloudServer) authRateLimiter() *RateLimiter {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.authLimiter == nil {
+		srv.authLimiter = NewRateLimiter(srv.AuthRateBurst, srv.AuthRateInterval)
+	}
+	return srv.authLimiter
+}
+
+// wrap adds the middleware common to all endpoints.
+func (srv *CloudServer) wrap(mux *http.ServeMux) http.Handler {
+	var handler http.Handler = CleanPathHandler{mux}
+	if srv.MaxInFlight > 0 {
+		handler = NewConcurrencyLimitHandler(handler, srv.MaxInFlight, srv.QueueWhenBusy)
+	}
+	handler = SecurityHeadersHandler{handler, srv.SecurityHeaders}
+	handler = UnproxyHandler{MethodOverrideHandler{handler}, srv.TrustedProxies}
+	if srv.TracerProvider != nil {
+		propagator := srv.Propagator
+		if propagator == nil {
+			propagator = propagation.TraceContext{}
+		}
+		handler = TracingHandler{handler, mux, srv.TracerProvider.Tracer(TracerName), propagator}
+	}
+	handler = ServerHeaderHandler{RequestIdHandler{handler}, srv.ServerHeader}
+	return srv.metrics.Handler(handler)
 }
 
 func (srv *CloudServer) Stop() {
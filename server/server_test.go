@@ -0,0 +1,214 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTestServer serves a new CloudServer on nPublic public and nAdmin
+// admin listeners on the loopback interface, returning it and the base URLs
+// of the listeners, public ones first.  The server is stopped when the test
+// ends.
+func startTestServer(t *testing.T, nPublic, nAdmin int, configure func(srv *CloudServer)) (*CloudServer, []string) {
+	t.Helper()
+	srv, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Log = NewLogger(io.Discard, ERROR)
+	srv.ShutdownTimeout = time.Second
+	if configure != nil {
+		configure(srv)
+	}
+	var urls []string
+	listen := func(n int) []net.Listener {
+		var ls []net.Listener
+		for i := 0; i < n; i++ {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ls = append(ls, l)
+			urls = append(urls, "http://"+l.Addr().String())
+		}
+		return ls
+	}
+	public, admin := listen(nPublic), listen(nAdmin)
+	errch := make(chan error, 1)
+	go func() { errch <- srv.ServeMulti(public, admin) }()
+	t.Cleanup(func() {
+		srv.Stop()
+		if err := <-errch; err != nil {
+			t.Errorf("ServeMulti: %v", err)
+		}
+		srv.Close()
+	})
+	return srv, urls
+}
+
+// getStatus returns the status of a GET of url.
+func getStatus(t *testing.T, url string) int {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestServeMulti(t *testing.T) {
+	_, urls := startTestServer(t, 2, 0, nil)
+	for _, url := range urls {
+		if status := getStatus(t, url+"/livez"); status != 200 {
+			t.Errorf("GET %s/livez: got status %d, want 200", url, status)
+		}
+	}
+}
+
+func TestListenAndServeMultiBindFailure(t *testing.T) {
+	srv, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.Log = NewLogger(io.Discard, ERROR)
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	freeAddr := free.Addr().String()
+	free.Close()
+
+	err = srv.ListenAndServeMulti([]ListenAddr{
+		{"tcp", freeAddr, false},
+		{"tcp", taken.Addr().String(), true},
+	})
+	if err == nil {
+		t.Fatal("ListenAndServeMulti succeeded with an address in use")
+	}
+	// The address that could be bound was let go again.
+	l, err := net.Listen("tcp", freeAddr)
+	if err != nil {
+		t.Fatalf("%s still bound: %v", freeAddr, err)
+	}
+	l.Close()
+}
+
+func TestAdminListener(t *testing.T) {
+	_, urls := startTestServer(t, 1, 1, func(srv *CloudServer) {
+		srv.TrustLoopbackAdmin = true
+	})
+	public, admin := urls[0], urls[1]
+	for _, test := range []struct {
+		url    string
+		status int
+	}{
+		{public + "/admin/stats", 404},
+		{admin + "/admin/stats", 200},
+		{admin + "/user", 404},
+		{public + "/user", 200},
+	} {
+		if status := getStatus(t, test.url); status != test.status {
+			t.Errorf("GET %s: got status %d, want %d", test.url, status, test.status)
+		}
+	}
+}
+
+func TestServeShutdownError(t *testing.T) {
+	serveOne := func() (*CloudServer, net.Listener, chan error) {
+		srv, err := New(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { srv.Close() })
+		srv.Log = NewLogger(io.Discard, ERROR)
+		srv.ShutdownTimeout = time.Second
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		errch := make(chan error, 1)
+		go func() { errch <- srv.Serve(l) }()
+		// The connection waits in the listen queue until Serve gets going.
+		if status := getStatus(t, "http://"+l.Addr().String()+"/livez"); status != 200 {
+			t.Fatalf("GET /livez: got status %d, want 200", status)
+		}
+		return srv, l, errch
+	}
+	wait := func(errch chan error) error {
+		t.Helper()
+		select {
+		case err := <-errch:
+			return err
+		case <-time.After(5 * time.Second):
+			t.Fatal("Serve did not return")
+			return nil
+		}
+	}
+
+	// Closing the listener is expected when shutting down.
+	srv, _, errch := serveOne()
+	srv.Stop()
+	if err := wait(errch); err != nil {
+		t.Errorf("Serve after Stop returned %v, want nil", err)
+	}
+
+	// Otherwise, it is a failure.
+	_, l, errch := serveOne()
+	l.Close()
+	if err := wait(errch); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Serve after its listener was closed returned %v, want %v", err, net.ErrClosed)
+	}
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	srv, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srv.MaxHeaderBytes != http.DefaultMaxHeaderBytes {
+		t.Errorf("MaxHeaderBytes defaults to %d, want %d", srv.MaxHeaderBytes, http.DefaultMaxHeaderBytes)
+	}
+	srv.Close()
+
+	_, urls := startTestServer(t, 1, 1, func(srv *CloudServer) {
+		srv.MaxHeaderBytes = 1 << 10
+		srv.TrustLoopbackAdmin = true
+	})
+	// The limit applies to the admin listeners too.
+	for _, url := range []string{urls[0] + "/livez", urls[1] + "/admin/stats"} {
+		for _, test := range []struct {
+			size, status int
+		}{
+			{100, 200},
+			// net/http allows some slack over the limit.
+			{16 << 10, 431},
+		} {
+			req, err := http.NewRequest(GET, url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("X-Padding", strings.Repeat("x", test.size))
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != test.status {
+				t.Errorf("%s with %d bytes of headers: got status %d, want %d", url, test.size, resp.StatusCode, test.status)
+			}
+		}
+	}
+}
@@ -9,7 +9,11 @@ import (
 
 var htmlTemplates = template.Must(template.New("").Parse(rawHTML))
 
-type Page struct { }
+// Page holds what the templates show.  FirstRun is set on the home page
+// until the first user is created.
+type Page struct {
+	FirstRun bool
+}
 
 func RenderHTML(w http.ResponseWriter, r *http.Request, name string, page *Page, cacheCtrl string) {
 	var buf bytes.Buffer
@@ -35,7 +39,13 @@ const rawHTML = `
 </head>
 <body>
 	<h1>Cloud9</h1>
+	{{if .FirstRun}}
+	<p>Welcome!  This server has no users yet.</p>
+	<p>Create the first account, which will be the administrator, with <code>POST /user</code>.</p>
+	{{else}}
 	<p>Hello, anonymous user!</p>
+	<p>Log in with <code>POST /login</code>.  Ask an administrator for an account.</p>
+	{{end}}
 </body>
 </html>
 {{end}}
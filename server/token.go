@@ -0,0 +1,78 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+var ErrMalformedToken = errors.New("malformed token")
+
+// Token is the stored half of a single-use token handed out to a user.  The
+// token itself has the form "<user id>.<secret>"; only a hash of the secret
+// is kept.
+type Token struct {
+	SecretHash []byte `protobuf:"bytes,1,opt,name=secret_hash" json:"-"`
+	EMail      string `protobuf:"bytes,2,opt,name=email" json:"email,omitempty"`
+	Expires    int64  `protobuf:"varint,3,opt,name=expires" json:"expires,omitempty"`
+
+	// Operation and Actor are set on confirmation tokens, which are stored
+	// under an id of their own rather than a user's; see NewConfirmation.
+	Operation string `protobuf:"bytes,4,opt,name=operation" json:"operation,omitempty"`
+	Actor     uint64 `protobuf:"varint,5,opt,name=actor" json:"actor,omitempty"`
+}
+
+func (m *Token) Reset()         { *m = Token{} }
+func (m *Token) String() string { return proto.CompactTextString(m) }
+func (*Token) ProtoMessage()    {}
+
+// NewToken returns a fresh token for the given user, valid for lifetime, and
+// the record to store under the user's id.
+func NewToken(userId uint64, email string, lifetime time.Duration) (string, *Token, error) {
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, err
+	}
+	hash := sha256.Sum256(secret)
+	t := &Token{
+		SecretHash: hash[:],
+		EMail:      email,
+		Expires:    time.Now().Add(lifetime).Unix(),
+	}
+	s := fmt.Sprintf("%d.%s", userId, base64.RawURLEncoding.EncodeToString(secret))
+	return s, t, nil
+}
+
+// ParseToken splits a token into the user id and the secret.
+func ParseToken(s string) (uint64, []byte, error) {
+	i := strings.IndexByte(s, '.')
+	if i < 0 {
+		return 0, nil, ErrMalformedToken
+	}
+	userId, err := strconv.ParseUint(s[:i], 10, 64)
+	if err != nil || userId == 0 {
+		return 0, nil, ErrMalformedToken
+	}
+	secret, err := base64.RawURLEncoding.DecodeString(s[i+1:])
+	if err != nil {
+		return 0, nil, ErrMalformedToken
+	}
+	return userId, secret, nil
+}
+
+// Check reports whether secret matches t and t has not yet expired.
+func (t *Token) Check(secret []byte, now time.Time) bool {
+	hash := sha256.Sum256(secret)
+	if subtle.ConstantTimeCompare(hash[:], t.SecretHash) != 1 {
+		return false
+	}
+	return now.Before(time.Unix(t.Expires, 0))
+}
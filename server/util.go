@@ -1,10 +1,14 @@
 package server
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/golang/protobuf/proto"
@@ -23,6 +27,43 @@ func MustMarshalJSON(v interface{}) []byte {
 	return raw
 }
 
+// MarshalJSONFor is MustMarshalJSON for the response to r, indented for
+// reading if r asks for it with "?pretty" or "?pretty=true", and with ids as
+// strings if it asks with "?string_ids" (see StringifyIds).  Listings'
+// ETags are computed over the bytes sent, so such responses have their
+// own; a single object's ETag is not (see ResourceETag).
+func MarshalJSONFor(r *http.Request, v interface{}) []byte {
+	raw, err := json.Marshal(v)
+	Must(err)
+	if WantStringIds(r) {
+		raw, err = StringifyIds(raw)
+		Must(err)
+	}
+	if WantPretty(r) {
+		var buf bytes.Buffer
+		Must(json.Indent(&buf, raw, "", "  "))
+		raw = buf.Bytes()
+	}
+	raw = append(raw, '\r', '\n')
+	return raw
+}
+
+// WantPretty reports whether r asks for indented JSON.
+func WantPretty(r *http.Request) bool {
+	return boolParam(r, "pretty")
+}
+
+// boolParam reports whether the query parameter name is present in r and
+// either empty or true.
+func boolParam(r *http.Request, name string) bool {
+	values, ok := r.URL.Query()[name]
+	if !ok {
+		return false
+	}
+	b, err := strconv.ParseBool(values[0])
+	return values[0] == "" || (err == nil && b)
+}
+
 func MustMarshalProto(v proto.Message) []byte {
 	raw, err := proto.Marshal(v)
 	Must(err)
@@ -73,21 +114,151 @@ func IsContentType(r *http.Request, t string) bool {
 	return strings.EqualFold(s, t)
 }
 
-func GetJSONBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+// Limits on JSON request bodies.  The deltas and other documents clients
+// send are small and flat, so anything beyond these is refused.
+const (
+	MaxJSONBodySize = 1 << 20
+	MaxJSONDepth    = 32
+)
+
+// InternalError answers r with 500.  The body gives r's request id, which
+// also tags the log lines about the failure, so that a client reporting
+// the error can say which one it was.
+func InternalError(w http.ResponseWriter, r *http.Request) {
+	InternalErrorMessage(w, r, "Internal Server Error")
+}
+
+// InternalErrorMessage is like InternalError, but with msg in place of
+// "Internal Server Error", for failures that clients should be able to tell
+// apart.
+func InternalErrorMessage(w http.ResponseWriter, r *http.Request, msg string) {
+	if id := RequestId(r); id != "" {
+		msg += " (request id " + id + ")"
+	}
+	http.Error(w, msg, 500)
+}
+
+// NotFoundError is the body of NotFound's JSON responses.
+type NotFoundError struct {
+	Code      string `json:"code"`
+	Message   string `json:"error"`
+	RequestId string `json:"request_id,omitempty"`
+}
+
+// NotFound answers r with 404, in JSON unless the client prefers plain
+// text.  The API endpoints use it in place of http.NotFound, so that
+// clients can decode every response they get from them.
+func NotFound(w http.ResponseWriter, r *http.Request) {
+	if NegotiateContentType(w, r, MediaTypeJSON, MediaTypeText) == MediaTypeText {
+		http.NotFound(w, r)
+		return
+	}
+	raw := MarshalJSONFor(r, NotFoundError{"not_found", "Not Found", RequestId(r)})
+	w.Header().Set(ContentType, MediaTypeJSON)
+	w.Header().Set(ContentLength, fmt.Sprintf("%d", len(raw)))
+	w.Header().Set(XContentTypeOptions, "nosniff")
+	w.WriteHeader(404)
+	w.Write(raw)
+}
+
+func GetJSONBody(logger *Logger, w http.ResponseWriter, r *http.Request, v interface{}) bool {
 	if !IsContentType(r, MediaTypeJSON) {
 		http.Error(w, "Unsupported Media Type", 415)
 		return false
 	}
-	raw, err := ioutil.ReadAll(r.Body)
+	raw, err := ioutil.ReadAll(io.LimitReader(r.Body, MaxJSONBodySize+1))
 	if err != nil {
-		log.Printf("error: failed to read request body: %v\n", err)
-		http.Error(w, "Internal Server Error", 500)
+		logger.For(r).Errorf("failed to read request body: %v", err)
+		InternalError(w, r)
+		return false
+	}
+	if len(raw) > MaxJSONBodySize {
+		http.Error(w, "Request Entity Too Large", 413)
+		return false
+	}
+	if err := CheckJSON(raw); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to parse JSON: %v", err), 400)
 		return false
 	}
 	err = json.Unmarshal(raw, v)
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		http.Error(w, fmt.Sprintf("Field '%s' must be of type %v", typeErr.Field, typeErr.Type), 400)
+		return false
+	}
+	var idErr *IdSyntaxError
+	if errors.As(err, &idErr) {
+		http.Error(w, idErr.Error(), 400)
+		return false
+	}
 	if err != nil {
 		http.Error(w, "Failed to parse JSON", 400)
 		return false
 	}
 	return true
 }
+
+// CheckJSON walks a JSON document, rejecting it if it nests deeper than
+// MaxJSONDepth or if any object repeats a key.  Duplicate keys are refused
+// because parsers disagree on which of them wins.
+func CheckJSON(raw []byte) error {
+	d := json.NewDecoder(bytes.NewReader(raw))
+	d.UseNumber()
+	type frame struct {
+		keys     map[string]bool
+		isObject bool
+		wantKey  bool
+	}
+	var stack []frame
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var top *frame
+		if len(stack) > 0 {
+			top = &stack[len(stack)-1]
+		}
+		if top != nil && top.isObject && top.wantKey {
+			if key, ok := tok.(string); ok {
+				if top.keys[key] {
+					return fmt.Errorf("duplicate key %q", key)
+				}
+				top.keys[key] = true
+				top.wantKey = false
+				continue
+			}
+		} else if top != nil && top.isObject {
+			top.wantKey = true
+		}
+		switch tok {
+		case json.Delim('{'):
+			if len(stack) >= MaxJSONDepth {
+				return errors.New("nested too deeply")
+			}
+			stack = append(stack, frame{keys: make(map[string]bool), isObject: true, wantKey: true})
+		case json.Delim('['):
+			if len(stack) >= MaxJSONDepth {
+				return errors.New("nested too deeply")
+			}
+			stack = append(stack, frame{})
+		case json.Delim('}'), json.Delim(']'):
+			stack = stack[:len(stack)-1]
+		}
+	}
+}
+
+// MatchETag reports whether etag is among the entity tags listed in an
+// "If-Match" or "If-None-Match" header value.  Weak tags never match.
+func MatchETag(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
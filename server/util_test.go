@@ -0,0 +1,119 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNotFoundJSON(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	cases := []struct {
+		path string
+		user string
+		h    http.Handler
+	}{
+		{"/user/99", "", UserHandler{Repo: rp, Auth: auth}},
+		{"/group/99", "", GroupHandler{Repo: rp, Auth: auth}},
+		{"/blob/99", "", BlobHandler{repo: rp, Auth: auth}},
+		{"/admin/nothing", "root", AdminHandler{Repo: rp, Auth: auth}},
+		{"/login/nothing", "", LoginHandler{Auth: auth}},
+		{"/password-reset/nothing", "", PasswordResetHandler{Repo: rp, Auth: auth}},
+		{"/verify/nothing", "", VerifyHandler{Repo: rp}},
+		{"/events/nothing", "", EventsHandler{}},
+	}
+	for _, c := range cases {
+		w := serve(c.h, newTestRequest(GET, c.path, ""), c.user)
+		expectStatus(t, w, 404)
+		var e NotFoundError
+		if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil || e.Code != "not_found" {
+			t.Errorf("%s: got %q, want a JSON NotFoundError", c.path, w.Body.String())
+		}
+
+		r := newTestRequest(GET, c.path, "")
+		r.Header.Set(Accept, MediaTypeText)
+		w = serve(c.h, r, c.user)
+		expectStatus(t, w, 404)
+		if got := w.Body.String(); got != "404 page not found\n" {
+			t.Errorf("%s: got %q for a plain text 404", c.path, got)
+		}
+	}
+}
+
+func TestCheckJSON(t *testing.T) {
+	for _, test := range []struct {
+		raw string
+		ok  bool
+	}{
+		{`{"a":1,"b":[{"a":2},{"a":3}],"c":{"a":{}}}`, true},
+		{`[1,"a","a",null]`, true},
+		{strings.Repeat("[", MaxJSONDepth) + strings.Repeat("]", MaxJSONDepth), true},
+		{strings.Repeat("[", MaxJSONDepth+1) + strings.Repeat("]", MaxJSONDepth+1), false},
+		{`{"a":1,"a":2}`, false},
+		{`{"a":{"b":1,"b":1}}`, false},
+		{`[{"a":1,"b":2,"a":3}]`, false},
+	} {
+		if err := CheckJSON([]byte(test.raw)); (err == nil) != test.ok {
+			t.Errorf("CheckJSON(%.40q) = %v, want ok %v", test.raw, err, test.ok)
+		}
+	}
+}
+
+func TestGetJSONBody(t *testing.T) {
+	type body struct {
+		Name  string `json:"name"`
+		Count int    `json:"count"`
+	}
+	for _, test := range []struct {
+		contentType, raw string
+		status           int
+	}{
+		{MediaTypeJSON, `{"name":"a","count":1}`, 200},
+		{MediaTypeText, `{"name":"a"}`, 415},
+		{MediaTypeJSON, `{"name":"a","name":"b"}`, 400},
+		{MediaTypeJSON, `{"count":"many"}`, 400},
+		{MediaTypeJSON, `{"name":"a"`, 400},
+		{MediaTypeJSON, `{"name":` + strings.Repeat("[", 100) + `}`, 400},
+		{MediaTypeJSON, `{"name":"` + strings.Repeat("a", MaxJSONBodySize) + `"}`, 413},
+	} {
+		r := newTestRequest(POST, "/", test.raw)
+		r.Header.Set(ContentType, test.contentType)
+		w := httptest.NewRecorder()
+		var v body
+		if GetJSONBody(nil, w, r, &v) {
+			w.WriteHeader(200)
+		}
+		if w.Code != test.status {
+			t.Errorf("%.40q as %s: got status %d, want %d", test.raw, test.contentType, w.Code, test.status)
+		}
+	}
+}
+
+func TestIdOverflow(t *testing.T) {
+	rp := newTestRepo(t)
+	auth := newTestAuth(rp)
+	addTestUser(t, auth, "root", true)
+	var buf bytes.Buffer
+	logger := NewLogger(&buf, INFO)
+	cases := []struct {
+		prefix string
+		h      http.Handler
+	}{
+		{"/user/", UserHandler{Repo: rp, Auth: auth, Log: logger}},
+		{"/group/", GroupHandler{Repo: rp, Auth: auth, Log: logger}},
+		{"/blob/", BlobHandler{repo: rp, Auth: auth, Log: logger}},
+	}
+	for _, c := range cases {
+		for _, id := range []string{"18446744073709551616", "99999999999999999999", strings.Repeat("1", 21), strings.Repeat("1", 1000)} {
+			expectStatus(t, serve(c.h, newTestRequest(GET, c.prefix+id, ""), "root"), 404)
+		}
+	}
+	if buf.Len() != 0 {
+		t.Errorf("logged %q for ids out of range", buf.String())
+	}
+}